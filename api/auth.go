@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwksRefreshInterval is the least time between JWKS fetches, so tokens with
+// unknown key IDs can't make every request hit the key endpoint
+const jwksRefreshInterval = time.Minute
+
+// authenticator verifies bearer tokens against a static public key
+// (JWT_PUBLIC_KEY) or the keys published at JWKS_URL
+type authenticator struct {
+	publicKey interface{}
+	jwksURL   string
+	// requireReads extends verification to GET requests (REQUIRE_AUTH_READS)
+	requireReads bool
+	httpClient   *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// subjectKey is the context key for the authenticated token subject
+type subjectKey struct{}
+
+// newAuthenticator reads JWT_PUBLIC_KEY, JWKS_URL and REQUIRE_AUTH_READS. It
+// returns nil when neither key source is configured, leaving the API open.
+func newAuthenticator() (*authenticator, error) {
+	pemKey := os.Getenv("JWT_PUBLIC_KEY")
+	jwksURL := os.Getenv("JWKS_URL")
+	if pemKey == "" && jwksURL == "" {
+		return nil, nil
+	}
+	if pemKey != "" && jwksURL != "" {
+		return nil, fmt.Errorf("JWT_PUBLIC_KEY and JWKS_URL are mutually exclusive")
+	}
+
+	a := &authenticator{
+		jwksURL:    jwksURL,
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+	}
+	if v := os.Getenv("REQUIRE_AUTH_READS"); v != "" {
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REQUIRE_AUTH_READS %q: must be true or false", v)
+		}
+		a.requireReads = parsed
+	}
+
+	if pemKey != "" {
+		// RSA keys are tried first; anything else must be an ECDSA key
+		if key, err := jwt.ParseRSAPublicKeyFromPEM([]byte(pemKey)); err == nil {
+			a.publicKey = key
+		} else if key, err := jwt.ParseECPublicKeyFromPEM([]byte(pemKey)); err == nil {
+			a.publicKey = key
+		} else {
+			return nil, fmt.Errorf("invalid JWT_PUBLIC_KEY: must be a PEM-encoded RSA or ECDSA public key")
+		}
+	}
+	return a, nil
+}
+
+// requires reports whether a request with this method needs a valid token.
+// Everything but GET changes state, so only reads can be left public.
+func (a *authenticator) requires(method string) bool {
+	return method != "GET" || a.requireReads
+}
+
+// authenticate validates the bearer token in an Authorization header value and
+// returns its subject
+func (a *authenticator) authenticate(ctx context.Context, authorization string) (string, error) {
+	scheme, raw, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || raw == "" {
+		return "", errors.New("missing bearer token")
+	}
+
+	// A key only verifies the methods of its own type, so an RSA key can't
+	// accept an ES256 token or the reverse
+	methods := []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}
+	token, err := jwt.Parse(raw, func(token *jwt.Token) (interface{}, error) {
+		if a.publicKey != nil {
+			return a.publicKey, nil
+		}
+		kid, _ := token.Header["kid"].(string)
+		return a.jwksKey(ctx, kid)
+	}, jwt.WithValidMethods(methods), jwt.WithExpirationRequired())
+	if err != nil {
+		return "", err
+	}
+
+	subject, err := token.Claims.GetSubject()
+	if err != nil || subject == "" {
+		return "", errors.New("token has no subject")
+	}
+	return subject, nil
+}
+
+// jwksKey returns the JWKS key with the given ID, refetching the key set when
+// the ID is unknown and the last fetch is older than jwksRefreshInterval
+func (a *authenticator) jwksKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(a.fetchedAt) < jwksRefreshInterval {
+		return nil, fmt.Errorf("unknown key ID %q", kid)
+	}
+
+	keys, err := a.fetchJWKS(ctx)
+	// A failed fetch also waits out the interval rather than retrying per request
+	a.fetchedAt = time.Now()
+	if err != nil {
+		return nil, err
+	}
+	a.keys = keys
+
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key ID %q", kid)
+}
+
+// fetchJWKS downloads the key set and returns its RSA and EC (P-256, P-384
+// and P-521) signing keys by key ID. Keys of other types, or that don't
+// decode, are skipped.
+func (a *authenticator) fetchJWKS(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.jwksURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build JWKS request: %w", err)
+	}
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("failed to decode JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil || len(e) > 4 {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			if key := ecJWK(k.Crv, k.X, k.Y); key != nil {
+				keys[k.Kid] = key
+			}
+		}
+	}
+	return keys, nil
+}
+
+// jwkCurves maps JWK crv names to their curves
+var jwkCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// ecJWK builds the public key of an EC JWK, or returns nil when the curve is
+// unsupported or the point isn't on it
+func ecJWK(crv, x, y string) *ecdsa.PublicKey {
+	curve, ok := jwkCurves[crv]
+	if !ok {
+		return nil
+	}
+	xBytes, errX := base64.RawURLEncoding.DecodeString(x)
+	yBytes, errY := base64.RawURLEncoding.DecodeString(y)
+	if errX != nil || errY != nil {
+		return nil
+	}
+	key := &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(xBytes),
+		Y:     new(big.Int).SetBytes(yBytes),
+	}
+	if !curve.IsOnCurve(key.X, key.Y) {
+		return nil
+	}
+	return key
+}
+
+// withSubject returns ctx carrying the authenticated subject
+func withSubject(ctx context.Context, subject string) context.Context {
+	return context.WithValue(ctx, subjectKey{}, subject)
+}
+
+// subjectFrom returns the authenticated subject in ctx, or "" for anonymous
+// requests
+func subjectFrom(ctx context.Context) string {
+	subject, _ := ctx.Value(subjectKey{}).(string)
+	return subject
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signed signs claims with key under method, setting kid when given
+func signed(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	raw, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+	return raw
+}
+
+func TestAuthenticate(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	a := &authenticator{publicKey: &key.PublicKey}
+	future := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantSubject   string
+	}{
+		{"valid", "Bearer " + signed(t, jwt.SigningMethodRS256, key, "", jwt.MapClaims{"sub": "user-a", "exp": future}), "user-a"},
+		{"lowercase scheme", "bearer " + signed(t, jwt.SigningMethodRS256, key, "", jwt.MapClaims{"sub": "user-a", "exp": future}), "user-a"},
+		{"expired", "Bearer " + signed(t, jwt.SigningMethodRS256, key, "", jwt.MapClaims{"sub": "user-a", "exp": time.Now().Add(-time.Minute).Unix()}), ""},
+		{"no expiry", "Bearer " + signed(t, jwt.SigningMethodRS256, key, "", jwt.MapClaims{"sub": "user-a"}), ""},
+		{"no subject", "Bearer " + signed(t, jwt.SigningMethodRS256, key, "", jwt.MapClaims{"exp": future}), ""},
+		{"other key", "Bearer " + signed(t, jwt.SigningMethodRS256, other, "", jwt.MapClaims{"sub": "user-a", "exp": future}), ""},
+		{"HMAC", "Bearer " + signed(t, jwt.SigningMethodHS256, []byte("secret"), "", jwt.MapClaims{"sub": "user-a", "exp": future}), ""},
+		{"missing", "", ""},
+		{"not bearer", "Basic dXNlcjpwYXNz", ""},
+		{"empty token", "Bearer ", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subject, err := a.authenticate(context.Background(), tt.authorization)
+			if tt.wantSubject == "" {
+				if err == nil {
+					t.Fatalf("authenticate accepted the token as %q", subject)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("authenticate: %v", err)
+			}
+			if subject != tt.wantSubject {
+				t.Errorf("subject = %q, want %q", subject, tt.wantSubject)
+			}
+		})
+	}
+}
+
+func TestAuthenticateWithJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate RSA key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate EC key: %v", err)
+	}
+
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa-1", "use": "sig", "n": encode(rsaKey.N.Bytes()), "e": encode(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec-1", "crv": "P-256", "x": encode(ecKey.X.Bytes()), "y": encode(ecKey.Y.Bytes())},
+			{"kty": "EC", "kid": "bad-point", "crv": "P-256", "x": encode([]byte{1}), "y": encode([]byte{2})},
+			{"kty": "oct", "kid": "hmac", "k": encode([]byte("secret"))},
+		}})
+	}))
+	defer server.Close()
+	a := &authenticator{jwksURL: server.URL, httpClient: server.Client()}
+	claims := jwt.MapClaims{"sub": "user-a", "exp": time.Now().Add(time.Hour).Unix()}
+
+	for _, token := range []string{
+		signed(t, jwt.SigningMethodRS256, rsaKey, "rsa-1", claims),
+		signed(t, jwt.SigningMethodES256, ecKey, "ec-1", claims),
+	} {
+		subject, err := a.authenticate(context.Background(), "Bearer "+token)
+		if err != nil {
+			t.Fatalf("authenticate: %v", err)
+		}
+		if subject != "user-a" {
+			t.Errorf("subject = %q, want user-a", subject)
+		}
+	}
+
+	// An EC token naming the RSA key, or a key that didn't decode, is refused
+	for _, token := range []string{
+		signed(t, jwt.SigningMethodES256, ecKey, "rsa-1", claims),
+		signed(t, jwt.SigningMethodES256, ecKey, "bad-point", claims),
+		signed(t, jwt.SigningMethodHS256, []byte("secret"), "hmac", claims),
+	} {
+		if _, err := a.authenticate(context.Background(), "Bearer "+token); err == nil {
+			t.Error("authenticate accepted a token its key can't verify")
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("JWKS fetched %d times, want 1 within the refresh interval", fetches)
+	}
+}
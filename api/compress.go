@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// compressMinBytes is the smallest body worth gzipping; below it the gzip
+// header and base64 overhead outweigh the savings
+const compressMinBytes = 1024
+
+// acceptsGzip reports whether an Accept-Encoding header value allows gzip,
+// listed by name or through "*". A q=0 weight refuses it, and an explicit gzip
+// entry wins over "*".
+func acceptsGzip(acceptEncoding string) bool {
+	starOK := false
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+
+		allowed := true
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				allowed = false
+			}
+		}
+		if coding == "gzip" {
+			return allowed
+		}
+		starOK = allowed
+	}
+	return starOK
+}
+
+// compressResponse gzips resp's body for clients that accept it once the body
+// reaches compressMinBytes. API Gateway needs binary bodies base64-encoded, so
+// the result is flagged IsBase64Encoded. Other responses are returned as is.
+func compressResponse(acceptEncoding string, resp events.APIGatewayV2HTTPResponse) events.APIGatewayV2HTTPResponse {
+	if resp.IsBase64Encoded || len(resp.Body) < compressMinBytes {
+		return resp
+	}
+
+	// Caches must key on the encoding whether or not this client gets gzip
+	headers := make(map[string]string, len(resp.Headers)+2)
+	for k, v := range resp.Headers {
+		headers[k] = v
+	}
+	if vary := headers["Vary"]; vary != "" {
+		headers["Vary"] = vary + ", Accept-Encoding"
+	} else {
+		headers["Vary"] = "Accept-Encoding"
+	}
+	resp.Headers = headers
+
+	if !acceptsGzip(acceptEncoding) {
+		return resp
+	}
+
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write([]byte(resp.Body)); err != nil {
+		return resp
+	}
+	if err := writer.Close(); err != nil {
+		return resp
+	}
+
+	headers["Content-Encoding"] = "gzip"
+	resp.Body = base64.StdEncoding.EncodeToString(buf.Bytes())
+	resp.IsBase64Encoded = true
+	return resp
+}
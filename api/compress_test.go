@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"GZIP", true},
+		{"deflate, gzip;q=0.8", true},
+		{"deflate, br", false},
+		{"gzip;q=0", false},
+		{"gzip; q=0", false},
+		{"*", true},
+		{"*;q=0", false},
+		{"gzip;q=0, *", false},
+		{"*, gzip;q=0", false},
+		{"*;q=0, gzip", true},
+	}
+	for _, tt := range tests {
+		if got := acceptsGzip(tt.header); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %t, want %t", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestCompressResponseLeavesSmallBodies(t *testing.T) {
+	resp := events.APIGatewayV2HTTPResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       `{"items":[]}`,
+	}
+	got := compressResponse("gzip", resp)
+	if got.IsBase64Encoded || got.Body != resp.Body || got.Headers["Content-Encoding"] != "" {
+		t.Errorf("small body compressed: %+v", got)
+	}
+}
+
+func TestGetImagesGzipRoundTrip(t *testing.T) {
+	h, f := newTestHandler(t)
+	// Enough images for the page to pass compressMinBytes
+	for i := 0; i < 10; i++ {
+		f.putImage(t, fmt.Sprintf("images/%02d.jpg", i), "user-a", fmt.Sprintf("2024-01-%02dT00:00:00Z", i+1))
+	}
+
+	get := func(acceptEncoding string) events.APIGatewayV2HTTPResponse {
+		t.Helper()
+		req := events.APIGatewayV2HTTPRequest{
+			RawPath: "/images",
+			Headers: map[string]string{"accept-encoding": acceptEncoding},
+		}
+		req.RequestContext.HTTP.Method = "GET"
+		resp, err := h.HandleRequest(context.Background(), req)
+		if err != nil || resp.StatusCode != 200 {
+			t.Fatalf("GET /images = %d, %v", resp.StatusCode, err)
+		}
+		return resp
+	}
+
+	plain := get("")
+	if len(plain.Body) < compressMinBytes {
+		t.Fatalf("page is %d bytes, want at least %d to test compression", len(plain.Body), compressMinBytes)
+	}
+	if plain.IsBase64Encoded || plain.Headers["Content-Encoding"] != "" {
+		t.Error("response compressed for a client that did not ask for gzip")
+	}
+
+	compressed := get("br, gzip")
+	if !compressed.IsBase64Encoded || compressed.Headers["Content-Encoding"] != "gzip" {
+		t.Fatalf("IsBase64Encoded, Content-Encoding = %t, %q; want true, gzip", compressed.IsBase64Encoded, compressed.Headers["Content-Encoding"])
+	}
+	if !strings.Contains(compressed.Headers["Vary"], "Accept-Encoding") {
+		t.Errorf("Vary = %q, want it to include Accept-Encoding", compressed.Headers["Vary"])
+	}
+	// Presigned URLs carry a signing time, so the two calls compare by images
+	if !equalKeys(itemKeys(t, events.APIGatewayV2HTTPResponse{Body: gunzip(t, compressed.Body)}), itemKeys(t, plain)) {
+		t.Error("compressed response lists different images")
+	}
+	// and the same body compressed must come back byte for byte
+	if got := gunzip(t, compressResponse("gzip", plain).Body); got != plain.Body {
+		t.Errorf("round trip = %s, want %s", got, plain.Body)
+	}
+}
+
+// gunzip decodes a base64 gzip response body
+func gunzip(t *testing.T, body string) string {
+	t.Helper()
+	raw, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		t.Fatalf("body is not base64: %v", err)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("body is not gzip: %v", err)
+	}
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("gunzip: %v", err)
+	}
+	return string(decompressed)
+}
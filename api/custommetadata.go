@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+
+	"aws-lambda-image-processor/internal/processor"
+)
+
+// maxUserMetadataBytes is S3's limit on an object's user metadata, counted as
+// the bytes of every key (without x-amz-meta-) and value
+const maxUserMetadataBytes = 2048
+
+// reservedMetadataBytes is kept free of custom metadata for the owner and
+// correlation-id entries, which aren't known when an upload is validated
+const reservedMetadataBytes = 256
+
+// customMetadataEntries maps client metadata to the user metadata entries it
+// is stored as: keys under processor.CustomMetadataPrefix, so they can't
+// overwrite the entries the processor reads, and URL-escaped values, since S3
+// only carries ASCII in metadata headers
+func customMetadataEntries(metadata map[string]string) map[string]string {
+	entries := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		entries[processor.CustomMetadataPrefix+k] = url.PathEscape(v)
+	}
+	return entries
+}
+
+// validCustomMetadataKey reports whether a metadata key is 1 to 128 lowercase
+// letters, digits, '-' or '_'. S3 lowercases metadata keys, so mixed case
+// would not survive the round trip.
+func validCustomMetadataKey(key string) bool {
+	if key == "" || len(key) > 128 {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// validateCustomMetadata checks an upload's metadata keys and that, stored
+// alongside its filename, it fits in S3's user metadata limit
+func validateCustomMetadata(uploadReq UploadRequest) *ErrorBody {
+	keys := make([]string, 0, len(uploadReq.Metadata))
+	for k := range uploadReq.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !validCustomMetadataKey(k) {
+			return &ErrorBody{
+				Code:    "INVALID_METADATA",
+				Message: fmt.Sprintf("metadata key %q must be 1 to 128 lowercase letters, digits, '-' or '_'", k),
+			}
+		}
+	}
+
+	size := 0
+	if name := displayFilename(uploadReq.Filename); name != "" {
+		size += len(processor.OriginalFilenameMetadataKey) + len(url.PathEscape(name))
+	}
+	for k, v := range customMetadataEntries(uploadReq.Metadata) {
+		size += len(k) + len(v)
+	}
+	if limit := maxUserMetadataBytes - reservedMetadataBytes; size > limit {
+		return &ErrorBody{
+			Code:    "METADATA_TOO_LARGE",
+			Message: fmt.Sprintf("metadata and filename take %d bytes once encoded; the limit is %d", size, limit),
+		}
+	}
+	return nil
+}
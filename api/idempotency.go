@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// idempotencyTTL is how long an Idempotency-Key keeps returning the same upload
+const idempotencyTTL = 24 * time.Hour
+
+// maxIdempotencyKeyLength bounds the Idempotency-Key header
+const maxIdempotencyKeyLength = 255
+
+// errIdempotencyMismatch is returned when an Idempotency-Key is reused for a
+// different request
+var errIdempotencyMismatch = errors.New("idempotency key reused with a different request")
+
+// idempotencyStore remembers which upload key an Idempotency-Key produced
+type idempotencyStore interface {
+	// claim maps id to uploadKey unless id is already mapped, returning the
+	// upload key id maps to. fingerprint identifies the request; reusing id
+	// with another fingerprint returns errIdempotencyMismatch.
+	claim(ctx context.Context, id, uploadKey, fingerprint string, expiresAt time.Time) (string, error)
+}
+
+// requestFingerprint identifies an upload request by its body, so a retry
+// matches and a different upload under the same Idempotency-Key does not
+func requestFingerprint(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// validIdempotencyKey reports whether an Idempotency-Key header value is
+// non-empty, at most maxIdempotencyKeyLength long and printable ASCII
+func validIdempotencyKey(id string) bool {
+	if id == "" || len(id) > maxIdempotencyKeyLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// dynamoIdempotencyStore keeps mappings as items in the image table, like the
+// rate counters: keyed by image_key, without gallery_pk, purged by TTL
+type dynamoIdempotencyStore struct {
+	client    DynamoDBAPI
+	tableName string
+}
+
+func (s *dynamoIdempotencyStore) claim(ctx context.Context, id, uploadKey, fingerprint string, expiresAt time.Time) (string, error) {
+	itemKey := "idempotency#upload#" + id
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	// TTL deletion lags, so an expired mapping is overwritten like a missing one
+	_, err := s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.tableName),
+		Item: map[string]types.AttributeValue{
+			"image_key":   &types.AttributeValueMemberS{Value: itemKey},
+			"upload_key":  &types.AttributeValueMemberS{Value: uploadKey},
+			"fingerprint": &types.AttributeValueMemberS{Value: fingerprint},
+			"expires_at":  &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Unix(), 10)},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(image_key) OR expires_at < :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: now},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if err == nil {
+		return uploadKey, nil
+	}
+	if !errors.As(err, &conditionFailed) {
+		return "", fmt.Errorf("failed to store idempotency key: %w", err)
+	}
+
+	result, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"image_key": &types.AttributeValueMemberS{Value: itemKey},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read idempotency key: %w", err)
+	}
+	stored, ok := result.Item["upload_key"].(*types.AttributeValueMemberS)
+	if !ok {
+		return "", fmt.Errorf("idempotency key item has no upload_key")
+	}
+	if previous, _ := result.Item["fingerprint"].(*types.AttributeValueMemberS); previous == nil || previous.Value != fingerprint {
+		return "", errIdempotencyMismatch
+	}
+	return stored.Value, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"aws-lambda-image-processor/internal/awsfake"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestDynamoIdempotencyStoreClaim(t *testing.T) {
+	fake := awsfake.NewDynamoDB()
+	var s idempotencyStore = &dynamoIdempotencyStore{client: fake, tableName: testTable}
+	ctx := context.Background()
+	expiresAt := time.Now().Add(idempotencyTTL)
+
+	got, err := s.claim(ctx, "user-a#retry-1", "images/1-first.jpg", "body-1", expiresAt)
+	if err != nil || got != "images/1-first.jpg" {
+		t.Fatalf("first claim = %q, %v; want images/1-first.jpg", got, err)
+	}
+
+	// The same request again gets the first upload key, not its own
+	got, err = s.claim(ctx, "user-a#retry-1", "images/2-second.jpg", "body-1", expiresAt)
+	if err != nil || got != "images/1-first.jpg" {
+		t.Errorf("replay = %q, %v; want images/1-first.jpg", got, err)
+	}
+
+	// A different request under the same key is refused
+	if _, err := s.claim(ctx, "user-a#retry-1", "images/3-third.jpg", "body-2", expiresAt); !errors.Is(err, errIdempotencyMismatch) {
+		t.Errorf("different body: err = %v, want errIdempotencyMismatch", err)
+	}
+
+	// A mapping past its expiry that TTL hasn't purged yet is overwritten
+	fake.Put(map[string]types.AttributeValue{
+		"image_key":   &types.AttributeValueMemberS{Value: "idempotency#upload#user-a#retry-2"},
+		"upload_key":  &types.AttributeValueMemberS{Value: "images/0-stale.jpg"},
+		"fingerprint": &types.AttributeValueMemberS{Value: "old-body"},
+		"expires_at":  &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)},
+	})
+	got, err = s.claim(ctx, "user-a#retry-2", "images/4-fresh.jpg", "body-3", expiresAt)
+	if err != nil || got != "images/4-fresh.jpg" {
+		t.Errorf("claim over expired mapping = %q, %v; want images/4-fresh.jpg", got, err)
+	}
+	got, err = s.claim(ctx, "user-a#retry-2", "images/5-later.jpg", "body-3", expiresAt)
+	if err != nil || got != "images/4-fresh.jpg" {
+		t.Errorf("replay after overwrite = %q, %v; want images/4-fresh.jpg", got, err)
+	}
+}
+
+func TestUploadIdempotencyKey(t *testing.T) {
+	h, f := newTestHandler(t)
+	token := f.token(t, "user-a", time.Now().Add(time.Hour))
+
+	upload := func(id, body string) events.APIGatewayV2HTTPResponse {
+		t.Helper()
+		req := events.APIGatewayV2HTTPRequest{
+			RawPath: "/upload",
+			Body:    body,
+			Headers: map[string]string{"authorization": "Bearer " + token, "idempotency-key": id},
+		}
+		req.RequestContext.HTTP.Method = "POST"
+		req.RequestContext.HTTP.SourceIP = "10.0.0.1"
+		resp, err := h.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatalf("POST /upload: %v", err)
+		}
+		return resp
+	}
+	uploadKey := func(resp events.APIGatewayV2HTTPResponse) string {
+		t.Helper()
+		if resp.StatusCode != 200 {
+			t.Fatalf("POST /upload status = %d, body %s", resp.StatusCode, resp.Body)
+		}
+		var body UploadResponse
+		if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+			t.Fatalf("unmarshal upload response: %v", err)
+		}
+		return body.Key
+	}
+
+	dog := `{"contentType":"image/jpeg","size":1024,"filename":"dog.jpg"}`
+	first := uploadKey(upload("retry-1", dog))
+	if again := uploadKey(upload("retry-1", dog)); again != first {
+		t.Errorf("retry got key %q, want the first call's %q", again, first)
+	}
+	if other := uploadKey(upload("retry-2", dog)); other == first {
+		t.Error("a new Idempotency-Key reused the first upload key")
+	}
+
+	resp := upload("retry-1", `{"contentType":"image/jpeg","size":1024,"filename":"cat.jpg"}`)
+	if resp.StatusCode != 422 {
+		t.Errorf("reused key with a different body: status = %d, want 422", resp.StatusCode)
+	}
+}
@@ -2,13 +2,27 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"math"
+	"math/bits"
+	"net/url"
 	"os"
+	"path"
+	"reflect"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -16,31 +30,245 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"golang.org/x/sync/errgroup"
+
+	"aws-lambda-image-processor/internal/processor"
 )
 
+// Gallery GSI: every processed image carries gallery_pk=IMAGE so the index can be
+// queried for all images ordered by processed_at.
+const galleryIndexName = "gallery-index"
+
+// Search GSI: the processor writes one search entry per image-term pair, keyed by
+// search_term and ordered by processed_at.
+const searchIndexName = "search-index"
+
+// Owner GSI: images uploaded by an authenticated caller carry its token subject
+// as owner, so GET /images can list one user's images ordered by processed_at.
+const ownerIndexName = "owner-index"
+
+// statusProcessing marks a placeholder for an upload the processor has not saved yet
+const statusProcessing = "processing"
+
 // Request/Response types
 type UploadRequest struct {
 	ContentType string `json:"contentType"`
 	Size        int64  `json:"size"`
+	Filename    string `json:"filename"`
+	// Metadata is app-specific data (album ID, caption) stored with the image
+	// as custom_metadata
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
+// UploadResponse tells the client how to upload. A PUT sends the file as the
+// body with Headers set; a POST sends multipart/form-data with Fields
+// followed by the file.
 type UploadResponse struct {
-	UploadURL string `json:"uploadUrl"`
-	Key       string `json:"key"`
+	Method    string            `json:"method"`
+	UploadURL string            `json:"uploadUrl"`
+	Key       string            `json:"key"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Fields    map[string]string `json:"fields,omitempty"`
+}
+
+// UploadBatchRequest is the body of POST /upload-batch
+type UploadBatchRequest struct {
+	Files []UploadRequest `json:"files"`
+}
+
+// UploadBatchResult is one file's outcome in a batch, in request order: the
+// upload to perform, or why the file was rejected
+type UploadBatchResult struct {
+	Index int `json:"index"`
+	*UploadResponse
+	Error *ErrorBody `json:"error,omitempty"`
+}
+
+type UploadBatchResponse struct {
+	Uploads []UploadBatchResult `json:"uploads"`
+}
+
+// UpdateTagsRequest is the body of PATCH /images. Tags are added to the image's
+// user_tags set and RemoveTags deleted from it; one request does one or the other.
+type UpdateTagsRequest struct {
+	Tags       []string `json:"tags"`
+	RemoveTags []string `json:"remove_tags"`
+}
+
+type UpdateTagsResponse struct {
+	Key      string   `json:"key"`
+	UserTags []string `json:"user_tags"`
+}
+
+type UploadCompleteRequest struct {
+	Key      string `json:"key"`
+	Filename string `json:"filename"`
+}
+
+// PendingImage is the placeholder written by POST /upload-complete until the
+// processor saves the full metadata under the same key
+type PendingImage struct {
+	GalleryPK        string `dynamodbav:"gallery_pk" json:"-"`
+	ImageKey         string `dynamodbav:"image_key" json:"image_key"`
+	OriginalFilename string `dynamodbav:"original_filename,omitempty" json:"original_filename,omitempty"`
+	Owner            string `dynamodbav:"owner,omitempty" json:"owner,omitempty"`
+	Status           string `dynamodbav:"status" json:"status"`
+	ProcessedAt      string `dynamodbav:"processed_at" json:"processed_at"`
 }
 
 type ImageResponse struct {
 	URL string `json:"url"`
 }
 
+type LabelInfo struct {
+	Name       string          `json:"name" dynamodbav:"name"`
+	Confidence float32         `json:"confidence" dynamodbav:"confidence"`
+	Parents    []string        `json:"parents,omitempty" dynamodbav:"parents,omitempty"`
+	Categories []string        `json:"categories,omitempty" dynamodbav:"categories,omitempty"`
+	Instances  []LabelInstance `json:"instances,omitempty" dynamodbav:"instances,omitempty"`
+	Source     string          `json:"source,omitempty" dynamodbav:"source,omitempty"`
+}
+
+type LabelInstance struct {
+	BoundingBox BoundingBox `json:"bounding_box" dynamodbav:"bounding_box"`
+	Confidence  float32     `json:"confidence" dynamodbav:"confidence"`
+}
+
+// BoundingBox is a region of the image as fractions of its width and height
+type BoundingBox struct {
+	Left   float32 `json:"left" dynamodbav:"left"`
+	Top    float32 `json:"top" dynamodbav:"top"`
+	Width  float32 `json:"width" dynamodbav:"width"`
+	Height float32 `json:"height" dynamodbav:"height"`
+}
+
+type RegenerateThumbnailResponse struct {
+	Key          string `json:"key"`
+	ThumbnailKey string `json:"thumbnail_key"`
+	URL          string `json:"url"`
+}
+
+// TransformRequest is the body of POST /transform: a clockwise rotation of
+// 0, 90, 180 or 270 degrees, then an optional "horizontal" or "vertical" flip
+type TransformRequest struct {
+	Rotate int    `json:"rotate"`
+	Flip   string `json:"flip"`
+}
+
+// TransformResponse is the body of POST /transform: the new dimensions and a
+// presigned URL for the regenerated primary thumbnail
+type TransformResponse struct {
+	Key          string `json:"key"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	ThumbnailKey string `json:"thumbnail_key"`
+	URL          string `json:"url"`
+}
+
+// StatsResponse is the body of GET /stats. ComputedAt tells clients how stale a
+// cached answer is.
+type StatsResponse struct {
+	ImageCount          int          `json:"image_count"`
+	TotalOriginalBytes  int64        `json:"total_original_bytes"`
+	TotalThumbnailBytes int64        `json:"total_thumbnail_bytes"`
+	TopLabels           []LabelCount `json:"top_labels"`
+	ComputedAt          string       `json:"computed_at"`
+}
+
+// LabelsResponse is the body of GET /labels: every label on at least one
+// image, most frequent first
+type LabelsResponse struct {
+	Labels []LabelCount `json:"labels"`
+}
+
+// SimilarResponse is the body of GET /similar. Items are gallery items with a
+// "distance" field, nearest first.
+type SimilarResponse struct {
+	Key         string                   `json:"key"`
+	MaxDistance int                      `json:"max_distance"`
+	Items       []map[string]interface{} `json:"items"`
+}
+
+type LabelCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// ThumbnailURLResponse is the body of GET /thumbnail-url: the chosen size and
+// a presigned URL for it
+type ThumbnailURLResponse struct {
+	Key          string `json:"key"`
+	Width        int    `json:"width"`
+	ThumbnailKey string `json:"thumbnail_key"`
+	URL          string `json:"url"`
+}
+
+type ImageLabelsResponse struct {
+	Key    string      `json:"key"`
+	Labels []LabelInfo `json:"labels"`
+}
+
+type DeleteFailure struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+type DeleteResponse struct {
+	Deleted []string        `json:"deleted"`
+	Failed  []DeleteFailure `json:"failed"`
+}
+
+// ErrorBody is the payload of every error response; Code is stable for clients to
+// switch on while Message is for humans
+type ErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// AllowedTypes lists the accepted content types on UNSUPPORTED_CONTENT_TYPE
+	AllowedTypes []string `json:"allowed_types,omitempty"`
+}
+
 // Handler holds the AWS service clients
 type Handler struct {
-	s3Client       *s3.Client
-	dynamoDBClient *dynamodb.Client
+	s3Client S3API
+	// presigner signs GET URLs and upload URLs and policies
+	presigner      *s3.Client
+	dynamoDBClient DynamoDBAPI
 	tableName      string
 	bucketName     string
-	logger         *slog.Logger
+	uploadURLTTL   time.Duration
+	getURLTTL      time.Duration
+	allowedOrigins map[string]bool
+	allowedTypes   map[string]bool
+	maxUploadBytes int64
+	// maxBatchUploads caps the files in one POST /upload-batch
+	maxBatchUploads int
+	maxPageSize     int
+	// validateKeyExists makes GET /image-url check the object exists first
+	validateKeyExists bool
+	sseKMSKeyID       string
+	processor         *processor.Handler
+	auth              *authenticator
+	uploadLimiter     *uploadLimiter
+	idempotency       idempotencyStore
+	statsTTL          time.Duration
+	stats             *statsCache
+	logger            *slog.Logger
+}
+
+// statsCache keeps the last GET /stats result of each owner across warm
+// invocations, keyed by subject ("" for the whole gallery). It is shared by
+// pointer so request-scoped handler copies see the same entries.
+type statsCache struct {
+	mu      sync.Mutex
+	entries map[string]statsEntry
+}
+
+type statsEntry struct {
+	value    *StatsResponse
+	computed time.Time
 }
 
 func NewHandler(ctx context.Context) (*Handler, error) {
@@ -59,26 +287,196 @@ func NewHandler(ctx context.Context) (*Handler, error) {
 		return nil, fmt.Errorf("S3_BUCKET_NAME environment variable is required")
 	}
 
+	// Presigned URL lifetimes; shorten them for security-sensitive deployments
+	uploadURLTTL, err := envDuration("UPLOAD_URL_TTL", 15*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	getURLTTL, err := envDuration("GET_URL_TTL", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	// Upper bound on ?limit, which caps how many URLs one request presigns
+	maxPageSize := 100
+	if v := os.Getenv("MAX_PAGE_SIZE"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid MAX_PAGE_SIZE %q: must be a positive integer", v)
+		}
+		maxPageSize = parsed
+	}
+
+	// Comma-separated CORS origins; "*" allows any origin without credentials
+	allowedOrigins := make(map[string]bool)
+	originList := os.Getenv("ALLOWED_ORIGINS")
+	if originList == "" {
+		originList = "*"
+	}
+	for _, origin := range strings.Split(originList, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			allowedOrigins[strings.TrimSuffix(origin, "/")] = true
+		}
+	}
+
+	// Comma-separated content types POST /upload accepts; the processor can also
+	// handle image/gif, image/heic, image/tiff, image/bmp and image/webp
+	allowedTypes := make(map[string]bool)
+	typeList := os.Getenv("ALLOWED_UPLOAD_TYPES")
+	if typeList == "" {
+		typeList = "image/jpeg,image/png"
+	}
+	for _, contentType := range strings.Split(typeList, ",") {
+		if contentType = strings.TrimSpace(contentType); contentType != "" {
+			allowedTypes[strings.ToLower(contentType)] = true
+		}
+	}
+
+	// GET /stats reads the whole gallery index, so its result is reused for this long
+	statsTTL := 5 * time.Minute
+	if v := os.Getenv("STATS_CACHE_TTL"); v != "" {
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("invalid STATS_CACHE_TTL %q: must be a non-negative duration", v)
+		}
+		statsTTL = parsed
+	}
+
+	// Largest upload accepted; presigned POSTs make S3 enforce it
+	maxUploadBytes := int64(5 * 1024 * 1024)
+	if v := os.Getenv("MAX_UPLOAD_BYTES"); v != "" {
+		parsed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid MAX_UPLOAD_BYTES %q: must be a positive integer", v)
+		}
+		maxUploadBytes = parsed
+	}
+
+	maxBatchUploads := 20
+	if v := os.Getenv("MAX_BATCH_UPLOADS"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid MAX_BATCH_UPLOADS %q: must be a positive integer", v)
+		}
+		maxBatchUploads = parsed
+	}
+
+	// Per-IP cap on POST /upload; 0 leaves presigning unlimited
+	uploadRate := 0
+	if v := os.Getenv("UPLOAD_RATE_PER_MINUTE"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("invalid UPLOAD_RATE_PER_MINUTE %q: must be a non-negative integer", v)
+		}
+		uploadRate = parsed
+	}
+
+	// An existence check costs a HeadObject per URL, so it is opt-in
+	validateKeyExists := false
+	if v := os.Getenv("VALIDATE_KEY_EXISTS"); v != "" {
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid VALIDATE_KEY_EXISTS %q: must be true or false", v)
+		}
+		validateKeyExists = parsed
+	}
+
+	// Bearer-token verification, off unless JWT_PUBLIC_KEY or JWKS_URL is set
+	auth, err := newAuthenticator()
+	if err != nil {
+		return nil, err
+	}
+
+	logLevel, err := processor.ParseLogLevel(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		return nil, err
+	}
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
-		Level: slog.LevelInfo,
+		Level: logLevel,
 	}))
 
+	s3Client := s3.NewFromConfig(cfg)
+	dynamoDBClient := dynamodb.NewFromConfig(cfg)
+
+	var limiter *uploadLimiter
+	if uploadRate > 0 {
+		limiter = &uploadLimiter{
+			store:     &dynamoRateStore{client: dynamoDBClient, tableName: tableName},
+			perMinute: uploadRate,
+		}
+	}
+
+	// Thumbnail regeneration reuses the processor pipeline, so the API honours the
+	// same THUMBNAIL_* and WATERMARK_* settings as the processor. The pipeline
+	// retries its own calls, so its clients don't.
+	pipelineCfg := processor.SingleAttemptConfig(cfg)
+	pipelineS3 := s3.NewFromConfig(pipelineCfg)
+	thumbnailer, err := processor.New(processor.Clients{
+		S3Getter:    pipelineS3,
+		S3Putter:    pipelineS3,
+		Rekognition: processor.NewRekognitionClient(pipelineCfg),
+		DynamoDB:    dynamodb.NewFromConfig(pipelineCfg),
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	return &Handler{
-		s3Client:       s3.NewFromConfig(cfg),
-		dynamoDBClient: dynamodb.NewFromConfig(cfg),
-		tableName:      tableName,
-		bucketName:     bucketName,
-		logger:         logger,
+		s3Client:          s3Client,
+		presigner:         s3Client,
+		dynamoDBClient:    dynamoDBClient,
+		tableName:         tableName,
+		bucketName:        bucketName,
+		uploadURLTTL:      uploadURLTTL,
+		getURLTTL:         getURLTTL,
+		allowedOrigins:    allowedOrigins,
+		allowedTypes:      allowedTypes,
+		maxUploadBytes:    maxUploadBytes,
+		maxBatchUploads:   maxBatchUploads,
+		maxPageSize:       maxPageSize,
+		validateKeyExists: validateKeyExists,
+		sseKMSKeyID:       os.Getenv("S3_SSE_KMS_KEY_ID"),
+		processor:         thumbnailer,
+		auth:              auth,
+		uploadLimiter:     limiter,
+		idempotency:       &dynamoIdempotencyStore{client: dynamoDBClient, tableName: tableName},
+		statsTTL:          statsTTL,
+		stats:             &statsCache{},
+		logger:            logger,
 	}, nil
 }
 
+// maxPresignTTL is the longest expiry SigV4 presigned URLs allow
+const maxPresignTTL = 7 * 24 * time.Hour
+
+// envDuration reads a presign TTL such as "15m" or "1h", returning def when it is
+// unset. Values must be positive and no longer than maxPresignTTL.
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 || parsed > maxPresignTTL {
+		return 0, fmt.Errorf("invalid %s %q: must be a positive duration of at most %s", name, value, maxPresignTTL)
+	}
+	return parsed, nil
+}
+
 func (h *Handler) HandleRequest(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	// Tag every log line of this request with the API Gateway request ID, which
+	// upload also hands to the processor
+	h = h.withLogger(h.logger.With(slog.String("request_id", req.RequestContext.RequestID)))
+
 	h.logger.Info("received request", slog.String("path", req.RawPath), slog.String("method", req.RequestContext.HTTP.Method))
 
 	// Content-Type Header
 	headers := map[string]string{
 		"Content-Type": "application/json",
 	}
+	h.setCORSHeaders(headers, req.Headers["origin"])
 
 	// Strip /api prefix if present (for CloudFront routing)
 	path := req.RawPath
@@ -97,117 +495,194 @@ func (h *Handler) HandleRequest(ctx context.Context, req events.APIGatewayV2HTTP
 		}, nil
 	}
 
+	// The health check stays public so load balancers need no token. A token
+	// sent to a public read is still verified, so the caller sees only its own
+	// images; only anonymous reads skip the check.
+	authorization := req.Headers["authorization"]
+	if h.auth != nil && path != "/health" && (h.auth.requires(method) || authorization != "") {
+		subject, err := h.auth.authenticate(ctx, authorization)
+		if err != nil {
+			h.logger.Warn("rejected unauthenticated request", slog.String("error", err.Error()))
+			headers["WWW-Authenticate"] = "Bearer"
+			return errorResponse(headers, 401, "UNAUTHORIZED", "Missing or invalid bearer token")
+		}
+		ctx = withSubject(ctx, subject)
+		h = h.withLogger(h.logger.With(slog.String("subject", subject)))
+	}
+
 	switch {
+	case path == "/health" && method == "GET":
+		return h.handleHealth(ctx, req, headers)
 	case path == "/images" && method == "GET":
-		return h.handleGetImages(ctx, req, headers)
+		// Pages of presigned URLs are large enough to be worth compressing
+		resp, err := h.handleGetImages(ctx, req, headers)
+		return compressResponse(req.Headers["accept-encoding"], resp), err
+	case path == "/images" && method == "PATCH":
+		return h.handleUpdateTags(ctx, req, headers)
+	case path == "/images" && method == "DELETE":
+		return h.handleDeleteImage(ctx, req, headers)
 	case path == "/upload" && method == "POST":
 		return h.handleUpload(ctx, req, headers)
+	case path == "/upload-batch" && method == "POST":
+		return h.handleUploadBatch(ctx, req, headers)
+	case path == "/upload-complete" && method == "POST":
+		return h.handleUploadComplete(ctx, req, headers)
 	case path == "/image-url" && method == "GET":
 		return h.handleGetImageURL(ctx, req, headers)
+	case path == "/thumbnail-url" && method == "GET":
+		return h.handleGetThumbnailURL(ctx, req, headers)
+	case path == "/regenerate-thumbnail" && method == "POST":
+		return h.handleRegenerateThumbnail(ctx, req, headers)
+	case path == "/transform" && method == "POST":
+		return h.handleTransform(ctx, req, headers)
+	case path == "/image-labels" && method == "GET":
+		return h.handleGetImageLabels(ctx, req, headers)
+	case path == "/stats" && method == "GET":
+		return h.handleStats(ctx, headers)
+	case path == "/labels" && method == "GET":
+		return h.handleGetLabels(ctx, headers)
+	case path == "/similar" && method == "GET":
+		return h.handleSimilar(ctx, req, headers)
+	case path == "/search" && method == "GET":
+		return h.handleSearch(ctx, req, headers)
 	default:
-		return events.APIGatewayV2HTTPResponse{
-			StatusCode: 404,
-			Headers:    headers,
-			Body:       `{"error":"Not Found"}`,
-		}, nil
+		return errorResponse(headers, 404, "NOT_FOUND", "Not Found")
 	}
 }
 
-func (h *Handler) handleGetImages(ctx context.Context, req events.APIGatewayV2HTTPRequest, headers map[string]string) (events.APIGatewayV2HTTPResponse, error) {
-	input := &dynamodb.ScanInput{
-		TableName: aws.String(h.tableName),
-	}
+// errorResponse builds a {"error":{"code":...,"message":...}} response
+func errorResponse(headers map[string]string, status int, code, message string) (events.APIGatewayV2HTTPResponse, error) {
+	return errorBodyResponse(headers, status, ErrorBody{Code: code, Message: message})
+}
 
-	result, err := h.dynamoDBClient.Scan(ctx, input)
-	if err != nil {
-		h.logger.Error("failed to scan dynamodb", slog.String("error", err.Error()))
-		return events.APIGatewayV2HTTPResponse{
-			StatusCode: 500,
-			Headers:    headers,
-			Body:       `{"error":"Failed to fetch images"}`,
-		}, nil
+// errorBodyResponse is errorResponse for bodies carrying more than a code and message
+func errorBodyResponse(headers map[string]string, status int, body ErrorBody) (events.APIGatewayV2HTTPResponse, error) {
+	responseBody, _ := json.Marshal(map[string]ErrorBody{"error": body})
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: status,
+		Headers:    headers,
+		Body:       string(responseBody),
+	}, nil
+}
+
+// withLogger returns a shallow copy of h that logs through logger
+func (h *Handler) withLogger(logger *slog.Logger) *Handler {
+	scoped := *h
+	scoped.logger = logger
+	return &scoped
+}
+
+// setCORSHeaders adds the Access-Control-* headers for origin. An explicitly
+// allowed origin is echoed back with credentials allowed; otherwise a "*" entry
+// answers with a wildcard, which browsers never combine with credentials.
+// Disallowed origins get no Allow-Origin header, so the browser blocks them.
+func (h *Handler) setCORSHeaders(headers map[string]string, origin string) {
+	if !h.allowedOrigins["*"] || len(h.allowedOrigins) > 1 {
+		headers["Vary"] = "Origin"
 	}
 
-	var items []map[string]interface{}
-	err = attributevalue.UnmarshalListOfMaps(result.Items, &items)
-	if err != nil {
-		h.logger.Error("failed to unmarshal items", slog.String("error", err.Error()))
-		return events.APIGatewayV2HTTPResponse{
-			StatusCode: 500,
-			Headers:    headers,
-			Body:       `{"error":"Failed to process images"}`,
-		}, nil
+	switch {
+	case origin != "" && h.allowedOrigins[origin]:
+		headers["Access-Control-Allow-Origin"] = origin
+		headers["Access-Control-Allow-Credentials"] = "true"
+	case h.allowedOrigins["*"]:
+		headers["Access-Control-Allow-Origin"] = "*"
+	default:
+		return
 	}
 
-	// Sort items by image_key descending (newest first)
-	// image_key format: images/<timestamp>-<name>
-	sort.Slice(items, func(i, j int) bool {
-		keyI, _ := items[i]["image_key"].(string)
-		keyJ, _ := items[j]["image_key"].(string)
-		return keyI > keyJ
-	})
+	headers["Access-Control-Allow-Methods"] = "GET, POST, PATCH, DELETE, OPTIONS"
+	headers["Access-Control-Allow-Headers"] = "Content-Type, Authorization, Idempotency-Key"
+	headers["Access-Control-Max-Age"] = "300"
+}
 
-	// Pagination Logic (In-Memory Slice)
-	limit := 10
-	page := 1
+// maxSearchPage bounds ?page on /search, since each page re-reads every earlier
+// page from the search index
+const maxSearchPage = 100
 
-	if l := req.QueryStringParameters["limit"]; l != "" {
-		if val, err := strconv.Atoi(l); err == nil && val > 0 {
-			limit = val
-		}
+// pageLimit parses ?limit, defaulting to 10 and clamping to MAX_PAGE_SIZE
+func (h *Handler) pageLimit(req events.APIGatewayV2HTTPRequest) (int, error) {
+	limit, err := queryInt(req, "limit", 10, 0)
+	if err != nil {
+		return 0, err
 	}
-	if p := req.QueryStringParameters["page"]; p != "" {
-		if val, err := strconv.Atoi(p); err == nil && val > 0 {
-			page = val
-		}
+	if limit > h.maxPageSize {
+		limit = h.maxPageSize
 	}
+	return limit, nil
+}
 
-	totalItems := len(items)
-	start := (page - 1) * limit
-	end := start + limit
+// queryInt parses a positive integer query parameter, returning def when it is
+// absent. A non-zero max rejects larger values.
+func queryInt(req events.APIGatewayV2HTTPRequest, name string, def, max int) (int, error) {
+	value, ok := req.QueryStringParameters[name]
+	if !ok || value == "" {
+		return def, nil
+	}
 
-	var pagedItems []map[string]interface{}
-	if start < totalItems {
-		if end > totalItems {
-			end = totalItems
-		}
-		pagedItems = items[start:end]
-	} else {
-		pagedItems = []map[string]interface{}{}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed <= 0 {
+		return 0, fmt.Errorf("%s must be a positive integer", name)
+	}
+	if max > 0 && parsed > max {
+		return 0, fmt.Errorf("%s must be at most %d", name, max)
 	}
+	return parsed, nil
+}
 
-	// Sign URLs for paged items
-	presignClient := s3.NewPresignClient(h.s3Client)
-	for i := range pagedItems {
-		// Determine which key to sign (thumbnail if available, else original)
-		key := ""
-		if k, ok := pagedItems[i]["thumbnail_key"].(string); ok && k != "" {
-			key = k
-		} else if k, ok := pagedItems[i]["image_key"].(string); ok && k != "" {
-			key = k
+// handleHealth answers load balancer and smoke-test checks. With ?deep=true it
+// also confirms DynamoDB is reachable through a DescribeTable call.
+func (h *Handler) handleHealth(ctx context.Context, req events.APIGatewayV2HTTPRequest, headers map[string]string) (events.APIGatewayV2HTTPResponse, error) {
+	if req.QueryStringParameters["deep"] == "true" {
+		_, err := h.dynamoDBClient.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(h.tableName),
+		})
+		if err != nil {
+			h.logger.Error("health check failed to describe table", slog.String("error", err.Error()))
+			return errorResponse(headers, 503, "SERVICE_UNAVAILABLE", "DynamoDB unreachable")
 		}
+	}
 
-		if key != "" {
-			presignedReq, err := presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
-				Bucket: aws.String(h.bucketName),
-				Key:    aws.String(key),
-			}, s3.WithPresignExpires(time.Hour))
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       `{"status":"ok"}`,
+	}, nil
+}
 
-			if err == nil {
-				pagedItems[i]["url"] = presignedReq.URL
-			} else {
-				h.logger.Error("failed to presign url for item", slog.String("key", key), slog.String("error", err.Error()))
+// statsTopLabels is how many labels GET /stats ranks
+const statsTopLabels = 10
+
+// handleStats returns totals over the images the caller may see: the whole
+// gallery, or an authenticated caller's own uploads. Each result is served from
+// the in-memory cache while it is younger than STATS_CACHE_TTL.
+func (h *Handler) handleStats(ctx context.Context, headers map[string]string) (events.APIGatewayV2HTTPResponse, error) {
+	h.stats.mu.Lock()
+	defer h.stats.mu.Unlock()
+
+	owner := subjectFrom(ctx)
+	entry, ok := h.stats.entries[owner]
+	if !ok || time.Since(entry.computed) >= h.statsTTL {
+		stats, err := h.computeStats(ctx)
+		if err != nil {
+			h.logger.Error("failed to compute stats", slog.String("error", err.Error()))
+			return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to compute stats")
+		}
+		// Expired entries are dropped so the cache only holds recent callers
+		for key, cached := range h.stats.entries {
+			if time.Since(cached.computed) >= h.statsTTL {
+				delete(h.stats.entries, key)
 			}
 		}
+		if h.stats.entries == nil {
+			h.stats.entries = make(map[string]statsEntry)
+		}
+		entry = statsEntry{value: stats, computed: time.Now()}
+		h.stats.entries[owner] = entry
 	}
 
-	responseBody, _ := json.Marshal(map[string]interface{}{
-		"items":       pagedItems,
-		"total_count": totalItems,
-		"page":        page,
-		"limit":       limit,
-		"has_more":    end < totalItems,
-	})
+	responseBody, _ := json.Marshal(entry.value)
 
 	return events.APIGatewayV2HTTPResponse{
 		StatusCode: 200,
@@ -216,60 +691,80 @@ func (h *Handler) handleGetImages(ctx context.Context, req events.APIGatewayV2HT
 	}, nil
 }
 
-func (h *Handler) handleUpload(ctx context.Context, req events.APIGatewayV2HTTPRequest, headers map[string]string) (events.APIGatewayV2HTTPResponse, error) {
-	var uploadReq UploadRequest
-	if err := json.Unmarshal([]byte(req.Body), &uploadReq); err != nil {
-		return events.APIGatewayV2HTTPResponse{
-			StatusCode: 400,
-			Headers:    headers,
-			Body:       `{"error":"Invalid request body"}`,
-		}, nil
-	}
+// computeStats reads every image the caller may see through the gallery or
+// owner index, which hold only image items, so search entries are never
+// counted. Upload placeholders still waiting for the processor are skipped. The
+// top labels are the ones GET /labels reports.
+func (h *Handler) computeStats(ctx context.Context) (*StatsResponse, error) {
+	stats := &StatsResponse{}
 
-	// Validate content type
-	if uploadReq.ContentType != "image/jpeg" && uploadReq.ContentType != "image/png" {
-		return events.APIGatewayV2HTTPResponse{
-			StatusCode: 400,
-			Headers:    headers,
-			Body:       `{"error":"Only JPEG and PNG images are allowed"}`,
-		}, nil
-	}
+	query := h.galleryQuery(ctx)
+	projectAttributes(&query, []string{"image_size", "thumbnail_bytes", "status"})
+	paginator := dynamodb.NewQueryPaginator(h.dynamoDBClient, &query)
 
-	// Validate file size (Max 5MB)
-	const MaxFileSize = 5 * 1024 * 1024 // 5MB
-	if uploadReq.Size > MaxFileSize {
-		return events.APIGatewayV2HTTPResponse{
-			StatusCode: 400,
-			Headers:    headers,
-			Body:       `{"error":"File size exceeds 5MB limit"}`,
-		}, nil
-	}
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query gallery index: %w", err)
+		}
 
-	key := fmt.Sprintf("images/%d-%s", time.Now().UnixNano(), "image")
-	// Note: In a real app we might want the original filename, but here we generate a unique one or expecting it from client.
-	// Let's stick to generating a unique key to allow multiple uploads.
+		var items []struct {
+			ImageSize      int64  `dynamodbav:"image_size"`
+			ThumbnailBytes int64  `dynamodbav:"thumbnail_bytes"`
+			Status         string `dynamodbav:"status"`
+		}
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &items); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal items: %w", err)
+		}
 
-	presignClient := s3.NewPresignClient(h.s3Client)
-	presignedReq, err := presignClient.PresignPutObject(ctx, &s3.PutObjectInput{
-		Bucket:      aws.String(h.bucketName),
-		Key:         aws.String(key),
-		ContentType: aws.String(uploadReq.ContentType),
-	}, s3.WithPresignExpires(time.Minute*15))
+		for _, item := range items {
+			if item.Status == statusProcessing {
+				continue
+			}
+			stats.ImageCount++
+			stats.TotalOriginalBytes += item.ImageSize
+			stats.TotalThumbnailBytes += item.ThumbnailBytes
+		}
+	}
 
+	labelCounts, err := h.labelCounts(ctx)
 	if err != nil {
-		h.logger.Error("failed to presign url", slog.String("error", err.Error()))
-		return events.APIGatewayV2HTTPResponse{
-			StatusCode: 500,
-			Headers:    headers,
-			Body:       `{"error":"Failed to generate upload URL"}`,
-		}, nil
+		return nil, err
+	}
+	stats.TopLabels = topLabels(labelCounts, statsTopLabels)
+	stats.ComputedAt = time.Now().UTC().Format(time.RFC3339)
+	return stats, nil
+}
+
+// topLabels returns the n most frequent labels, ties broken alphabetically so
+// the ranking is stable between computations
+func topLabels(counts map[string]int, n int) []LabelCount {
+	ranked := make([]LabelCount, 0, len(counts))
+	for name, count := range counts {
+		ranked = append(ranked, LabelCount{Name: name, Count: count})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Count != ranked[j].Count {
+			return ranked[i].Count > ranked[j].Count
+		}
+		return ranked[i].Name < ranked[j].Name
+	})
+	if len(ranked) > n {
+		ranked = ranked[:n]
 	}
+	return ranked
+}
 
-	resp := UploadResponse{
-		UploadURL: presignedReq.URL,
-		Key:       key,
+// handleGetLabels lists label names with the number of images carrying each,
+// over the images the caller may see
+func (h *Handler) handleGetLabels(ctx context.Context, headers map[string]string) (events.APIGatewayV2HTTPResponse, error) {
+	counts, err := h.labelCounts(ctx)
+	if err != nil {
+		h.logger.Error("failed to list labels", slog.String("error", err.Error()))
+		return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to fetch labels")
 	}
-	responseBody, _ := json.Marshal(resp)
+
+	responseBody, _ := json.Marshal(LabelsResponse{Labels: topLabels(counts, len(counts))})
 
 	return events.APIGatewayV2HTTPResponse{
 		StatusCode: 200,
@@ -278,35 +773,1891 @@ func (h *Handler) handleUpload(ctx context.Context, req events.APIGatewayV2HTTPR
 	}, nil
 }
 
-func (h *Handler) handleGetImageURL(ctx context.Context, req events.APIGatewayV2HTTPRequest, headers map[string]string) (events.APIGatewayV2HTTPResponse, error) {
-	key := req.QueryStringParameters["key"]
-	if key == "" {
-		return events.APIGatewayV2HTTPResponse{
-			StatusCode: 400,
-			Headers:    headers,
-			Body:       `{"error":"Missing key parameter"}`,
-		}, nil
+// labelCounts returns the number of images carrying each label. Across the
+// whole gallery they are read from the count items the processor keeps up to
+// date rather than by scanning every image; those span all owners, so an
+// authenticated caller's counts are tallied from their own images instead.
+func (h *Handler) labelCounts(ctx context.Context) (map[string]int, error) {
+	if subjectFrom(ctx) == "" {
+		return h.processor.LabelCounts(ctx)
 	}
 
-	presignClient := s3.NewPresignClient(h.s3Client)
-	presignedReq, err := presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(h.bucketName),
-		Key:    aws.String(key),
-	}, s3.WithPresignExpires(time.Hour))
+	query := h.galleryQuery(ctx)
+	projectAttributes(&query, []string{"detected_labels"})
+	paginator := dynamodb.NewQueryPaginator(h.dynamoDBClient, &query)
+
+	counts := make(map[string]int)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query owner index: %w", err)
+		}
+
+		var items []struct {
+			DetectedLabels []processor.LabelInfo `dynamodbav:"detected_labels"`
+		}
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &items); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal items: %w", err)
+		}
+		for _, item := range items {
+			processor.AddLabelReleases(counts, item.DetectedLabels)
+		}
+	}
+	return counts, nil
+}
 
+func (h *Handler) handleGetImages(ctx context.Context, req events.APIGatewayV2HTTPRequest, headers map[string]string) (events.APIGatewayV2HTTPResponse, error) {
+	limit, err := h.pageLimit(req)
 	if err != nil {
-		h.logger.Error("failed to generate signed url", slog.String("error", err.Error()))
-		return events.APIGatewayV2HTTPResponse{
-			StatusCode: 500,
-			Headers:    headers,
-			Body:       `{"error":"Failed to generate image URL"}`,
-		}, nil
+		return errorResponse(headers, 400, "INVALID_PARAMETER", err.Error())
 	}
 
-	resp := ImageResponse{
-		URL: presignedReq.URL,
+	startKey, err := decodeCursor(req.QueryStringParameters["cursor"])
+	if err != nil {
+		return errorResponse(headers, 400, "INVALID_CURSOR", "Invalid cursor")
 	}
-	responseBody, _ := json.Marshal(resp)
+
+	// Optional label filter (case-insensitive)
+	label := req.QueryStringParameters["label"]
+	minConfidence := 0.0
+	if c := req.QueryStringParameters["minConfidence"]; c != "" {
+		val, err := strconv.ParseFloat(c, 64)
+		if err != nil || val < 0 || val > 100 {
+			return errorResponse(headers, 400, "INVALID_PARAMETER", "minConfidence must be a number between 0 and 100")
+		}
+		minConfidence = val
+	}
+
+	// Optional ?topLabels=N keeps only each item's N most confident labels
+	topLabels, err := queryInt(req, "topLabels", 0, 0)
+	if err != nil {
+		return errorResponse(headers, 400, "INVALID_PARAMETER", err.Error())
+	}
+
+	// Optional ?minSharpness= drops images whose stored sharpness is lower,
+	// including those without quality scores
+	minSharpness := -1.0
+	if v := req.QueryStringParameters["minSharpness"]; v != "" {
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil || parsed < 0 || parsed > 100 {
+			return errorResponse(headers, 400, "INVALID_PARAMETER", "minSharpness must be a number between 0 and 100")
+		}
+		minSharpness = parsed
+	}
+
+	query := h.galleryQuery(ctx)
+	// Without ?full=true only what a gallery grid and the filters need is read
+	if req.QueryStringParameters["full"] != "true" {
+		projectAttributes(&query, listAttributes)
+	}
+
+	// Cursor-based pagination over the GSI, newest first by processed_at.
+	// When filtering, keep querying until the page is full; each Query is limited to
+	// the remaining slots so the cursor never skips an evaluated-but-unreturned item.
+	pagedItems := []map[string]interface{}{}
+	for {
+		input := query
+		input.Limit = aws.Int32(int32(limit - len(pagedItems)))
+		input.ExclusiveStartKey = startKey
+		result, err := h.dynamoDBClient.Query(ctx, &input)
+		if err != nil {
+			h.logger.Error("failed to query gallery index", slog.String("error", err.Error()))
+			return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to fetch images")
+		}
+
+		var items []map[string]interface{}
+		err = attributevalue.UnmarshalListOfMaps(result.Items, &items)
+		if err != nil {
+			h.logger.Error("failed to unmarshal items", slog.String("error", err.Error()))
+			return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to process images")
+		}
+
+		for _, item := range items {
+			// Items saved before status existed were all fully processed
+			if _, ok := item["status"]; !ok {
+				item["status"] = "complete"
+			}
+			if label != "" && !hasLabel(item, label, minConfidence) {
+				continue
+			}
+			if minSharpness >= 0 && !sharpEnough(item, minSharpness) {
+				continue
+			}
+			pagedItems = append(pagedItems, item)
+		}
+
+		startKey = result.LastEvaluatedKey
+		if len(startKey) == 0 || len(pagedItems) >= limit {
+			break
+		}
+	}
+
+	nextCursor, err := encodeCursor(startKey)
+	if err != nil {
+		h.logger.Error("failed to encode cursor", slog.String("error", err.Error()))
+		return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to process images")
+	}
+
+	// Trimmed after filtering, so ?label still matches labels outside the top N
+	if topLabels > 0 {
+		for _, item := range pagedItems {
+			trimLabels(item, topLabels)
+		}
+	}
+
+	h.presignItemURLs(ctx, pagedItems, req.QueryStringParameters["srcset"] == "true")
+
+	responseBody, _ := json.Marshal(map[string]interface{}{
+		"items":       pagedItems,
+		"limit":       limit,
+		"next_cursor": nextCursor,
+		"has_more":    nextCursor != "",
+	})
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(responseBody),
+	}, nil
+}
+
+// listAttributes are the item attributes GET /images returns by default: enough
+// to render and filter a gallery grid, leaving out faces, OCR text, EXIF and
+// the other per-image detail
+var listAttributes = []string{
+	"image_key", "bucket_name", "image_size", "processed_at", "status", "failure_reason",
+	"original_filename", "owner", "detected_labels", "user_tags", "image_quality",
+	"thumbnail_key", "thumbnail_bucket", "thumbnails", "thumbnail_mode", "thumbnail_width",
+	"thumbnail_height", "width", "height", "converted_key", "blurhash", "dominant_colors",
+	"custom_metadata", "ppe_violation",
+}
+
+// projectAttributes limits query to attributes, each through a placeholder
+// name since several (status, owner) are reserved words
+func projectAttributes(query *dynamodb.QueryInput, attributes []string) {
+	if query.ExpressionAttributeNames == nil {
+		query.ExpressionAttributeNames = make(map[string]string, len(attributes))
+	}
+	placeholders := make([]string, len(attributes))
+	for i, attribute := range attributes {
+		placeholders[i] = fmt.Sprintf("#p%d", i)
+		query.ExpressionAttributeNames[placeholders[i]] = attribute
+	}
+	query.ProjectionExpression = aws.String(strings.Join(placeholders, ", "))
+}
+
+// galleryQuery returns a newest-first query over every image the caller may
+// see: the gallery GSI, or for authenticated callers the owner GSI with only
+// their own uploads
+func (h *Handler) galleryQuery(ctx context.Context) dynamodb.QueryInput {
+	query := dynamodb.QueryInput{
+		TableName:              aws.String(h.tableName),
+		IndexName:              aws.String(galleryIndexName),
+		KeyConditionExpression: aws.String("gallery_pk = :pk"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk": &types.AttributeValueMemberS{Value: processor.GalleryPartition},
+		},
+		ScanIndexForward: aws.Bool(false),
+	}
+	if owner := subjectFrom(ctx); owner != "" {
+		query.IndexName = aws.String(ownerIndexName)
+		query.KeyConditionExpression = aws.String("#owner = :owner")
+		query.ExpressionAttributeNames = map[string]string{"#owner": "owner"}
+		query.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":owner": &types.AttributeValueMemberS{Value: owner},
+		}
+	}
+	return query
+}
+
+// presignWorkers bounds how many presigns run at once for a page. It is a
+// variable so the benchmark can compare a serial run.
+var presignWorkers = 8
+
+// presignItemURLs sets presigned GET URLs on each item: "url" for the full
+// image (the JPEG converted from a HEIC or TIFF upload, else the original) and
+// "thumbnail_url" for the thumbnail when it has one. With srcset it also sets
+// "srcset" to every stored thumbnail size as "<url> <width>w" entries,
+// smallest first, ready for an <img srcset>. Failed presigns are logged and
+// leave the field unset, or the size out of srcset.
+func (h *Handler) presignItemURLs(ctx context.Context, items []map[string]interface{}, srcset bool) {
+	type presignJob struct {
+		item        int
+		field       string
+		bucket, key string
+		// width is the srcset descriptor of a "srcset" job
+		width int
+	}
+	var jobs []presignJob
+	for i, item := range items {
+		if k, ok := item["converted_key"].(string); ok && k != "" {
+			jobs = append(jobs, presignJob{item: i, field: "url", bucket: h.bucketName, key: k})
+		} else if k, ok := item["image_key"].(string); ok && k != "" {
+			jobs = append(jobs, presignJob{item: i, field: "url", bucket: h.bucketName, key: k})
+		}
+		if k, ok := item["thumbnail_key"].(string); ok && k != "" {
+			jobs = append(jobs, presignJob{item: i, field: "thumbnail_url", bucket: thumbnailBucket(item, h.bucketName), key: k})
+		}
+		if !srcset {
+			continue
+		}
+		thumbnails, _ := item["thumbnails"].(map[string]interface{})
+		for w, v := range thumbnails {
+			width, err := strconv.Atoi(w)
+			if k, ok := v.(string); ok && k != "" && err == nil {
+				jobs = append(jobs, presignJob{item: i, field: "srcset", bucket: thumbnailBucket(item, h.bucketName), key: k, width: srcsetWidth(item, width)})
+			}
+		}
+	}
+
+	presignClient := s3.NewPresignClient(h.presigner)
+	urls := make([]string, len(jobs))
+
+	var g errgroup.Group
+	g.SetLimit(presignWorkers)
+	for i, job := range jobs {
+		// Each goroutine writes only its own slot; maps are filled in after Wait
+		g.Go(func() error {
+			presignedReq, err := presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
+				Bucket: aws.String(job.bucket),
+				Key:    aws.String(job.key),
+			}, s3.WithPresignExpires(h.getURLTTL))
+
+			if err == nil {
+				urls[i] = presignedReq.URL
+			} else {
+				h.logger.Error("failed to presign url for item", slog.String("key", job.key), slog.String("error", err.Error()))
+			}
+			return nil
+		})
+	}
+	g.Wait()
+
+	type srcsetEntry struct {
+		width int
+		url   string
+	}
+	srcsets := make(map[int][]srcsetEntry)
+	for i, job := range jobs {
+		if urls[i] == "" {
+			continue
+		}
+		if job.field == "srcset" {
+			srcsets[job.item] = append(srcsets[job.item], srcsetEntry{job.width, urls[i]})
+			continue
+		}
+		items[job.item][job.field] = urls[i]
+	}
+	for i, entries := range srcsets {
+		sort.Slice(entries, func(a, b int) bool { return entries[a].width < entries[b].width })
+		parts := make([]string, len(entries))
+		for j, entry := range entries {
+			parts[j] = fmt.Sprintf("%s %dw", entry.url, entry.width)
+		}
+		items[i]["srcset"] = strings.Join(parts, ", ")
+	}
+}
+
+// srcsetWidth returns the pixel width of the thumbnail stored under width. An
+// image narrower than every configured width keeps its native size under the
+// smallest one, in fill mode the shorter side, so the descriptor is capped there.
+func srcsetWidth(item map[string]interface{}, width int) int {
+	native, _ := item["width"].(float64)
+	if mode, _ := item["thumbnail_mode"].(string); mode == "fill" {
+		if height, _ := item["height"].(float64); height > 0 && height < native {
+			native = height
+		}
+	}
+	if native > 0 && int(native) < width {
+		return int(native)
+	}
+	return width
+}
+
+// thumbnailBucket returns the bucket an item's thumbnails live in. Items saved
+// before thumbnail_bucket existed kept them in the image bucket.
+func thumbnailBucket(item map[string]interface{}, imageBucket string) string {
+	if b, ok := item["thumbnail_bucket"].(string); ok && b != "" {
+		return b
+	}
+	return imageBucket
+}
+
+// handleSearch returns images whose labels or OCR text contain a term, via the
+// search GSI which holds one row per image-term pair. Authenticated callers
+// only find their own images.
+func (h *Handler) handleSearch(ctx context.Context, req events.APIGatewayV2HTTPRequest, headers map[string]string) (events.APIGatewayV2HTTPResponse, error) {
+	terms := searchTerms(req.QueryStringParameters["q"])
+	if len(terms) == 0 {
+		return errorResponse(headers, 400, "MISSING_PARAMETER", "Missing q parameter")
+	}
+
+	limit, err := h.pageLimit(req)
+	if err != nil {
+		return errorResponse(headers, 400, "INVALID_PARAMETER", err.Error())
+	}
+	page, err := queryInt(req, "page", 1, maxSearchPage)
+	if err != nil {
+		return errorResponse(headers, 400, "INVALID_PARAMETER", err.Error())
+	}
+
+	// Each term's entries come back newest first, so the top page*limit+1 of every
+	// term is enough to build this page of the merged result and detect has_more
+	wanted := page*limit + 1
+	latest := make(map[string]string)
+	for _, term := range terms {
+		matches, err := h.querySearchIndex(ctx, term, wanted)
+		if err != nil {
+			h.logger.Error("failed to query search index", slog.String("term", term), slog.String("error", err.Error()))
+			return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to search images")
+		}
+		// An image matching several terms is listed once
+		for _, m := range matches {
+			if m.ProcessedAt > latest[m.TargetKey] {
+				latest[m.TargetKey] = m.ProcessedAt
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(latest))
+	for k := range latest {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if latest[keys[i]] != latest[keys[j]] {
+			return latest[keys[i]] > latest[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	startIndex := (page - 1) * limit
+	endIndex := startIndex + limit
+	if startIndex > len(keys) {
+		startIndex = len(keys)
+	}
+	if endIndex > len(keys) {
+		endIndex = len(keys)
+	}
+	pageKeys := keys[startIndex:endIndex]
+
+	pagedItems, err := h.batchGetImages(ctx, pageKeys)
+	if err != nil {
+		h.logger.Error("failed to fetch search results", slog.String("error", err.Error()))
+		return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to fetch images")
+	}
+
+	h.presignItemURLs(ctx, pagedItems, false)
+
+	responseBody, _ := json.Marshal(map[string]interface{}{
+		"items":    pagedItems,
+		"page":     page,
+		"limit":    limit,
+		"has_more": endIndex < len(keys),
+	})
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(responseBody),
+	}, nil
+}
+
+// searchTerms returns the lookup terms for a query: the whole phrase, which
+// matches multi-word label names, plus each of its words
+func searchTerms(q string) []string {
+	q = strings.ToLower(strings.TrimSpace(q))
+	if q == "" {
+		return nil
+	}
+
+	terms := []string{q}
+	seen := map[string]bool{q: true}
+	for _, word := range strings.FieldsFunc(q, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if !seen[word] {
+			seen[word] = true
+			terms = append(terms, word)
+		}
+	}
+
+	return terms
+}
+
+// searchMatch is the projection of a search entry read from the search GSI
+type searchMatch struct {
+	TargetKey   string `dynamodbav:"target_key"`
+	ProcessedAt string `dynamodbav:"processed_at"`
+}
+
+// querySearchIndex returns up to max entries for term, newest first. For an
+// authenticated caller only entries of its own images are returned.
+func (h *Handler) querySearchIndex(ctx context.Context, term string, max int) ([]searchMatch, error) {
+	query := dynamodb.QueryInput{
+		TableName:              aws.String(h.tableName),
+		IndexName:              aws.String(searchIndexName),
+		KeyConditionExpression: aws.String("search_term = :term"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":term": &types.AttributeValueMemberS{Value: term},
+		},
+		ScanIndexForward: aws.Bool(false),
+	}
+	if owner := subjectFrom(ctx); owner != "" {
+		query.FilterExpression = aws.String("target_owner = :owner")
+		query.ExpressionAttributeValues[":owner"] = &types.AttributeValueMemberS{Value: owner}
+	}
+
+	matches := []searchMatch{}
+	var startKey map[string]types.AttributeValue
+	for {
+		input := query
+		input.Limit = aws.Int32(int32(max - len(matches)))
+		input.ExclusiveStartKey = startKey
+		result, err := h.dynamoDBClient.Query(ctx, &input)
+		if err != nil {
+			return nil, err
+		}
+
+		var page []searchMatch
+		if err := attributevalue.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, err
+		}
+		matches = append(matches, page...)
+
+		startKey = result.LastEvaluatedKey
+		if len(startKey) == 0 || len(matches) >= max {
+			return matches, nil
+		}
+	}
+}
+
+// batchGetImages fetches the metadata items for keys, preserving their order and
+// skipping any that no longer exist
+func (h *Handler) batchGetImages(ctx context.Context, keys []string) ([]map[string]interface{}, error) {
+	items := []map[string]interface{}{}
+	if len(keys) == 0 {
+		return items, nil
+	}
+
+	requestKeys := make([]map[string]types.AttributeValue, 0, len(keys))
+	for _, k := range keys {
+		requestKeys = append(requestKeys, map[string]types.AttributeValue{
+			"image_key": &types.AttributeValueMemberS{Value: k},
+		})
+	}
+
+	// BatchGetItem accepts at most 100 keys per call
+	byKey := make(map[string]map[string]interface{}, len(keys))
+	for start := 0; start < len(requestKeys); start += 100 {
+		end := start + 100
+		if end > len(requestKeys) {
+			end = len(requestKeys)
+		}
+
+		pending := map[string]types.KeysAndAttributes{h.tableName: {Keys: requestKeys[start:end]}}
+		for attempt := 0; len(pending[h.tableName].Keys) > 0; attempt++ {
+			if attempt > 3 {
+				return nil, fmt.Errorf("%d keys left unprocessed", len(pending[h.tableName].Keys))
+			}
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * 50 * time.Millisecond)
+			}
+
+			result, err := h.dynamoDBClient.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+				RequestItems: pending,
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			var page []map[string]interface{}
+			if err := attributevalue.UnmarshalListOfMaps(result.Responses[h.tableName], &page); err != nil {
+				return nil, err
+			}
+			for _, item := range page {
+				if k, ok := item["image_key"].(string); ok {
+					byKey[k] = item
+				}
+			}
+
+			pending = result.UnprocessedKeys
+		}
+	}
+
+	for _, k := range keys {
+		if item, ok := byKey[k]; ok {
+			items = append(items, item)
+		}
+	}
+
+	return items, nil
+}
+
+// encodeCursor turns a DynamoDB LastEvaluatedKey into an opaque base64 cursor.
+// An empty key (no more pages) yields an empty cursor.
+func encodeCursor(key map[string]types.AttributeValue) (string, error) {
+	if len(key) == 0 {
+		return "", nil
+	}
+
+	var plain map[string]interface{}
+	if err := attributevalue.UnmarshalMap(key, &plain); err != nil {
+		return "", err
+	}
+	raw, err := json.Marshal(plain)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// decodeCursor reverses encodeCursor into an ExclusiveStartKey
+func decodeCursor(cursor string) (map[string]types.AttributeValue, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	var plain map[string]interface{}
+	if err := json.Unmarshal(raw, &plain); err != nil {
+		return nil, err
+	}
+	return attributevalue.MarshalMap(plain)
+}
+
+// trimLabels sorts an item's detected_labels by confidence, highest first, and
+// keeps the first n. Only the response copy changes; the stored item is untouched.
+func trimLabels(item map[string]interface{}, n int) {
+	labels, ok := item["detected_labels"].([]interface{})
+	if !ok {
+		return
+	}
+	confidence := func(l interface{}) float64 {
+		label, _ := l.(map[string]interface{})
+		c, _ := label["confidence"].(float64)
+		return c
+	}
+	sort.SliceStable(labels, func(i, j int) bool {
+		return confidence(labels[i]) > confidence(labels[j])
+	})
+	if len(labels) > n {
+		labels = labels[:n]
+	}
+	item["detected_labels"] = labels
+}
+
+// hasLabel reports whether an item has a detected label at or above minConfidence
+// whose name, parent or category matches name (case-insensitive)
+func hasLabel(item map[string]interface{}, name string, minConfidence float64) bool {
+	// User tags carry no confidence, so they match regardless of minConfidence
+	tags, _ := item["user_tags"].([]string)
+	for _, tag := range tags {
+		if strings.EqualFold(tag, name) {
+			return true
+		}
+	}
+
+	labels, _ := item["detected_labels"].([]interface{})
+	for _, l := range labels {
+		label, ok := l.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		confidence, _ := label["confidence"].(float64)
+		if confidence < minConfidence {
+			continue
+		}
+		if labelName, _ := label["name"].(string); strings.EqualFold(labelName, name) {
+			return true
+		}
+		// A parent or category match lets ?label=Animal find Dog and Cat images
+		for _, field := range []string{"parents", "categories"} {
+			values, _ := label[field].([]interface{})
+			for _, v := range values {
+				if s, ok := v.(string); ok && strings.EqualFold(s, name) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// sharpEnough reports whether an item's image_quality sharpness is at least
+// minSharpness. Items processed without REKOGNITION_IMAGE_PROPERTIES have no
+// score and never match.
+func sharpEnough(item map[string]interface{}, minSharpness float64) bool {
+	quality, ok := item["image_quality"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	sharpness, ok := quality["sharpness"].(float64)
+	return ok && sharpness >= minSharpness
+}
+
+// Limits on PATCH /images tags
+const (
+	maxTagsPerRequest = 50
+	maxTagLength      = 64
+)
+
+// handleUpdateTags adds or removes user tags with a single UpdateItem. ADD and
+// DELETE operate on the stored string set, so concurrent edits merge instead of
+// overwriting each other.
+func (h *Handler) handleUpdateTags(ctx context.Context, req events.APIGatewayV2HTTPRequest, headers map[string]string) (events.APIGatewayV2HTTPResponse, error) {
+	key := req.QueryStringParameters["key"]
+	if key == "" {
+		return errorResponse(headers, 400, "MISSING_PARAMETER", "Missing key parameter")
+	}
+
+	var updateReq UpdateTagsRequest
+	if err := decodeBody(req.Body, &updateReq); err != nil {
+		return errorResponse(headers, 400, "INVALID_REQUEST_BODY", err.Error())
+	}
+
+	// DynamoDB rejects ADD and DELETE on the same attribute in one expression
+	operation, rawTags := "ADD", updateReq.Tags
+	switch {
+	case len(updateReq.Tags) > 0 && len(updateReq.RemoveTags) > 0:
+		return errorResponse(headers, 400, "INVALID_REQUEST_BODY", "Send either tags or remove_tags, not both")
+	case len(updateReq.RemoveTags) > 0:
+		operation, rawTags = "DELETE", updateReq.RemoveTags
+	}
+
+	tags, err := normalizeTags(rawTags)
+	if err != nil {
+		return errorResponse(headers, 400, "INVALID_REQUEST_BODY", err.Error())
+	}
+
+	// attribute_exists(gallery_pk) keeps search entries from being tagged
+	update := &dynamodb.UpdateItemInput{
+		TableName: aws.String(h.tableName),
+		Key: map[string]types.AttributeValue{
+			"image_key": &types.AttributeValueMemberS{Value: key},
+		},
+		UpdateExpression:    aws.String(operation + " user_tags :tags"),
+		ConditionExpression: aws.String("attribute_exists(gallery_pk)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tags": &types.AttributeValueMemberSS{Value: tags},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	}
+	// Authenticated callers may only tag their own images; others get a 404
+	if owner := subjectFrom(ctx); owner != "" {
+		update.ConditionExpression = aws.String("attribute_exists(gallery_pk) AND #owner = :owner")
+		update.ExpressionAttributeNames = map[string]string{"#owner": "owner"}
+		update.ExpressionAttributeValues[":owner"] = &types.AttributeValueMemberS{Value: owner}
+	}
+	result, err := h.dynamoDBClient.UpdateItem(ctx, update)
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return errorResponse(headers, 404, "NOT_FOUND", "Image not found")
+	}
+	if err != nil {
+		h.logger.Error("failed to update tags", slog.String("key", key), slog.String("error", err.Error()))
+		return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to update tags")
+	}
+
+	// Deleting the last tag removes the attribute, leaving nothing in UPDATED_NEW
+	userTags := []string{}
+	if set, ok := result.Attributes["user_tags"].(*types.AttributeValueMemberSS); ok {
+		userTags = set.Value
+	}
+	sort.Strings(userTags)
+
+	responseBody, _ := json.Marshal(UpdateTagsResponse{Key: key, UserTags: userTags})
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(responseBody),
+	}, nil
+}
+
+// normalizeTags trims and lowercases tags and drops duplicates, since a string
+// set must be non-empty and free of repeats
+func normalizeTags(raw []string) ([]string, error) {
+	if len(raw) == 0 {
+		return nil, errors.New("tags must not be empty")
+	}
+	if len(raw) > maxTagsPerRequest {
+		return nil, fmt.Errorf("at most %d tags per request", maxTagsPerRequest)
+	}
+
+	seen := make(map[string]bool, len(raw))
+	tags := make([]string, 0, len(raw))
+	for _, tag := range raw {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" {
+			return nil, errors.New("tags must not be blank")
+		}
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			return nil, fmt.Errorf("tags must be at most %d characters", maxTagLength)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags, nil
+}
+
+func (h *Handler) handleDeleteImage(ctx context.Context, req events.APIGatewayV2HTTPRequest, headers map[string]string) (events.APIGatewayV2HTTPResponse, error) {
+	key := req.QueryStringParameters["key"]
+	if key == "" {
+		return errorResponse(headers, 400, "MISSING_PARAMETER", "Missing key parameter")
+	}
+
+	itemKey := map[string]types.AttributeValue{
+		"image_key": &types.AttributeValueMemberS{Value: key},
+	}
+
+	result, err := h.dynamoDBClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(h.tableName),
+		Key:       itemKey,
+	})
+	if err != nil {
+		h.logger.Error("failed to get item", slog.String("key", key), slog.String("error", err.Error()))
+		return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to fetch image")
+	}
+	if result.Item == nil {
+		return errorResponse(headers, 404, "NOT_FOUND", "Image not found")
+	}
+
+	var item map[string]interface{}
+	if err := attributevalue.UnmarshalMap(result.Item, &item); err != nil {
+		h.logger.Error("failed to unmarshal item", slog.String("key", key), slog.String("error", err.Error()))
+		return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to process image")
+	}
+
+	// Another user's image is reported as missing rather than forbidden, so keys
+	// can't be probed for existence
+	if !ownedBy(item, subjectFrom(ctx)) {
+		h.logger.Warn("refused to delete image of another owner", slog.String("key", key))
+		return errorResponse(headers, 404, "NOT_FOUND", "Image not found")
+	}
+
+	// Only image items carry gallery_pk; the label counts, search entries, rate
+	// limit windows and idempotency records sharing the table can't be deleted
+	deleteItem := &dynamodb.DeleteItemInput{
+		TableName:           aws.String(h.tableName),
+		Key:                 itemKey,
+		ConditionExpression: aws.String("attribute_exists(gallery_pk)"),
+		ReturnValues:        types.ReturnValueAllOld,
+	}
+	// The owner is checked again here in case the image was replaced since the read
+	if owner := subjectFrom(ctx); owner != "" {
+		deleteItem.ConditionExpression = aws.String("attribute_exists(gallery_pk) AND #owner = :owner")
+		deleteItem.ExpressionAttributeNames = map[string]string{"#owner": "owner"}
+		deleteItem.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":owner": &types.AttributeValueMemberS{Value: owner},
+		}
+	}
+	deleted, err := h.dynamoDBClient.DeleteItem(ctx, deleteItem)
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return errorResponse(headers, 404, "NOT_FOUND", "Image not found")
+	}
+	if err != nil {
+		h.logger.Error("failed to delete item", slog.String("key", key), slog.String("error", err.Error()))
+		return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to delete image")
+	}
+
+	// The processor may have rewritten the item since the read, so its search
+	// entries, labels and objects are taken from what was actually deleted
+	var deletedItem map[string]interface{}
+	if err := attributevalue.UnmarshalMap(deleted.Attributes, &deletedItem); err != nil {
+		h.logger.Error("failed to unmarshal deleted item", slog.String("key", key), slog.String("error", err.Error()))
+	} else {
+		item = deletedItem
+	}
+
+	// Stale search entries only cost a skipped lookup in handleSearch, so a
+	// failure here is logged rather than surfaced
+	if err := h.processor.DeleteSearchEntries(ctx, key, stringList(item["search_terms"])); err != nil {
+		h.logger.Error("failed to delete search entries", slog.String("key", key), slog.String("error", err.Error()))
+	}
+	var labels struct {
+		DetectedLabels []processor.LabelInfo `dynamodbav:"detected_labels"`
+	}
+	if err := attributevalue.UnmarshalMap(deleted.Attributes, &labels); err != nil {
+		h.logger.Error("failed to read detected labels", slog.String("key", key), slog.String("error", err.Error()))
+	}
+	released := make(map[string]int, len(labels.DetectedLabels))
+	processor.AddLabelReleases(released, labels.DetectedLabels)
+	if err := h.processor.ReleaseLabelCounts(ctx, released); err != nil {
+		h.logger.Error("failed to update label counts", slog.String("key", key), slog.String("error", err.Error()))
+	}
+
+	// The metadata is gone, so from here S3 deletes are best-effort but reported
+	resp := DeleteResponse{
+		Deleted: []string{},
+		Failed:  []DeleteFailure{},
+	}
+	for bucket, keys := range objectKeys(h.bucketName, key, item) {
+		bucketResp := h.deleteObjects(ctx, bucket, keys)
+		resp.Deleted = append(resp.Deleted, bucketResp.Deleted...)
+		resp.Failed = append(resp.Failed, bucketResp.Failed...)
+	}
+	if len(resp.Failed) == 0 {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: 204,
+			Headers:    headers,
+		}, nil
+	}
+
+	h.logger.Error("failed to delete some objects", slog.String("key", key), slog.Int("failed_count", len(resp.Failed)))
+	responseBody, _ := json.Marshal(resp)
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: 207,
+		Headers:    headers,
+		Body:       string(responseBody),
+	}, nil
+}
+
+// stringList returns the strings of a list attribute, skipping any other values
+func stringList(value interface{}) []string {
+	list, _ := value.([]interface{})
+	strs := make([]string, 0, len(list))
+	for _, v := range list {
+		if str, ok := v.(string); ok {
+			strs = append(strs, str)
+		}
+	}
+	return strs
+}
+
+// ownsImage reports whether key is an image item owned by subject
+func (h *Handler) ownsImage(ctx context.Context, key, subject string) (bool, error) {
+	result, err := h.dynamoDBClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(h.tableName),
+		Key: map[string]types.AttributeValue{
+			"image_key": &types.AttributeValueMemberS{Value: key},
+		},
+		ProjectionExpression:     aws.String("gallery_pk, #owner"),
+		ExpressionAttributeNames: map[string]string{"#owner": "owner"},
+	})
+	if err != nil {
+		return false, err
+	}
+	var item map[string]interface{}
+	if err := attributevalue.UnmarshalMap(result.Item, &item); err != nil {
+		return false, err
+	}
+	return isImage(item) && ownedBy(item, subject), nil
+}
+
+// isImage reports whether item is an image rather than one of the search
+// entries, label counts or other records sharing its table; only images carry
+// gallery_pk
+func isImage(item map[string]interface{}) bool {
+	return item["gallery_pk"] != nil
+}
+
+// ownedBy reports whether an authenticated caller may modify item. Anonymous
+// callers (auth disabled) may modify anything; otherwise owner must match.
+func ownedBy(item map[string]interface{}, subject string) bool {
+	if subject == "" {
+		return true
+	}
+	owner, _ := item["owner"].(string)
+	return owner == subject
+}
+
+// objectKeys returns the original and every derived S3 key recorded on an item,
+// grouped by bucket since thumbnails may live outside the image bucket
+func objectKeys(imageBucket, key string, item map[string]interface{}) map[string][]string {
+	keys := map[string][]string{imageBucket: {key}}
+	seen := map[string]bool{imageBucket + "/" + key: true}
+	add := func(bucket, k string) {
+		if k != "" && !seen[bucket+"/"+k] {
+			seen[bucket+"/"+k] = true
+			keys[bucket] = append(keys[bucket], k)
+		}
+	}
+
+	if k, ok := item["converted_key"].(string); ok {
+		add(imageBucket, k)
+	}
+	if k, ok := item["quarantine_key"].(string); ok {
+		add(imageBucket, k)
+	}
+	if k, ok := item["optimized_key"].(string); ok {
+		add(imageBucket, k)
+	}
+
+	thumbnails := thumbnailBucket(item, imageBucket)
+	if k, ok := item["thumbnail_key"].(string); ok {
+		add(thumbnails, k)
+	}
+	if widths, ok := item["thumbnails"].(map[string]interface{}); ok {
+		for _, v := range widths {
+			if k, ok := v.(string); ok {
+				add(thumbnails, k)
+			}
+		}
+	}
+
+	return keys
+}
+
+// deleteObjects removes the given keys from bucket and reports per-key outcomes
+func (h *Handler) deleteObjects(ctx context.Context, bucket string, keys []string) DeleteResponse {
+	resp := DeleteResponse{
+		Deleted: []string{},
+		Failed:  []DeleteFailure{},
+	}
+
+	objects := make([]s3types.ObjectIdentifier, 0, len(keys))
+	for _, k := range keys {
+		objects = append(objects, s3types.ObjectIdentifier{Key: aws.String(k)})
+	}
+
+	result, err := h.s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String(bucket),
+		Delete: &s3types.Delete{Objects: objects},
+	})
+	if err != nil {
+		for _, k := range keys {
+			resp.Failed = append(resp.Failed, DeleteFailure{Key: k, Error: err.Error()})
+		}
+		return resp
+	}
+
+	for _, deleted := range result.Deleted {
+		resp.Deleted = append(resp.Deleted, aws.ToString(deleted.Key))
+	}
+	for _, failed := range result.Errors {
+		resp.Failed = append(resp.Failed, DeleteFailure{
+			Key:   aws.ToString(failed.Key),
+			Error: aws.ToString(failed.Message),
+		})
+	}
+
+	return resp
+}
+
+// decodeBody strictly decodes a JSON request body into v: unknown fields, wrong
+// types and trailing data are rejected with a message naming the problem, which
+// is safe to return to the client
+func decodeBody(body string, v interface{}) error {
+	if strings.TrimSpace(body) == "" {
+		return errors.New("request body is empty")
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(body))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return errors.New("request body is not valid JSON")
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return fmt.Errorf("request body must be a JSON object")
+		}
+		return fmt.Errorf("field %q must be %s, got %s", typeErr.Field, jsonTypeName(typeErr.Type), typeErr.Value)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no typed error for this case
+		return fmt.Errorf("unknown field %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+	default:
+		return errors.New("request body is not valid JSON")
+	}
+
+	if decoder.More() {
+		return errors.New("request body must contain a single JSON object")
+	}
+	return nil
+}
+
+// jsonTypeName names a Go type the way a JSON client would see it, with article
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
+
+func (h *Handler) handleUpload(ctx context.Context, req events.APIGatewayV2HTTPRequest, headers map[string]string) (events.APIGatewayV2HTTPResponse, error) {
+	var uploadReq UploadRequest
+	if err := decodeBody(req.Body, &uploadReq); err != nil {
+		return errorResponse(headers, 400, "INVALID_REQUEST_BODY", err.Error())
+	}
+
+	if body := h.validateUpload(uploadReq); body != nil {
+		return errorBodyResponse(headers, 400, *body)
+	}
+
+	mode, err := uploadMode(req)
+	if err != nil {
+		return errorResponse(headers, 400, "INVALID_PARAMETER", err.Error())
+	}
+
+	id := req.Headers["idempotency-key"]
+	if id != "" && !validIdempotencyKey(id) {
+		return errorResponse(headers, 400, "INVALID_IDEMPOTENCY_KEY", fmt.Sprintf("Idempotency-Key must be 1 to %d printable ASCII characters", maxIdempotencyKeyLength))
+	}
+
+	// Only requests that will be presigned count, as in handleUploadBatch
+	if resp, limited := h.rateLimited(ctx, req, headers, 1); limited {
+		return resp, nil
+	}
+
+	// A retry carrying the same Idempotency-Key gets the key of the first call,
+	// presigned afresh, rather than a second upload
+	key := newUploadKey(uploadReq.Filename)
+	if id != "" {
+		// Scoped to the caller, so clients can't collide on each other's keys
+		scope := subjectFrom(ctx)
+		if scope == "" {
+			scope = req.RequestContext.HTTP.SourceIP
+		}
+		stored, err := h.idempotency.claim(ctx, scope+"#"+id, key, requestFingerprint(req.Body), time.Now().Add(idempotencyTTL))
+		switch {
+		case errors.Is(err, errIdempotencyMismatch):
+			return errorResponse(headers, 422, "IDEMPOTENCY_KEY_REUSED", "Idempotency-Key was already used for a different upload")
+		case err != nil:
+			// Without the store the upload still works, just without retry safety
+			h.logger.Error("failed to claim idempotency key", slog.String("error", err.Error()))
+		default:
+			key = stored
+		}
+	}
+
+	resp, err := h.presignUpload(ctx, req, uploadReq, key, mode)
+	if err != nil {
+		h.logger.Error("failed to presign upload", slog.String("error", err.Error()))
+		return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to generate upload URL")
+	}
+	responseBody, _ := json.Marshal(resp)
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(responseBody),
+	}, nil
+}
+
+// handleUploadBatch presigns up to maxBatchUploads uploads in one call. Any
+// invalid file rejects the whole batch with per-file errors, unless
+// ?partial=true asks for the valid files to be presigned anyway.
+func (h *Handler) handleUploadBatch(ctx context.Context, req events.APIGatewayV2HTTPRequest, headers map[string]string) (events.APIGatewayV2HTTPResponse, error) {
+	var batchReq UploadBatchRequest
+	if err := decodeBody(req.Body, &batchReq); err != nil {
+		return errorResponse(headers, 400, "INVALID_REQUEST_BODY", err.Error())
+	}
+	if len(batchReq.Files) == 0 {
+		return errorResponse(headers, 400, "INVALID_REQUEST_BODY", "files must not be empty")
+	}
+	if len(batchReq.Files) > h.maxBatchUploads {
+		return errorResponse(headers, 400, "BATCH_TOO_LARGE", fmt.Sprintf("At most %d files per batch", h.maxBatchUploads))
+	}
+
+	mode, err := uploadMode(req)
+	if err != nil {
+		return errorResponse(headers, 400, "INVALID_PARAMETER", err.Error())
+	}
+	partial := req.QueryStringParameters["partial"] == "true"
+
+	results := make([]UploadBatchResult, len(batchReq.Files))
+	invalid := 0
+	for i, file := range batchReq.Files {
+		results[i].Index = i
+		if body := h.validateUpload(file); body != nil {
+			results[i].Error = body
+			invalid++
+		}
+	}
+	if invalid > 0 && !partial {
+		responseBody, _ := json.Marshal(map[string]interface{}{
+			"error": ErrorBody{
+				Code:    "INVALID_BATCH",
+				Message: fmt.Sprintf("%d of %d files are invalid", invalid, len(results)),
+			},
+			"uploads": results,
+		})
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: 400,
+			Headers:    headers,
+			Body:       string(responseBody),
+		}, nil
+	}
+
+	// Each presigned file counts against the per-IP upload rate
+	if resp, limited := h.rateLimited(ctx, req, headers, len(results)-invalid); limited {
+		return resp, nil
+	}
+
+	for i, file := range batchReq.Files {
+		if results[i].Error != nil {
+			continue
+		}
+		resp, err := h.presignUpload(ctx, req, file, newUploadKey(file.Filename), mode)
+		if err != nil {
+			h.logger.Error("failed to presign upload", slog.Int("index", i), slog.String("error", err.Error()))
+			return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to generate upload URLs")
+		}
+		results[i].UploadResponse = &resp
+	}
+	responseBody, _ := json.Marshal(UploadBatchResponse{Uploads: results})
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(responseBody),
+	}, nil
+}
+
+// rateLimited counts n uploads against the caller's per-IP rate. When the
+// limit is exceeded it returns the 429 response and true.
+func (h *Handler) rateLimited(ctx context.Context, req events.APIGatewayV2HTTPRequest, headers map[string]string, n int) (events.APIGatewayV2HTTPResponse, bool) {
+	if h.uploadLimiter == nil || n == 0 {
+		return events.APIGatewayV2HTTPResponse{}, false
+	}
+
+	sourceIP := req.RequestContext.HTTP.SourceIP
+	allowed, retryAfter, err := h.uploadLimiter.allow(ctx, sourceIP, n, time.Now())
+	switch {
+	case err != nil:
+		// A counter outage shouldn't take uploads down with it
+		h.logger.Error("failed to check upload rate", slog.String("source_ip", sourceIP), slog.String("error", err.Error()))
+	case !allowed:
+		h.logger.Warn("upload rate exceeded", slog.String("source_ip", sourceIP))
+		headers["Retry-After"] = strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))
+		resp, _ := errorResponse(headers, 429, "RATE_LIMITED", "Too many upload requests, try again later")
+		return resp, true
+	}
+	return events.APIGatewayV2HTTPResponse{}, false
+}
+
+// validateUpload checks a requested upload's content type, declared size and metadata,
+// returning the error body to reject it with, or nil
+func (h *Handler) validateUpload(uploadReq UploadRequest) *ErrorBody {
+	if uploadReq.ContentType == "" {
+		return &ErrorBody{Code: "INVALID_REQUEST_BODY", Message: "contentType is required"}
+	}
+	if uploadReq.Size < 0 {
+		return &ErrorBody{Code: "INVALID_REQUEST_BODY", Message: "size must not be negative"}
+	}
+	if !h.allowedTypes[uploadReq.ContentType] {
+		allowed := make([]string, 0, len(h.allowedTypes))
+		for contentType := range h.allowedTypes {
+			allowed = append(allowed, contentType)
+		}
+		sort.Strings(allowed)
+		return &ErrorBody{
+			Code:         "UNSUPPORTED_CONTENT_TYPE",
+			Message:      fmt.Sprintf("Content type %q is not allowed", uploadReq.ContentType),
+			AllowedTypes: allowed,
+		}
+	}
+
+	// The declared size is checked up front; POST uploads are also capped by S3
+	if uploadReq.Size > h.maxUploadBytes {
+		return &ErrorBody{
+			Code:    "FILE_TOO_LARGE",
+			Message: fmt.Sprintf("File size exceeds %d byte limit", h.maxUploadBytes),
+		}
+	}
+	return validateCustomMetadata(uploadReq)
+}
+
+// uploadMode reads ?mode: "post" (the default) or "put", which keeps the
+// presigned PUT older clients use but can't limit size
+func uploadMode(req events.APIGatewayV2HTTPRequest) (string, error) {
+	mode := req.QueryStringParameters["mode"]
+	switch mode {
+	case "", "post":
+		return "post", nil
+	case "put":
+		return mode, nil
+	default:
+		return "", fmt.Errorf("mode must be put or post")
+	}
+}
+
+// newUploadKey picks the S3 key for an upload. The nanosecond prefix orders
+// keys and the random suffix keeps uploads in the same nanosecond, such as a
+// batch on a coarse clock, apart; the filename only makes them readable.
+func newUploadKey(filename string) string {
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	return fmt.Sprintf("images/%d-%s-%s", time.Now().UnixNano(), hex.EncodeToString(suffix), keyFilename(displayFilename(filename)))
+}
+
+// presignUpload presigns a validated upload to key in mode
+func (h *Handler) presignUpload(ctx context.Context, req events.APIGatewayV2HTTPRequest, uploadReq UploadRequest, key, mode string) (UploadResponse, error) {
+	displayName := displayFilename(uploadReq.Filename)
+
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(h.bucketName),
+		Key:         aws.String(key),
+		ContentType: aws.String(uploadReq.ContentType),
+	}
+
+	// The display filename travels as user metadata so the processor can store it
+	// unmangled. It is signed, so the client must send it back as a header (PUT) or
+	// form field (POST).
+	// The request ID rides along the same way so processor logs for this upload
+	// share it.
+	input.Metadata = map[string]string{}
+	if displayName != "" {
+		input.Metadata[processor.OriginalFilenameMetadataKey] = url.PathEscape(displayName)
+	}
+	for k, v := range customMetadataEntries(uploadReq.Metadata) {
+		input.Metadata[k] = v
+	}
+	if requestID := req.RequestContext.RequestID; requestID != "" {
+		input.Metadata[processor.CorrelationIDMetadataKey] = requestID
+	}
+	if owner := subjectFrom(ctx); owner != "" {
+		input.Metadata[processor.OwnerMetadataKey] = owner
+	}
+	uploadHeaders := make(map[string]string, len(input.Metadata))
+	for k, v := range input.Metadata {
+		uploadHeaders["x-amz-meta-"+k] = v
+	}
+
+	// SSE-KMS settings are signed too; S3 rejects the upload unless the client
+	// repeats them exactly
+	if h.sseKMSKeyID != "" {
+		input.ServerSideEncryption = s3types.ServerSideEncryptionAwsKms
+		input.SSEKMSKeyId = aws.String(h.sseKMSKeyID)
+		uploadHeaders["x-amz-server-side-encryption"] = string(s3types.ServerSideEncryptionAwsKms)
+		uploadHeaders["x-amz-server-side-encryption-aws-kms-key-id"] = h.sseKMSKeyID
+	}
+
+	if mode == "put" {
+		presignClient := s3.NewPresignClient(h.presigner)
+		presignedReq, err := presignClient.PresignPutObject(ctx, input, s3.WithPresignExpires(h.uploadURLTTL))
+		if err != nil {
+			return UploadResponse{}, fmt.Errorf("failed to presign url: %w", err)
+		}
+		return UploadResponse{
+			Method:    "PUT",
+			UploadURL: presignedReq.URL,
+			Key:       key,
+			Headers:   uploadHeaders,
+		}, nil
+	}
+
+	// The same values go in as form fields, each pinned by the policy
+	fields := map[string]string{"Content-Type": uploadReq.ContentType}
+	for k, v := range uploadHeaders {
+		fields[k] = v
+	}
+	options := h.presigner.Options()
+	post, err := presignPost(ctx, options.Credentials, options.Region, time.Now(), postPolicyRequest{
+		Bucket:   h.bucketName,
+		Key:      key,
+		Fields:   fields,
+		MaxBytes: h.maxUploadBytes,
+		Expires:  h.uploadURLTTL,
+	})
+	if err != nil {
+		return UploadResponse{}, fmt.Errorf("failed to presign post: %w", err)
+	}
+	return UploadResponse{
+		Method:    "POST",
+		UploadURL: post.URL,
+		Key:       key,
+		Fields:    post.Fields,
+	}, nil
+}
+
+// contentDisposition builds an attachment header for an already sanitized
+// filename: an ASCII fallback in filename= plus the exact name as RFC 5987
+// filename*, so quotes, backslashes and non-ASCII can't break out of the value
+func contentDisposition(filename string) string {
+	fallback := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, filename)
+
+	return fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, fallback, strings.ReplaceAll(url.QueryEscape(filename), "+", "%20"))
+}
+
+// handleUploadComplete records a processing placeholder for a finished upload so
+// the gallery can list it before the processor runs. The write is conditional:
+// if the processor already saved the image, the call is a no-op. A key with no
+// object behind it is a 404.
+func (h *Handler) handleUploadComplete(ctx context.Context, req events.APIGatewayV2HTTPRequest, headers map[string]string) (events.APIGatewayV2HTTPResponse, error) {
+	var completeReq UploadCompleteRequest
+	if err := decodeBody(req.Body, &completeReq); err != nil {
+		return errorResponse(headers, 400, "INVALID_REQUEST_BODY", err.Error())
+	}
+	if !strings.HasPrefix(completeReq.Key, "images/") {
+		return errorResponse(headers, 400, "INVALID_PARAMETER", "key must be an upload key under images/")
+	}
+
+	// A placeholder for an object that was never uploaded would sit in the
+	// gallery as processing forever
+	_, err := h.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(h.bucketName),
+		Key:    aws.String(completeReq.Key),
+	})
+	var notFound *s3types.NotFound
+	if errors.As(err, &notFound) {
+		return errorResponse(headers, 404, "NOT_FOUND", "No upload found for key")
+	}
+	if err != nil {
+		h.logger.Error("failed to check upload", slog.String("key", completeReq.Key), slog.String("error", err.Error()))
+		return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to record upload")
+	}
+
+	pending := PendingImage{
+		GalleryPK:        processor.GalleryPartition,
+		ImageKey:         completeReq.Key,
+		OriginalFilename: displayFilename(completeReq.Filename),
+		Owner:            subjectFrom(ctx),
+		Status:           statusProcessing,
+		ProcessedAt:      time.Now().UTC().Format(time.RFC3339),
+	}
+	item, err := attributevalue.MarshalMap(pending)
+	if err != nil {
+		h.logger.Error("failed to marshal pending item", slog.String("key", completeReq.Key), slog.String("error", err.Error()))
+		return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to record upload")
+	}
+
+	_, err = h.dynamoDBClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(h.tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(image_key)"),
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: 204,
+			Headers:    headers,
+		}, nil
+	}
+	if err != nil {
+		h.logger.Error("failed to put pending item", slog.String("key", completeReq.Key), slog.String("error", err.Error()))
+		return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to record upload")
+	}
+
+	responseBody, _ := json.Marshal(pending)
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: 202,
+		Headers:    headers,
+		Body:       string(responseBody),
+	}, nil
+}
+
+// maxFilenameRunes bounds the display filename and the filename part of a key
+const maxFilenameRunes = 100
+
+// displayFilename reduces a client-supplied filename to its base name without
+// control characters, truncated to maxFilenameRunes. It returns "" when nothing
+// usable remains.
+func displayFilename(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = name[strings.LastIndex(name, "/")+1:]
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "." || name == ".." {
+		return ""
+	}
+
+	return truncateFilename(name, maxFilenameRunes)
+}
+
+// keyFilename makes a display filename safe for an S3 key by replacing anything
+// other than letters, digits, '.', '-' and '_' with '-'
+func keyFilename(name string) string {
+	if name == "" {
+		return "image"
+	}
+
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '-'
+	}, name)
+}
+
+// truncateFilename shortens name to max runes, keeping a short extension intact
+func truncateFilename(name string, max int) string {
+	runes := []rune(name)
+	if len(runes) <= max {
+		return name
+	}
+
+	ext := []rune(path.Ext(name))
+	if len(ext) >= max/2 {
+		ext = nil
+	}
+
+	return string(runes[:max-len(ext)]) + string(ext)
+}
+
+func (h *Handler) handleGetImageURL(ctx context.Context, req events.APIGatewayV2HTTPRequest, headers map[string]string) (events.APIGatewayV2HTTPResponse, error) {
+	key := req.QueryStringParameters["key"]
+	if key == "" {
+		return errorResponse(headers, 400, "MISSING_PARAMETER", "Missing key parameter")
+	}
+	if suspiciousKey(key) {
+		return errorResponse(headers, 400, "INVALID_KEY", "key must not start with / or contain .. segments")
+	}
+
+	// An authenticated caller may only sign its own originals; thumbnail keys
+	// can't be traced back to their image, so it fetches those through
+	// GET /thumbnail-url or the URLs GET /images returns
+	if subject := subjectFrom(ctx); subject != "" {
+		owned, err := h.ownsImage(ctx, key, subject)
+		if err != nil {
+			h.logger.Error("failed to get item", slog.String("key", key), slog.String("error", err.Error()))
+			return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to fetch image")
+		}
+		if !owned {
+			return errorResponse(headers, 404, "NOT_FOUND", "Image not found")
+		}
+	}
+
+	// Thumbnails may be kept in THUMBNAIL_BUCKET rather than the image bucket
+	bucket := h.bucketName
+	if h.processor.IsThumbnailKey(key) {
+		bucket = h.processor.ThumbnailBucket(bucket)
+	}
+
+	if h.validateKeyExists {
+		_, err := h.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		var notFound *s3types.NotFound
+		if errors.As(err, &notFound) {
+			return errorResponse(headers, 404, "NOT_FOUND", "Image not found")
+		}
+		if err != nil {
+			h.logger.Error("failed to check object", slog.String("key", key), slog.String("error", err.Error()))
+			return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to generate image URL")
+		}
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+
+	// ?download=true makes S3 serve the object as an attachment, named after
+	// ?filename or else the last segment of the key
+	if req.QueryStringParameters["download"] == "true" {
+		filename := displayFilename(req.QueryStringParameters["filename"])
+		if filename == "" {
+			filename = displayFilename(key)
+		}
+		input.ResponseContentDisposition = aws.String(contentDisposition(filename))
+	}
+
+	presignClient := s3.NewPresignClient(h.presigner)
+	presignedReq, err := presignClient.PresignGetObject(ctx, input, s3.WithPresignExpires(h.getURLTTL))
+
+	if err != nil {
+		h.logger.Error("failed to generate signed url", slog.String("error", err.Error()))
+		return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to generate image URL")
+	}
+
+	resp := ImageResponse{
+		URL: presignedReq.URL,
+	}
+	responseBody, _ := json.Marshal(resp)
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(responseBody),
+	}, nil
+}
+
+// handleGetThumbnailURL presigns the thumbnail best suited to ?width: the
+// smallest stored size at least that wide, or the largest when none is
+func (h *Handler) handleGetThumbnailURL(ctx context.Context, req events.APIGatewayV2HTTPRequest, headers map[string]string) (events.APIGatewayV2HTTPResponse, error) {
+	key := req.QueryStringParameters["key"]
+	if key == "" {
+		return errorResponse(headers, 400, "MISSING_PARAMETER", "Missing key parameter")
+	}
+	if req.QueryStringParameters["width"] == "" {
+		return errorResponse(headers, 400, "MISSING_PARAMETER", "Missing width parameter")
+	}
+	width, err := queryInt(req, "width", 0, 0)
+	if err != nil {
+		return errorResponse(headers, 400, "INVALID_PARAMETER", err.Error())
+	}
+
+	result, err := h.dynamoDBClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(h.tableName),
+		Key: map[string]types.AttributeValue{
+			"image_key": &types.AttributeValueMemberS{Value: key},
+		},
+		ProjectionExpression:     aws.String("thumbnails, thumbnail_bucket, gallery_pk, #owner"),
+		ExpressionAttributeNames: map[string]string{"#owner": "owner"},
+	})
+	if err != nil {
+		h.logger.Error("failed to get item", slog.String("key", key), slog.String("error", err.Error()))
+		return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to fetch image")
+	}
+	var item map[string]interface{}
+	if err := attributevalue.UnmarshalMap(result.Item, &item); err != nil {
+		h.logger.Error("failed to unmarshal item", slog.String("key", key), slog.String("error", err.Error()))
+		return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to process image")
+	}
+	if !isImage(item) || !ownedBy(item, subjectFrom(ctx)) {
+		return errorResponse(headers, 404, "NOT_FOUND", "Image not found")
+	}
+
+	thumbnails, _ := item["thumbnails"].(map[string]interface{})
+	chosenWidth, thumbnailKey := pickThumbnail(thumbnails, width)
+	if thumbnailKey == "" {
+		return errorResponse(headers, 404, "NO_THUMBNAILS", "Image has no thumbnails")
+	}
+
+	presignClient := s3.NewPresignClient(h.presigner)
+	presignedReq, err := presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(thumbnailBucket(item, h.bucketName)),
+		Key:    aws.String(thumbnailKey),
+	}, s3.WithPresignExpires(h.getURLTTL))
+	if err != nil {
+		h.logger.Error("failed to generate signed url", slog.String("error", err.Error()))
+		return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to generate thumbnail URL")
+	}
+
+	responseBody, _ := json.Marshal(ThumbnailURLResponse{
+		Key:          key,
+		Width:        chosenWidth,
+		ThumbnailKey: thumbnailKey,
+		URL:          presignedReq.URL,
+	})
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(responseBody),
+	}, nil
+}
+
+// pickThumbnail chooses from an item's thumbnails map (width to key) the
+// smallest thumbnail at least width wide, falling back to the largest. It
+// returns an empty key when there are none.
+func pickThumbnail(thumbnails map[string]interface{}, width int) (int, string) {
+	bestWidth, bestKey := 0, ""
+	largestWidth, largestKey := 0, ""
+	for w, v := range thumbnails {
+		size, err := strconv.Atoi(w)
+		k, ok := v.(string)
+		if err != nil || !ok || k == "" {
+			continue
+		}
+		if size >= width && (bestKey == "" || size < bestWidth) {
+			bestWidth, bestKey = size, k
+		}
+		if size > largestWidth {
+			largestWidth, largestKey = size, k
+		}
+	}
+	if bestKey != "" {
+		return bestWidth, bestKey
+	}
+	return largestWidth, largestKey
+}
+
+// suspiciousKey reports whether key starts with a slash or has a ".." segment.
+// S3 would treat either literally, so such keys only ever point somewhere other
+// than the caller meant.
+func suspiciousKey(key string) bool {
+	if strings.HasPrefix(key, "/") {
+		return true
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// handleRegenerateThumbnail rebuilds the thumbnails of an existing image with the
+// current thumbnail settings and returns a presigned URL for the new primary one
+func (h *Handler) handleRegenerateThumbnail(ctx context.Context, req events.APIGatewayV2HTTPRequest, headers map[string]string) (events.APIGatewayV2HTTPResponse, error) {
+	key := req.QueryStringParameters["key"]
+	if key == "" {
+		return errorResponse(headers, 400, "MISSING_PARAMETER", "Missing key parameter")
+	}
+
+	bucket, thumbnailKey, err := h.processor.RegenerateThumbnail(ctx, key, subjectFrom(ctx))
+	switch {
+	case errors.Is(err, processor.ErrNotFound):
+		return errorResponse(headers, 404, "NOT_FOUND", "Image not found")
+	case errors.Is(err, processor.ErrModerationFlagged):
+		return errorResponse(headers, 409, "MODERATION_FLAGGED", "Image is flagged by moderation and has no thumbnails")
+	case err != nil:
+		h.logger.Error("failed to regenerate thumbnail", slog.String("key", key), slog.String("error", err.Error()))
+		return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to regenerate thumbnail")
+	}
+
+	presignClient := s3.NewPresignClient(h.presigner)
+	presignedReq, err := presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(thumbnailKey),
+	}, s3.WithPresignExpires(h.getURLTTL))
+	if err != nil {
+		h.logger.Error("failed to generate signed url", slog.String("error", err.Error()))
+		return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to generate thumbnail URL")
+	}
+
+	responseBody, _ := json.Marshal(RegenerateThumbnailResponse{
+		Key:          key,
+		ThumbnailKey: thumbnailKey,
+		URL:          presignedReq.URL,
+	})
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(responseBody),
+	}, nil
+}
+
+// handleTransform rotates and flips an image in place, regenerating its
+// thumbnails, and returns a presigned URL for the new primary thumbnail
+func (h *Handler) handleTransform(ctx context.Context, req events.APIGatewayV2HTTPRequest, headers map[string]string) (events.APIGatewayV2HTTPResponse, error) {
+	key := req.QueryStringParameters["key"]
+	if key == "" {
+		return errorResponse(headers, 400, "MISSING_PARAMETER", "Missing key parameter")
+	}
+
+	var transformReq TransformRequest
+	if err := decodeBody(req.Body, &transformReq); err != nil {
+		return errorResponse(headers, 400, "INVALID_REQUEST_BODY", err.Error())
+	}
+	transform := processor.Transform{Rotate: transformReq.Rotate, Flip: transformReq.Flip}
+	if err := transform.Validate(); err != nil {
+		return errorResponse(headers, 400, "INVALID_TRANSFORM", err.Error())
+	}
+
+	metadata, err := h.processor.TransformImage(ctx, key, subjectFrom(ctx), transform)
+	switch {
+	case errors.Is(err, processor.ErrNotFound):
+		return errorResponse(headers, 404, "NOT_FOUND", "Image not found")
+	case errors.Is(err, processor.ErrModerationFlagged):
+		return errorResponse(headers, 409, "MODERATION_FLAGGED", "Image is flagged by moderation and cannot be transformed")
+	case errors.Is(err, processor.ErrTransformUnsupported):
+		return errorResponse(headers, 409, "UNSUPPORTED_FORMAT", "Only JPEG and PNG images can be transformed")
+	case err != nil:
+		h.logger.Error("failed to transform image", slog.String("key", key), slog.String("error", err.Error()))
+		return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to transform image")
+	}
+
+	presignClient := s3.NewPresignClient(h.presigner)
+	presignedReq, err := presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(metadata.ThumbnailBucket),
+		Key:    aws.String(metadata.ThumbnailKey),
+	}, s3.WithPresignExpires(h.getURLTTL))
+	if err != nil {
+		h.logger.Error("failed to generate signed url", slog.String("error", err.Error()))
+		return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to generate thumbnail URL")
+	}
+
+	responseBody, _ := json.Marshal(TransformResponse{
+		Key:          key,
+		Width:        metadata.Width,
+		Height:       metadata.Height,
+		ThumbnailKey: metadata.ThumbnailKey,
+		URL:          presignedReq.URL,
+	})
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(responseBody),
+	}, nil
+}
+
+func (h *Handler) handleGetImageLabels(ctx context.Context, req events.APIGatewayV2HTTPRequest, headers map[string]string) (events.APIGatewayV2HTTPResponse, error) {
+	key := req.QueryStringParameters["key"]
+	if key == "" {
+		return errorResponse(headers, 400, "MISSING_PARAMETER", "Missing key parameter")
+	}
+
+	// Single-item lookup; only the labels, owner and gallery_pk are fetched
+	result, err := h.dynamoDBClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(h.tableName),
+		Key: map[string]types.AttributeValue{
+			"image_key": &types.AttributeValueMemberS{Value: key},
+		},
+		ProjectionExpression:     aws.String("detected_labels, gallery_pk, #owner"),
+		ExpressionAttributeNames: map[string]string{"#owner": "owner"},
+	})
+	if err != nil {
+		h.logger.Error("failed to get item", slog.String("key", key), slog.String("error", err.Error()))
+		return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to fetch labels")
+	}
+	var owner string
+	if v, ok := result.Item["owner"].(*types.AttributeValueMemberS); ok {
+		owner = v.Value
+	}
+	_, image := result.Item["gallery_pk"]
+	if !image || !ownedBy(map[string]interface{}{"owner": owner}, subjectFrom(ctx)) {
+		return errorResponse(headers, 404, "NOT_FOUND", "Image not found")
+	}
+
+	resp := ImageLabelsResponse{
+		Key:    key,
+		Labels: []LabelInfo{},
+	}
+	if labels, ok := result.Item["detected_labels"]; ok {
+		if err := attributevalue.Unmarshal(labels, &resp.Labels); err != nil {
+			h.logger.Error("failed to unmarshal labels", slog.String("key", key), slog.String("error", err.Error()))
+			return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to process labels")
+		}
+	}
+	if resp.Labels == nil {
+		resp.Labels = []LabelInfo{}
+	}
+	responseBody, _ := json.Marshal(resp)
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(responseBody),
+	}, nil
+}
+
+// defaultSimilarDistance is GET /similar's maxDistance when none is given; at
+// most 10 of 64 hash bits differing is typically the same picture resized,
+// recompressed or lightly edited
+const defaultSimilarDistance = 10
+
+// handleSimilar returns images whose perceptual hash is within maxDistance bits
+// of the given image's. Hashes are compared in memory over the whole gallery
+// (or the caller's images when authenticated), so it suits modest galleries.
+func (h *Handler) handleSimilar(ctx context.Context, req events.APIGatewayV2HTTPRequest, headers map[string]string) (events.APIGatewayV2HTTPResponse, error) {
+	key := req.QueryStringParameters["key"]
+	if key == "" {
+		return errorResponse(headers, 400, "MISSING_PARAMETER", "Missing key parameter")
+	}
+
+	maxDistance := defaultSimilarDistance
+	if v := req.QueryStringParameters["maxDistance"]; v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 0 || parsed > 64 {
+			return errorResponse(headers, 400, "INVALID_PARAMETER", "maxDistance must be an integer between 0 and 64")
+		}
+		maxDistance = parsed
+	}
+
+	limit, err := h.pageLimit(req)
+	if err != nil {
+		return errorResponse(headers, 400, "INVALID_PARAMETER", err.Error())
+	}
+
+	result, err := h.dynamoDBClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(h.tableName),
+		Key: map[string]types.AttributeValue{
+			"image_key": &types.AttributeValueMemberS{Value: key},
+		},
+		ProjectionExpression:     aws.String("phash, gallery_pk, #owner"),
+		ExpressionAttributeNames: map[string]string{"#owner": "owner"},
+	})
+	if err != nil {
+		h.logger.Error("failed to get item", slog.String("key", key), slog.String("error", err.Error()))
+		return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to fetch image")
+	}
+	var target struct {
+		PHash     string `dynamodbav:"phash"`
+		GalleryPK string `dynamodbav:"gallery_pk"`
+		Owner     string `dynamodbav:"owner"`
+	}
+	if result.Item != nil {
+		if err := attributevalue.UnmarshalMap(result.Item, &target); err != nil {
+			h.logger.Error("failed to unmarshal item", slog.String("key", key), slog.String("error", err.Error()))
+			return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to process image")
+		}
+	}
+	if target.GalleryPK == "" || !ownedBy(map[string]interface{}{"owner": target.Owner}, subjectFrom(ctx)) {
+		return errorResponse(headers, 404, "NOT_FOUND", "Image not found")
+	}
+	targetHash, err := strconv.ParseUint(target.PHash, 16, 64)
+	if err != nil {
+		return errorResponse(headers, 409, "NO_PERCEPTUAL_HASH", "Image has no perceptual hash yet; reprocess it to compute one")
+	}
+
+	query := h.galleryQuery(ctx)
+	query.ProjectionExpression = aws.String("image_key, phash, processed_at, original_filename, thumbnail_key, thumbnail_bucket, converted_key, width, height")
+	paginator := dynamodb.NewQueryPaginator(h.dynamoDBClient, &query)
+
+	matches := []map[string]interface{}{}
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			h.logger.Error("failed to query gallery index", slog.String("error", err.Error()))
+			return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to fetch images")
+		}
+
+		var items []map[string]interface{}
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &items); err != nil {
+			h.logger.Error("failed to unmarshal items", slog.String("error", err.Error()))
+			return errorResponse(headers, 500, "INTERNAL_ERROR", "Failed to process images")
+		}
+
+		for _, item := range items {
+			if item["image_key"] == key {
+				continue
+			}
+			phash, _ := item["phash"].(string)
+			hash, err := strconv.ParseUint(phash, 16, 64)
+			if err != nil {
+				continue
+			}
+			if distance := bits.OnesCount64(hash ^ targetHash); distance <= maxDistance {
+				item["distance"] = distance
+				matches = append(matches, item)
+			}
+		}
+	}
+
+	// Nearest first; the query order keeps ties newest first
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i]["distance"].(int) < matches[j]["distance"].(int)
+	})
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+
+	h.presignItemURLs(ctx, matches, false)
+
+	responseBody, _ := json.Marshal(SimilarResponse{
+		Key:         key,
+		MaxDistance: maxDistance,
+		Items:       matches,
+	})
 
 	return events.APIGatewayV2HTTPResponse{
 		StatusCode: 200,
@@ -0,0 +1,2402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"log/slog"
+	"maps"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"aws-lambda-image-processor/internal/awsfake"
+	"aws-lambda-image-processor/internal/processor"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testBucket = "test-bucket"
+	testTable  = "image-labels"
+)
+
+// fakes are the in-memory clients behind a test Handler
+type fakes struct {
+	s3       *awsfake.S3
+	dynamoDB *awsfake.DynamoDB
+	// key signs the tokens the Handler's authenticator accepts
+	key *rsa.PrivateKey
+}
+
+// newTestHandler builds a Handler over fresh fakes with bearer-token auth on
+// and public reads, as configured by JWT_PUBLIC_KEY alone
+func newTestHandler(t *testing.T) (*Handler, *fakes) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	f := &fakes{s3: awsfake.NewS3(), dynamoDB: awsfake.NewDynamoDB(), key: key}
+
+	t.Setenv("DYNAMODB_TABLE_NAME", testTable)
+	pipeline, err := processor.New(processor.Clients{
+		S3Getter:    f.s3,
+		S3Putter:    f.s3,
+		Rekognition: &awsfake.Rekognition{},
+		DynamoDB:    f.dynamoDB,
+	})
+	if err != nil {
+		t.Fatalf("processor.New: %v", err)
+	}
+
+	// Presigning runs locally, so the real client never calls S3
+	presigner := s3.New(s3.Options{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKIDEXAMPLE", "secret", ""),
+	})
+	h := &Handler{
+		s3Client:        f.s3,
+		presigner:       presigner,
+		dynamoDBClient:  f.dynamoDB,
+		tableName:       testTable,
+		bucketName:      testBucket,
+		uploadURLTTL:    15 * time.Minute,
+		getURLTTL:       time.Hour,
+		allowedTypes:    map[string]bool{"image/jpeg": true, "image/png": true},
+		maxUploadBytes:  5 * 1024 * 1024,
+		maxBatchUploads: 20,
+		maxPageSize:     100,
+		processor:       pipeline,
+		idempotency:     &dynamoIdempotencyStore{client: f.dynamoDB, tableName: testTable},
+		auth:            &authenticator{publicKey: &key.PublicKey},
+		stats:           &statsCache{},
+		logger:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	return h, f
+}
+
+// token signs an RS256 token for subject that expires at expires
+func (f *fakes) token(t *testing.T, subject string, expires time.Time) string {
+	t.Helper()
+	claims := jwt.MapClaims{"exp": expires.Unix()}
+	if subject != "" {
+		claims["sub"] = subject
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(f.key)
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+	return signed
+}
+
+// putImage seeds a processed image item owned by owner and labeled Dog, its
+// search entry and its objects
+func (f *fakes) putImage(t *testing.T, key, owner, processedAt string) {
+	t.Helper()
+	item, err := attributevalue.MarshalMap(map[string]interface{}{
+		"image_key":       key,
+		"gallery_pk":      processor.GalleryPartition,
+		"bucket_name":     testBucket,
+		"processed_at":    processedAt,
+		"status":          "complete",
+		"owner":           owner,
+		"thumbnail_key":   "thumbnails/300/" + key,
+		"thumbnails":      map[string]string{"150": "thumbnails/150/" + key, "300": "thumbnails/300/" + key},
+		"search_terms":    []string{"dog"},
+		"detected_labels": []map[string]interface{}{{"name": "Dog", "confidence": 97.5}},
+	})
+	if err != nil {
+		t.Fatalf("marshal %s: %v", key, err)
+	}
+	f.dynamoDB.Put(item)
+	f.putSearchEntry(t, "dog", key, owner, processedAt)
+	for _, k := range []string{key, "thumbnails/150/" + key, "thumbnails/300/" + key} {
+		f.s3.PutBytes(testBucket, k, []byte("object"), nil)
+	}
+}
+
+// putSearchEntry seeds the search entry of an image-term pair
+func (f *fakes) putSearchEntry(t *testing.T, term, key, owner, processedAt string) {
+	t.Helper()
+	entry, err := attributevalue.MarshalMap(map[string]interface{}{
+		"image_key":    "search#" + term + "#" + key,
+		"search_term":  term,
+		"target_key":   key,
+		"target_owner": owner,
+		"processed_at": processedAt,
+	})
+	if err != nil {
+		t.Fatalf("marshal search entry: %v", err)
+	}
+	f.dynamoDB.Put(entry)
+}
+
+// call sends one request through HandleRequest, with a bearer token when
+// token is set
+func call(t *testing.T, h *Handler, method, path, token string, query map[string]string) events.APIGatewayV2HTTPResponse {
+	t.Helper()
+	return callWithBody(t, h, method, path, token, query, "")
+}
+
+// callWithBody is call for requests that carry a body
+func callWithBody(t *testing.T, h *Handler, method, path, token string, query map[string]string, body string) events.APIGatewayV2HTTPResponse {
+	t.Helper()
+	req := events.APIGatewayV2HTTPRequest{
+		RawPath:               path,
+		QueryStringParameters: query,
+		Headers:               map[string]string{},
+		Body:                  body,
+	}
+	req.RequestContext.HTTP.Method = method
+	if token != "" {
+		req.Headers["authorization"] = "Bearer " + token
+	}
+	resp, err := h.HandleRequest(context.Background(), req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return resp
+}
+
+func TestDeleteImageRemovesItemAndDerivatives(t *testing.T) {
+	h, f := newTestHandler(t)
+	token := f.token(t, "user-a", time.Now().Add(time.Hour))
+	key := "images/1700000000-dog.jpg"
+	f.putImage(t, key, "user-a", "2024-01-01T00:00:00Z")
+	f.putImage(t, "images/1700000001-cat.jpg", "user-a", "2024-01-01T00:00:01Z")
+
+	resp := call(t, h, "DELETE", "/images", token, map[string]string{"key": key})
+	if resp.StatusCode != 204 {
+		t.Fatalf("DELETE /images = %d %s, want 204", resp.StatusCode, resp.Body)
+	}
+	if f.dynamoDB.Item(key) != nil {
+		t.Error("metadata item survived the delete")
+	}
+	if f.dynamoDB.Item("search#dog#"+key) != nil {
+		t.Error("search entry survived the delete")
+	}
+	want := []string{"images/1700000001-cat.jpg", "thumbnails/150/images/1700000001-cat.jpg", "thumbnails/300/images/1700000001-cat.jpg"}
+	if got := f.s3.Keys(testBucket, ""); !slices.Equal(got, want) {
+		t.Errorf("objects left = %v, want only the other image's %v", got, want)
+	}
+}
+
+func TestDeleteImageErrors(t *testing.T) {
+	h, f := newTestHandler(t)
+	token := f.token(t, "user-a", time.Now().Add(time.Hour))
+	if resp := call(t, h, "DELETE", "/images", token, nil); resp.StatusCode != 400 {
+		t.Errorf("DELETE /images without a key = %d, want 400", resp.StatusCode)
+	}
+	if resp := call(t, h, "DELETE", "/images", token, map[string]string{"key": "images/missing.jpg"}); resp.StatusCode != 404 {
+		t.Errorf("DELETE /images of a missing image = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestDeleteImageReportsFailedObjectDeletes(t *testing.T) {
+	h, f := newTestHandler(t)
+	token := f.token(t, "user-a", time.Now().Add(time.Hour))
+	key := "images/1700000000-dog.jpg"
+	f.putImage(t, key, "user-a", "2024-01-01T00:00:00Z")
+	f.s3.BeforeCall = func(operation string) error {
+		if operation == "DeleteObjects" {
+			return errors.New("access denied")
+		}
+		return nil
+	}
+
+	resp := call(t, h, "DELETE", "/images", token, map[string]string{"key": key})
+	if resp.StatusCode != 207 {
+		t.Fatalf("DELETE /images = %d %s, want 207", resp.StatusCode, resp.Body)
+	}
+	var body DeleteResponse
+	if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+		t.Fatalf("decode %q: %v", resp.Body, err)
+	}
+	// The original and both thumbnails are reported once each
+	if len(body.Failed) != 3 || len(body.Deleted) != 0 {
+		t.Errorf("deleted %v, failed %+v; want all three keys failed", body.Deleted, body.Failed)
+	}
+	if f.dynamoDB.Item(key) != nil {
+		t.Error("metadata item survived the delete")
+	}
+}
+
+// decodeError reads the error object of an API error response
+func decodeError(t *testing.T, resp events.APIGatewayV2HTTPResponse) ErrorBody {
+	t.Helper()
+	var body struct {
+		Error ErrorBody `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+		t.Fatalf("decode error body %q: %v", resp.Body, err)
+	}
+	return body.Error
+}
+
+// itemKeys returns the image_key of every item in a listing response, sorted
+func itemKeys(t *testing.T, resp events.APIGatewayV2HTTPResponse) []string {
+	t.Helper()
+	var body struct {
+		Items []map[string]interface{} `json:"items"`
+	}
+	if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+		t.Fatalf("decode %q: %v", resp.Body, err)
+	}
+	keys := make([]string, 0, len(body.Items))
+	for _, item := range body.Items {
+		key, _ := item["image_key"].(string)
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func equalKeys(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestHasLabel(t *testing.T) {
+	item := map[string]interface{}{
+		"detected_labels": []interface{}{
+			map[string]interface{}{"name": "Dog", "confidence": 92.0},
+			map[string]interface{}{"name": "Grass", "confidence": 55.0},
+		},
+	}
+	tests := []struct {
+		name          string
+		minConfidence float64
+		want          bool
+	}{
+		{"Dog", 0, true},
+		{"dog", 90, true},
+		{"Dog", 92, true},
+		{"Dog", 95, false},
+		{"grass", 50, true},
+		{"Grass", 60, false},
+		{"Cat", 0, false},
+	}
+	for _, tt := range tests {
+		if got := hasLabel(item, tt.name, tt.minConfidence); got != tt.want {
+			t.Errorf("hasLabel(%q, %v) = %t, want %t", tt.name, tt.minConfidence, got, tt.want)
+		}
+	}
+}
+
+func TestGetImagesLabelFilter(t *testing.T) {
+	h, f := newTestHandler(t)
+	for key, labels := range map[string][]map[string]interface{}{
+		"images/1-dog.jpg":   {{"name": "Dog", "confidence": 97.5}, {"name": "Animal", "confidence": 97.5}},
+		"images/2-cat.jpg":   {{"name": "Cat", "confidence": 70.0}, {"name": "Animal", "confidence": 70.0}},
+		"images/3-chair.jpg": {{"name": "Chair", "confidence": 99.0}},
+	} {
+		item, err := attributevalue.MarshalMap(map[string]interface{}{
+			"image_key":       key,
+			"gallery_pk":      processor.GalleryPartition,
+			"processed_at":    "2024-01-01T00:00:00Z",
+			"detected_labels": labels,
+		})
+		if err != nil {
+			t.Fatalf("marshal %s: %v", key, err)
+		}
+		f.dynamoDB.Put(item)
+	}
+
+	tests := []struct {
+		query map[string]string
+		want  []string
+	}{
+		{map[string]string{"label": "animal"}, []string{"images/1-dog.jpg", "images/2-cat.jpg"}},
+		{map[string]string{"label": "Animal", "minConfidence": "80"}, []string{"images/1-dog.jpg"}},
+		{map[string]string{"label": "chair", "minConfidence": "99"}, []string{"images/3-chair.jpg"}},
+		{map[string]string{"label": "Cat", "minConfidence": "100"}, []string{}},
+	}
+	for _, tt := range tests {
+		resp := call(t, h, "GET", "/images", "", tt.query)
+		if resp.StatusCode != 200 {
+			t.Fatalf("GET /images %v: status %d, body %s", tt.query, resp.StatusCode, resp.Body)
+		}
+		if got := itemKeys(t, resp); !equalKeys(got, tt.want) {
+			t.Errorf("GET /images %v = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"high", "-1", "101"} {
+		resp := call(t, h, "GET", "/images", "", map[string]string{"label": "Dog", "minConfidence": bad})
+		if resp.StatusCode != 400 {
+			t.Errorf("minConfidence=%s: status %d, body %s; want 400", bad, resp.StatusCode, resp.Body)
+		}
+	}
+}
+
+// listPage is the body of GET /images
+type listPage struct {
+	Items []map[string]interface{} `json:"items"`
+	Next  string                   `json:"next_cursor"`
+	More  bool                     `json:"has_more"`
+}
+
+func decodePage(t *testing.T, resp events.APIGatewayV2HTTPResponse) listPage {
+	t.Helper()
+	if resp.StatusCode != 200 {
+		t.Fatalf("status %d, body %s", resp.StatusCode, resp.Body)
+	}
+	var page listPage
+	if err := json.Unmarshal([]byte(resp.Body), &page); err != nil {
+		t.Fatalf("decode %q: %v", resp.Body, err)
+	}
+	return page
+}
+
+// collectPages follows next_cursor from the first page of query until
+// has_more is false and returns every image_key seen, in order
+func collectPages(t *testing.T, h *Handler, query map[string]string) []string {
+	t.Helper()
+	var got []string
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("pagination did not end after 10 pages")
+		}
+		page := decodePage(t, call(t, h, "GET", "/images", "", query))
+		for _, item := range page.Items {
+			got = append(got, item["image_key"].(string))
+		}
+		if !page.More {
+			return got
+		}
+		if page.Next == "" {
+			t.Fatal("has_more without next_cursor")
+		}
+		query["cursor"] = page.Next
+	}
+}
+
+func TestGetImagesNewestFirst(t *testing.T) {
+	h, f := newTestHandler(t)
+	// Inserted out of order; the gallery index orders them by processed_at
+	for key, processedAt := range map[string]string{
+		"images/b.jpg": "2024-01-02T00:00:00Z",
+		"images/d.jpg": "2024-01-04T00:00:00Z",
+		"images/a.jpg": "2024-01-01T00:00:00Z",
+		"images/e.jpg": "2024-01-05T00:00:00Z",
+		"images/c.jpg": "2024-01-03T00:00:00Z",
+	} {
+		f.putImage(t, key, "user-a", processedAt)
+	}
+
+	got := collectPages(t, h, map[string]string{"limit": "2"})
+	want := []string{"images/e.jpg", "images/d.jpg", "images/c.jpg", "images/b.jpg", "images/a.jpg"}
+	if !slices.Equal(got, want) {
+		t.Errorf("GET /images order = %v, want %v", got, want)
+	}
+
+	resp := call(t, h, "GET", "/images", "", map[string]string{"cursor": "not base64!"})
+	if resp.StatusCode != 400 {
+		t.Errorf("bad cursor: status %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestGetImagesCursorPaginationWithLabelFilter(t *testing.T) {
+	h, f := newTestHandler(t)
+	// Only every other image matches, so each page needs several Queries to fill
+	for i, key := range []string{"images/a.jpg", "images/b.jpg", "images/c.jpg", "images/d.jpg", "images/e.jpg", "images/f.jpg"} {
+		label := "Dog"
+		if i%2 == 1 {
+			label = "Cat"
+		}
+		item, err := attributevalue.MarshalMap(map[string]interface{}{
+			"image_key":       key,
+			"gallery_pk":      processor.GalleryPartition,
+			"processed_at":    "2024-01-01T00:00:0" + strconv.Itoa(i) + "Z",
+			"detected_labels": []map[string]interface{}{{"name": label, "confidence": 90.0}},
+		})
+		if err != nil {
+			t.Fatalf("marshal %s: %v", key, err)
+		}
+		f.dynamoDB.Put(item)
+	}
+
+	got := collectPages(t, h, map[string]string{"label": "dog", "limit": "2"})
+	if want := []string{"images/e.jpg", "images/c.jpg", "images/a.jpg"}; !slices.Equal(got, want) {
+		t.Errorf("filtered pages = %v, want %v", got, want)
+	}
+}
+
+func TestGetImageLabels(t *testing.T) {
+	h, f := newTestHandler(t)
+	key := "images/1700000000-dog.jpg"
+	f.putImage(t, key, "user-a", "2024-01-01T00:00:00Z")
+	bare, err := attributevalue.MarshalMap(map[string]string{"image_key": "images/1700000001-blank.jpg", "gallery_pk": processor.GalleryPartition})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	f.dynamoDB.Put(bare)
+
+	tests := []struct {
+		name   string
+		query  map[string]string
+		status int
+		body   string
+	}{
+		{"labelled", map[string]string{"key": key}, 200, `{"key":"images/1700000000-dog.jpg","labels":[{"name":"Dog","confidence":97.5}]}`},
+		{"no labels", map[string]string{"key": "images/1700000001-blank.jpg"}, 200, `{"key":"images/1700000001-blank.jpg","labels":[]}`},
+		{"missing key", nil, 400, `{"error":{"code":"MISSING_PARAMETER","message":"Missing key parameter"}}`},
+		{"unknown image", map[string]string{"key": "images/missing.jpg"}, 404, `{"error":{"code":"NOT_FOUND","message":"Image not found"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := call(t, h, "GET", "/image-labels", "", tt.query)
+			if resp.StatusCode != tt.status || resp.Body != tt.body {
+				t.Errorf("GET /image-labels = %d %s, want %d %s", resp.StatusCode, resp.Body, tt.status, tt.body)
+			}
+		})
+	}
+}
+
+func TestSearch(t *testing.T) {
+	h, f := newTestHandler(t)
+	f.putImage(t, "images/1.jpg", "user-a", "2024-01-01T00:00:00Z")
+	f.putImage(t, "images/2.jpg", "user-a", "2024-01-02T00:00:00Z")
+	f.putSearchEntry(t, "golden retriever", "images/1.jpg", "user-a", "2024-01-01T00:00:00Z")
+	f.putSearchEntry(t, "retriever", "images/1.jpg", "user-a", "2024-01-01T00:00:00Z")
+
+	tests := []struct {
+		q    string
+		want []string
+	}{
+		{"dog", []string{"images/1.jpg", "images/2.jpg"}},
+		{"DOG", []string{"images/1.jpg", "images/2.jpg"}},
+		{"Golden Retriever", []string{"images/1.jpg"}},
+		{"cat", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.q, func(t *testing.T) {
+			resp := call(t, h, "GET", "/search", "", map[string]string{"q": tt.q})
+			if resp.StatusCode != 200 {
+				t.Fatalf("GET /search = %d %s, want 200", resp.StatusCode, resp.Body)
+			}
+			if got := itemKeys(t, resp); !slices.Equal(got, tt.want) {
+				t.Errorf("q=%q found %v, want %v", tt.q, got, tt.want)
+			}
+		})
+	}
+
+	if resp := call(t, h, "GET", "/search", "", map[string]string{"q": "  "}); resp.StatusCode != 400 {
+		t.Errorf("GET /search with a blank q = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestSearchDeduplicatesAcrossPages(t *testing.T) {
+	h, f := newTestHandler(t)
+	// Every image matches both "dog" and "brown", so each is found twice
+	keys := []string{"images/1.jpg", "images/2.jpg", "images/3.jpg"}
+	for i, key := range keys {
+		processedAt := fmt.Sprintf("2024-01-0%dT00:00:00Z", i+1)
+		f.putImage(t, key, "user-a", processedAt)
+		f.putSearchEntry(t, "brown", key, "user-a", processedAt)
+	}
+
+	seen := map[string]bool{}
+	for page := 1; page <= 3; page++ {
+		resp := call(t, h, "GET", "/search", "", map[string]string{"q": "brown dog", "limit": "1", "page": strconv.Itoa(page)})
+		if resp.StatusCode != 200 {
+			t.Fatalf("page %d = %d (%s), want 200", page, resp.StatusCode, resp.Body)
+		}
+		var body struct {
+			Items   []map[string]interface{} `json:"items"`
+			HasMore bool                     `json:"has_more"`
+		}
+		if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+			t.Fatalf("decode page %d: %v", page, err)
+		}
+		if len(body.Items) != 1 {
+			t.Fatalf("page %d has %d items, want 1", page, len(body.Items))
+		}
+		key, _ := body.Items[0]["image_key"].(string)
+		if seen[key] {
+			t.Errorf("page %d repeats %s", page, key)
+		}
+		seen[key] = true
+		if url, _ := body.Items[0]["url"].(string); url == "" {
+			t.Errorf("page %d item has no url", page)
+		}
+		if want := page < 3; body.HasMore != want {
+			t.Errorf("page %d has_more = %v, want %v", page, body.HasMore, want)
+		}
+	}
+	if len(seen) != len(keys) {
+		t.Errorf("pages listed %d images, want %d", len(seen), len(keys))
+	}
+}
+
+func TestSingleImageEndpointsIgnoreSearchEntries(t *testing.T) {
+	h, f := newTestHandler(t)
+	token := f.token(t, "user-a", time.Now().Add(time.Hour))
+	f.putImage(t, "images/a.jpg", "user-a", "2024-01-02T00:00:00Z")
+	entryKey := "search#dog#images/a.jpg"
+
+	if resp := call(t, h, "GET", "/image-labels", "", map[string]string{"key": entryKey}); resp.StatusCode != 404 {
+		t.Errorf("GET /image-labels of a search entry = %d, want 404", resp.StatusCode)
+	}
+	if resp := call(t, h, "GET", "/similar", "", map[string]string{"key": entryKey}); resp.StatusCode != 404 {
+		t.Errorf("GET /similar of a search entry = %d, want 404", resp.StatusCode)
+	}
+	if resp := call(t, h, "DELETE", "/images", token, map[string]string{"key": entryKey}); resp.StatusCode != 404 {
+		t.Errorf("DELETE of a search entry = %d, want 404", resp.StatusCode)
+	}
+	if f.dynamoDB.Item(entryKey) == nil {
+		t.Error("search entry was deleted")
+	}
+}
+
+func TestUploadFilenames(t *testing.T) {
+	tests := []struct {
+		name        string
+		filename    string
+		wantDisplay string
+		wantKey     string
+	}{
+		{"plain", "dog.jpg", "dog.jpg", "dog.jpg"},
+		{"unix path", "/home/me/pics/dog.jpg", "dog.jpg", "dog.jpg"},
+		{"windows path", `C:\Users\me\dog.jpg`, "dog.jpg", "dog.jpg"},
+		{"traversal", "../../etc/passwd", "passwd", "passwd"},
+		{"dot dot only", "..", "", "image"},
+		{"control characters", "dog\r\n\x00\t.jpg", "dog.jpg", "dog.jpg"},
+		{"spaces", "  my dog.jpg  ", "my dog.jpg", "my-dog.jpg"},
+		{"unicode", "chó của tôi.jpg", "chó của tôi.jpg", "chó-của-tôi.jpg"},
+		{"empty", "", "", "image"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			display := displayFilename(tt.filename)
+			if display != tt.wantDisplay {
+				t.Errorf("displayFilename(%q) = %q, want %q", tt.filename, display, tt.wantDisplay)
+			}
+			if got := keyFilename(display); got != tt.wantKey {
+				t.Errorf("keyFilename(%q) = %q, want %q", display, got, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestTruncateFilenameKeepsExtension(t *testing.T) {
+	long := strings.Repeat("a", 150)
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"short", "dog.jpg", "dog.jpg"},
+		{"long with extension", long + ".jpeg", strings.Repeat("a", maxFilenameRunes-5) + ".jpeg"},
+		{"long without extension", long, strings.Repeat("a", maxFilenameRunes)},
+		{"multibyte", strings.Repeat("ó", 150) + ".png", strings.Repeat("ó", maxFilenameRunes-4) + ".png"},
+		// An extension half the limit or longer is part of the name
+		{"long extension", "a." + long, "a." + strings.Repeat("a", maxFilenameRunes-2)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateFilename(tt.in, maxFilenameRunes)
+			if got != tt.want {
+				t.Errorf("truncateFilename = %q, want %q", got, tt.want)
+			}
+			if n := len([]rune(got)); n > maxFilenameRunes {
+				t.Errorf("result is %d runes, want at most %d", n, maxFilenameRunes)
+			}
+		})
+	}
+}
+
+func TestUploadKeyUsesSanitizedFilename(t *testing.T) {
+	h, f := newTestHandler(t)
+	token := f.token(t, "user-a", time.Now().Add(time.Hour))
+	resp := callWithBody(t, h, "POST", "/upload", token, map[string]string{"mode": "put"}, `{"contentType":"image/jpeg","size":1024,"filename":"../My Photos/beach day.jpg"}`)
+	if resp.StatusCode != 200 {
+		t.Fatalf("status = %d, want 200: %s", resp.StatusCode, resp.Body)
+	}
+	var body UploadResponse
+	if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+		t.Fatalf("decode %q: %v", resp.Body, err)
+	}
+	if !regexp.MustCompile(`^images/\d+-[0-9a-f]{16}-beach-day\.jpg$`).MatchString(body.Key) {
+		t.Errorf("key = %q, want images/<nanos>-<random hex>-beach-day.jpg", body.Key)
+	}
+	// The unmangled name is signed into the URL, so the client must send it back
+	if got := body.Headers["x-amz-meta-original-filename"]; got != "beach%20day.jpg" {
+		t.Errorf("original filename header = %q, want beach%%20day.jpg", got)
+	}
+	if !strings.Contains(body.UploadURL, "x-amz-meta-original-filename") {
+		t.Errorf("upload URL %q does not sign the filename header", body.UploadURL)
+	}
+}
+
+func TestNewUploadKeyUnique(t *testing.T) {
+	// Calls in a tight loop can share a clock reading; the random part keeps
+	// their keys apart
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		key := newUploadKey("photo.jpg")
+		if seen[key] {
+			t.Fatalf("newUploadKey returned %q twice", key)
+		}
+		seen[key] = true
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     string
+	}{
+		{"dog.jpg", `attachment; filename="dog.jpg"; filename*=UTF-8''dog.jpg`},
+		{"my dog.jpg", `attachment; filename="my dog.jpg"; filename*=UTF-8''my%20dog.jpg`},
+		{`say "hi".jpg`, `attachment; filename="say _hi_.jpg"; filename*=UTF-8''say%20%22hi%22.jpg`},
+		{`back\slash.jpg`, `attachment; filename="back_slash.jpg"; filename*=UTF-8''back%5Cslash.jpg`},
+		{"chó.jpg", `attachment; filename="ch_.jpg"; filename*=UTF-8''ch%C3%B3.jpg`},
+	}
+	for _, tt := range tests {
+		if got := contentDisposition(tt.filename); got != tt.want {
+			t.Errorf("contentDisposition(%q) = %s, want %s", tt.filename, got, tt.want)
+		}
+	}
+}
+
+func TestImageURLDownloadDisposition(t *testing.T) {
+	h, f := newTestHandler(t)
+	f.putImage(t, "images/1700000000-dog.jpg", "user-a", "2024-01-01T00:00:00Z")
+
+	tests := []struct {
+		name  string
+		query map[string]string
+		want  string
+	}{
+		{"inline", map[string]string{}, ""},
+		{"named after key", map[string]string{"download": "true"}, contentDisposition("1700000000-dog.jpg")},
+		{"named by filename", map[string]string{"download": "true", "filename": "Rex\r\nSet-Cookie: x.jpg"}, contentDisposition("RexSet-Cookie: x.jpg")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.query["key"] = "images/1700000000-dog.jpg"
+			resp := call(t, h, "GET", "/image-url", "", tt.query)
+			if resp.StatusCode != 200 {
+				t.Fatalf("status = %d, want 200: %s", resp.StatusCode, resp.Body)
+			}
+			var body ImageResponse
+			if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+				t.Fatalf("decode %q: %v", resp.Body, err)
+			}
+			presigned, err := url.Parse(body.URL)
+			if err != nil {
+				t.Fatalf("parse %q: %v", body.URL, err)
+			}
+			if got := presigned.Query().Get("response-content-disposition"); got != tt.want {
+				t.Errorf("response-content-disposition = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvDuration(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", time.Hour, false},
+		{"15m", 15 * time.Minute, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"168h", maxPresignTTL, false},
+		{"168h1s", 0, true},
+		{"720h", 0, true},
+		{"0s", 0, true},
+		{"-5m", 0, true},
+		{"900", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("GET_URL_TTL", tt.value)
+			got, err := envDuration("GET_URL_TTL", time.Hour)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("envDuration = %s, %v; want %s, error %t", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestImageURLUsesGetURLTTL(t *testing.T) {
+	h, f := newTestHandler(t)
+	h.getURLTTL = 5 * time.Minute
+	f.putImage(t, "images/1700000000-dog.jpg", "user-a", "2024-01-01T00:00:00Z")
+
+	resp := call(t, h, "GET", "/image-url", "", map[string]string{"key": "images/1700000000-dog.jpg"})
+	var body ImageResponse
+	if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+		t.Fatalf("decode %q: %v", resp.Body, err)
+	}
+	presigned, err := url.Parse(body.URL)
+	if err != nil {
+		t.Fatalf("parse %q: %v", body.URL, err)
+	}
+	if got := presigned.Query().Get("X-Amz-Expires"); got != "300" {
+		t.Errorf("X-Amz-Expires = %q, want 300", got)
+	}
+}
+
+func TestCORSHeaders(t *testing.T) {
+	const app, other = "https://app.example.com", "https://evil.example.com"
+	tests := []struct {
+		name        string
+		allowed     []string
+		origin      string
+		wantOrigin  string
+		credentials bool
+	}{
+		{"allowed origin", []string{app}, app, app, true},
+		{"disallowed origin", []string{app}, other, "", false},
+		{"no origin", []string{app}, "", "", false},
+		{"wildcard", []string{"*"}, other, "*", false},
+		{"listed origin beside wildcard", []string{"*", app}, app, app, true},
+		{"unlisted origin beside wildcard", []string{"*", app}, other, "*", false},
+	}
+	for _, tt := range tests {
+		for _, method := range []string{"OPTIONS", "GET"} {
+			t.Run(tt.name+" "+method, func(t *testing.T) {
+				h, _ := newTestHandler(t)
+				h.allowedOrigins = make(map[string]bool)
+				for _, origin := range tt.allowed {
+					h.allowedOrigins[origin] = true
+				}
+
+				req := events.APIGatewayV2HTTPRequest{RawPath: "/images", Headers: map[string]string{}}
+				req.RequestContext.HTTP.Method = method
+				if tt.origin != "" {
+					req.Headers["origin"] = tt.origin
+				}
+				resp, err := h.HandleRequest(context.Background(), req)
+				if err != nil || resp.StatusCode != 200 {
+					t.Fatalf("%s /images = %d, %v", method, resp.StatusCode, err)
+				}
+
+				if got := resp.Headers["Access-Control-Allow-Origin"]; got != tt.wantOrigin {
+					t.Errorf("Allow-Origin = %q, want %q", got, tt.wantOrigin)
+				}
+				// A wildcard answer must never allow credentials
+				if got := resp.Headers["Access-Control-Allow-Credentials"] == "true"; got != tt.credentials {
+					t.Errorf("Allow-Credentials = %q, want credentials %t", resp.Headers["Access-Control-Allow-Credentials"], tt.credentials)
+				}
+
+				wantAllow := map[string]string{
+					"Access-Control-Allow-Methods": "GET, POST, PATCH, DELETE, OPTIONS",
+					"Access-Control-Allow-Headers": "Content-Type, Authorization, Idempotency-Key",
+					"Access-Control-Max-Age":       "300",
+				}
+				for name, want := range wantAllow {
+					if tt.wantOrigin == "" {
+						want = ""
+					}
+					if got := resp.Headers[name]; got != want {
+						t.Errorf("%s = %q, want %q", name, got, want)
+					}
+				}
+
+				// Responses that depend on the origin must say so to caches
+				wantVary := ""
+				if len(tt.allowed) > 1 || tt.allowed[0] != "*" {
+					wantVary = "Origin"
+				}
+				if got := resp.Headers["Vary"]; got != wantVary {
+					t.Errorf("Vary = %q, want %q", got, wantVary)
+				}
+			})
+		}
+	}
+}
+
+func TestRequestIDInLogsAndUploadMetadata(t *testing.T) {
+	h, f := newTestHandler(t)
+	var logs bytes.Buffer
+	h.logger = slog.New(slog.NewJSONHandler(&logs, nil))
+
+	req := events.APIGatewayV2HTTPRequest{
+		RawPath: "/upload",
+		Headers: map[string]string{"authorization": "Bearer " + f.token(t, "user-a", time.Now().Add(time.Hour))},
+		Body:    `{"contentType":"image/jpeg","size":1024,"filename":"dog.jpg"}`,
+	}
+	req.RequestContext.HTTP.Method = "POST"
+	req.RequestContext.RequestID = "req-abc123"
+	resp, err := h.HandleRequest(context.Background(), req)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("POST /upload = %d, %v: %s", resp.StatusCode, err, resp.Body)
+	}
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) == 0 || lines[0] == "" {
+		t.Fatal("nothing logged")
+	}
+	for _, line := range lines {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("decode log record %q: %v", line, err)
+		}
+		if record["request_id"] != "req-abc123" {
+			t.Errorf("request_id = %v in %s, want req-abc123", record["request_id"], line)
+		}
+	}
+
+	// The processor picks the ID up from the object's metadata
+	var body UploadResponse
+	if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+		t.Fatalf("decode %q: %v", resp.Body, err)
+	}
+	if got := body.Fields["x-amz-meta-correlation-id"]; got != "req-abc123" {
+		t.Errorf("correlation ID field = %q, want req-abc123", got)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      map[string]string
+		dynamoErr  error
+		wantStatus int
+		wantCalls  int
+	}{
+		{"shallow", nil, nil, 200, 0},
+		{"shallow ignores DynamoDB", nil, errors.New("unreachable"), 200, 0},
+		{"deep", map[string]string{"deep": "true"}, nil, 200, 1},
+		{"deep with DynamoDB down", map[string]string{"deep": "true"}, errors.New("unreachable"), 503, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, f := newTestHandler(t)
+			f.dynamoDB.BeforeCall = func(string) error { return tt.dynamoErr }
+
+			resp := call(t, h, "GET", "/health", "", tt.query)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, resp.Body)
+			}
+			if n := f.dynamoDB.Calls("DescribeTable"); n != tt.wantCalls {
+				t.Errorf("DescribeTable called %d times, want %d", n, tt.wantCalls)
+			}
+			if tt.wantStatus == 200 && resp.Body != `{"status":"ok"}` {
+				t.Errorf("body = %s, want {\"status\":\"ok\"}", resp.Body)
+			}
+			if tt.wantStatus == 503 {
+				if code := decodeError(t, resp).Code; code != "SERVICE_UNAVAILABLE" {
+					t.Errorf("code = %q, want SERVICE_UNAVAILABLE", code)
+				}
+			}
+		})
+	}
+}
+
+func TestErrorResponseShape(t *testing.T) {
+	h, _ := newTestHandler(t)
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		query      map[string]string
+		wantStatus int
+		wantBody   string
+	}{
+		{"400", "GET", "/image-url", nil, 400, `{"error":{"code":"MISSING_PARAMETER","message":"Missing key parameter"}}`},
+		{"404 route", "GET", "/nowhere", nil, 404, `{"error":{"code":"NOT_FOUND","message":"Not Found"}}`},
+		{"404 image", "GET", "/image-labels", map[string]string{"key": "images/missing.jpg"}, 404, `{"error":{"code":"NOT_FOUND","message":"Image not found"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := call(t, h, tt.method, tt.path, "", tt.query)
+			if resp.StatusCode != tt.wantStatus || resp.Body != tt.wantBody {
+				t.Errorf("response = %d %s, want %d %s", resp.StatusCode, resp.Body, tt.wantStatus, tt.wantBody)
+			}
+			if got := resp.Headers["Content-Type"]; got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+		})
+	}
+}
+
+func TestPaginationParameters(t *testing.T) {
+	h, f := newTestHandler(t)
+	h.maxPageSize = 3
+	for i := 0; i < 5; i++ {
+		f.putImage(t, fmt.Sprintf("images/%d.jpg", i), "user-a", fmt.Sprintf("2024-01-0%dT00:00:00Z", i+1))
+	}
+
+	// Over MAX_PAGE_SIZE is clamped rather than rejected
+	resp := call(t, h, "GET", "/images", "", map[string]string{"limit": "1000000"})
+	page := decodePage(t, resp)
+	var body struct {
+		Limit int `json:"limit"`
+	}
+	if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+		t.Fatalf("decode %q: %v", resp.Body, err)
+	}
+	if body.Limit != 3 || len(page.Items) != 3 || !page.More {
+		t.Errorf("limit, items, has_more = %d, %d, %t; want 3, 3, true", body.Limit, len(page.Items), page.More)
+	}
+
+	tests := []struct {
+		name  string
+		path  string
+		query map[string]string
+	}{
+		{"negative limit", "/images", map[string]string{"limit": "-5"}},
+		{"zero limit", "/images", map[string]string{"limit": "0"}},
+		{"non-numeric limit", "/images", map[string]string{"limit": "ten"}},
+		{"negative search limit", "/search", map[string]string{"q": "dog", "limit": "-1"}},
+		{"non-numeric search limit", "/search", map[string]string{"q": "dog", "limit": "1.5"}},
+		{"negative page", "/search", map[string]string{"q": "dog", "page": "-2"}},
+		{"non-numeric page", "/search", map[string]string{"q": "dog", "page": "two"}},
+		{"page over max", "/search", map[string]string{"q": "dog", "page": strconv.Itoa(maxSearchPage + 1)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := call(t, h, "GET", tt.path, "", tt.query)
+			if resp.StatusCode != 400 {
+				t.Fatalf("status = %d, want 400; body %s", resp.StatusCode, resp.Body)
+			}
+			if code := decodeError(t, resp).Code; code != "INVALID_PARAMETER" {
+				t.Errorf("code = %q, want INVALID_PARAMETER", code)
+			}
+		})
+	}
+}
+
+// failingPresigner is a presign client that signs like the test Handler's
+// but fails for failKey
+func failingPresigner(failKey string) *s3.Client {
+	return s3.New(s3.Options{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKIDEXAMPLE", "secret", ""),
+		APIOptions: []func(*middleware.Stack) error{func(stack *middleware.Stack) error {
+			return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("failKey", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+				if input, ok := in.Parameters.(*s3.GetObjectInput); ok && aws.ToString(input.Key) == failKey {
+					return middleware.InitializeOutput{}, middleware.Metadata{}, errors.New("signing failed")
+				}
+				return next.HandleInitialize(ctx, in)
+			}), middleware.Before)
+		}},
+	})
+}
+
+func TestPresignItemURLsPartialFailure(t *testing.T) {
+	h, _ := newTestHandler(t)
+	h.presigner = failingPresigner("images/broken.jpg")
+
+	items := []map[string]interface{}{
+		{"image_key": "images/ok.jpg", "thumbnail_key": "thumbnails/ok.jpg"},
+		{"image_key": "images/broken.jpg", "thumbnail_key": "thumbnails/broken.jpg"},
+	}
+	h.presignItemURLs(context.Background(), items, false)
+
+	for _, field := range []string{"url", "thumbnail_url"} {
+		if url, _ := items[0][field].(string); !strings.Contains(url, "X-Amz-Signature=") {
+			t.Errorf("ok item %s = %q, want a presigned URL", field, url)
+		}
+	}
+	if url, ok := items[1]["url"]; ok {
+		t.Errorf("failed presign left url = %v, want it absent", url)
+	}
+	if url, _ := items[1]["thumbnail_url"].(string); !strings.Contains(url, "thumbnails/broken.jpg") {
+		t.Errorf("thumbnail_url = %q, want the thumbnail presigned despite the failed original", url)
+	}
+}
+
+func BenchmarkPresignItemURLs(b *testing.B) {
+	presigner := s3.New(s3.Options{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKIDEXAMPLE", "secret", ""),
+	})
+	h := &Handler{presigner: presigner, bucketName: testBucket, getURLTTL: time.Hour, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	page := func() []map[string]interface{} {
+		items := make([]map[string]interface{}, 100)
+		for i := range items {
+			items[i] = map[string]interface{}{
+				"image_key":     fmt.Sprintf("images/%d-photo.jpg", i),
+				"thumbnail_key": fmt.Sprintf("thumbnails/%d-photo.jpg", i),
+			}
+		}
+		return items
+	}
+
+	defer func(workers int) { presignWorkers = workers }(presignWorkers)
+	for _, bench := range []struct {
+		name    string
+		workers int
+	}{{"serial", 1}, {"parallel", presignWorkers}} {
+		b.Run(bench.name, func(b *testing.B) {
+			presignWorkers = bench.workers
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				items := page()
+				b.StartTimer()
+				h.presignItemURLs(context.Background(), items, false)
+			}
+		})
+	}
+}
+
+func TestUploadCompleteStatusTransitions(t *testing.T) {
+	h, f := newTestHandler(t)
+	token := f.token(t, "user-a", time.Now().Add(time.Hour))
+	key := "images/1700000000-dog.jpg"
+	status := func() string {
+		t.Helper()
+		var item struct {
+			Status string `dynamodbav:"status"`
+		}
+		if err := attributevalue.UnmarshalMap(f.dynamoDB.Item(key), &item); err != nil {
+			t.Fatalf("unmarshal %s: %v", key, err)
+		}
+		return item.Status
+	}
+	complete := func() events.APIGatewayV2HTTPResponse {
+		t.Helper()
+		return callWithBody(t, h, "POST", "/upload-complete", token, nil, `{"key":"`+key+`","filename":"dog.jpg"}`)
+	}
+
+	// Nothing uploaded yet
+	if resp := complete(); resp.StatusCode != 404 {
+		t.Fatalf("before upload: status = %d, want 404", resp.StatusCode)
+	}
+
+	f.s3.PutBytes(testBucket, key, []byte("original"), nil)
+
+	resp := complete()
+	if resp.StatusCode != 202 {
+		t.Fatalf("after upload: status = %d, want 202: %s", resp.StatusCode, resp.Body)
+	}
+	if got := status(); got != statusProcessing {
+		t.Errorf("placeholder status = %q, want %q", got, statusProcessing)
+	}
+
+	// The processor replaces the placeholder
+	f.putImage(t, key, "user-a", "2024-01-01T00:00:00Z")
+	if got := status(); got != "complete" {
+		t.Errorf("processed status = %q, want complete", got)
+	}
+
+	// A late or repeated callback leaves the processed item alone
+	if resp := complete(); resp.StatusCode != 204 {
+		t.Errorf("after processing: status = %d, want 204", resp.StatusCode)
+	}
+	if got := status(); got != "complete" {
+		t.Errorf("status after repeated callback = %q, want complete", got)
+	}
+}
+
+func TestGetImagesDefaultsLegacyStatus(t *testing.T) {
+	h, f := newTestHandler(t)
+	legacy, err := attributevalue.MarshalMap(map[string]string{
+		"image_key":    "images/1700000000-old.jpg",
+		"gallery_pk":   processor.GalleryPartition,
+		"processed_at": "2023-01-01T00:00:00Z",
+	})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	f.dynamoDB.Put(legacy)
+
+	page := decodePage(t, call(t, h, "GET", "/images", "", nil))
+	if len(page.Items) != 1 || page.Items[0]["status"] != "complete" {
+		t.Errorf("items = %v, want the legacy image listed as complete", page.Items)
+	}
+}
+
+func TestRegenerateThumbnailEndpoint(t *testing.T) {
+	h, f := newTestHandler(t)
+	token := f.token(t, "user-a", time.Now().Add(time.Hour))
+	key := "images/1700000000-dog.jpg"
+	f.putImage(t, key, "user-a", "2024-01-01T00:00:00Z")
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 640, 480)), nil); err != nil {
+		t.Fatalf("encode JPEG: %v", err)
+	}
+	f.s3.PutBytes(testBucket, key, buf.Bytes(), nil)
+
+	resp := call(t, h, "POST", "/regenerate-thumbnail", token, map[string]string{"key": key})
+	if resp.StatusCode != 200 {
+		t.Fatalf("status = %d, want 200: %s", resp.StatusCode, resp.Body)
+	}
+	var body RegenerateThumbnailResponse
+	if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+		t.Fatalf("decode %q: %v", resp.Body, err)
+	}
+	if body.Key != key || body.ThumbnailKey == "" || !strings.Contains(body.URL, "/"+body.ThumbnailKey+"?") {
+		t.Errorf("response = %+v, want a presigned URL for the new thumbnail", body)
+	}
+	if _, ok := f.s3.Object(testBucket, body.ThumbnailKey); !ok {
+		t.Errorf("%s was not uploaded", body.ThumbnailKey)
+	}
+
+	tests := []struct {
+		name  string
+		query map[string]string
+		setup func()
+		want  int
+	}{
+		{"missing key", nil, nil, 400},
+		{"unknown image", map[string]string{"key": "images/unknown.jpg"}, nil, 404},
+		{"search entry", map[string]string{"key": "search#dog#" + key}, nil, 404},
+		{"missing original", map[string]string{"key": key}, func() {
+			if _, err := f.s3.DeleteObject(context.Background(), &s3.DeleteObjectInput{Bucket: aws.String(testBucket), Key: aws.String(key)}); err != nil {
+				t.Fatalf("delete original: %v", err)
+			}
+		}, 404},
+	}
+	for _, tt := range tests {
+		if tt.setup != nil {
+			tt.setup()
+		}
+		if resp := call(t, h, "POST", "/regenerate-thumbnail", token, tt.query); resp.StatusCode != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestStatsAggregation(t *testing.T) {
+	h, f := newTestHandler(t)
+	h.statsTTL = time.Hour
+	put := func(values map[string]interface{}) {
+		t.Helper()
+		item, err := attributevalue.MarshalMap(values)
+		if err != nil {
+			t.Fatalf("marshal item: %v", err)
+		}
+		f.dynamoDB.Put(item)
+	}
+	for i, size := range []int{1000, 2500, 500} {
+		put(map[string]interface{}{
+			"image_key":       fmt.Sprintf("images/%d.jpg", i),
+			"gallery_pk":      processor.GalleryPartition,
+			"processed_at":    fmt.Sprintf("2024-01-0%dT00:00:00Z", i+1),
+			"status":          "complete",
+			"image_size":      size,
+			"thumbnail_bytes": size / 10,
+		})
+	}
+	// A placeholder for an upload still processing isn't counted yet
+	put(map[string]interface{}{
+		"image_key":    "images/pending.jpg",
+		"gallery_pk":   processor.GalleryPartition,
+		"processed_at": "2024-01-05T00:00:00Z",
+		"status":       statusProcessing,
+		"image_size":   9999,
+	})
+	// Twelve labels, so two fall outside the top ten; Bird and Cat tie
+	counts := map[string]int{"Dog": 9, "Bird": 7, "Cat": 7, "Tree": 6, "Car": 5, "Sky": 4, "Person": 3,
+		"Grass": 3, "Water": 2, "Food": 2, "Boat": 1, "Zebra": 1}
+	for name, n := range counts {
+		put(map[string]interface{}{
+			"image_key":   processor.LabelCountKey(name),
+			"label_pk":    "LABEL",
+			"label_name":  name,
+			"image_count": n,
+		})
+	}
+
+	stats := func() StatsResponse {
+		t.Helper()
+		resp := call(t, h, "GET", "/stats", "", nil)
+		if resp.StatusCode != 200 {
+			t.Fatalf("status = %d, want 200: %s", resp.StatusCode, resp.Body)
+		}
+		var body StatsResponse
+		if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+			t.Fatalf("decode %q: %v", resp.Body, err)
+		}
+		return body
+	}
+
+	got := stats()
+	if got.ImageCount != 3 || got.TotalOriginalBytes != 4000 || got.TotalThumbnailBytes != 400 {
+		t.Errorf("count, original bytes, thumbnail bytes = %d, %d, %d; want 3, 4000, 400", got.ImageCount, got.TotalOriginalBytes, got.TotalThumbnailBytes)
+	}
+	want := []LabelCount{{"Dog", 9}, {"Bird", 7}, {"Cat", 7}, {"Tree", 6}, {"Car", 5}, {"Sky", 4}, {"Grass", 3}, {"Person", 3}, {"Food", 2}, {"Water", 2}}
+	if !slices.Equal(got.TopLabels, want) {
+		t.Errorf("top labels = %v, want %v", got.TopLabels, want)
+	}
+	if _, err := time.Parse(time.RFC3339, got.ComputedAt); err != nil {
+		t.Errorf("computed_at = %q, want an RFC 3339 time", got.ComputedAt)
+	}
+
+	// Within STATS_CACHE_TTL the cached totals are served
+	put(map[string]interface{}{"image_key": "images/new.jpg", "gallery_pk": processor.GalleryPartition, "processed_at": "2024-02-01T00:00:00Z", "status": "complete", "image_size": 1})
+	if cached := stats(); cached.ImageCount != 3 || cached.ComputedAt != got.ComputedAt {
+		t.Errorf("cached count, computed_at = %d, %q; want 3, %q", cached.ImageCount, cached.ComputedAt, got.ComputedAt)
+	}
+}
+
+// putLabelCounts seeds one processor count item per label
+func (f *fakes) putLabelCounts(t *testing.T, counts map[string]int) {
+	t.Helper()
+	for name, n := range counts {
+		item, err := attributevalue.MarshalMap(map[string]interface{}{
+			"image_key":   processor.LabelCountKey(name),
+			"label_pk":    "LABEL",
+			"label_name":  name,
+			"image_count": n,
+		})
+		if err != nil {
+			t.Fatalf("marshal %s count: %v", name, err)
+		}
+		f.dynamoDB.Put(item)
+	}
+}
+
+func TestGetLabels(t *testing.T) {
+	h, f := newTestHandler(t)
+	if resp := call(t, h, "GET", "/labels", "", nil); resp.StatusCode != 200 || resp.Body != `{"labels":[]}` {
+		t.Errorf("GET /labels before any counts = %d %s, want 200 and no labels", resp.StatusCode, resp.Body)
+	}
+
+	f.putLabelCounts(t, map[string]int{"Dog": 3, "Cat": 5, "Bird": 3})
+	resp := call(t, h, "GET", "/labels", "", nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("GET /labels = %d %s, want 200", resp.StatusCode, resp.Body)
+	}
+	var body LabelsResponse
+	if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+		t.Fatalf("decode %q: %v", resp.Body, err)
+	}
+	if want := []LabelCount{{"Cat", 5}, {"Bird", 3}, {"Dog", 3}}; !slices.Equal(body.Labels, want) {
+		t.Errorf("labels = %v, want %v", body.Labels, want)
+	}
+}
+
+func TestStatsAndLabelsScopedToOwner(t *testing.T) {
+	h, f := newTestHandler(t)
+	h.statsTTL = time.Hour
+	f.putImage(t, "images/a.jpg", "user-a", "2024-01-01T00:00:00Z")
+	f.putImage(t, "images/b1.jpg", "user-b", "2024-01-02T00:00:00Z")
+	f.putImage(t, "images/b2.jpg", "user-b", "2024-01-03T00:00:00Z")
+	// user-b's second image is also a Cat; the count items span every owner
+	f.dynamoDB.Put(withLabels(t, f.dynamoDB.Item("images/b2.jpg"), "Dog", "Cat"))
+	f.putLabelCounts(t, map[string]int{"Dog": 3, "Cat": 1})
+
+	get := func(path, token string, body interface{}) {
+		t.Helper()
+		resp := call(t, h, "GET", path, token, nil)
+		if resp.StatusCode != 200 {
+			t.Fatalf("GET %s = %d %s, want 200", path, resp.StatusCode, resp.Body)
+		}
+		if err := json.Unmarshal([]byte(resp.Body), body); err != nil {
+			t.Fatalf("decode %q: %v", resp.Body, err)
+		}
+	}
+	tokenA := f.token(t, "user-a", time.Now().Add(time.Hour))
+	tokenB := f.token(t, "user-b", time.Now().Add(time.Hour))
+
+	var labels LabelsResponse
+	get("/labels", tokenA, &labels)
+	if want := []LabelCount{{"Dog", 1}}; !slices.Equal(labels.Labels, want) {
+		t.Errorf("labels as user-a = %v, want %v", labels.Labels, want)
+	}
+	get("/labels", "", &labels)
+	if want := []LabelCount{{"Dog", 3}, {"Cat", 1}}; !slices.Equal(labels.Labels, want) {
+		t.Errorf("anonymous labels = %v, want %v", labels.Labels, want)
+	}
+
+	// Each owner gets their own totals, even with another owner's cached
+	var stats StatsResponse
+	get("/stats", tokenA, &stats)
+	if want := []LabelCount{{"Dog", 1}}; stats.ImageCount != 1 || !slices.Equal(stats.TopLabels, want) {
+		t.Errorf("stats as user-a = %d images, top labels %v; want 1, %v", stats.ImageCount, stats.TopLabels, want)
+	}
+	get("/stats", tokenB, &stats)
+	if want := []LabelCount{{"Dog", 2}, {"Cat", 1}}; stats.ImageCount != 2 || !slices.Equal(stats.TopLabels, want) {
+		t.Errorf("stats as user-b = %d images, top labels %v; want 2, %v", stats.ImageCount, stats.TopLabels, want)
+	}
+	get("/stats", "", &stats)
+	if stats.ImageCount != 3 {
+		t.Errorf("anonymous stats = %d images, want 3", stats.ImageCount)
+	}
+}
+
+// withLabels returns item with its detected labels replaced by names
+func withLabels(t *testing.T, item map[string]types.AttributeValue, names ...string) map[string]types.AttributeValue {
+	t.Helper()
+	labels := make([]processor.LabelInfo, len(names))
+	for i, name := range names {
+		labels[i] = processor.LabelInfo{Name: name, Confidence: 90}
+	}
+	av, err := attributevalue.Marshal(labels)
+	if err != nil {
+		t.Fatalf("marshal labels: %v", err)
+	}
+	item["detected_labels"] = av
+	return item
+}
+
+func TestDeleteImageReleasesLabelCounts(t *testing.T) {
+	h, f := newTestHandler(t)
+	f.putImage(t, "images/a.jpg", "user-a", "2024-01-02T00:00:00Z")
+	count, err := attributevalue.MarshalMap(map[string]interface{}{
+		"image_key":   processor.LabelCountKey("Dog"),
+		"label_pk":    "LABEL",
+		"label_name":  "Dog",
+		"image_count": 2,
+	})
+	if err != nil {
+		t.Fatalf("marshal count: %v", err)
+	}
+	f.dynamoDB.Put(count)
+
+	resp := call(t, h, "DELETE", "/images", f.token(t, "user-a", time.Now().Add(time.Hour)), map[string]string{"key": "images/a.jpg"})
+	if resp.StatusCode != 204 {
+		t.Fatalf("DELETE = %d (%s), want 204", resp.StatusCode, resp.Body)
+	}
+	counts, err := h.processor.LabelCounts(context.Background())
+	if err != nil {
+		t.Fatalf("LabelCounts: %v", err)
+	}
+	if len(counts) != 1 || counts["Dog"] != 1 {
+		t.Errorf("label counts = %v, want map[Dog:1]", counts)
+	}
+}
+
+func TestDeleteImageReleasesWhatWasDeleted(t *testing.T) {
+	h, f := newTestHandler(t)
+	f.putImage(t, "images/a.jpg", "user-a", "2024-01-02T00:00:00Z")
+	f.putLabelCounts(t, map[string]int{"Dog": 2, "Cat": 2})
+
+	// The image is reprocessed as a Cat between the read and the delete
+	f.dynamoDB.BeforeCall = func(operation string) error {
+		if operation != "DeleteItem" {
+			return nil
+		}
+		item := withLabels(t, f.dynamoDB.Item("images/a.jpg"), "Cat")
+		terms, err := attributevalue.Marshal([]string{"cat"})
+		if err != nil {
+			t.Fatalf("marshal search terms: %v", err)
+		}
+		item["search_terms"] = terms
+		f.dynamoDB.Put(item)
+		f.putSearchEntry(t, "cat", "images/a.jpg", "user-a", "2024-01-02T00:00:00Z")
+		return nil
+	}
+
+	resp := call(t, h, "DELETE", "/images", f.token(t, "user-a", time.Now().Add(time.Hour)), map[string]string{"key": "images/a.jpg"})
+	if resp.StatusCode != 204 {
+		t.Fatalf("DELETE = %d (%s), want 204", resp.StatusCode, resp.Body)
+	}
+	if f.dynamoDB.Item(processor.SearchEntryKey("cat", "images/a.jpg")) != nil {
+		t.Error("the deleted item's search entry was left behind")
+	}
+	counts, err := h.processor.LabelCounts(context.Background())
+	if err != nil {
+		t.Fatalf("LabelCounts: %v", err)
+	}
+	if want := map[string]int{"Dog": 2, "Cat": 1}; !maps.Equal(counts, want) {
+		t.Errorf("label counts = %v, want %v", counts, want)
+	}
+}
+
+func TestUpdateTags(t *testing.T) {
+	h, f := newTestHandler(t)
+	token := f.token(t, "user-a", time.Now().Add(time.Hour))
+	key := "images/1700000000-dog.jpg"
+	f.putImage(t, key, "user-a", "2024-01-01T00:00:00Z")
+
+	patch := func(body string) events.APIGatewayV2HTTPResponse {
+		t.Helper()
+		return callWithBody(t, h, "PATCH", "/images", token, map[string]string{"key": key}, body)
+	}
+	userTags := func(resp events.APIGatewayV2HTTPResponse) []string {
+		t.Helper()
+		if resp.StatusCode != 200 {
+			t.Fatalf("status = %d, want 200: %s", resp.StatusCode, resp.Body)
+		}
+		var body UpdateTagsResponse
+		if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+			t.Fatalf("decode %q: %v", resp.Body, err)
+		}
+		return body.UserTags
+	}
+
+	// Tags are trimmed, lowercased and deduplicated
+	if got := userTags(patch(`{"tags":[" Vacation ","family","FAMILY"]}`)); !slices.Equal(got, []string{"family", "vacation"}) {
+		t.Errorf("after add = %v, want [family vacation]", got)
+	}
+	// A second add merges into the set rather than replacing it
+	if got := userTags(patch(`{"tags":["beach","vacation"]}`)); !slices.Equal(got, []string{"beach", "family", "vacation"}) {
+		t.Errorf("after merge = %v, want [beach family vacation]", got)
+	}
+	if got := userTags(patch(`{"remove_tags":["family","unknown"]}`)); !slices.Equal(got, []string{"beach", "vacation"}) {
+		t.Errorf("after remove = %v, want [beach vacation]", got)
+	}
+	if got := userTags(patch(`{"remove_tags":["beach","vacation"]}`)); len(got) != 0 {
+		t.Errorf("after removing all = %v, want none", got)
+	}
+
+	// The stored set follows, and ?label= matches user tags
+	userTags(patch(`{"tags":["holiday"]}`))
+	if got := itemKeys(t, call(t, h, "GET", "/images", "", map[string]string{"label": "holiday"})); !equalKeys(got, []string{key}) {
+		t.Errorf("label=holiday lists %v, want [%s]", got, key)
+	}
+
+	tests := []struct {
+		name string
+		key  string
+		body string
+		want int
+	}{
+		{"both add and remove", key, `{"tags":["a"],"remove_tags":["b"]}`, 400},
+		{"empty tags", key, `{"tags":[]}`, 400},
+		{"blank tag", key, `{"tags":["  "]}`, 400},
+		{"missing image", "images/missing.jpg", `{"tags":["a"]}`, 404},
+	}
+	for _, tt := range tests {
+		resp := callWithBody(t, h, "PATCH", "/images", token, map[string]string{"key": tt.key}, tt.body)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestUploadSignsSSEKMSHeaders(t *testing.T) {
+	const keyID = "arn:aws:kms:us-east-1:123456789012:key/abcd-1234"
+	h, f := newTestHandler(t)
+	h.sseKMSKeyID = keyID
+	token := f.token(t, "user-a", time.Now().Add(time.Hour))
+	wantHeaders := map[string]string{
+		"x-amz-server-side-encryption":                "aws:kms",
+		"x-amz-server-side-encryption-aws-kms-key-id": keyID,
+	}
+
+	for _, mode := range []string{"put", "post"} {
+		t.Run(mode, func(t *testing.T) {
+			resp := callWithBody(t, h, "POST", "/upload", token, map[string]string{"mode": mode}, `{"contentType":"image/jpeg","size":1024,"filename":"dog.jpg"}`)
+			if resp.StatusCode != 200 {
+				t.Fatalf("status = %d, want 200: %s", resp.StatusCode, resp.Body)
+			}
+			var body UploadResponse
+			if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+				t.Fatalf("decode %q: %v", resp.Body, err)
+			}
+
+			// The client must send these back exactly, as headers or form fields
+			sent := body.Headers
+			if mode == "post" {
+				sent = body.Fields
+			}
+			for name, want := range wantHeaders {
+				if got := sent[name]; got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if mode != "put" {
+				return
+			}
+			presigned, err := url.Parse(body.UploadURL)
+			if err != nil {
+				t.Fatalf("parse %q: %v", body.UploadURL, err)
+			}
+			signed := presigned.Query().Get("X-Amz-SignedHeaders")
+			for name := range wantHeaders {
+				if !slices.Contains(strings.Split(signed, ";"), name) {
+					t.Errorf("signed headers %q do not include %s", signed, name)
+				}
+			}
+		})
+	}
+
+	// Without a key nothing asks the client for encryption headers
+	h.sseKMSKeyID = ""
+	resp := callWithBody(t, h, "POST", "/upload", token, map[string]string{"mode": "put"}, `{"contentType":"image/jpeg","size":1024}`)
+	var body UploadResponse
+	if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+		t.Fatalf("decode %q: %v", resp.Body, err)
+	}
+	if _, ok := body.Headers["x-amz-server-side-encryption"]; ok {
+		t.Errorf("headers = %v, want no encryption header", body.Headers)
+	}
+}
+
+func TestThumbnailBucket(t *testing.T) {
+	h, f := newTestHandler(t)
+	token := f.token(t, "user-a", time.Now().Add(time.Hour))
+	f.putImage(t, "images/same.jpg", "user-a", "2024-01-01T00:00:00Z")
+	f.putImage(t, "images/separate.jpg", "user-a", "2024-01-02T00:00:00Z")
+	item := f.dynamoDB.Item("images/separate.jpg")
+	item["thumbnail_bucket"] = &types.AttributeValueMemberS{Value: "thumbnail-bucket"}
+	f.dynamoDB.Put(item)
+	f.s3.PutBytes("thumbnail-bucket", "thumbnails/300/images/separate.jpg", []byte("thumbnail"), nil)
+	f.s3.PutBytes(testBucket, "thumbnails/300/images/same.jpg", []byte("thumbnail"), nil)
+
+	// Items without thumbnail_bucket predate it and keep thumbnails beside the image
+	want := map[string]string{"images/same.jpg": testBucket, "images/separate.jpg": "thumbnail-bucket"}
+	for _, item := range decodePage(t, call(t, h, "GET", "/images", "", nil)).Items {
+		key, _ := item["image_key"].(string)
+		thumbnailURL, _ := item["thumbnail_url"].(string)
+		imageURL, _ := item["url"].(string)
+		if !strings.Contains(thumbnailURL, want[key]) {
+			t.Errorf("%s thumbnail_url = %q, want it in %s", key, thumbnailURL, want[key])
+		}
+		if !strings.Contains(imageURL, testBucket) {
+			t.Errorf("%s url = %q, want it in %s", key, imageURL, testBucket)
+		}
+	}
+
+	for key, bucket := range want {
+		if resp := call(t, h, "DELETE", "/images", token, map[string]string{"key": key}); resp.StatusCode != 204 {
+			t.Fatalf("DELETE %s = %d: %s", key, resp.StatusCode, resp.Body)
+		}
+		if _, ok := f.s3.Object(bucket, "thumbnails/300/"+key); ok {
+			t.Errorf("thumbnail of %s left in %s", key, bucket)
+		}
+	}
+}
+
+func TestUploadContentTypeAllowlist(t *testing.T) {
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("S3_BUCKET_NAME", testBucket)
+	t.Setenv("ALLOWED_UPLOAD_TYPES", " image/WEBP, image/jpeg ,")
+	configured, err := NewHandler(context.Background())
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+	want := map[string]bool{"image/webp": true, "image/jpeg": true}
+	if len(configured.allowedTypes) != len(want) || !configured.allowedTypes["image/webp"] || !configured.allowedTypes["image/jpeg"] {
+		t.Fatalf("allowed types = %v, want %v", configured.allowedTypes, want)
+	}
+
+	h, f := newTestHandler(t)
+	token := f.token(t, "user-a", time.Now().Add(time.Hour))
+	h.allowedTypes = configured.allowedTypes
+	upload := func(contentType string) events.APIGatewayV2HTTPResponse {
+		t.Helper()
+		return callWithBody(t, h, "POST", "/upload", token, nil, `{"contentType":"`+contentType+`","size":1024,"filename":"photo"}`)
+	}
+
+	if resp := upload("image/webp"); resp.StatusCode != 200 {
+		t.Errorf("image/webp: status = %d, want 200: %s", resp.StatusCode, resp.Body)
+	}
+	resp := upload("image/png")
+	if resp.StatusCode != 400 {
+		t.Fatalf("image/png: status = %d, want 400", resp.StatusCode)
+	}
+	body := decodeError(t, resp)
+	if body.Code != "UNSUPPORTED_CONTENT_TYPE" || !slices.Equal(body.AllowedTypes, []string{"image/jpeg", "image/webp"}) {
+		t.Errorf("error = %+v, want UNSUPPORTED_CONTENT_TYPE listing image/jpeg and image/webp", body)
+	}
+}
+
+func TestUploadContentTypeDefaults(t *testing.T) {
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("S3_BUCKET_NAME", testBucket)
+	t.Setenv("ALLOWED_UPLOAD_TYPES", "")
+	h, err := NewHandler(context.Background())
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+	if len(h.allowedTypes) != 2 || !h.allowedTypes["image/jpeg"] || !h.allowedTypes["image/png"] {
+		t.Errorf("allowed types = %v, want image/jpeg and image/png", h.allowedTypes)
+	}
+}
+
+func TestGetImagesPresignsImageAndThumbnailURLs(t *testing.T) {
+	h, f := newTestHandler(t)
+	f.putImage(t, "images/thumbnailed.jpg", "user-a", "2024-01-03T00:00:00Z")
+	f.putImage(t, "images/pending.jpg", "user-a", "2024-01-02T00:00:00Z")
+	f.putImage(t, "images/photo.heic", "user-a", "2024-01-01T00:00:00Z")
+	pending := f.dynamoDB.Item("images/pending.jpg")
+	delete(pending, "thumbnail_key")
+	f.dynamoDB.Put(pending)
+	converted := f.dynamoDB.Item("images/photo.heic")
+	converted["converted_key"] = &types.AttributeValueMemberS{Value: "converted/images/photo.jpg"}
+	f.dynamoDB.Put(converted)
+
+	wantURL := map[string]string{
+		"images/thumbnailed.jpg": "/images/thumbnailed.jpg?",
+		"images/pending.jpg":     "/images/pending.jpg?",
+		// A HEIC original is served as the JPEG it was converted to
+		"images/photo.heic": "/converted/images/photo.jpg?",
+	}
+	wantThumbnail := map[string]string{
+		"images/thumbnailed.jpg": "/thumbnails/300/images/thumbnailed.jpg?",
+		"images/photo.heic":      "/thumbnails/300/images/photo.heic?",
+	}
+	items := decodePage(t, call(t, h, "GET", "/images", "", nil)).Items
+	if len(items) != len(wantURL) {
+		t.Fatalf("listed %d images, want %d", len(items), len(wantURL))
+	}
+	for _, item := range items {
+		key, _ := item["image_key"].(string)
+		for field, want := range map[string]string{"url": wantURL[key], "thumbnail_url": wantThumbnail[key]} {
+			got, ok := item[field].(string)
+			switch {
+			case want == "" && ok:
+				t.Errorf("%s %s = %q, want it absent", key, field, got)
+			case want != "" && (!strings.Contains(got, want) || !strings.Contains(got, "X-Amz-Signature=")):
+				t.Errorf("%s %s = %q, want a presigned URL for %s", key, field, got, want)
+			}
+		}
+	}
+}
+
+func TestGetImagesTopLabels(t *testing.T) {
+	h, f := newTestHandler(t)
+	key := "images/a.jpg"
+	f.putImage(t, key, "user-a", "2024-01-01T00:00:00Z")
+	labels, err := attributevalue.Marshal([]map[string]interface{}{
+		{"name": "Grass", "confidence": 60.0},
+		{"name": "Dog", "confidence": 97.5},
+		{"name": "Person", "confidence": 80.0},
+	})
+	if err != nil {
+		t.Fatalf("marshal labels: %v", err)
+	}
+	item := f.dynamoDB.Item(key)
+	item["detected_labels"] = labels
+	f.dynamoDB.Put(item)
+
+	names := func(query map[string]string) []string {
+		t.Helper()
+		items := decodePage(t, call(t, h, "GET", "/images", "", query)).Items
+		if len(items) != 1 {
+			t.Fatalf("%v listed %d images, want 1", query, len(items))
+		}
+		var names []string
+		for _, l := range items[0]["detected_labels"].([]interface{}) {
+			names = append(names, l.(map[string]interface{})["name"].(string))
+		}
+		return names
+	}
+
+	tests := []struct {
+		query map[string]string
+		want  []string
+	}{
+		{nil, []string{"Grass", "Dog", "Person"}},
+		{map[string]string{"topLabels": "2"}, []string{"Dog", "Person"}},
+		{map[string]string{"topLabels": "10"}, []string{"Dog", "Person", "Grass"}},
+		// The label filter sees every label before the trim
+		{map[string]string{"topLabels": "1", "label": "grass"}, []string{"Dog"}},
+	}
+	for _, tt := range tests {
+		if got := names(tt.query); !slices.Equal(got, tt.want) {
+			t.Errorf("%v labels = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	// Trimming only shapes the response
+	var stored struct {
+		Labels []map[string]interface{} `dynamodbav:"detected_labels"`
+	}
+	if err := attributevalue.UnmarshalMap(f.dynamoDB.Item(key), &stored); err != nil {
+		t.Fatalf("unmarshal %s: %v", key, err)
+	}
+	if len(stored.Labels) != 3 || stored.Labels[0]["name"] != "Grass" {
+		t.Errorf("stored labels = %v, want all three in their original order", stored.Labels)
+	}
+
+	for _, bad := range []string{"0", "-1", "two"} {
+		resp := call(t, h, "GET", "/images", "", map[string]string{"topLabels": bad})
+		if resp.StatusCode != 400 || decodeError(t, resp).Code != "INVALID_PARAMETER" {
+			t.Errorf("topLabels=%s: status %d, body %s; want 400 INVALID_PARAMETER", bad, resp.StatusCode, resp.Body)
+		}
+	}
+}
+
+func TestPublicReadsAuthenticateSentTokens(t *testing.T) {
+	h, f := newTestHandler(t)
+	f.putImage(t, "images/a.jpg", "user-a", "2024-01-02T00:00:00Z")
+	f.putImage(t, "images/b.jpg", "user-b", "2024-01-01T00:00:00Z")
+
+	resp := call(t, h, "GET", "/images", "", nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("anonymous GET /images = %d, want 200", resp.StatusCode)
+	}
+	if got := itemKeys(t, resp); !equalKeys(got, []string{"images/a.jpg", "images/b.jpg"}) {
+		t.Errorf("anonymous GET /images = %v, want every image", got)
+	}
+
+	resp = call(t, h, "GET", "/images", f.token(t, "user-a", time.Now().Add(time.Hour)), nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("GET /images as user-a = %d, want 200", resp.StatusCode)
+	}
+	if got := itemKeys(t, resp); !equalKeys(got, []string{"images/a.jpg"}) {
+		t.Errorf("GET /images as user-a = %v, want only images/a.jpg", got)
+	}
+
+	expired := f.token(t, "user-a", time.Now().Add(-time.Hour))
+	if resp := call(t, h, "GET", "/images", expired, nil); resp.StatusCode != 401 {
+		t.Errorf("GET /images with an expired token = %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestOwnerCannotDeleteAnotherOwnersImage(t *testing.T) {
+	h, f := newTestHandler(t)
+	f.putImage(t, "images/a.jpg", "user-a", "2024-01-02T00:00:00Z")
+	f.putImage(t, "images/b.jpg", "user-b", "2024-01-01T00:00:00Z")
+	tokenA := f.token(t, "user-a", time.Now().Add(time.Hour))
+
+	resp := call(t, h, "DELETE", "/images", tokenA, map[string]string{"key": "images/b.jpg"})
+	if resp.StatusCode != 404 {
+		t.Errorf("DELETE another owner's image = %d, want 404", resp.StatusCode)
+	}
+	if f.dynamoDB.Item("images/b.jpg") == nil {
+		t.Error("another owner's item was deleted")
+	}
+	if _, ok := f.s3.Object(testBucket, "images/b.jpg"); !ok {
+		t.Error("another owner's object was deleted")
+	}
+
+	resp = call(t, h, "DELETE", "/images", tokenA, map[string]string{"key": "images/a.jpg"})
+	if resp.StatusCode != 204 {
+		t.Fatalf("DELETE own image = %d (%s), want 204", resp.StatusCode, resp.Body)
+	}
+	if f.dynamoDB.Item("images/a.jpg") != nil {
+		t.Error("own item was not deleted")
+	}
+	if f.dynamoDB.Item("search#dog#images/a.jpg") != nil {
+		t.Error("search entry of the deleted image was kept")
+	}
+	if _, ok := f.s3.Object(testBucket, "images/a.jpg"); ok {
+		t.Error("own object was not deleted")
+	}
+}
+
+func TestDeleteImageRechecksOwnerOnDelete(t *testing.T) {
+	h, f := newTestHandler(t)
+	f.putImage(t, "images/a.jpg", "user-a", "2024-01-02T00:00:00Z")
+	tokenA := f.token(t, "user-a", time.Now().Add(time.Hour))
+
+	// user-b replaces the image between the ownership read and the delete
+	f.dynamoDB.BeforeCall = func(operation string) error {
+		if operation == "DeleteItem" {
+			f.putImage(t, "images/a.jpg", "user-b", "2024-01-03T00:00:00Z")
+		}
+		return nil
+	}
+
+	resp := call(t, h, "DELETE", "/images", tokenA, map[string]string{"key": "images/a.jpg"})
+	if resp.StatusCode != 404 {
+		t.Errorf("DELETE of an image replaced by another owner = %d, want 404", resp.StatusCode)
+	}
+	if f.dynamoDB.Item("images/a.jpg") == nil {
+		t.Error("the other owner's item was deleted")
+	}
+	if _, ok := f.s3.Object(testBucket, "images/a.jpg"); !ok {
+		t.Error("the other owner's object was deleted")
+	}
+}
+
+func TestSingleImageReadsScopedToOwner(t *testing.T) {
+	h, f := newTestHandler(t)
+	f.putImage(t, "images/a.jpg", "user-a", "2024-01-02T00:00:00Z")
+	f.putImage(t, "images/b.jpg", "user-b", "2024-01-01T00:00:00Z")
+	tokenA := f.token(t, "user-a", time.Now().Add(time.Hour))
+
+	for _, path := range []string{"/image-url", "/image-labels"} {
+		if resp := call(t, h, "GET", path, tokenA, map[string]string{"key": "images/b.jpg"}); resp.StatusCode != 404 {
+			t.Errorf("GET %s of another owner's image = %d, want 404", path, resp.StatusCode)
+		}
+		if resp := call(t, h, "GET", path, tokenA, map[string]string{"key": "images/a.jpg"}); resp.StatusCode != 200 {
+			t.Errorf("GET %s of own image = %d (%s), want 200", path, resp.StatusCode, resp.Body)
+		}
+	}
+
+	resp := call(t, h, "POST", "/regenerate-thumbnail", tokenA, map[string]string{"key": "images/b.jpg"})
+	if resp.StatusCode != 404 {
+		t.Errorf("POST /regenerate-thumbnail of another owner's image = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestSearchScopedToOwner(t *testing.T) {
+	h, f := newTestHandler(t)
+	f.putImage(t, "images/a.jpg", "user-a", "2024-01-02T00:00:00Z")
+	f.putImage(t, "images/b.jpg", "user-b", "2024-01-01T00:00:00Z")
+
+	resp := call(t, h, "GET", "/search", f.token(t, "user-a", time.Now().Add(time.Hour)), map[string]string{"q": "dog"})
+	if resp.StatusCode != 200 {
+		t.Fatalf("GET /search = %d (%s), want 200", resp.StatusCode, resp.Body)
+	}
+	if got := itemKeys(t, resp); !equalKeys(got, []string{"images/a.jpg"}) {
+		t.Errorf("GET /search as user-a = %v, want only images/a.jpg", got)
+	}
+
+	if got := itemKeys(t, call(t, h, "GET", "/search", "", map[string]string{"q": "dog"})); !equalKeys(got, []string{"images/a.jpg", "images/b.jpg"}) {
+		t.Errorf("anonymous GET /search = %v, want every image", got)
+	}
+}
+
+func TestSimilarReturnsNearestWithinMaxDistance(t *testing.T) {
+	h, f := newTestHandler(t)
+	// Hashes differing from the target's in 0, 2, 5 and 20 bits
+	hashes := map[string]string{
+		"images/target.jpg": "0000000000000000",
+		"images/two.jpg":    "0000000000000003",
+		"images/five.jpg":   "000000000000001f",
+		"images/twenty.jpg": "00000000000fffff",
+		"images/zero.jpg":   "0000000000000000",
+	}
+	for key, hash := range hashes {
+		f.putImage(t, key, "user-a", "2024-01-01T00:00:00Z")
+		item := f.dynamoDB.Item(key)
+		item["phash"] = &types.AttributeValueMemberS{Value: hash}
+		f.dynamoDB.Put(item)
+	}
+
+	resp := call(t, h, "GET", "/similar", "", map[string]string{"key": "images/target.jpg", "maxDistance": "5"})
+	if resp.StatusCode != 200 {
+		t.Fatalf("status = %d, want 200: %s", resp.StatusCode, resp.Body)
+	}
+	var body struct {
+		MaxDistance int                      `json:"max_distance"`
+		Items       []map[string]interface{} `json:"items"`
+	}
+	if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+		t.Fatalf("decode %q: %v", resp.Body, err)
+	}
+	var got []string
+	for _, item := range body.Items {
+		got = append(got, fmt.Sprintf("%v@%v", item["image_key"], item["distance"]))
+	}
+	want := []string{"images/zero.jpg@0", "images/two.jpg@2", "images/five.jpg@5"}
+	if !slices.Equal(got, want) {
+		t.Errorf("items = %v, want %v", got, want)
+	}
+	if body.MaxDistance != 5 {
+		t.Errorf("max_distance = %d, want 5", body.MaxDistance)
+	}
+
+	for _, maxDistance := range []string{"-1", "65", "near"} {
+		resp := call(t, h, "GET", "/similar", "", map[string]string{"key": "images/target.jpg", "maxDistance": maxDistance})
+		if resp.StatusCode != 400 {
+			t.Errorf("maxDistance=%s: status = %d, want 400", maxDistance, resp.StatusCode)
+		}
+	}
+}
+
+func TestUploadBatch(t *testing.T) {
+	const (
+		valid    = `{"contentType":"image/jpeg","size":1024,"filename":"dog.jpg"}`
+		badType  = `{"contentType":"text/plain","size":10,"filename":"notes.txt"}`
+		tooLarge = `{"contentType":"image/png","size":10485760,"filename":"huge.png"}`
+	)
+	tests := []struct {
+		name       string
+		query      map[string]string
+		files      []string
+		wantStatus int
+		wantCode   string
+		// wantErrors is each file's error code, "" for a presigned file
+		wantErrors []string
+		// wantCounted is how many uploads the rate limiter was charged
+		wantCounted int
+	}{
+		{"all valid", nil, []string{valid, valid}, 200, "", []string{"", ""}, 2},
+		{"invalid file rejects the batch", nil, []string{valid, badType, tooLarge}, 400, "INVALID_BATCH", []string{"", "UNSUPPORTED_CONTENT_TYPE", "FILE_TOO_LARGE"}, 0},
+		{"partial presigns only valid files", map[string]string{"partial": "true"}, []string{valid, badType, valid}, 200, "", []string{"", "UNSUPPORTED_CONTENT_TYPE", ""}, 2},
+		{"partial with nothing valid", map[string]string{"partial": "true"}, []string{badType}, 200, "", []string{"UNSUPPORTED_CONTENT_TYPE"}, 0},
+		{"too many files", nil, []string{valid, valid, valid, valid}, 400, "BATCH_TOO_LARGE", nil, 0},
+		{"no files", nil, nil, 400, "INVALID_REQUEST_BODY", nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, f := newTestHandler(t)
+			h.maxBatchUploads = 3
+			store := &memRateStore{counts: map[string]int{}}
+			h.uploadLimiter = &uploadLimiter{store: store, perMinute: 10}
+			token := f.token(t, "user-a", time.Now().Add(time.Hour))
+
+			resp := callWithBody(t, h, "POST", "/upload-batch", token, tt.query, `{"files":[`+strings.Join(tt.files, ",")+`]}`)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, resp.Body)
+			}
+			var body struct {
+				Error   *ErrorBody `json:"error"`
+				Uploads []struct {
+					Index int        `json:"index"`
+					Key   string     `json:"key"`
+					Error *ErrorBody `json:"error"`
+				} `json:"uploads"`
+			}
+			if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+				t.Fatalf("decode %q: %v", resp.Body, err)
+			}
+			if tt.wantCode != "" && (body.Error == nil || body.Error.Code != tt.wantCode) {
+				t.Errorf("error = %+v, want code %s", body.Error, tt.wantCode)
+			}
+
+			if len(body.Uploads) != len(tt.wantErrors) {
+				t.Fatalf("uploads = %+v, want %d results", body.Uploads, len(tt.wantErrors))
+			}
+			for i, upload := range body.Uploads {
+				if upload.Index != i {
+					t.Errorf("uploads[%d].index = %d", i, upload.Index)
+				}
+				gotCode := ""
+				if upload.Error != nil {
+					gotCode = upload.Error.Code
+				}
+				if gotCode != tt.wantErrors[i] {
+					t.Errorf("uploads[%d] error = %q, want %q", i, gotCode, tt.wantErrors[i])
+				}
+				// Only files the batch accepted are presigned
+				if presigned := upload.Key != ""; presigned != (gotCode == "" && tt.wantStatus == 200) {
+					t.Errorf("uploads[%d] key = %q with error %q and status %d", i, upload.Key, gotCode, resp.StatusCode)
+				}
+			}
+
+			counted := 0
+			for _, count := range store.counts {
+				counted += count
+			}
+			if counted != tt.wantCounted {
+				t.Errorf("rate limiter charged %d uploads, want %d", counted, tt.wantCounted)
+			}
+		})
+	}
+}
+
+func TestGetImagesMinSharpness(t *testing.T) {
+	h, f := newTestHandler(t)
+	for key, sharpness := range map[string]float64{"images/sharp.jpg": 80, "images/edge.jpg": 50, "images/blurry.jpg": 12} {
+		f.putImage(t, key, "user-a", "2024-01-01T00:00:00Z")
+		item := f.dynamoDB.Item(key)
+		quality, err := attributevalue.MarshalMap(map[string]float64{"sharpness": sharpness, "brightness": 50, "contrast": 50})
+		if err != nil {
+			t.Fatalf("marshal quality: %v", err)
+		}
+		item["image_quality"] = &types.AttributeValueMemberM{Value: quality}
+		f.dynamoDB.Put(item)
+	}
+	// Processed without image properties, so it has no score
+	f.putImage(t, "images/unscored.jpg", "user-a", "2024-01-01T00:00:00Z")
+
+	tests := []struct {
+		minSharpness string
+		want         []string
+	}{
+		{"", []string{"images/blurry.jpg", "images/edge.jpg", "images/sharp.jpg", "images/unscored.jpg"}},
+		{"50", []string{"images/edge.jpg", "images/sharp.jpg"}},
+		{"0", []string{"images/blurry.jpg", "images/edge.jpg", "images/sharp.jpg"}},
+		{"90", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run("minSharpness="+tt.minSharpness, func(t *testing.T) {
+			query := map[string]string{}
+			if tt.minSharpness != "" {
+				query["minSharpness"] = tt.minSharpness
+			}
+			resp := call(t, h, "GET", "/images", "", query)
+			if resp.StatusCode != 200 {
+				t.Fatalf("status = %d, want 200: %s", resp.StatusCode, resp.Body)
+			}
+			if got := itemKeys(t, resp); !equalKeys(got, tt.want) {
+				t.Errorf("keys = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	for _, bad := range []string{"-1", "101", "sharp"} {
+		if resp := call(t, h, "GET", "/images", "", map[string]string{"minSharpness": bad}); resp.StatusCode != 400 {
+			t.Errorf("minSharpness=%s: status = %d, want 400", bad, resp.StatusCode)
+		}
+	}
+}
+
+func TestUploadRejectsMalformedBodies(t *testing.T) {
+	h, f := newTestHandler(t)
+	token := f.token(t, "user-a", time.Now().Add(time.Hour))
+
+	tests := []struct {
+		name    string
+		body    string
+		message string
+	}{
+		{"unknown field", `{"contentType":"image/jpeg","size":1024,"foo":"bar"}`, `unknown field "foo"`},
+		{"wrong type", `{"contentType":123,"size":1024}`, `field "contentType" must be a string, got number`},
+		{"wrong size type", `{"contentType":"image/jpeg","size":"big"}`, `field "size" must be an integer, got string`},
+		{"empty body", "", "request body is empty"},
+		{"not an object", `["image/jpeg"]`, "request body must be a JSON object"},
+		{"invalid JSON", `{"contentType":`, "request body is not valid JSON"},
+		{"trailing data", `{"contentType":"image/jpeg"} {}`, "request body must contain a single JSON object"},
+		{"missing contentType", `{"size":1024}`, "contentType is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := callWithBody(t, h, "POST", "/upload", token, nil, tt.body)
+			if resp.StatusCode != 400 {
+				t.Fatalf("status = %d, want 400; body %s", resp.StatusCode, resp.Body)
+			}
+			if body := decodeError(t, resp); body.Code != "INVALID_REQUEST_BODY" || body.Message != tt.message {
+				t.Errorf("error = %s %q, want INVALID_REQUEST_BODY %q", body.Code, body.Message, tt.message)
+			}
+		})
+	}
+}
+
+func TestUpdateTagsRejectsUnknownFields(t *testing.T) {
+	h, f := newTestHandler(t)
+	token := f.token(t, "user-a", time.Now().Add(time.Hour))
+	f.putImage(t, "images/a.jpg", "user-a", "2024-01-01T00:00:00Z")
+
+	resp := callWithBody(t, h, "PATCH", "/images", token, map[string]string{"key": "images/a.jpg"}, `{"tag":["beach"]}`)
+	if resp.StatusCode != 400 {
+		t.Fatalf("status = %d, want 400; body %s", resp.StatusCode, resp.Body)
+	}
+	if body := decodeError(t, resp); body.Message != `unknown field "tag"` {
+		t.Errorf("message = %q, want the unknown field named", body.Message)
+	}
+}
+
+func TestUploadCompleteRejectsUnknownFields(t *testing.T) {
+	h, f := newTestHandler(t)
+	token := f.token(t, "user-a", time.Now().Add(time.Hour))
+
+	resp := callWithBody(t, h, "POST", "/upload-complete", token, nil, `{"key":"images/a.jpg","name":"a.jpg"}`)
+	if resp.StatusCode != 400 {
+		t.Fatalf("status = %d, want 400; body %s", resp.StatusCode, resp.Body)
+	}
+	if body := decodeError(t, resp); body.Message != `unknown field "name"` {
+		t.Errorf("message = %q, want the unknown field named", body.Message)
+	}
+}
+
+func TestImageURLRejectsSuspiciousKeys(t *testing.T) {
+	h, _ := newTestHandler(t)
+	for _, key := range []string{"/images/dog.jpg", "images/../secrets.txt", "..", "images/a/../../b.jpg"} {
+		t.Run(key, func(t *testing.T) {
+			resp := call(t, h, "GET", "/image-url", "", map[string]string{"key": key})
+			if resp.StatusCode != 400 {
+				t.Fatalf("status = %d, want 400", resp.StatusCode)
+			}
+			if code := decodeError(t, resp).Code; code != "INVALID_KEY" {
+				t.Errorf("code = %q, want INVALID_KEY", code)
+			}
+		})
+	}
+
+	// Dots inside a segment are just part of a name
+	for _, key := range []string{"images/dog..jpg", "images/.hidden.jpg"} {
+		if suspiciousKey(key) {
+			t.Errorf("suspiciousKey(%q) = true, want false", key)
+		}
+	}
+}
+
+func TestImageURLValidatesKeyExists(t *testing.T) {
+	h, f := newTestHandler(t)
+	h.validateKeyExists = true
+	f.putImage(t, "images/1700000000-dog.jpg", "", "2024-01-01T00:00:00Z")
+
+	if resp := call(t, h, "GET", "/image-url", "", map[string]string{"key": "images/1700000000-dog.jpg"}); resp.StatusCode != 200 {
+		t.Errorf("existing object: status = %d, want 200: %s", resp.StatusCode, resp.Body)
+	}
+
+	resp := call(t, h, "GET", "/image-url", "", map[string]string{"key": "images/1700000001-gone.jpg"})
+	if resp.StatusCode != 404 {
+		t.Fatalf("missing object: status = %d, want 404", resp.StatusCode)
+	}
+	if code := decodeError(t, resp).Code; code != "NOT_FOUND" {
+		t.Errorf("code = %q, want NOT_FOUND", code)
+	}
+
+	// Without the check the URL is signed unseen
+	h.validateKeyExists = false
+	if resp := call(t, h, "GET", "/image-url", "", map[string]string{"key": "images/1700000001-gone.jpg"}); resp.StatusCode != 200 {
+		t.Errorf("unchecked missing object: status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestPickThumbnail(t *testing.T) {
+	thumbnails := map[string]interface{}{
+		"150":  "thumbnails/150/images/dog.jpg",
+		"300":  "thumbnails/300/images/dog.jpg",
+		"1024": "thumbnails/1024/images/dog.jpg",
+	}
+	tests := []struct {
+		name       string
+		thumbnails map[string]interface{}
+		width      int
+		wantWidth  int
+		wantKey    string
+	}{
+		{"exact width", thumbnails, 300, 300, "thumbnails/300/images/dog.jpg"},
+		{"next larger width", thumbnails, 301, 1024, "thumbnails/1024/images/dog.jpg"},
+		{"smaller than every size", thumbnails, 10, 150, "thumbnails/150/images/dog.jpg"},
+		{"above every size", thumbnails, 4000, 1024, "thumbnails/1024/images/dog.jpg"},
+		{"malformed entries skipped", map[string]interface{}{"wide": "thumbnails/x.jpg", "300": 7, "150": "thumbnails/150/images/dog.jpg"}, 300, 150, "thumbnails/150/images/dog.jpg"},
+		{"none", map[string]interface{}{}, 300, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			width, key := pickThumbnail(tt.thumbnails, tt.width)
+			if width != tt.wantWidth || key != tt.wantKey {
+				t.Errorf("pickThumbnail(%d) = %d, %q; want %d, %q", tt.width, width, key, tt.wantWidth, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestThumbnailURLWithoutThumbnails(t *testing.T) {
+	h, f := newTestHandler(t)
+	// An item saved before the thumbnails map existed has only thumbnail_key
+	f.putImage(t, "images/1700000000-dog.jpg", "", "2024-01-01T00:00:00Z")
+	item := f.dynamoDB.Item("images/1700000000-dog.jpg")
+	delete(item, "thumbnails")
+	f.dynamoDB.Put(item)
+
+	resp := call(t, h, "GET", "/thumbnail-url", "", map[string]string{"key": "images/1700000000-dog.jpg", "width": "300"})
+	if resp.StatusCode != 404 {
+		t.Fatalf("status = %d, want 404: %s", resp.StatusCode, resp.Body)
+	}
+	if code := decodeError(t, resp).Code; code != "NO_THUMBNAILS" {
+		t.Errorf("code = %q, want NO_THUMBNAILS", code)
+	}
+}
+
+func TestTransformOnlyFindsOwnImages(t *testing.T) {
+	h, f := newTestHandler(t)
+	f.putImage(t, "images/b.jpg", "user-b", "2024-01-01T00:00:00Z")
+	token := f.token(t, "user-a", time.Now().Add(time.Hour))
+
+	// Neither a search entry nor another owner's image is something to transform
+	for _, key := range []string{"search#dog#images/b.jpg", "images/b.jpg"} {
+		resp := callWithBody(t, h, "POST", "/transform", token, map[string]string{"key": key}, `{"rotate":90}`)
+		if resp.StatusCode != 404 {
+			t.Errorf("POST /transform %s = %d (%s), want 404", key, resp.StatusCode, resp.Body)
+		}
+	}
+}
+
+func TestGetImagesSrcset(t *testing.T) {
+	h, f := newTestHandler(t)
+	thumbnails := func(widths ...string) types.AttributeValue {
+		m := make(map[string]types.AttributeValue, len(widths))
+		for _, w := range widths {
+			m[w] = &types.AttributeValueMemberS{Value: "thumbnails/" + w + "/img.jpg"}
+		}
+		return &types.AttributeValueMemberM{Value: m}
+	}
+	number := func(n string) types.AttributeValue { return &types.AttributeValueMemberN{Value: n} }
+	seed := func(key, processedAt string, attributes map[string]types.AttributeValue) {
+		f.putImage(t, key, "", processedAt)
+		item := f.dynamoDB.Item(key)
+		delete(item, "thumbnails")
+		for name, value := range attributes {
+			item[name] = value
+		}
+		f.dynamoDB.Put(item)
+	}
+	seed("images/large.jpg", "2024-01-04T00:00:00Z", map[string]types.AttributeValue{
+		"width": number("2000"), "height": number("1500"), "thumbnails": thumbnails("1280", "320", "640"),
+	})
+	// Narrower than the smallest size, so stored at its own width
+	seed("images/small.jpg", "2024-01-03T00:00:00Z", map[string]types.AttributeValue{
+		"width": number("200"), "height": number("150"), "thumbnails": thumbnails("320"),
+	})
+	// Fill mode crops to a square of the shorter side
+	seed("images/wide.jpg", "2024-01-02T00:00:00Z", map[string]types.AttributeValue{
+		"width": number("300"), "height": number("120"), "thumbnail_mode": &types.AttributeValueMemberS{Value: "fill"}, "thumbnails": thumbnails("320"),
+	})
+	seed("images/legacy.jpg", "2024-01-01T00:00:00Z", nil)
+
+	want := map[string][]string{
+		"images/large.jpg":  {"thumbnails/320/img.jpg 320w", "thumbnails/640/img.jpg 640w", "thumbnails/1280/img.jpg 1280w"},
+		"images/small.jpg":  {"thumbnails/320/img.jpg 200w"},
+		"images/wide.jpg":   {"thumbnails/320/img.jpg 120w"},
+		"images/legacy.jpg": nil,
+	}
+	// srcset entries are "<presigned url> <width>w"; keep the key and descriptor
+	entry := regexp.MustCompile(`/(thumbnails/\d+/img\.jpg)\?\S+ (\d+w)`)
+	for _, item := range decodePage(t, call(t, h, "GET", "/images", "", map[string]string{"srcset": "true"})).Items {
+		key, _ := item["image_key"].(string)
+		srcset, ok := item["srcset"].(string)
+		if want[key] == nil {
+			if ok {
+				t.Errorf("%s srcset = %q, want none without a thumbnails map", key, srcset)
+			}
+			continue
+		}
+		var got []string
+		for _, m := range entry.FindAllStringSubmatch(srcset, -1) {
+			got = append(got, m[1]+" "+m[2])
+		}
+		if !slices.Equal(got, want[key]) {
+			t.Errorf("%s srcset = %q, want entries %v", key, srcset, want[key])
+		}
+	}
+
+	for _, item := range decodePage(t, call(t, h, "GET", "/images", "", nil)).Items {
+		if srcset, ok := item["srcset"]; ok {
+			t.Errorf("%s srcset = %v without ?srcset=true", item["image_key"], srcset)
+		}
+	}
+}
+
+func TestGetImagesProjectsUnlessFull(t *testing.T) {
+	h, f := newTestHandler(t)
+	key := "images/a.jpg"
+	f.putImage(t, key, "", "2024-01-01T00:00:00Z")
+	detail, err := attributevalue.MarshalMap(map[string]interface{}{
+		"faces":         []map[string]interface{}{{"confidence": 99.1, "age_range": map[string]int{"low": 20, "high": 30}}},
+		"detected_text": []map[string]interface{}{{"text": "STOP", "confidence": 98.0}},
+		"text_blob":     "stop",
+		"exif":          map[string]string{"camera_model": "X100"},
+		"phash":         "8f3c0a1b2c3d4e5f",
+		"search_terms":  []string{"dog", "stop"},
+	})
+	if err != nil {
+		t.Fatalf("marshal detail: %v", err)
+	}
+	item := f.dynamoDB.Item(key)
+	for name, value := range detail {
+		item[name] = value
+	}
+	f.dynamoDB.Put(item)
+	heavy := []string{"faces", "detected_text", "text_blob", "exif", "phash", "search_terms", "gallery_pk"}
+
+	// The label filter reads projected attributes too
+	for _, query := range []map[string]string{nil, {"label": "dog"}} {
+		items := decodePage(t, call(t, h, "GET", "/images", "", query)).Items
+		if len(items) != 1 {
+			t.Fatalf("%v listed %d images, want 1", query, len(items))
+		}
+		for _, name := range heavy {
+			if value, ok := items[0][name]; ok {
+				t.Errorf("%v: %s = %v, want it left out of the list view", query, name, value)
+			}
+		}
+		for _, name := range []string{"image_key", "processed_at", "status", "detected_labels", "thumbnail_key", "url", "thumbnail_url"} {
+			if _, ok := items[0][name]; !ok {
+				t.Errorf("%v: no %s in the list view", query, name)
+			}
+		}
+	}
+
+	items := decodePage(t, call(t, h, "GET", "/images", "", map[string]string{"full": "true"})).Items
+	if len(items) != 1 {
+		t.Fatalf("full listed %d images, want 1", len(items))
+	}
+	for _, name := range heavy {
+		if _, ok := items[0][name]; !ok {
+			t.Errorf("full=true has no %s", name)
+		}
+	}
+}
+
+func TestCustomMetadataRoundTrip(t *testing.T) {
+	h, f := newTestHandler(t)
+	token := f.token(t, "user-a", time.Now().Add(time.Hour))
+	metadata := map[string]string{"album": "Été à Paris", "trip_id": "42", "caption": "dog & ball"}
+	request, err := json.Marshal(UploadRequest{ContentType: "image/jpeg", Size: 1024, Filename: "dog.jpg", Metadata: metadata})
+	if err != nil {
+		t.Fatalf("marshal request: %v", err)
+	}
+	resp := callWithBody(t, h, "POST", "/upload", token, map[string]string{"mode": "put"}, string(request))
+	if resp.StatusCode != 200 {
+		t.Fatalf("status = %d, want 200: %s", resp.StatusCode, resp.Body)
+	}
+	var upload UploadResponse
+	if err := json.Unmarshal([]byte(resp.Body), &upload); err != nil {
+		t.Fatalf("decode %q: %v", resp.Body, err)
+	}
+
+	// Upload as a client would, sending the signed headers; S3 keeps the
+	// x-amz-meta- ones as user metadata
+	userMetadata := make(map[string]string)
+	for name, value := range upload.Headers {
+		if k, ok := strings.CutPrefix(name, "x-amz-meta-"); ok {
+			userMetadata[k] = value
+		}
+	}
+	for k, v := range userMetadata {
+		if strings.HasPrefix(k, processor.CustomMetadataPrefix) && !isASCII(v) {
+			t.Errorf("header %s = %q, want it escaped to ASCII", k, v)
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 64, 48)), nil); err != nil {
+		t.Fatalf("encode JPEG: %v", err)
+	}
+	f.s3.PutBytes(testBucket, upload.Key, buf.Bytes(), userMetadata)
+	event := events.S3Event{Records: []events.S3EventRecord{{S3: events.S3Entity{
+		Bucket: events.S3Bucket{Name: testBucket},
+		Object: events.S3Object{Key: upload.Key, URLDecodedKey: upload.Key, Size: int64(buf.Len())},
+	}}}}
+	if err := h.processor.HandleS3Event(context.Background(), event); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	items := decodePage(t, call(t, h, "GET", "/images", "", nil)).Items
+	if len(items) != 1 {
+		t.Fatalf("listed %d images, want 1", len(items))
+	}
+	got, _ := items[0]["custom_metadata"].(map[string]interface{})
+	if len(got) != len(metadata) {
+		t.Fatalf("custom_metadata = %v, want %v", got, metadata)
+	}
+	for k, v := range metadata {
+		if got[k] != v {
+			t.Errorf("custom_metadata[%s] = %v, want %q", k, got[k], v)
+		}
+	}
+}
+
+func TestUploadRejectsInvalidCustomMetadata(t *testing.T) {
+	h, f := newTestHandler(t)
+	token := f.token(t, "user-a", time.Now().Add(time.Hour))
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		want     string
+	}{
+		{"uppercase key", map[string]string{"Album": "x"}, "INVALID_METADATA"},
+		{"empty key", map[string]string{"": "x"}, "INVALID_METADATA"},
+		{"key with a dot", map[string]string{"album.id": "x"}, "INVALID_METADATA"},
+		{"too large", map[string]string{"caption": strings.Repeat("a", maxUserMetadataBytes)}, "METADATA_TOO_LARGE"},
+	}
+	for _, tt := range tests {
+		request, err := json.Marshal(UploadRequest{ContentType: "image/jpeg", Size: 1024, Metadata: tt.metadata})
+		if err != nil {
+			t.Fatalf("marshal request: %v", err)
+		}
+		resp := callWithBody(t, h, "POST", "/upload", token, nil, string(request))
+		if resp.StatusCode != 400 || decodeError(t, resp).Code != tt.want {
+			t.Errorf("%s: status %d, body %s; want 400 %s", tt.name, resp.StatusCode, resp.Body, tt.want)
+		}
+	}
+}
+
+// isASCII reports whether s has only ASCII bytes
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
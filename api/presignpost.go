@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// presignedPost is a browser-form upload: the client POSTs multipart/form-data
+// to URL with Fields first and the file last, in a part named "file"
+type presignedPost struct {
+	URL    string
+	Fields map[string]string
+}
+
+// postPolicyRequest describes the object a presigned POST may create. Fields
+// are pinned to their exact values by the policy; MaxBytes caps the body.
+type postPolicyRequest struct {
+	Bucket   string
+	Key      string
+	Fields   map[string]string
+	MaxBytes int64
+	Expires  time.Duration
+}
+
+// presignPost signs a SigV4 POST policy for an S3 browser upload. Unlike a
+// presigned PUT, the policy's content-length-range makes S3 itself reject
+// bodies over MaxBytes. The SDK version in use has no PresignPostObject, so
+// the policy is built and signed here.
+func presignPost(ctx context.Context, provider aws.CredentialsProvider, region string, now time.Time, req postPolicyRequest) (*presignedPost, error) {
+	creds, err := provider.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve credentials: %w", err)
+	}
+
+	now = now.UTC()
+	date := now.Format("20060102")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, region)
+
+	fields := map[string]string{
+		"key":              req.Key,
+		"x-amz-algorithm":  "AWS4-HMAC-SHA256",
+		"x-amz-credential": creds.AccessKeyID + "/" + scope,
+		"x-amz-date":       now.Format("20060102T150405Z"),
+	}
+	if creds.SessionToken != "" {
+		fields["x-amz-security-token"] = creds.SessionToken
+	}
+	for k, v := range req.Fields {
+		fields[k] = v
+	}
+
+	conditions := []interface{}{
+		map[string]string{"bucket": req.Bucket},
+		[]interface{}{"content-length-range", 1, req.MaxBytes},
+	}
+	for k, v := range fields {
+		conditions = append(conditions, map[string]string{k: v})
+	}
+	policy, err := json.Marshal(map[string]interface{}{
+		"expiration": now.Add(req.Expires).Format("2006-01-02T15:04:05.000Z"),
+		"conditions": conditions,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode POST policy: %w", err)
+	}
+	encodedPolicy := base64.StdEncoding.EncodeToString(policy)
+
+	signingKey := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	for _, part := range []string{region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	fields["policy"] = encodedPolicy
+	fields["x-amz-signature"] = hex.EncodeToString(hmacSHA256(signingKey, encodedPolicy))
+
+	return &presignedPost{
+		URL:    fmt.Sprintf("https://%s.s3.%s.amazonaws.com/", req.Bucket, region),
+		Fields: fields,
+	}, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+func TestPresignPostPinsEveryField(t *testing.T) {
+	const maxBytes = 5 * 1024 * 1024
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	provider := credentials.NewStaticCredentialsProvider("AKIDEXAMPLE", "secret", "session-token")
+
+	post, err := presignPost(context.Background(), provider, "eu-west-1", now, postPolicyRequest{
+		Bucket:   testBucket,
+		Key:      "images/1709294400-dog.jpg",
+		Fields:   map[string]string{"Content-Type": "image/jpeg", "x-amz-meta-owner": "user-a"},
+		MaxBytes: maxBytes,
+		Expires:  15 * time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("presignPost: %v", err)
+	}
+	if want := "https://" + testBucket + ".s3.eu-west-1.amazonaws.com/"; post.URL != want {
+		t.Errorf("URL = %q, want %q", post.URL, want)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(post.Fields["policy"])
+	if err != nil {
+		t.Fatalf("policy is not base64: %v", err)
+	}
+	var policy struct {
+		Expiration string            `json:"expiration"`
+		Conditions []json.RawMessage `json:"conditions"`
+	}
+	if err := json.Unmarshal(raw, &policy); err != nil {
+		t.Fatalf("policy is not JSON: %v", err)
+	}
+	if want := "2024-03-01T12:15:00.000Z"; policy.Expiration != want {
+		t.Errorf("expiration = %q, want %q", policy.Expiration, want)
+	}
+
+	pinned := map[string]string{}
+	hasLengthRange := false
+	for _, condition := range policy.Conditions {
+		var exact map[string]string
+		if json.Unmarshal(condition, &exact) == nil {
+			for k, v := range exact {
+				pinned[k] = v
+			}
+			continue
+		}
+		var list []interface{}
+		if err := json.Unmarshal(condition, &list); err != nil {
+			t.Fatalf("unexpected condition %s", condition)
+		}
+		if len(list) == 3 && list[0] == "content-length-range" && list[1] == 1.0 && list[2] == float64(maxBytes) {
+			hasLengthRange = true
+		}
+	}
+	if !hasLengthRange {
+		t.Errorf("conditions %s lack [\"content-length-range\", 1, %d]", raw, maxBytes)
+	}
+	if pinned["bucket"] != testBucket {
+		t.Errorf("bucket pinned to %q, want %q", pinned["bucket"], testBucket)
+	}
+
+	// The policy and signature are the only fields that can't sign themselves
+	for k, v := range post.Fields {
+		if k == "policy" || k == "x-amz-signature" {
+			continue
+		}
+		if got, ok := pinned[k]; !ok || got != v {
+			t.Errorf("field %s = %q is not pinned by the policy (condition: %q)", k, v, got)
+		}
+	}
+	for _, k := range []string{"key", "Content-Type", "x-amz-meta-owner", "x-amz-security-token", "x-amz-credential", "x-amz-date"} {
+		if _, ok := post.Fields[k]; !ok {
+			t.Errorf("field %s missing", k)
+		}
+	}
+	if want := "AKIDEXAMPLE/20240301/eu-west-1/s3/aws4_request"; post.Fields["x-amz-credential"] != want {
+		t.Errorf("x-amz-credential = %q, want %q", post.Fields["x-amz-credential"], want)
+	}
+
+	// SigV4: the policy is signed with the key derived from the date, region
+	// and service
+	key := []byte("AWS4secret")
+	for _, part := range []string{"20240301", "eu-west-1", "s3", "aws4_request"} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(post.Fields["policy"]))
+	if want := hex.EncodeToString(mac.Sum(nil)); post.Fields["x-amz-signature"] != want {
+		t.Errorf("x-amz-signature = %q, want %q", post.Fields["x-amz-signature"], want)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// rateWindow is the span each upload rate counter covers
+const rateWindow = time.Minute
+
+// rateStore adds n to a named counter, returning its new value. Counters are
+// kept until expiresAt, after which the store may drop them.
+type rateStore interface {
+	increment(ctx context.Context, key string, n int, expiresAt time.Time) (int, error)
+}
+
+// uploadLimiter caps presigned uploads, from POST /upload and /upload-batch
+// alike, at perMinute per source IP. Lambda instances share nothing, so counts
+// live in a rateStore: one counter per IP and minute window.
+type uploadLimiter struct {
+	store     rateStore
+	perMinute int
+}
+
+// allow counts n uploads from ip at now. When the window's limit is exceeded
+// it returns false and how long until the next window opens.
+func (l *uploadLimiter) allow(ctx context.Context, ip string, n int, now time.Time) (bool, time.Duration, error) {
+	window := now.Truncate(rateWindow)
+	next := window.Add(rateWindow)
+
+	count, err := l.store.increment(ctx, fmt.Sprintf("ratelimit#upload#%s#%d", ip, window.Unix()), n, next)
+	if err != nil {
+		return false, 0, err
+	}
+	if count > l.perMinute {
+		return false, next.Sub(now), nil
+	}
+	return true, 0, nil
+}
+
+// dynamoRateStore keeps counters as items in the image table, keyed by
+// image_key like search entries. They carry no gallery_pk, so no listing sees
+// them, and expires_at lets the table's TTL purge them.
+type dynamoRateStore struct {
+	client    DynamoDBAPI
+	tableName string
+}
+
+func (s *dynamoRateStore) increment(ctx context.Context, key string, n int, expiresAt time.Time) (int, error) {
+	result, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"image_key": &types.AttributeValueMemberS{Value: key},
+		},
+		UpdateExpression: aws.String("ADD request_count :n SET expires_at = if_not_exists(expires_at, :expires)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":n":       &types.AttributeValueMemberN{Value: strconv.Itoa(n)},
+			":expires": &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Unix(), 10)},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to increment rate counter: %w", err)
+	}
+
+	counter, ok := result.Attributes["request_count"].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, fmt.Errorf("rate counter missing from UpdateItem result")
+	}
+	return strconv.Atoi(counter.Value)
+}
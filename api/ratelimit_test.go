@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"aws-lambda-image-processor/internal/awsfake"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+)
+
+// memRateStore is a rateStore over a map. Expiry is ignored, since every
+// window has its own key.
+type memRateStore struct {
+	counts map[string]int
+	err    error
+}
+
+func (s *memRateStore) increment(ctx context.Context, key string, n int, expiresAt time.Time) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	s.counts[key] += n
+	return s.counts[key], nil
+}
+
+func TestUploadLimiterAllow(t *testing.T) {
+	window := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	l := &uploadLimiter{store: &memRateStore{counts: map[string]int{}}, perMinute: 5}
+
+	// The steps run in order against the same limiter
+	steps := []struct {
+		name           string
+		ip             string
+		n              int
+		at             time.Time
+		wantAllowed    bool
+		wantRetryAfter time.Duration
+	}{
+		{"first upload", "10.0.0.1", 1, window, true, 0},
+		{"batch up to the limit", "10.0.0.1", 4, window.Add(10 * time.Second), true, 0},
+		{"one over", "10.0.0.1", 1, window.Add(45 * time.Second), false, 15 * time.Second},
+		{"still refused late in the window", "10.0.0.1", 1, window.Add(59*time.Second + 500*time.Millisecond), false, 500 * time.Millisecond},
+		{"other IP has its own count", "10.0.0.2", 5, window.Add(50 * time.Second), true, 0},
+		{"next window starts over", "10.0.0.1", 5, window.Add(rateWindow), true, 0},
+		{"batch over the limit in one go", "10.0.0.3", 6, window.Add(rateWindow + 20*time.Second), false, 40 * time.Second},
+	}
+	for _, step := range steps {
+		allowed, retryAfter, err := l.allow(context.Background(), step.ip, step.n, step.at)
+		if err != nil {
+			t.Fatalf("%s: allow: %v", step.name, err)
+		}
+		if allowed != step.wantAllowed || retryAfter != step.wantRetryAfter {
+			t.Errorf("%s: allow = %t, %v; want %t, %v", step.name, allowed, retryAfter, step.wantAllowed, step.wantRetryAfter)
+		}
+	}
+}
+
+func TestUploadLimiterStoreError(t *testing.T) {
+	l := &uploadLimiter{store: &memRateStore{err: errors.New("throttled")}, perMinute: 5}
+	if _, _, err := l.allow(context.Background(), "10.0.0.1", 1, time.Now()); err == nil {
+		t.Error("allow swallowed the store error")
+	}
+}
+
+func TestRateLimitedSetsRetryAfter(t *testing.T) {
+	h, _ := newTestHandler(t)
+	h.uploadLimiter = &uploadLimiter{store: &memRateStore{counts: map[string]int{}}, perMinute: 1}
+
+	var req events.APIGatewayV2HTTPRequest
+	req.RequestContext.HTTP.SourceIP = "10.0.0.1"
+	if _, limited := h.rateLimited(context.Background(), req, map[string]string{}, 1); limited {
+		t.Fatal("first upload was rate limited")
+	}
+
+	headers := map[string]string{}
+	resp, limited := h.rateLimited(context.Background(), req, headers, 1)
+	if !limited || resp.StatusCode != 429 {
+		t.Fatalf("second upload: limited = %t, status = %d; want true, 429", limited, resp.StatusCode)
+	}
+	// Whole seconds, rounded up, until the next window
+	seconds, err := strconv.Atoi(headers["Retry-After"])
+	if err != nil || seconds < 1 || seconds > int(rateWindow/time.Second) {
+		t.Errorf("Retry-After = %q, want 1-60 seconds", headers["Retry-After"])
+	}
+}
+
+func TestDynamoRateStoreIncrement(t *testing.T) {
+	fake := awsfake.NewDynamoDB()
+	s := &dynamoRateStore{client: fake, tableName: testTable}
+	expiresAt := time.Date(2024, 3, 1, 12, 1, 0, 0, time.UTC)
+
+	for want := 2; want <= 6; want += 2 {
+		count, err := s.increment(context.Background(), "ratelimit#upload#10.0.0.1#1709294400", 2, expiresAt.Add(time.Duration(want)*time.Minute))
+		if err != nil {
+			t.Fatalf("increment: %v", err)
+		}
+		if count != want {
+			t.Errorf("count = %d, want %d", count, want)
+		}
+	}
+
+	// The first increment sets the expiry; later ones leave it alone
+	var counter struct {
+		ExpiresAt int64 `dynamodbav:"expires_at"`
+	}
+	if err := attributevalue.UnmarshalMap(fake.Item("ratelimit#upload#10.0.0.1#1709294400"), &counter); err != nil {
+		t.Fatalf("unmarshal counter: %v", err)
+	}
+	if want := expiresAt.Add(2 * time.Minute).Unix(); counter.ExpiresAt != want {
+		t.Errorf("expires_at = %d, want the first increment's %d", counter.ExpiresAt, want)
+	}
+}
+
+func TestUploadRateLimitCountsOnlyValidRequests(t *testing.T) {
+	h, f := newTestHandler(t)
+	h.uploadLimiter = &uploadLimiter{store: &memRateStore{counts: map[string]int{}}, perMinute: 1}
+	token := f.token(t, "user-a", time.Now().Add(time.Hour))
+
+	upload := func(body string) int {
+		t.Helper()
+		req := events.APIGatewayV2HTTPRequest{
+			RawPath: "/upload",
+			Body:    body,
+			Headers: map[string]string{"authorization": "Bearer " + token},
+		}
+		req.RequestContext.HTTP.Method = "POST"
+		req.RequestContext.HTTP.SourceIP = "10.0.0.1"
+		resp, err := h.HandleRequest(context.Background(), req)
+		if err != nil {
+			t.Fatalf("POST /upload: %v", err)
+		}
+		return resp.StatusCode
+	}
+
+	// Rejected requests leave the single upload of the minute unspent
+	for _, bad := range []string{`not json`, `{"contentType":"text/plain","size":10,"filename":"a.txt"}`} {
+		if status := upload(bad); status != 400 {
+			t.Errorf("invalid upload %s: status %d, want 400", bad, status)
+		}
+	}
+	valid := `{"contentType":"image/jpeg","size":1024,"filename":"dog.jpg"}`
+	if status := upload(valid); status != 200 {
+		t.Fatalf("first valid upload: status %d, want 200", status)
+	}
+	if status := upload(valid); status != 429 {
+		t.Errorf("second valid upload: status %d, want 429", status)
+	}
+}
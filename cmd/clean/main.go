@@ -1,24 +1,144 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"flag"
 	"fmt"
 	"log"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"aws-lambda-image-processor/internal/processor"
 )
 
+// maxSampleKeys is how many keys a summary lists per store
+const maxSampleKeys = 10
+
+// cleanSummary counts what was (or in a dry run, would be) deleted
+type cleanSummary struct {
+	Count   int
+	Samples []string
+
+	// seen, when set, holds every key added, so a later pass can skip them
+	seen map[string]bool
+}
+
+func (s *cleanSummary) add(key string) {
+	if s.seen != nil {
+		s.seen[key] = true
+	}
+	s.Count++
+	if len(s.Samples) < maxSampleKeys {
+		s.Samples = append(s.Samples, key)
+	}
+}
+
+// cleanConfig is the parsed command line
+type cleanConfig struct {
+	Bucket  string
+	Table   string
+	Region  string
+	DryRun  bool
+	Confirm bool
+
+	// Prefix and OlderThan narrow the clean to matching keys; zero values match all
+	Prefix    string
+	OlderThan time.Duration
+
+	// Label limits the clean to images with this detected label at or above
+	// MinConfidence
+	Label         string
+	MinConfidence float64
+}
+
+// filtered reports whether only part of the bucket and table is being cleaned
+func (c cleanConfig) filtered() bool {
+	return c.Prefix != "" || c.OlderThan > 0 || c.Label != ""
+}
+
+// cutoff returns the time before which objects and items are deleted, or the zero
+// time when there is no age filter
+func (c cleanConfig) cutoff(now time.Time) time.Time {
+	if c.OlderThan <= 0 {
+		return time.Time{}
+	}
+	return now.Add(-c.OlderThan)
+}
+
+// parseConfig reads the flags, falling back to S3_BUCKET_NAME and
+// DYNAMODB_TABLE_NAME, and requires both a bucket and a table
+func parseConfig(args []string) (cleanConfig, error) {
+	var cfg cleanConfig
+	fs := flag.NewFlagSet("clean", flag.ContinueOnError)
+	fs.StringVar(&cfg.Bucket, "bucket", os.Getenv("S3_BUCKET_NAME"), "bucket to empty (default $S3_BUCKET_NAME)")
+	fs.StringVar(&cfg.Table, "table", os.Getenv("DYNAMODB_TABLE_NAME"), "table to empty (default $DYNAMODB_TABLE_NAME)")
+	fs.StringVar(&cfg.Region, "region", "", "AWS region (default from the AWS config chain)")
+	fs.BoolVar(&cfg.DryRun, "dry-run", false, "list what would be deleted without deleting anything")
+	fs.BoolVar(&cfg.Confirm, "confirm", false, "delete without asking to type the bucket name")
+	fs.StringVar(&cfg.Prefix, "prefix", "", "only delete S3 keys and items whose image_key start with this prefix")
+	fs.DurationVar(&cfg.OlderThan, "older-than", 0, "only delete objects and items older than this, e.g. 720h")
+	fs.StringVar(&cfg.Label, "label", "", "only delete images with this detected label (case-insensitive)")
+	fs.Float64Var(&cfg.MinConfidence, "min-confidence", 0, "with -label, the lowest label confidence that matches (0-100)")
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if cfg.Bucket == "" {
+		return cfg, fmt.Errorf("no bucket: pass -bucket or set S3_BUCKET_NAME")
+	}
+	if cfg.Table == "" {
+		return cfg, fmt.Errorf("no table: pass -table or set DYNAMODB_TABLE_NAME")
+	}
+	if cfg.OlderThan < 0 {
+		return cfg, fmt.Errorf("-older-than must not be negative")
+	}
+	if cfg.MinConfidence < 0 || cfg.MinConfidence > 100 {
+		return cfg, fmt.Errorf("-min-confidence must be between 0 and 100")
+	}
+	if cfg.MinConfidence > 0 && cfg.Label == "" {
+		return cfg, fmt.Errorf("-min-confidence needs -label")
+	}
+	return cfg, nil
+}
+
 func main() {
-	bucketName := "image-processor-source-975050162743"
-	tableName := "image-labels"
+	cleanCfg, err := parseConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	bucketName := cleanCfg.Bucket
+	tableName := cleanCfg.Table
+
+	// Real deletion needs -confirm or the bucket name typed back, so a stray run
+	// against the wrong account can't wipe it
+	if !cleanCfg.DryRun && !cleanCfg.Confirm {
+		scope := "every"
+		if cleanCfg.filtered() {
+			scope = "matching"
+		}
+		fmt.Printf("This deletes %s object in %s and %s item in %s.\nType the bucket name to continue: ", scope, bucketName, scope, tableName)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.TrimSpace(answer) != bucketName {
+			log.Fatal("bucket name did not match; nothing was deleted")
+		}
+	}
 
 	ctx := context.TODO()
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion("ap-southeast-2"))
+	var opts []func(*config.LoadOptions) error
+	if cleanCfg.Region != "" {
+		opts = append(opts, config.WithRegion(cleanCfg.Region))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
 	if err != nil {
 		log.Fatalf("unable to load SDK config, %v", err)
 	}
@@ -26,86 +146,380 @@ func main() {
 	s3Client := s3.NewFromConfig(cfg)
 	dynamoClient := dynamodb.NewFromConfig(cfg)
 
-	// 1. Clean S3
-	fmt.Printf("Cleaning S3 Bucket: %s...\n", bucketName)
-	if err := cleanS3(ctx, s3Client, bucketName); err != nil {
-		log.Printf("Failed to clean S3: %v\n", err)
-	} else {
-		fmt.Println("S3 Bucket cleaned.")
+	// Label counts are released through the processor, which already retries
+	// its calls, so its client makes single attempts
+	counts, err := processor.New(processor.Clients{
+		DynamoDB: dynamodb.NewFromConfig(processor.SingleAttemptConfig(cfg)),
+	})
+	if err != nil {
+		log.Fatalf("unable to configure label counts, %v", err)
+	}
+	counts = counts.WithTable(tableName)
+
+	verb := "Deleted"
+	if cleanCfg.DryRun {
+		verb = "Would delete"
+	}
+
+	cutoff := cleanCfg.cutoff(time.Now())
+
+	// 1. Clean S3. Labels are only known from the table, so a label clean
+	// deletes originals with the derived objects in step 3 instead.
+	var s3Summary cleanSummary
+	if cleanCfg.Label == "" {
+		fmt.Printf("Cleaning S3 Bucket: %s...\n", bucketName)
+		s3Summary, err = cleanS3(ctx, s3Client, bucketName, cleanCfg.Prefix, cutoff, cleanCfg.DryRun)
+		if err != nil {
+			log.Printf("Failed to clean S3: %v\n", err)
+		} else if !cleanCfg.DryRun {
+			fmt.Println("S3 Bucket cleaned.")
+		}
 	}
 
 	// 2. Clean DynamoDB
 	fmt.Printf("Cleaning DynamoDB Table: %s...\n", tableName)
-	if err := cleanDynamoDB(ctx, dynamoClient, tableName); err != nil {
+	dynamoSummary, derivedKeys, err := cleanDynamoDB(ctx, dynamoClient, counts, tableName, bucketName, cleanCfg, cutoff)
+	if err != nil {
 		log.Printf("Failed to clean DynamoDB: %v\n", err)
-	} else {
+	} else if !cleanCfg.DryRun {
 		fmt.Println("DynamoDB Table cleaned.")
 	}
+
+	// 3. A filtered clean leaves thumbnails and other derived objects outside the
+	// prefix, so remove the ones recorded on the deleted items
+	if err == nil {
+		cleanDerived(ctx, s3Client, bucketName, derivedKeys, cleanCfg.DryRun, &s3Summary)
+	}
+
+	printSummary(verb, "S3 objects", s3Summary)
+	printSummary(verb, "DynamoDB items", dynamoSummary)
 }
 
-func cleanS3(ctx context.Context, client *s3.Client, bucket string) error {
-	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+func printSummary(verb, what string, summary cleanSummary) {
+	fmt.Printf("%s %d %s\n", verb, summary.Count, what)
+	for _, key := range summary.Samples {
+		fmt.Printf("  %s\n", key)
+	}
+	if summary.Count > len(summary.Samples) {
+		fmt.Printf("  ... and %d more\n", summary.Count-len(summary.Samples))
+	}
+}
+
+// cleanS3 deletes the objects under prefix last modified before cutoff. With
+// either filter set, the summary remembers the keys for cleanDerived.
+func cleanS3(ctx context.Context, client S3API, bucket, prefix string, cutoff time.Time, dryRun bool) (cleanSummary, error) {
+	var summary cleanSummary
+	if prefix != "" || !cutoff.IsZero() {
+		summary.seen = make(map[string]bool)
+	}
+	input := &s3.ListObjectsV2Input{
 		Bucket: aws.String(bucket),
-	})
+	}
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+	paginator := s3.NewListObjectsV2Paginator(client, input)
 
 	for paginator.HasMorePages() {
 		page, err := paginator.NextPage(ctx)
 		if err != nil {
-			return err
+			return summary, err
+		}
+
+		var keys []string
+		for _, obj := range page.Contents {
+			if !cutoff.IsZero() && !aws.ToTime(obj.LastModified).Before(cutoff) {
+				continue
+			}
+			keys = append(keys, aws.ToString(obj.Key))
 		}
 
-		if len(page.Contents) == 0 {
+		if err := deleteKeys(ctx, client, bucket, keys, dryRun, &summary); err != nil {
+			return summary, err
+		}
+	}
+	return summary, nil
+}
+
+// cleanDerived deletes the derived objects of the deleted items, recording them
+// in summary. Those step 1 already matched in the image bucket, such as old
+// thumbnails in an age-only clean, are skipped so none is deleted or counted
+// twice.
+func cleanDerived(ctx context.Context, client S3API, imageBucket string, derivedKeys map[string][]string, dryRun bool, summary *cleanSummary) {
+	for bucket, keys := range derivedKeys {
+		if bucket == imageBucket && summary.seen != nil {
+			var unseen []string
+			for _, key := range keys {
+				if !summary.seen[key] {
+					unseen = append(unseen, key)
+				}
+			}
+			keys = unseen
+		}
+		if len(keys) == 0 {
 			continue
 		}
 
-		var objects []s3types.ObjectIdentifier
-		for _, obj := range page.Contents {
-			objects = append(objects, s3types.ObjectIdentifier{Key: obj.Key})
+		fmt.Printf("Cleaning %d derived S3 objects in %s...\n", len(keys), bucket)
+		if err := deleteKeys(ctx, client, bucket, keys, dryRun, summary); err != nil {
+			log.Printf("Failed to clean derived objects: %v\n", err)
 		}
+	}
+}
 
-		_, err = client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
-			Bucket: aws.String(bucket),
-			Delete: &s3types.Delete{
-				Objects: objects,
-				Quiet:   aws.Bool(true),
-			},
-		})
-		if err != nil {
-			return err
+// deleteKeys removes keys in DeleteObjects calls of up to 1000, recording them in
+// summary. In a dry run it only records them.
+func deleteKeys(ctx context.Context, client S3API, bucket string, keys []string, dryRun bool, summary *cleanSummary) error {
+	const maxDeleteObjects = 1000
+
+	for start := 0; start < len(keys); start += maxDeleteObjects {
+		end := start + maxDeleteObjects
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		if !dryRun {
+			var objects []s3types.ObjectIdentifier
+			for _, key := range keys[start:end] {
+				objects = append(objects, s3types.ObjectIdentifier{Key: aws.String(key)})
+			}
+
+			_, err := client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+				Bucket: aws.String(bucket),
+				Delete: &s3types.Delete{
+					Objects: objects,
+					Quiet:   aws.Bool(true),
+				},
+			})
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Deleted %d objects from S3\n", len(objects))
+		}
+
+		for _, key := range keys[start:end] {
+			summary.add(key)
 		}
-		fmt.Printf("Deleted %d objects from S3\n", len(objects))
 	}
 	return nil
 }
 
-func cleanDynamoDB(ctx context.Context, client *dynamodb.Client, table string) error {
-	paginator := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{
+// cleanItem is the projection scanned from the table: the key plus what a
+// filtered clean needs to find derived objects and search entries
+type cleanItem struct {
+	ImageKey        string                `dynamodbav:"image_key"`
+	ThumbnailKey    string                `dynamodbav:"thumbnail_key"`
+	ThumbnailBucket string                `dynamodbav:"thumbnail_bucket"`
+	Thumbnails      map[string]string     `dynamodbav:"thumbnails"`
+	ConvertedKey    string                `dynamodbav:"converted_key"`
+	QuarantineKey   string                `dynamodbav:"quarantine_key"`
+	OptimizedKey    string                `dynamodbav:"optimized_key"`
+	SearchTerms     []string              `dynamodbav:"search_terms"`
+	DetectedLabels  []processor.LabelInfo `dynamodbav:"detected_labels"`
+}
+
+// hasLabel reports whether the item has a detected label named name
+// (case-insensitive) at or above minConfidence
+func (item cleanItem) hasLabel(name string, minConfidence float64) bool {
+	for _, label := range item.DetectedLabels {
+		if strings.EqualFold(label.Name, name) && float64(label.Confidence) >= minConfidence {
+			return true
+		}
+	}
+	return false
+}
+
+// scanInput builds the table scan. A full clean only needs keys; a filtered one
+// matches image_key prefix and processed_at age, skips search entries (they are
+// removed through their image's search_terms) and the label count items, and
+// reads the derived keys and detected_labels. A label clean matches those after
+// the scan, since a filter expression can't look inside the list.
+func scanInput(table string, cleanCfg cleanConfig, cutoff time.Time) *dynamodb.ScanInput {
+	input := &dynamodb.ScanInput{
 		TableName:            aws.String(table),
 		ProjectionExpression: aws.String("image_key"),
-	})
+	}
+	if !cleanCfg.filtered() {
+		return input
+	}
+
+	filters := []string{"NOT begins_with(image_key, :search)", "NOT begins_with(image_key, :labels)"}
+	values := map[string]dynamodbtypes.AttributeValue{
+		":search": &dynamodbtypes.AttributeValueMemberS{Value: processor.SearchEntryPrefix},
+		":labels": &dynamodbtypes.AttributeValueMemberS{Value: processor.LabelCountPrefix},
+	}
+	if cleanCfg.Prefix != "" {
+		filters = append(filters, "begins_with(image_key, :prefix)")
+		values[":prefix"] = &dynamodbtypes.AttributeValueMemberS{Value: cleanCfg.Prefix}
+	}
+	if !cutoff.IsZero() {
+		filters = append(filters, "processed_at < :cutoff")
+		values[":cutoff"] = &dynamodbtypes.AttributeValueMemberS{Value: cutoff.UTC().Format(time.RFC3339)}
+	}
 
-	var deletedCount int
+	input.ProjectionExpression = aws.String("image_key, thumbnail_key, thumbnail_bucket, thumbnails, converted_key, quarantine_key, optimized_key, search_terms, detected_labels")
+	input.FilterExpression = aws.String(strings.Join(filters, " AND "))
+	input.ExpressionAttributeValues = values
+	return input
+}
+
+// cleanDynamoDB deletes the matching items. For a filtered clean it also deletes
+// their search entries, takes their labels off the label counts and returns the
+// derived S3 keys they recorded, by bucket; for a label clean those include the
+// originals. A full clean deletes the label count items with everything else.
+func cleanDynamoDB(ctx context.Context, client DynamoDBAPI, counts *processor.Handler, table, bucket string, cleanCfg cleanConfig, cutoff time.Time) (cleanSummary, map[string][]string, error) {
+	var summary cleanSummary
+	derivedKeys := make(map[string][]string)
+	paginator := dynamodb.NewScanPaginator(client, scanInput(table, cleanCfg, cutoff))
+
+	var unprocessed []string
+	released := make(map[string]int)
 	for paginator.HasMorePages() {
 		page, err := paginator.NextPage(ctx)
 		if err != nil {
-			return err
+			return summary, derivedKeys, err
+		}
+
+		var items []cleanItem
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &items); err != nil {
+			return summary, derivedKeys, err
 		}
 
-		for _, item := range page.Items {
-			key := item["image_key"].(*dynamodbtypes.AttributeValueMemberS).Value
-			_, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
-				TableName: aws.String(table),
+		var keys []string
+		labelsByKey := make(map[string][]processor.LabelInfo)
+		for _, item := range items {
+			if cleanCfg.Label != "" && !item.hasLabel(cleanCfg.Label, cleanCfg.MinConfidence) {
+				continue
+			}
+			keys = append(keys, item.ImageKey)
+			if !cleanCfg.filtered() {
+				continue
+			}
+			labelsByKey[item.ImageKey] = item.DetectedLabels
+			if cleanCfg.Label != "" {
+				derivedKeys[bucket] = append(derivedKeys[bucket], item.ImageKey)
+			}
+			for _, term := range item.SearchTerms {
+				keys = append(keys, processor.SearchEntryKey(term, item.ImageKey))
+			}
+			for b, k := range item.derivedKeys(bucket) {
+				derivedKeys[b] = append(derivedKeys[b], k...)
+			}
+		}
+		if cleanCfg.DryRun {
+			for _, key := range keys {
+				summary.add(key)
+			}
+			continue
+		}
+
+		for start := 0; start < len(keys); start += batchWriteSize {
+			end := start + batchWriteSize
+			if end > len(keys) {
+				end = len(keys)
+			}
+
+			deleted, failed, err := batchDelete(ctx, client, table, keys[start:end])
+			if err != nil {
+				return summary, derivedKeys, err
+			}
+			for _, key := range deleted {
+				summary.add(key)
+				processor.AddLabelReleases(released, labelsByKey[key])
+			}
+			unprocessed = append(unprocessed, failed...)
+		}
+		fmt.Printf("Deleted %d items from DynamoDB so far\n", summary.Count)
+	}
+
+	if err := counts.ReleaseLabelCounts(ctx, released); err != nil {
+		log.Printf("Failed to update label counts: %v\n", err)
+	}
+
+	if len(unprocessed) > 0 {
+		log.Printf("%d items were left unprocessed after retries:\n", len(unprocessed))
+		for _, key := range unprocessed {
+			log.Printf("  %s\n", key)
+		}
+	}
+	return summary, derivedKeys, nil
+}
+
+// derivedKeys lists the thumbnail, converted, quarantine and optimized objects of
+// an item by bucket. Converted, quarantined and optimized copies stay in the
+// image bucket; thumbnails are in thumbnail_bucket when the item records one.
+func (item cleanItem) derivedKeys(bucket string) map[string][]string {
+	thumbnailBucket := item.ThumbnailBucket
+	if thumbnailBucket == "" {
+		thumbnailBucket = bucket
+	}
+
+	seen := map[string]bool{}
+	keys := make(map[string][]string)
+	add := func(bucket, key string) {
+		if key != "" && !seen[bucket+"/"+key] {
+			seen[bucket+"/"+key] = true
+			keys[bucket] = append(keys[bucket], key)
+		}
+	}
+
+	add(thumbnailBucket, item.ThumbnailKey)
+	for _, key := range item.Thumbnails {
+		add(thumbnailBucket, key)
+	}
+	add(bucket, item.ConvertedKey)
+	add(bucket, item.QuarantineKey)
+	add(bucket, item.OptimizedKey)
+	return keys
+}
+
+// batchWriteSize is the most requests BatchWriteItem accepts per call
+const batchWriteSize = 25
+
+// maxBatchAttempts bounds how often unprocessed items are resubmitted
+const maxBatchAttempts = 5
+
+// batchDelete deletes up to batchWriteSize keys, resubmitting unprocessed items
+// with backoff. It returns the deleted keys and those still unprocessed.
+func batchDelete(ctx context.Context, client DynamoDBAPI, table string, keys []string) ([]string, []string, error) {
+	requests := make([]dynamodbtypes.WriteRequest, 0, len(keys))
+	for _, key := range keys {
+		requests = append(requests, dynamodbtypes.WriteRequest{
+			DeleteRequest: &dynamodbtypes.DeleteRequest{
 				Key: map[string]dynamodbtypes.AttributeValue{
 					"image_key": &dynamodbtypes.AttributeValueMemberS{Value: key},
 				},
-			})
-			if err != nil {
-				log.Printf("Failed to delete item %s: %v\n", key, err)
-			} else {
-				deletedCount++
-			}
+			},
+		})
+	}
+
+	pending := requests
+	for attempt := 0; len(pending) > 0 && attempt < maxBatchAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(1<<attempt) * 50 * time.Millisecond)
+		}
+
+		result, err := client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]dynamodbtypes.WriteRequest{table: pending},
+		})
+		if err != nil {
+			return nil, nil, err
 		}
+		pending = result.UnprocessedItems[table]
 	}
-	fmt.Printf("Deleted %d items from DynamoDB\n", deletedCount)
-	return nil
+
+	failed := make(map[string]bool, len(pending))
+	for _, request := range pending {
+		failed[request.DeleteRequest.Key["image_key"].(*dynamodbtypes.AttributeValueMemberS).Value] = true
+	}
+
+	var deleted, unprocessed []string
+	for _, key := range keys {
+		if failed[key] {
+			unprocessed = append(unprocessed, key)
+		} else {
+			deleted = append(deleted, key)
+		}
+	}
+	return deleted, unprocessed, nil
 }
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"aws-lambda-image-processor/internal/awsfake"
+	"aws-lambda-image-processor/internal/processor"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	testBucket = "images-bucket"
+	testTable  = "image-labels"
+)
+
+// batchRecorder is the fake table with BatchWriteItem wrapped: it records the
+// size of every call, and the first call hands back its last unprocessed
+// requests unprocessed, as a throttled table does
+type batchRecorder struct {
+	*awsfake.DynamoDB
+	unprocessed int
+	sizes       []int
+}
+
+func (b *batchRecorder) BatchWriteItem(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+	requests := params.RequestItems[testTable]
+	b.sizes = append(b.sizes, len(requests))
+
+	var skipped []dynamodbtypes.WriteRequest
+	if b.unprocessed > 0 && len(requests) > b.unprocessed {
+		requests, skipped = requests[:len(requests)-b.unprocessed], requests[len(requests)-b.unprocessed:]
+		b.unprocessed = 0
+	}
+	if _, err := b.DynamoDB.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+		RequestItems: map[string][]dynamodbtypes.WriteRequest{testTable: requests},
+	}, optFns...); err != nil {
+		return nil, err
+	}
+
+	out := &dynamodb.BatchWriteItemOutput{}
+	if len(skipped) > 0 {
+		out.UnprocessedItems = map[string][]dynamodbtypes.WriteRequest{testTable: skipped}
+	}
+	return out, nil
+}
+
+// labelCounts is the processor the clean releases label counts through
+func labelCounts(t *testing.T, table *awsfake.DynamoDB) *processor.Handler {
+	t.Helper()
+	counts, err := processor.New(processor.Clients{DynamoDB: table})
+	if err != nil {
+		t.Fatalf("processor.New: %v", err)
+	}
+	return counts.WithTable(testTable)
+}
+
+func putImageItem(table *awsfake.DynamoDB, key string) {
+	table.Put(map[string]dynamodbtypes.AttributeValue{
+		"image_key": &dynamodbtypes.AttributeValueMemberS{Value: key},
+	})
+}
+
+func TestCleanDynamoDBBatchesAndRetriesUnprocessed(t *testing.T) {
+	table := awsfake.NewDynamoDB()
+	for i := 0; i < 60; i++ {
+		putImageItem(table, fmt.Sprintf("images/%02d.jpg", i))
+	}
+	client := &batchRecorder{DynamoDB: table, unprocessed: 2}
+
+	summary, _, err := cleanDynamoDB(context.Background(), client, labelCounts(t, table), testTable, testBucket, cleanConfig{}, time.Time{})
+	if err != nil {
+		t.Fatalf("cleanDynamoDB: %v", err)
+	}
+
+	// Three batches of at most 25, plus the resubmitted two from the first
+	want := []int{25, 2, 25, 10}
+	if fmt.Sprint(client.sizes) != fmt.Sprint(want) {
+		t.Errorf("BatchWriteItem sizes = %v, want %v", client.sizes, want)
+	}
+	if summary.Count != 60 {
+		t.Errorf("summary count = %d, want 60", summary.Count)
+	}
+	if keys := table.Keys(); len(keys) != 0 {
+		t.Errorf("items left after the clean: %v", keys)
+	}
+}
+
+func TestDryRunDeletesNothing(t *testing.T) {
+	ctx := context.Background()
+	table := awsfake.NewDynamoDB()
+	bucket := awsfake.NewS3()
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("images/%02d.jpg", i)
+		putImageItem(table, key)
+		bucket.PutBytes(testBucket, key, []byte("jpeg"), nil)
+	}
+	deletes := 0
+	bucket.BeforeCall = func(operation string) error {
+		if operation == "DeleteObjects" {
+			deletes++
+		}
+		return nil
+	}
+
+	cfg := cleanConfig{Bucket: testBucket, Table: testTable, DryRun: true}
+	s3Summary, err := cleanS3(ctx, bucket, testBucket, "", time.Time{}, true)
+	if err != nil {
+		t.Fatalf("cleanS3: %v", err)
+	}
+	dynamoSummary, _, err := cleanDynamoDB(ctx, table, labelCounts(t, table), testTable, testBucket, cfg, time.Time{})
+	if err != nil {
+		t.Fatalf("cleanDynamoDB: %v", err)
+	}
+
+	if s3Summary.Count != 30 || dynamoSummary.Count != 30 {
+		t.Errorf("would delete %d objects and %d items, want 30 and 30", s3Summary.Count, dynamoSummary.Count)
+	}
+	if len(s3Summary.Samples) != maxSampleKeys {
+		t.Errorf("%d sample keys, want %d", len(s3Summary.Samples), maxSampleKeys)
+	}
+	if deletes != 0 {
+		t.Errorf("DeleteObjects called %d times in a dry run", deletes)
+	}
+	if n := table.Calls("BatchWriteItem"); n != 0 {
+		t.Errorf("BatchWriteItem called %d times in a dry run", n)
+	}
+	if len(bucket.Keys(testBucket, "")) != 30 || len(table.Keys()) != 30 {
+		t.Error("a dry run removed objects or items")
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		want    cleanConfig
+		wantErr bool
+	}{
+		{
+			name: "flags",
+			args: []string{"-bucket", "b", "-table", "t", "-region", "eu-west-1", "-dry-run", "-prefix", "images/2023", "-older-than", "720h"},
+			want: cleanConfig{Bucket: "b", Table: "t", Region: "eu-west-1", DryRun: true, Prefix: "images/2023", OlderThan: 720 * time.Hour},
+		},
+		{
+			name: "env fallback",
+			env:  map[string]string{"S3_BUCKET_NAME": "env-bucket", "DYNAMODB_TABLE_NAME": "env-table"},
+			args: []string{"-confirm"},
+			want: cleanConfig{Bucket: "env-bucket", Table: "env-table", Confirm: true},
+		},
+		{
+			name: "flags override env",
+			env:  map[string]string{"S3_BUCKET_NAME": "env-bucket", "DYNAMODB_TABLE_NAME": "env-table"},
+			args: []string{"-bucket", "b"},
+			want: cleanConfig{Bucket: "b", Table: "env-table"},
+		},
+		{
+			name: "label with confidence",
+			args: []string{"-bucket", "b", "-table", "t", "-label", "Dog", "-min-confidence", "90"},
+			want: cleanConfig{Bucket: "b", Table: "t", Label: "Dog", MinConfidence: 90},
+		},
+		{name: "missing bucket", args: []string{"-table", "t"}, wantErr: true},
+		{name: "missing table", args: []string{"-bucket", "b"}, wantErr: true},
+		{name: "negative age", args: []string{"-bucket", "b", "-table", "t", "-older-than", "-1h"}, wantErr: true},
+		{name: "confidence over 100", args: []string{"-bucket", "b", "-table", "t", "-label", "Dog", "-min-confidence", "101"}, wantErr: true},
+		{name: "confidence without label", args: []string{"-bucket", "b", "-table", "t", "-min-confidence", "50"}, wantErr: true},
+		{name: "unknown flag", args: []string{"-bucket", "b", "-table", "t", "-force"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("S3_BUCKET_NAME", tt.env["S3_BUCKET_NAME"])
+			t.Setenv("DYNAMODB_TABLE_NAME", tt.env["DYNAMODB_TABLE_NAME"])
+
+			got, err := parseConfig(tt.args)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseConfig(%q) = %+v, want an error", tt.args, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseConfig(%q): %v", tt.args, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseConfig(%q) = %+v, want %+v", tt.args, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCutoff(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	if got := (cleanConfig{}).cutoff(now); !got.IsZero() {
+		t.Errorf("cutoff without -older-than = %v, want the zero time", got)
+	}
+	if got, want := (cleanConfig{OlderThan: 48 * time.Hour}).cutoff(now), now.Add(-48*time.Hour); !got.Equal(want) {
+		t.Errorf("cutoff = %v, want %v", got, want)
+	}
+}
+
+func TestScanInput(t *testing.T) {
+	cutoff := time.Date(2024, 3, 1, 12, 0, 0, 0, time.FixedZone("CET", 3600))
+
+	full := scanInput(testTable, cleanConfig{}, time.Time{})
+	if full.FilterExpression != nil || *full.ProjectionExpression != "image_key" {
+		t.Errorf("full clean scan: filter %v, projection %q; want no filter and image_key", full.FilterExpression, *full.ProjectionExpression)
+	}
+
+	filtered := scanInput(testTable, cleanConfig{Prefix: "images/2023", OlderThan: time.Hour}, cutoff)
+	want := "NOT begins_with(image_key, :search) AND NOT begins_with(image_key, :labels) AND begins_with(image_key, :prefix) AND processed_at < :cutoff"
+	if got := *filtered.FilterExpression; got != want {
+		t.Errorf("filter = %q, want %q", got, want)
+	}
+	values := map[string]string{
+		":search": processor.SearchEntryPrefix,
+		":labels": processor.LabelCountPrefix,
+		":prefix": "images/2023",
+		":cutoff": "2024-03-01T11:00:00Z",
+	}
+	for name, want := range values {
+		if got, ok := filtered.ExpressionAttributeValues[name].(*dynamodbtypes.AttributeValueMemberS); !ok || got.Value != want {
+			t.Errorf("%s = %v, want %q", name, filtered.ExpressionAttributeValues[name], want)
+		}
+	}
+
+	// A label clean matches labels after the scan, so it only skips the
+	// search entries and label counts
+	labeled := scanInput(testTable, cleanConfig{Label: "Dog"}, time.Time{})
+	if got := *labeled.FilterExpression; got != "NOT begins_with(image_key, :search) AND NOT begins_with(image_key, :labels)" {
+		t.Errorf("label clean filter = %q", got)
+	}
+}
+
+func TestCleanS3Filters(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	bucket := awsfake.NewS3()
+	objects := map[string]time.Duration{
+		"images/2023/old.jpg":    90 * 24 * time.Hour,
+		"images/2023/recent.jpg": time.Hour,
+		"images/2024/old.jpg":    90 * 24 * time.Hour,
+	}
+	for key, age := range objects {
+		bucket.PutBytes(testBucket, key, []byte("jpeg"), nil)
+		bucket.Touch(testBucket, key, now.Add(-age))
+	}
+
+	summary, err := cleanS3(context.Background(), bucket, testBucket, "images/2023/", now.Add(-30*24*time.Hour), false)
+	if err != nil {
+		t.Fatalf("cleanS3: %v", err)
+	}
+	if summary.Count != 1 || summary.Samples[0] != "images/2023/old.jpg" {
+		t.Errorf("deleted %v, want only images/2023/old.jpg", summary.Samples)
+	}
+	if got := bucket.Keys(testBucket, ""); fmt.Sprint(got) != "[images/2023/recent.jpg images/2024/old.jpg]" {
+		t.Errorf("left %v, want the recent and out-of-prefix objects", got)
+	}
+}
+
+func TestAgeCleanCountsThumbnailsOnce(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	old, recent := now.Add(-90*24*time.Hour), now.Add(-time.Hour)
+	table := awsfake.NewDynamoDB()
+	bucket := awsfake.NewS3()
+
+	// images/a.jpg and its thumbnail are both old; images/c.jpg is old but its
+	// thumbnail was regenerated recently, so only step 3 finds it
+	objects := map[string]time.Time{
+		"images/a.jpg":     old,
+		"thumbnails/a.jpg": old,
+		"images/c.jpg":     old,
+		"thumbnails/c.jpg": recent,
+		"images/new.jpg":   recent,
+	}
+	for key, modified := range objects {
+		bucket.PutBytes(testBucket, key, []byte("jpeg"), nil)
+		bucket.Touch(testBucket, key, modified)
+	}
+	for key, processed := range map[string]time.Time{"images/a.jpg": old, "images/c.jpg": old, "images/new.jpg": recent} {
+		table.Put(map[string]dynamodbtypes.AttributeValue{
+			"image_key":     &dynamodbtypes.AttributeValueMemberS{Value: key},
+			"processed_at":  &dynamodbtypes.AttributeValueMemberS{Value: processed.Format(time.RFC3339)},
+			"thumbnail_key": &dynamodbtypes.AttributeValueMemberS{Value: "thumbnails/" + key[len("images/"):]},
+		})
+	}
+
+	cfg := cleanConfig{Bucket: testBucket, Table: testTable, OlderThan: 30 * 24 * time.Hour}
+	cutoff := cfg.cutoff(now)
+	s3Summary, err := cleanS3(ctx, bucket, testBucket, "", cutoff, false)
+	if err != nil {
+		t.Fatalf("cleanS3: %v", err)
+	}
+	dynamoSummary, derivedKeys, err := cleanDynamoDB(ctx, table, labelCounts(t, table), testTable, testBucket, cfg, cutoff)
+	if err != nil {
+		t.Fatalf("cleanDynamoDB: %v", err)
+	}
+	cleanDerived(ctx, bucket, testBucket, derivedKeys, false, &s3Summary)
+
+	if s3Summary.Count != 4 {
+		t.Errorf("S3 count = %d (%v), want 4", s3Summary.Count, s3Summary.Samples)
+	}
+	if dynamoSummary.Count != 2 {
+		t.Errorf("DynamoDB count = %d, want 2", dynamoSummary.Count)
+	}
+	if got := bucket.Keys(testBucket, ""); fmt.Sprint(got) != "[images/new.jpg]" {
+		t.Errorf("left %v, want only images/new.jpg", got)
+	}
+	if got := table.Keys(); fmt.Sprint(got) != "[images/new.jpg]" {
+		t.Errorf("items left %v, want images/new.jpg", got)
+	}
+}
+
+func TestCleanItemHasLabel(t *testing.T) {
+	item := cleanItem{DetectedLabels: []processor.LabelInfo{{Name: "Dog", Confidence: 85}, {Name: "Grass", Confidence: 60}}}
+	tests := []struct {
+		label         string
+		minConfidence float64
+		want          bool
+	}{
+		{"Dog", 0, true},
+		{"dog", 80, true},
+		{"Dog", 85, true},
+		{"Dog", 90, false},
+		{"Grass", 70, false},
+		{"Cat", 0, false},
+	}
+	for _, tt := range tests {
+		if got := item.hasLabel(tt.label, tt.minConfidence); got != tt.want {
+			t.Errorf("hasLabel(%q, %v) = %t, want %t", tt.label, tt.minConfidence, got, tt.want)
+		}
+	}
+}
+
+func TestLabelCleanLeavesOtherImages(t *testing.T) {
+	table := awsfake.NewDynamoDB()
+	images := map[string][]processor.LabelInfo{
+		"images/dog.jpg":       {{Name: "Dog", Confidence: 95}},
+		"images/puppy.jpg":     {{Name: "dog", Confidence: 90}},
+		"images/maybe-dog.jpg": {{Name: "Dog", Confidence: 60}},
+		"images/cat.jpg":       {{Name: "Cat", Confidence: 99}},
+	}
+	for key, labels := range images {
+		item, err := attributevalue.MarshalMap(cleanItem{ImageKey: key, ThumbnailKey: "thumbnails/" + key, DetectedLabels: labels})
+		if err != nil {
+			t.Fatalf("marshal %s: %v", key, err)
+		}
+		table.Put(item)
+	}
+
+	cfg := cleanConfig{Bucket: testBucket, Table: testTable, Label: "Dog", MinConfidence: 80}
+	summary, derivedKeys, err := cleanDynamoDB(context.Background(), table, labelCounts(t, table), testTable, testBucket, cfg, time.Time{})
+	if err != nil {
+		t.Fatalf("cleanDynamoDB: %v", err)
+	}
+
+	if summary.Count != 2 {
+		t.Errorf("deleted %d items (%v), want 2", summary.Count, summary.Samples)
+	}
+	if got := table.Keys(); fmt.Sprint(got) != "[images/cat.jpg images/maybe-dog.jpg]" {
+		t.Errorf("items left %v, want the cat and the low-confidence dog", got)
+	}
+
+	// Originals of matching images are queued with their thumbnails; nothing
+	// of the others is
+	queued := map[string]bool{}
+	for _, key := range derivedKeys[testBucket] {
+		queued[key] = true
+	}
+	for _, key := range []string{"images/dog.jpg", "images/puppy.jpg", "thumbnails/images/dog.jpg", "thumbnails/images/puppy.jpg"} {
+		if !queued[key] {
+			t.Errorf("%s not queued for deletion", key)
+		}
+	}
+	for _, key := range []string{"images/cat.jpg", "images/maybe-dog.jpg", "thumbnails/images/cat.jpg", "thumbnails/images/maybe-dog.jpg"} {
+		if queued[key] {
+			t.Errorf("%s queued for deletion", key)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"aws-lambda-image-processor/internal/processor"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// reprocessConfig is the parsed command line
+type reprocessConfig struct {
+	Key         string
+	Since       string
+	Concurrency int
+}
+
+// parseConfig reads the flags, normalizing -since to UTC
+func parseConfig(args []string) (reprocessConfig, error) {
+	var cfg reprocessConfig
+	fs := flag.NewFlagSet("reprocess", flag.ContinueOnError)
+	fs.StringVar(&cfg.Key, "key", "", "relabel only this image key")
+	fs.StringVar(&cfg.Since, "since", "", "only relabel images processed at or after this RFC3339 time")
+	fs.IntVar(&cfg.Concurrency, "concurrency", 4, "images relabeled in parallel")
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if cfg.Concurrency <= 0 {
+		return cfg, fmt.Errorf("-concurrency must be positive")
+	}
+	if cfg.Since != "" {
+		parsed, err := time.Parse(time.RFC3339, cfg.Since)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid -since %q: must be an RFC3339 time such as 2024-01-02T15:04:05Z", cfg.Since)
+		}
+		cfg.Since = parsed.UTC().Format(time.RFC3339)
+	}
+	return cfg, nil
+}
+
+// reprocess re-runs label detection on stored images without re-uploading them.
+// It reads the same environment as the processor Lambda (DYNAMODB_TABLE_NAME,
+// AWS_REGION, ...), so label settings match what new uploads get.
+func main() {
+	cfg, err := parseConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := context.Background()
+	handler, err := processor.NewHandler(ctx)
+	if err != nil {
+		log.Fatalf("failed to initialize handler: %v", err)
+	}
+
+	if _, err := reprocess(ctx, handler, cfg, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// reprocess relabels cfg.Key, or every image processed since cfg.Since, and
+// reports progress to out. It returns the keys that failed.
+func reprocess(ctx context.Context, handler *processor.Handler, cfg reprocessConfig, out io.Writer) ([]string, error) {
+	keys := []string{cfg.Key}
+	if cfg.Key == "" {
+		var err error
+		keys, err = handler.ImageKeys(ctx, cfg.Since)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list images: %w", err)
+		}
+	}
+	fmt.Fprintf(out, "Relabeling %d images...\n", len(keys))
+
+	var mu sync.Mutex
+	var failed []string
+	var g errgroup.Group
+	g.SetLimit(cfg.Concurrency)
+	for _, k := range keys {
+		g.Go(func() error {
+			if err := handler.Relabel(ctx, k); err != nil {
+				log.Printf("Failed to relabel %s: %v\n", k, err)
+				mu.Lock()
+				failed = append(failed, k)
+				mu.Unlock()
+			}
+			return nil
+		})
+	}
+	g.Wait()
+
+	fmt.Fprintf(out, "Relabeled %d images, %d failed\n", len(keys)-len(failed), len(failed))
+	for _, k := range failed {
+		fmt.Fprintf(out, "  %s\n", k)
+	}
+	return failed, nil
+}
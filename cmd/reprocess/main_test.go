@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"io"
+	"slices"
+	"testing"
+
+	"aws-lambda-image-processor/internal/awsfake"
+	"aws-lambda-image-processor/internal/processor"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition"
+	rekognitionTypes "github.com/aws/aws-sdk-go-v2/service/rekognition/types"
+)
+
+const testBucket = "test-bucket"
+
+type fakes struct {
+	s3          *awsfake.S3
+	rekognition *awsfake.Rekognition
+	dynamoDB    *awsfake.DynamoDB
+}
+
+func newTestHandler(t *testing.T) (*processor.Handler, *fakes) {
+	t.Helper()
+	f := &fakes{
+		s3:          awsfake.NewS3(),
+		rekognition: &awsfake.Rekognition{},
+		dynamoDB:    awsfake.NewDynamoDB(),
+	}
+	h, err := processor.New(processor.Clients{
+		S3Getter:    f.s3,
+		S3Putter:    f.s3,
+		Rekognition: f.rekognition,
+		DynamoDB:    f.dynamoDB,
+	})
+	if err != nil {
+		t.Fatalf("processor.New: %v", err)
+	}
+	return h, f
+}
+
+// putImage stores a processed image labeled Cat, with its original in S3
+func (f *fakes) putImage(t *testing.T, key, processedAt string) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 32, 32)), nil); err != nil {
+		t.Fatalf("encode JPEG: %v", err)
+	}
+	f.s3.PutBytes(testBucket, key, buf.Bytes(), nil)
+
+	item, err := attributevalue.MarshalMap(processor.ImageMetadata{
+		ImageKey:       key,
+		BucketName:     testBucket,
+		GalleryPK:      processor.GalleryPartition,
+		ProcessedAt:    processedAt,
+		DetectedLabels: []processor.LabelInfo{{Name: "Cat", Confidence: 80}},
+	})
+	if err != nil {
+		t.Fatalf("marshal %s: %v", key, err)
+	}
+	f.dynamoDB.Put(item)
+}
+
+func (f *fakes) labels(t *testing.T, key string) []string {
+	t.Helper()
+	var metadata processor.ImageMetadata
+	if err := attributevalue.UnmarshalMap(f.dynamoDB.Item(key), &metadata); err != nil {
+		t.Fatalf("unmarshal %s: %v", key, err)
+	}
+	var names []string
+	for _, label := range metadata.DetectedLabels {
+		names = append(names, label.Name)
+	}
+	return names
+}
+
+func dogLabels() rekognition.DetectLabelsOutput {
+	return rekognition.DetectLabelsOutput{Labels: []rekognitionTypes.Label{{
+		Name:       aws.String("Dog"),
+		Confidence: aws.Float32(97.5),
+	}}}
+}
+
+func TestReprocessOneKey(t *testing.T) {
+	h, f := newTestHandler(t)
+	f.rekognition.Labels = dogLabels()
+	f.putImage(t, "images/1700000000-a.jpg", "2024-01-01T00:00:00Z")
+	f.putImage(t, "images/1700000001-b.jpg", "2024-01-01T00:00:00Z")
+
+	cfg, err := parseConfig([]string{"-key", "images/1700000000-a.jpg"})
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	failed, err := reprocess(context.Background(), h, cfg, io.Discard)
+	if err != nil || len(failed) != 0 {
+		t.Fatalf("reprocess = %v, %v; want no failures", failed, err)
+	}
+
+	if got := f.labels(t, "images/1700000000-a.jpg"); !slices.Equal(got, []string{"Dog"}) {
+		t.Errorf("relabeled image has labels %v, want [Dog]", got)
+	}
+	if got := f.labels(t, "images/1700000001-b.jpg"); !slices.Equal(got, []string{"Cat"}) {
+		t.Errorf("other image has labels %v, want its old [Cat]", got)
+	}
+	if n := f.rekognition.Calls("DetectLabels"); n != 1 {
+		t.Errorf("DetectLabels called %d times, want 1", n)
+	}
+}
+
+func TestReprocessSince(t *testing.T) {
+	h, f := newTestHandler(t)
+	f.rekognition.Labels = dogLabels()
+	f.putImage(t, "images/old.jpg", "2023-06-01T00:00:00Z")
+	f.putImage(t, "images/new.jpg", "2024-02-01T00:00:00Z")
+
+	cfg, err := parseConfig([]string{"-since", "2024-01-01T01:00:00+01:00", "-concurrency", "2"})
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if cfg.Since != "2024-01-01T00:00:00Z" {
+		t.Errorf("since = %q, want it normalized to UTC", cfg.Since)
+	}
+	if failed, err := reprocess(context.Background(), h, cfg, io.Discard); err != nil || len(failed) != 0 {
+		t.Fatalf("reprocess = %v, %v; want no failures", failed, err)
+	}
+
+	if got := f.labels(t, "images/new.jpg"); !slices.Equal(got, []string{"Dog"}) {
+		t.Errorf("new image has labels %v, want [Dog]", got)
+	}
+	if got := f.labels(t, "images/old.jpg"); !slices.Equal(got, []string{"Cat"}) {
+		t.Errorf("image before -since has labels %v, want its old [Cat]", got)
+	}
+}
+
+func TestReprocessRejectsNonImageItems(t *testing.T) {
+	h, f := newTestHandler(t)
+	f.rekognition.Labels = dogLabels()
+	f.putImage(t, "images/a.jpg", "2024-01-01T00:00:00Z")
+	searchEntry := processor.SearchEntryKey("dog", "images/a.jpg")
+	// Even with an object under its key, the entry must not be relabeled
+	original, _ := f.s3.Object(testBucket, "images/a.jpg")
+	f.s3.PutBytes(testBucket, searchEntry, original.Body, nil)
+	f.dynamoDB.Put(map[string]types.AttributeValue{
+		"image_key":   &types.AttributeValueMemberS{Value: searchEntry},
+		"bucket_name": &types.AttributeValueMemberS{Value: testBucket},
+	})
+
+	failed, err := reprocess(context.Background(), h, reprocessConfig{Key: searchEntry, Concurrency: 1}, io.Discard)
+	if err != nil {
+		t.Fatalf("reprocess: %v", err)
+	}
+	if !slices.Equal(failed, []string{searchEntry}) {
+		t.Errorf("failed = %v, want the search entry", failed)
+	}
+	if n := f.rekognition.Calls("DetectLabels"); n != 0 {
+		t.Errorf("DetectLabels called %d times for a search entry", n)
+	}
+	if _, ok := f.dynamoDB.Item(searchEntry)["detected_labels"]; ok {
+		t.Error("search entry was given labels")
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	for _, args := range [][]string{
+		{"-concurrency", "0"},
+		{"-since", "yesterday"},
+		{"-unknown"},
+	} {
+		if _, err := parseConfig(args); err == nil {
+			t.Errorf("parseConfig(%q) succeeded, want an error", args)
+		}
+	}
+}
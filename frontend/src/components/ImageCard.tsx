@@ -16,6 +16,9 @@ export interface ProcessedImage {
     detected_labels: ImageLabel[];
     thumbnail_key?: string;
     url?: string;
+    original_filename?: string;
+    status?: 'processing' | 'complete' | 'failed';
+    failure_reason?: string;
 }
 
 interface ImageCardProps {
@@ -41,9 +44,10 @@ function formatDate(dateString: string): string {
 }
 
 export function ImageCard({ image }: ImageCardProps) {
-    // If backend provides URL, use it directly
-    const [imageUrl, setImageUrl] = useState<string | null>((image as any).url || null);
-    const [loading, setLoading] = useState(!(image as any).url);
+    // If backend provides URLs, use them directly, preferring the thumbnail for the grid
+    const initialUrl: string | null = (image as any).thumbnail_url || (image as any).url || null;
+    const [imageUrl, setImageUrl] = useState<string | null>(initialUrl);
+    const [loading, setLoading] = useState(!initialUrl);
     const [error, setError] = useState(false);
 
     useEffect(() => {
@@ -100,9 +104,19 @@ export function ImageCard({ image }: ImageCardProps) {
             <div className="p-4 space-y-3">
                 {/* File name */}
                 <h3 className="font-medium text-sm truncate" style={{ fontFamily: 'Poppins, sans-serif' }}>
-                    {image.image_key}
+                    {image.original_filename || image.image_key}
                 </h3>
 
+                {/* Processing status */}
+                {image.status === 'processing' && (
+                    <p className="text-xs text-[var(--color-text-muted)]">Processing...</p>
+                )}
+                {image.status === 'failed' && (
+                    <p className="text-xs text-red-500 truncate" title={image.failure_reason}>
+                        Processing failed{image.failure_reason ? `: ${image.failure_reason}` : ''}
+                    </p>
+                )}
+
                 {/* Metadata */}
                 <div className="flex items-center gap-4 text-xs text-[var(--color-text-muted)]">
                     <div className="flex items-center gap-1">
@@ -14,19 +14,20 @@ export function ImageGallery({ refreshTrigger = 0 }: ImageGalleryProps) {
     const [loading, setLoading] = useState(true);
     const [loadingMore, setLoadingMore] = useState(false);
     const [error, setError] = useState<string | null>(null);
-    const [page, setPage] = useState(1);
+    const [cursor, setCursor] = useState<string | null>(null);
     const [hasMore, setHasMore] = useState(true);
     const [totalCount, setTotalCount] = useState(0);
 
-    const fetchImages = async (pageNum: number = 1, isRefresh: boolean = false) => {
+    const fetchImages = async (pageCursor: string | null = null, isRefresh: boolean = false) => {
         try {
-            if (pageNum === 1) setLoading(true);
+            if (!pageCursor) setLoading(true);
             else setLoadingMore(true);
             setError(null);
 
             const API_BASE = process.env.NEXT_PUBLIC_API_URL || '/api';
-            // Add limit and page params, plus timestamp
-            const response = await fetch(`${API_BASE}/images?limit=10&page=${pageNum}&t=${Date.now()}`);
+            // Add limit and cursor params, plus timestamp
+            const cursorParam = pageCursor ? `&cursor=${encodeURIComponent(pageCursor)}` : '';
+            const response = await fetch(`${API_BASE}/images?limit=10${cursorParam}&t=${Date.now()}`);
             if (!response.ok) {
                 throw new Error('Failed to fetch images');
             }
@@ -36,7 +37,7 @@ export function ImageGallery({ refreshTrigger = 0 }: ImageGalleryProps) {
             // Handle pagination response properly
             const newItems = data.items || [];
 
-            if (pageNum === 1 || isRefresh) {
+            if (!pageCursor || isRefresh) {
                 setImages(newItems);
             } else {
                 setImages(prev => [...prev, ...newItems]);
@@ -44,7 +45,7 @@ export function ImageGallery({ refreshTrigger = 0 }: ImageGalleryProps) {
 
             setHasMore(data.has_more);
             setTotalCount(data.total_count || 0);
-            setPage(pageNum);
+            setCursor(data.next_cursor || null);
 
         } catch (err) {
             setError(err instanceof Error ? err.message : 'Failed to load images');
@@ -55,12 +56,12 @@ export function ImageGallery({ refreshTrigger = 0 }: ImageGalleryProps) {
     };
 
     useEffect(() => {
-        fetchImages(1, true);
+        fetchImages(null, true);
     }, [refreshTrigger]);
 
     const handleLoadMore = () => {
         if (!loadingMore && hasMore) {
-            fetchImages(page + 1);
+            fetchImages(cursor);
         }
     };
 
@@ -78,7 +79,7 @@ export function ImageGallery({ refreshTrigger = 0 }: ImageGalleryProps) {
             <div className="flex flex-col items-center justify-center py-16 text-red-500">
                 <p className="text-sm">{error}</p>
                 <button
-                    onClick={() => fetchImages(1, true)}
+                    onClick={() => fetchImages(null, true)}
                     className="mt-3 flex items-center gap-2 rounded-lg bg-[var(--color-primary)] px-4 py-2 text-sm text-white hover:bg-[var(--color-primary)]/90 transition-colors cursor-pointer"
                 >
                     <RefreshCw className="h-4 w-4" />
@@ -115,7 +116,7 @@ export function ImageGallery({ refreshTrigger = 0 }: ImageGalleryProps) {
                     </span>
                 </h2>
                 <button
-                    onClick={() => fetchImages(1, true)}
+                    onClick={() => fetchImages(null, true)}
                     disabled={loading || loadingMore}
                     className="flex items-center gap-2 rounded-lg border border-[var(--color-border)] px-3 py-1.5 text-sm hover:bg-[var(--color-border)] transition-colors cursor-pointer disabled:opacity-50"
                 >
@@ -39,7 +39,7 @@ export function UploadZone({ onUploadComplete }: UploadZoneProps) {
                 method: 'POST',
                 headers: { 'Content-Type': 'application/json' },
                 body: JSON.stringify({
-                    fileName: file.name,
+                    filename: file.name,
                     contentType: file.type,
                     size: file.size
                 }),
@@ -49,23 +49,41 @@ export function UploadZone({ onUploadComplete }: UploadZoneProps) {
                 throw new Error('Failed to get upload URL');
             }
 
-            const { uploadUrl, key } = await response.json();
+            const { method, uploadUrl, key, headers: uploadHeaders, fields } = await response.json();
 
             setStatusMessage('Uploading to S3...');
 
             // Upload directly to S3
-            const uploadResponse = await fetch(uploadUrl, {
-                method: 'PUT',
-                body: file,
-                headers: {
-                    'Content-Type': file.type,
-                },
-            });
+            let uploadResponse: Response;
+            if (method === 'POST') {
+                // Policy fields must precede the file, which S3 expects last
+                const form = new FormData();
+                Object.entries(fields ?? {}).forEach(([name, value]) => form.append(name, value as string));
+                form.append('file', file);
+                uploadResponse = await fetch(uploadUrl, { method: 'POST', body: form });
+            } else {
+                uploadResponse = await fetch(uploadUrl, {
+                    method: 'PUT',
+                    body: file,
+                    headers: {
+                        'Content-Type': file.type,
+                        // Signed into the URL (e.g. the original filename metadata)
+                        ...(uploadHeaders ?? {}),
+                    },
+                });
+            }
 
             if (!uploadResponse.ok) {
                 throw new Error('Failed to upload to S3');
             }
 
+            // Record a pending placeholder so the gallery shows the upload right away
+            await fetch(`${API_BASE}/upload-complete`, {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ key, filename: file.name }),
+            }).catch(() => undefined);
+
             setStatus('analyzing');
             setStatusMessage('AI is analyzing your image...');
 
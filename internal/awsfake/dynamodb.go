@@ -0,0 +1,470 @@
+// Package awsfake has in-memory stand-ins for the AWS clients the processor
+// and API call, so tests can run the real code paths without AWS. Each fake
+// implements only the operations and expression features the repo uses.
+package awsfake
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// tableKey is the table's only key attribute
+const tableKey = "image_key"
+
+// Index is a global secondary index: the items carrying its key attributes,
+// ordered by the sort key
+type Index struct {
+	PartitionKey string
+	SortKey      string
+}
+
+// TableIndexes mirror the GSIs of the metadata table in terraform/main.tf.
+// Projections aren't modeled; every index returns whole items.
+var TableIndexes = map[string]Index{
+	"gallery-index":      {PartitionKey: "gallery_pk", SortKey: "processed_at"},
+	"content_hash-index": {PartitionKey: "content_hash"},
+	"search-index":       {PartitionKey: "search_term", SortKey: "processed_at"},
+	"owner-index":        {PartitionKey: "owner", SortKey: "processed_at"},
+	"label-count-index":  {PartitionKey: "label_pk", SortKey: "image_count"},
+}
+
+// DynamoDB is a single table keyed by image_key, with TableIndexes
+type DynamoDB struct {
+	// BeforeCall, when set, runs before each operation with its name (e.g.
+	// "PutItem"); a non-nil error is returned in place of running it
+	BeforeCall func(operation string) error
+
+	mu    sync.Mutex
+	items map[string]map[string]types.AttributeValue
+	calls map[string]int
+}
+
+// NewDynamoDB returns an empty table
+func NewDynamoDB() *DynamoDB {
+	return &DynamoDB{
+		items: make(map[string]map[string]types.AttributeValue),
+		calls: make(map[string]int),
+	}
+}
+
+// Item returns a copy of the item stored under key, or nil
+func (d *DynamoDB) Item(key string) map[string]types.AttributeValue {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if item, ok := d.items[key]; ok {
+		return copyItem(item)
+	}
+	return nil
+}
+
+// Keys returns the key of every stored item, sorted
+func (d *DynamoDB) Keys() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	keys := make([]string, 0, len(d.items))
+	for key := range d.items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Put stores item as is, for seeding a test
+func (d *DynamoDB) Put(item map[string]types.AttributeValue) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.items[stringValue(item[tableKey])] = copyItem(item)
+}
+
+// Calls returns how many times operation was called, including failed calls
+func (d *DynamoDB) Calls(operation string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.calls[operation]
+}
+
+// begin counts the call, runs BeforeCall and takes the lock; the caller
+// must call d.mu.Unlock when err is nil
+func (d *DynamoDB) begin(operation string) error {
+	d.mu.Lock()
+	d.calls[operation]++
+	d.mu.Unlock()
+	if d.BeforeCall != nil {
+		if err := d.BeforeCall(operation); err != nil {
+			return err
+		}
+	}
+	d.mu.Lock()
+	return nil
+}
+
+func (d *DynamoDB) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	if err := d.begin("PutItem"); err != nil {
+		return nil, err
+	}
+	defer d.mu.Unlock()
+
+	key, err := itemKey(params.Item)
+	if err != nil {
+		return nil, err
+	}
+	existing := d.items[key]
+	if err := checkCondition(params.ConditionExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues, existing); err != nil {
+		return nil, err
+	}
+	d.items[key] = copyItem(params.Item)
+
+	out := &dynamodb.PutItemOutput{}
+	if params.ReturnValues == types.ReturnValueAllOld && existing != nil {
+		out.Attributes = copyItem(existing)
+	}
+	return out, nil
+}
+
+func (d *DynamoDB) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	if err := d.begin("GetItem"); err != nil {
+		return nil, err
+	}
+	defer d.mu.Unlock()
+
+	key, err := itemKey(params.Key)
+	if err != nil {
+		return nil, err
+	}
+	out := &dynamodb.GetItemOutput{}
+	if item, ok := d.items[key]; ok {
+		out.Item = project(item, params.ProjectionExpression, params.ExpressionAttributeNames)
+	}
+	return out, nil
+}
+
+func (d *DynamoDB) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	if err := d.begin("DeleteItem"); err != nil {
+		return nil, err
+	}
+	defer d.mu.Unlock()
+
+	key, err := itemKey(params.Key)
+	if err != nil {
+		return nil, err
+	}
+	existing := d.items[key]
+	if err := checkCondition(params.ConditionExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues, existing); err != nil {
+		return nil, err
+	}
+	delete(d.items, key)
+
+	out := &dynamodb.DeleteItemOutput{}
+	if params.ReturnValues == types.ReturnValueAllOld && existing != nil {
+		out.Attributes = copyItem(existing)
+	}
+	return out, nil
+}
+
+func (d *DynamoDB) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	if err := d.begin("UpdateItem"); err != nil {
+		return nil, err
+	}
+	defer d.mu.Unlock()
+
+	key, err := itemKey(params.Key)
+	if err != nil {
+		return nil, err
+	}
+	existing := d.items[key]
+	if err := checkCondition(params.ConditionExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues, existing); err != nil {
+		return nil, err
+	}
+
+	item := copyItem(existing)
+	if item == nil {
+		item = copyItem(params.Key)
+	}
+	updated, err := applyUpdate(aws.ToString(params.UpdateExpression), params.ExpressionAttributeNames, params.ExpressionAttributeValues, item)
+	if err != nil {
+		return nil, err
+	}
+	d.items[key] = item
+
+	out := &dynamodb.UpdateItemOutput{}
+	switch params.ReturnValues {
+	case types.ReturnValueAllOld:
+		out.Attributes = copyItem(existing)
+	case types.ReturnValueAllNew:
+		out.Attributes = copyItem(item)
+	case types.ReturnValueUpdatedNew:
+		out.Attributes = make(map[string]types.AttributeValue, len(updated))
+		for _, name := range updated {
+			if value, ok := item[name]; ok {
+				out.Attributes[name] = value
+			}
+		}
+	}
+	return out, nil
+}
+
+func (d *DynamoDB) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	if err := d.begin("Query"); err != nil {
+		return nil, err
+	}
+	defer d.mu.Unlock()
+
+	index := Index{PartitionKey: tableKey}
+	if name := aws.ToString(params.IndexName); name != "" {
+		var ok bool
+		if index, ok = TableIndexes[name]; !ok {
+			return nil, fmt.Errorf("awsfake: no index %q", name)
+		}
+	}
+
+	var matched []map[string]types.AttributeValue
+	for _, item := range d.items {
+		if _, ok := item[index.PartitionKey]; !ok {
+			continue
+		}
+		if _, ok := item[index.SortKey]; index.SortKey != "" && !ok {
+			continue
+		}
+		ok, err := evalCondition(aws.ToString(params.KeyConditionExpression), params.ExpressionAttributeNames, params.ExpressionAttributeValues, item)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, item)
+		}
+	}
+
+	forward := params.ScanIndexForward == nil || *params.ScanIndexForward
+	// less orders by the sort key, then image_key, in the query's direction;
+	// an item is never less than itself, so ExclusiveStartKey is skipped
+	less := func(a, b map[string]types.AttributeValue) bool {
+		c := 0
+		if index.SortKey != "" {
+			c, _ = compare(a[index.SortKey], b[index.SortKey])
+		}
+		if c == 0 {
+			c = strings.Compare(stringValue(a[tableKey]), stringValue(b[tableKey]))
+		}
+		if forward {
+			return c < 0
+		}
+		return c > 0
+	}
+	sort.Slice(matched, func(i, j int) bool { return less(matched[i], matched[j]) })
+
+	if start := params.ExclusiveStartKey; len(start) > 0 {
+		i := 0
+		for i < len(matched) && !less(start, matched[i]) {
+			i++
+		}
+		matched = matched[i:]
+	}
+
+	evaluated := matched
+	var lastKey map[string]types.AttributeValue
+	if limit := int(aws.ToInt32(params.Limit)); limit > 0 && len(matched) > limit {
+		evaluated = matched[:limit]
+		last := evaluated[limit-1]
+		lastKey = map[string]types.AttributeValue{tableKey: last[tableKey]}
+		for _, name := range []string{index.PartitionKey, index.SortKey} {
+			if name != "" {
+				lastKey[name] = last[name]
+			}
+		}
+	}
+
+	out := &dynamodb.QueryOutput{ScannedCount: int32(len(evaluated)), LastEvaluatedKey: lastKey}
+	for _, item := range evaluated {
+		if filter := aws.ToString(params.FilterExpression); filter != "" {
+			ok, err := evalCondition(filter, params.ExpressionAttributeNames, params.ExpressionAttributeValues, item)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		out.Items = append(out.Items, project(item, params.ProjectionExpression, params.ExpressionAttributeNames))
+	}
+	out.Count = int32(len(out.Items))
+	return out, nil
+}
+
+// Scan reads items in key order. Limit caps the items evaluated per page,
+// before the filter, as DynamoDB does.
+func (d *DynamoDB) Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	if err := d.begin("Scan"); err != nil {
+		return nil, err
+	}
+	defer d.mu.Unlock()
+
+	keys := make([]string, 0, len(d.items))
+	for key := range d.items {
+		if start := stringValue(params.ExclusiveStartKey[tableKey]); start == "" || key > start {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	out := &dynamodb.ScanOutput{}
+	if limit := int(aws.ToInt32(params.Limit)); limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+		out.LastEvaluatedKey = map[string]types.AttributeValue{tableKey: d.items[keys[limit-1]][tableKey]}
+	}
+	out.ScannedCount = int32(len(keys))
+	for _, key := range keys {
+		item := d.items[key]
+		if filter := aws.ToString(params.FilterExpression); filter != "" {
+			ok, err := evalCondition(filter, params.ExpressionAttributeNames, params.ExpressionAttributeValues, item)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		out.Items = append(out.Items, project(item, params.ProjectionExpression, params.ExpressionAttributeNames))
+	}
+	out.Count = int32(len(out.Items))
+	return out, nil
+}
+
+func (d *DynamoDB) BatchWriteItem(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+	if err := d.begin("BatchWriteItem"); err != nil {
+		return nil, err
+	}
+	defer d.mu.Unlock()
+
+	for _, requests := range params.RequestItems {
+		if len(requests) > 25 {
+			return nil, fmt.Errorf("awsfake: BatchWriteItem takes at most 25 requests, got %d", len(requests))
+		}
+		for _, request := range requests {
+			switch {
+			case request.PutRequest != nil:
+				key, err := itemKey(request.PutRequest.Item)
+				if err != nil {
+					return nil, err
+				}
+				d.items[key] = copyItem(request.PutRequest.Item)
+			case request.DeleteRequest != nil:
+				key, err := itemKey(request.DeleteRequest.Key)
+				if err != nil {
+					return nil, err
+				}
+				delete(d.items, key)
+			}
+		}
+	}
+	return &dynamodb.BatchWriteItemOutput{}, nil
+}
+
+func (d *DynamoDB) BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+	if err := d.begin("BatchGetItem"); err != nil {
+		return nil, err
+	}
+	defer d.mu.Unlock()
+
+	out := &dynamodb.BatchGetItemOutput{Responses: make(map[string][]map[string]types.AttributeValue)}
+	for table, keys := range params.RequestItems {
+		if len(keys.Keys) > 100 {
+			return nil, fmt.Errorf("awsfake: BatchGetItem takes at most 100 keys, got %d", len(keys.Keys))
+		}
+		for _, k := range keys.Keys {
+			key, err := itemKey(k)
+			if err != nil {
+				return nil, err
+			}
+			if item, ok := d.items[key]; ok {
+				out.Responses[table] = append(out.Responses[table], project(item, keys.ProjectionExpression, keys.ExpressionAttributeNames))
+			}
+		}
+	}
+	return out, nil
+}
+
+func (d *DynamoDB) DescribeTable(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+	if err := d.begin("DescribeTable"); err != nil {
+		return nil, err
+	}
+	defer d.mu.Unlock()
+
+	return &dynamodb.DescribeTableOutput{
+		Table: &types.TableDescription{
+			TableName: params.TableName,
+			ItemCount: aws.Int64(int64(len(d.items))),
+		},
+	}, nil
+}
+
+// checkCondition evaluates an optional condition expression against the
+// existing item, failing the way DynamoDB does
+func checkCondition(expression *string, names map[string]string, values map[string]types.AttributeValue, existing map[string]types.AttributeValue) error {
+	if aws.ToString(expression) == "" {
+		return nil
+	}
+	if existing == nil {
+		existing = map[string]types.AttributeValue{}
+	}
+	ok, err := evalCondition(*expression, names, values, existing)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &types.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")}
+	}
+	return nil
+}
+
+// project keeps only the attributes named in a projection expression
+func project(item map[string]types.AttributeValue, expression *string, names map[string]string) map[string]types.AttributeValue {
+	if aws.ToString(expression) == "" {
+		return copyItem(item)
+	}
+	out := make(map[string]types.AttributeValue)
+	for _, path := range strings.Split(*expression, ",") {
+		path = strings.TrimSpace(path)
+		if name, ok := names[path]; ok {
+			path = name
+		}
+		if value, ok := item[path]; ok {
+			out[path] = value
+		}
+	}
+	return out
+}
+
+func itemKey(item map[string]types.AttributeValue) (string, error) {
+	key, ok := item[tableKey].(*types.AttributeValueMemberS)
+	if !ok || key.Value == "" {
+		return "", fmt.Errorf("awsfake: item has no string %s", tableKey)
+	}
+	return key.Value, nil
+}
+
+func stringValue(v types.AttributeValue) string {
+	if s, ok := v.(*types.AttributeValueMemberS); ok {
+		return s.Value
+	}
+	return ""
+}
+
+// copyItem copies the item map; attribute values are never modified in
+// place, so they can be shared
+func copyItem(item map[string]types.AttributeValue) map[string]types.AttributeValue {
+	if item == nil {
+		return nil
+	}
+	out := make(map[string]types.AttributeValue, len(item))
+	for k, v := range item {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,21 @@
+package awsfake
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+)
+
+// EventBridge records every put event
+type EventBridge struct {
+	mu   sync.Mutex
+	Puts []eventbridge.PutEventsInput
+}
+
+func (e *EventBridge) PutEvents(ctx context.Context, params *eventbridge.PutEventsInput, optFns ...func(*eventbridge.Options)) (*eventbridge.PutEventsOutput, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.Puts = append(e.Puts, *params)
+	return &eventbridge.PutEventsOutput{}, nil
+}
@@ -0,0 +1,640 @@
+package awsfake
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// The expression support covers what the repo writes: top-level attribute
+// paths only, condition and key expressions built from comparisons,
+// BETWEEN, AND/OR/NOT and the attribute_exists, attribute_not_exists,
+// begins_with and contains functions, and update expressions with SET
+// (including if_not_exists, list_append and +/-), ADD, REMOVE and DELETE.
+
+// tokenize splits an expression into names, placeholders, operators and
+// punctuation
+func tokenize(expression string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expression); {
+		c := expression[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')' || c == ',' || c == '=' || c == '+' || c == '-':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '<' || c == '>':
+			if i+1 < len(expression) && (expression[i+1] == '=' || c == '<' && expression[i+1] == '>') {
+				tokens = append(tokens, expression[i:i+2])
+				i += 2
+			} else {
+				tokens = append(tokens, string(c))
+				i++
+			}
+		case c == '#' || c == ':' || c == '_' || isAlnum(c):
+			j := i + 1
+			for j < len(expression) && (expression[j] == '_' || isAlnum(expression[j])) {
+				j++
+			}
+			tokens = append(tokens, expression[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("awsfake: unsupported character %q in expression %q", c, expression)
+		}
+	}
+	return tokens, nil
+}
+
+func isAlnum(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// parser walks the tokens of one expression against an item
+type parser struct {
+	tokens []string
+	pos    int
+	names  map[string]string
+	values map[string]types.AttributeValue
+}
+
+func newParser(expression string, names map[string]string, values map[string]types.AttributeValue) (*parser, error) {
+	tokens, err := tokenize(expression)
+	if err != nil {
+		return nil, err
+	}
+	return &parser{tokens: tokens, names: names, values: values}, nil
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *parser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *parser) keyword(word string) bool {
+	if strings.EqualFold(p.peek(), word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(token string) error {
+	if t := p.next(); t != token {
+		return fmt.Errorf("awsfake: expected %q, got %q", token, t)
+	}
+	return nil
+}
+
+// path resolves an attribute name token, through the placeholder names
+func (p *parser) path() (string, error) {
+	t := p.next()
+	switch {
+	case strings.HasPrefix(t, "#"):
+		name, ok := p.names[t]
+		if !ok {
+			return "", fmt.Errorf("awsfake: undefined attribute name %s", t)
+		}
+		return name, nil
+	case t == "" || strings.HasPrefix(t, ":") || !isAlnum(t[0]) && t[0] != '_':
+		return "", fmt.Errorf("awsfake: expected an attribute name, got %q", t)
+	}
+	return t, nil
+}
+
+// operand is a placeholder value or an attribute of item; ok is false for a
+// missing attribute
+func (p *parser) operand(item map[string]types.AttributeValue) (types.AttributeValue, bool, error) {
+	if t := p.peek(); strings.HasPrefix(t, ":") {
+		p.pos++
+		value, ok := p.values[t]
+		if !ok {
+			return nil, false, fmt.Errorf("awsfake: undefined attribute value %s", t)
+		}
+		return value, true, nil
+	}
+	name, err := p.path()
+	if err != nil {
+		return nil, false, err
+	}
+	value, ok := item[name]
+	return value, ok, nil
+}
+
+// evalCondition evaluates a condition, key condition or filter expression
+func evalCondition(expression string, names map[string]string, values map[string]types.AttributeValue, item map[string]types.AttributeValue) (bool, error) {
+	p, err := newParser(expression, names, values)
+	if err != nil {
+		return false, err
+	}
+	result, err := p.or(item)
+	if err != nil {
+		return false, err
+	}
+	if p.pos != len(p.tokens) {
+		return false, fmt.Errorf("awsfake: unexpected %q in %q", p.peek(), expression)
+	}
+	return result, nil
+}
+
+func (p *parser) or(item map[string]types.AttributeValue) (bool, error) {
+	result, err := p.and(item)
+	if err != nil {
+		return false, err
+	}
+	for p.keyword("OR") {
+		right, err := p.and(item)
+		if err != nil {
+			return false, err
+		}
+		result = result || right
+	}
+	return result, nil
+}
+
+func (p *parser) and(item map[string]types.AttributeValue) (bool, error) {
+	result, err := p.not(item)
+	if err != nil {
+		return false, err
+	}
+	for p.keyword("AND") {
+		right, err := p.not(item)
+		if err != nil {
+			return false, err
+		}
+		result = result && right
+	}
+	return result, nil
+}
+
+func (p *parser) not(item map[string]types.AttributeValue) (bool, error) {
+	if p.keyword("NOT") {
+		result, err := p.not(item)
+		return !result, err
+	}
+	return p.primary(item)
+}
+
+func (p *parser) primary(item map[string]types.AttributeValue) (bool, error) {
+	if p.peek() == "(" {
+		p.pos++
+		result, err := p.or(item)
+		if err != nil {
+			return false, err
+		}
+		return result, p.expect(")")
+	}
+
+	switch fn := strings.ToLower(p.peek()); fn {
+	case "attribute_exists", "attribute_not_exists":
+		p.pos++
+		if err := p.expect("("); err != nil {
+			return false, err
+		}
+		name, err := p.path()
+		if err != nil {
+			return false, err
+		}
+		_, exists := item[name]
+		return exists == (fn == "attribute_exists"), p.expect(")")
+	case "begins_with", "contains":
+		p.pos++
+		if err := p.expect("("); err != nil {
+			return false, err
+		}
+		subject, ok, err := p.operand(item)
+		if err != nil {
+			return false, err
+		}
+		if err := p.expect(","); err != nil {
+			return false, err
+		}
+		other, _, err := p.operand(item)
+		if err != nil {
+			return false, err
+		}
+		if err := p.expect(")"); err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, nil
+		}
+		if fn == "begins_with" {
+			s, isString := subject.(*types.AttributeValueMemberS)
+			prefix, prefixString := other.(*types.AttributeValueMemberS)
+			return isString && prefixString && strings.HasPrefix(s.Value, prefix.Value), nil
+		}
+		return contains(subject, other), nil
+	}
+
+	left, leftOK, err := p.operand(item)
+	if err != nil {
+		return false, err
+	}
+	if p.keyword("BETWEEN") {
+		low, _, err := p.operand(item)
+		if err != nil {
+			return false, err
+		}
+		if !p.keyword("AND") {
+			return false, fmt.Errorf("awsfake: BETWEEN without AND")
+		}
+		high, _, err := p.operand(item)
+		if err != nil {
+			return false, err
+		}
+		if !leftOK {
+			return false, nil
+		}
+		c1, ok1 := compare(low, left)
+		c2, ok2 := compare(left, high)
+		return ok1 && ok2 && c1 <= 0 && c2 <= 0, nil
+	}
+
+	op := p.next()
+	right, rightOK, err := p.operand(item)
+	if err != nil {
+		return false, err
+	}
+	if !leftOK || !rightOK {
+		return false, nil
+	}
+	switch op {
+	case "=":
+		return equal(left, right), nil
+	case "<>":
+		return !equal(left, right), nil
+	case "<", "<=", ">", ">=":
+		c, ok := compare(left, right)
+		if !ok {
+			return false, nil
+		}
+		switch op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		default:
+			return c >= 0, nil
+		}
+	}
+	return false, fmt.Errorf("awsfake: unsupported comparator %q", op)
+}
+
+// applyUpdate runs an update expression against item in place, returning the
+// names of the attributes it set, added to or removed
+func applyUpdate(expression string, names map[string]string, values map[string]types.AttributeValue, item map[string]types.AttributeValue) ([]string, error) {
+	p, err := newParser(expression, names, values)
+	if err != nil {
+		return nil, err
+	}
+
+	var updated []string
+	for p.pos < len(p.tokens) {
+		clause := strings.ToUpper(p.next())
+		for {
+			name, err := p.path()
+			if err != nil {
+				return nil, err
+			}
+			updated = append(updated, name)
+
+			switch clause {
+			case "SET":
+				if err := p.expect("="); err != nil {
+					return nil, err
+				}
+				value, err := p.setValue(item)
+				if err != nil {
+					return nil, err
+				}
+				item[name] = value
+			case "REMOVE":
+				delete(item, name)
+			case "ADD", "DELETE":
+				value, _, err := p.operand(item)
+				if err != nil {
+					return nil, err
+				}
+				current, exists := item[name]
+				if clause == "ADD" {
+					result, err := add(current, exists, value)
+					if err != nil {
+						return nil, fmt.Errorf("awsfake: ADD %s: %w", name, err)
+					}
+					item[name] = result
+				} else if exists {
+					if result, ok := removeFromSet(current, value); ok {
+						item[name] = result
+					} else {
+						delete(item, name)
+					}
+				}
+			default:
+				return nil, fmt.Errorf("awsfake: unsupported update clause %q", clause)
+			}
+
+			if p.peek() != "," {
+				break
+			}
+			p.pos++
+		}
+	}
+	return updated, nil
+}
+
+// setValue is the right-hand side of a SET action
+func (p *parser) setValue(item map[string]types.AttributeValue) (types.AttributeValue, error) {
+	value, err := p.setOperand(item)
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "+" || p.peek() == "-" {
+		sign := p.next()
+		other, err := p.setOperand(item)
+		if err != nil {
+			return nil, err
+		}
+		a, aok := number(value)
+		b, bok := number(other)
+		if !aok || !bok {
+			return nil, fmt.Errorf("awsfake: %s on a non-number", sign)
+		}
+		if sign == "-" {
+			b = -b
+		}
+		value = formatNumber(a + b)
+	}
+	return value, nil
+}
+
+func (p *parser) setOperand(item map[string]types.AttributeValue) (types.AttributeValue, error) {
+	switch fn := strings.ToLower(p.peek()); fn {
+	case "if_not_exists":
+		p.pos++
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		name, err := p.path()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		def, err := p.setOperand(item)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		if existing, ok := item[name]; ok {
+			return existing, nil
+		}
+		return def, nil
+	case "list_append":
+		p.pos++
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		first, err := p.setOperand(item)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		second, err := p.setOperand(item)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		a, aok := first.(*types.AttributeValueMemberL)
+		b, bok := second.(*types.AttributeValueMemberL)
+		if !aok || !bok {
+			return nil, fmt.Errorf("awsfake: list_append on a non-list")
+		}
+		return &types.AttributeValueMemberL{Value: append(append([]types.AttributeValue{}, a.Value...), b.Value...)}, nil
+	}
+
+	value, ok, err := p.operand(item)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("awsfake: SET from a missing attribute")
+	}
+	return value, nil
+}
+
+// add is the ADD action: numbers are summed, sets are unioned
+func add(current types.AttributeValue, exists bool, value types.AttributeValue) (types.AttributeValue, error) {
+	switch v := value.(type) {
+	case *types.AttributeValueMemberN:
+		delta, _ := number(v)
+		if !exists {
+			return formatNumber(delta), nil
+		}
+		n, ok := number(current)
+		if !ok {
+			return nil, fmt.Errorf("existing attribute is not a number")
+		}
+		return formatNumber(n + delta), nil
+	case *types.AttributeValueMemberSS:
+		var existing []string
+		if exists {
+			ss, ok := current.(*types.AttributeValueMemberSS)
+			if !ok {
+				return nil, fmt.Errorf("existing attribute is not a string set")
+			}
+			existing = ss.Value
+		}
+		return &types.AttributeValueMemberSS{Value: union(existing, v.Value)}, nil
+	case *types.AttributeValueMemberNS:
+		var existing []string
+		if exists {
+			ns, ok := current.(*types.AttributeValueMemberNS)
+			if !ok {
+				return nil, fmt.Errorf("existing attribute is not a number set")
+			}
+			existing = ns.Value
+		}
+		return &types.AttributeValueMemberNS{Value: union(existing, v.Value)}, nil
+	}
+	return nil, fmt.Errorf("only numbers and sets can be added")
+}
+
+// removeFromSet is the DELETE action; ok is false once the set is empty
+func removeFromSet(current, value types.AttributeValue) (types.AttributeValue, bool) {
+	minus := func(from, remove []string) []string {
+		drop := make(map[string]bool, len(remove))
+		for _, s := range remove {
+			drop[s] = true
+		}
+		var kept []string
+		for _, s := range from {
+			if !drop[s] {
+				kept = append(kept, s)
+			}
+		}
+		return kept
+	}
+	switch c := current.(type) {
+	case *types.AttributeValueMemberSS:
+		if v, ok := value.(*types.AttributeValueMemberSS); ok {
+			kept := minus(c.Value, v.Value)
+			return &types.AttributeValueMemberSS{Value: kept}, len(kept) > 0
+		}
+	case *types.AttributeValueMemberNS:
+		if v, ok := value.(*types.AttributeValueMemberNS); ok {
+			kept := minus(c.Value, v.Value)
+			return &types.AttributeValueMemberNS{Value: kept}, len(kept) > 0
+		}
+	}
+	return current, true
+}
+
+func union(a, b []string) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	var out []string
+	for _, s := range append(append([]string{}, a...), b...) {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func number(v types.AttributeValue) (float64, bool) {
+	n, ok := v.(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(n.Value, 64)
+	return f, err == nil
+}
+
+func formatNumber(f float64) *types.AttributeValueMemberN {
+	return &types.AttributeValueMemberN{Value: strconv.FormatFloat(f, 'f', -1, 64)}
+}
+
+// compare orders two strings, numbers or binaries; ok is false for any other
+// pairing
+func compare(a, b types.AttributeValue) (int, bool) {
+	switch x := a.(type) {
+	case *types.AttributeValueMemberS:
+		if y, ok := b.(*types.AttributeValueMemberS); ok {
+			return strings.Compare(x.Value, y.Value), true
+		}
+	case *types.AttributeValueMemberN:
+		fx, _ := number(x)
+		if fy, ok := number(b); ok {
+			switch {
+			case fx < fy:
+				return -1, true
+			case fx > fy:
+				return 1, true
+			}
+			return 0, true
+		}
+	case *types.AttributeValueMemberB:
+		if y, ok := b.(*types.AttributeValueMemberB); ok {
+			return bytes.Compare(x.Value, y.Value), true
+		}
+	}
+	return 0, false
+}
+
+// equal reports whether two attribute values are the same, sets compared
+// regardless of order
+func equal(a, b types.AttributeValue) bool {
+	if c, ok := compare(a, b); ok {
+		return c == 0
+	}
+	sameSet := func(x, y []string) bool {
+		x, y = append([]string{}, x...), append([]string{}, y...)
+		sort.Strings(x)
+		sort.Strings(y)
+		return strings.Join(x, "\x00") == strings.Join(y, "\x00")
+	}
+	switch x := a.(type) {
+	case *types.AttributeValueMemberBOOL:
+		y, ok := b.(*types.AttributeValueMemberBOOL)
+		return ok && x.Value == y.Value
+	case *types.AttributeValueMemberNULL:
+		_, ok := b.(*types.AttributeValueMemberNULL)
+		return ok
+	case *types.AttributeValueMemberSS:
+		y, ok := b.(*types.AttributeValueMemberSS)
+		return ok && sameSet(x.Value, y.Value)
+	case *types.AttributeValueMemberNS:
+		y, ok := b.(*types.AttributeValueMemberNS)
+		return ok && sameSet(x.Value, y.Value)
+	case *types.AttributeValueMemberL:
+		y, ok := b.(*types.AttributeValueMemberL)
+		if !ok || len(x.Value) != len(y.Value) {
+			return false
+		}
+		for i := range x.Value {
+			if !equal(x.Value[i], y.Value[i]) {
+				return false
+			}
+		}
+		return true
+	case *types.AttributeValueMemberM:
+		y, ok := b.(*types.AttributeValueMemberM)
+		if !ok || len(x.Value) != len(y.Value) {
+			return false
+		}
+		for k, v := range x.Value {
+			if w, ok := y.Value[k]; !ok || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// contains is the contains function: a substring of a string, or a member of
+// a set or list
+func contains(subject, value types.AttributeValue) bool {
+	switch s := subject.(type) {
+	case *types.AttributeValueMemberS:
+		v, ok := value.(*types.AttributeValueMemberS)
+		return ok && strings.Contains(s.Value, v.Value)
+	case *types.AttributeValueMemberSS:
+		if v, ok := value.(*types.AttributeValueMemberS); ok {
+			for _, member := range s.Value {
+				if member == v.Value {
+					return true
+				}
+			}
+		}
+	case *types.AttributeValueMemberL:
+		for _, member := range s.Value {
+			if equal(member, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package awsfake
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/rekognition"
+)
+
+// Rekognition answers every call with the canned output set for it, or an
+// empty one
+type Rekognition struct {
+	// BeforeCall, when set, runs before each operation with its name (e.g.
+	// "DetectLabels"); a non-nil error is returned in place of the output
+	BeforeCall func(operation string) error
+
+	Labels         rekognition.DetectLabelsOutput
+	Faces          rekognition.DetectFacesOutput
+	Text           rekognition.DetectTextOutput
+	Moderation     rekognition.DetectModerationLabelsOutput
+	CustomLabels   rekognition.DetectCustomLabelsOutput
+	ProtectiveGear rekognition.DetectProtectiveEquipmentOutput
+
+	mu    sync.Mutex
+	calls map[string]int
+	// LabelsInputs records every DetectLabels request
+	LabelsInputs []rekognition.DetectLabelsInput
+}
+
+// Calls returns how many times operation was called, including failed calls
+func (r *Rekognition) Calls(operation string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.calls[operation]
+}
+
+func (r *Rekognition) begin(operation string) error {
+	r.mu.Lock()
+	if r.calls == nil {
+		r.calls = make(map[string]int)
+	}
+	r.calls[operation]++
+	r.mu.Unlock()
+	if r.BeforeCall != nil {
+		return r.BeforeCall(operation)
+	}
+	return nil
+}
+
+func (r *Rekognition) DetectLabels(ctx context.Context, params *rekognition.DetectLabelsInput, optFns ...func(*rekognition.Options)) (*rekognition.DetectLabelsOutput, error) {
+	r.mu.Lock()
+	r.LabelsInputs = append(r.LabelsInputs, *params)
+	r.mu.Unlock()
+	if err := r.begin("DetectLabels"); err != nil {
+		return nil, err
+	}
+	out := r.Labels
+	return &out, nil
+}
+
+func (r *Rekognition) DetectFaces(ctx context.Context, params *rekognition.DetectFacesInput, optFns ...func(*rekognition.Options)) (*rekognition.DetectFacesOutput, error) {
+	if err := r.begin("DetectFaces"); err != nil {
+		return nil, err
+	}
+	out := r.Faces
+	return &out, nil
+}
+
+func (r *Rekognition) DetectText(ctx context.Context, params *rekognition.DetectTextInput, optFns ...func(*rekognition.Options)) (*rekognition.DetectTextOutput, error) {
+	if err := r.begin("DetectText"); err != nil {
+		return nil, err
+	}
+	out := r.Text
+	return &out, nil
+}
+
+func (r *Rekognition) DetectModerationLabels(ctx context.Context, params *rekognition.DetectModerationLabelsInput, optFns ...func(*rekognition.Options)) (*rekognition.DetectModerationLabelsOutput, error) {
+	if err := r.begin("DetectModerationLabels"); err != nil {
+		return nil, err
+	}
+	out := r.Moderation
+	return &out, nil
+}
+
+func (r *Rekognition) DetectCustomLabels(ctx context.Context, params *rekognition.DetectCustomLabelsInput, optFns ...func(*rekognition.Options)) (*rekognition.DetectCustomLabelsOutput, error) {
+	if err := r.begin("DetectCustomLabels"); err != nil {
+		return nil, err
+	}
+	out := r.CustomLabels
+	return &out, nil
+}
+
+func (r *Rekognition) DetectProtectiveEquipment(ctx context.Context, params *rekognition.DetectProtectiveEquipmentInput, optFns ...func(*rekognition.Options)) (*rekognition.DetectProtectiveEquipmentOutput, error) {
+	if err := r.begin("DetectProtectiveEquipment"); err != nil {
+		return nil, err
+	}
+	out := r.ProtectiveGear
+	return &out, nil
+}
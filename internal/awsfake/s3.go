@@ -0,0 +1,265 @@
+package awsfake
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Object is one stored S3 object. LastModified is the zero time unless a test
+// sets it with Touch.
+type Object struct {
+	Body         []byte
+	ContentType  string
+	Metadata     map[string]string
+	Tags         map[string]string
+	LastModified time.Time
+}
+
+// S3 is a set of in-memory buckets
+type S3 struct {
+	// BeforeCall, when set, runs before each operation with its name (e.g.
+	// "GetObject"); a non-nil error is returned in place of running it
+	BeforeCall func(operation string) error
+
+	mu      sync.Mutex
+	objects map[string]Object
+}
+
+// NewS3 returns an S3 with no objects
+func NewS3() *S3 {
+	return &S3{objects: make(map[string]Object)}
+}
+
+func objectPath(bucket, key string) string {
+	return bucket + "/" + key
+}
+
+// PutBytes stores an object, for seeding a test
+func (f *S3) PutBytes(bucket, key string, body []byte, metadata map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[objectPath(bucket, key)] = Object{Body: body, Metadata: metadata}
+}
+
+// Object returns the object stored under bucket and key
+func (f *S3) Object(bucket, key string) (Object, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	object, ok := f.objects[objectPath(bucket, key)]
+	return object, ok
+}
+
+// Touch sets the LastModified time of a stored object, for seeding a test
+func (f *S3) Touch(bucket, key string, lastModified time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := objectPath(bucket, key)
+	if object, ok := f.objects[path]; ok {
+		object.LastModified = lastModified
+		f.objects[path] = object
+	}
+}
+
+// Keys returns the keys stored in bucket under prefix, sorted
+func (f *S3) Keys(bucket, prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for path := range f.objects {
+		if key, ok := strings.CutPrefix(path, bucket+"/"); ok && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *S3) before(operation string) error {
+	if f.BeforeCall != nil {
+		return f.BeforeCall(operation)
+	}
+	return nil
+}
+
+func (f *S3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	if err := f.before("GetObject"); err != nil {
+		return nil, err
+	}
+	object, ok := f.Object(aws.ToString(params.Bucket), aws.ToString(params.Key))
+	if !ok {
+		return nil, &types.NoSuchKey{Message: aws.String("The specified key does not exist.")}
+	}
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(object.Body)),
+		ContentLength: aws.Int64(int64(len(object.Body))),
+		ContentType:   aws.String(object.ContentType),
+		Metadata:      object.Metadata,
+	}, nil
+}
+
+func (f *S3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	if err := f.before("HeadObject"); err != nil {
+		return nil, err
+	}
+	object, ok := f.Object(aws.ToString(params.Bucket), aws.ToString(params.Key))
+	if !ok {
+		return nil, &types.NotFound{Message: aws.String("Not Found")}
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(object.Body))),
+		ContentType:   aws.String(object.ContentType),
+		Metadata:      object.Metadata,
+	}, nil
+}
+
+func (f *S3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if err := f.before("PutObject"); err != nil {
+		return nil, err
+	}
+	var body []byte
+	if params.Body != nil {
+		var err error
+		if body, err = io.ReadAll(params.Body); err != nil {
+			return nil, err
+		}
+	}
+	tags, err := url.ParseQuery(aws.ToString(params.Tagging))
+	if err != nil {
+		return nil, fmt.Errorf("awsfake: invalid Tagging: %w", err)
+	}
+	object := Object{
+		Body:        body,
+		ContentType: aws.ToString(params.ContentType),
+		Metadata:    params.Metadata,
+	}
+	for k := range tags {
+		if object.Tags == nil {
+			object.Tags = make(map[string]string)
+		}
+		object.Tags[k] = tags.Get(k)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[objectPath(aws.ToString(params.Bucket), aws.ToString(params.Key))] = object
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *S3) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	if err := f.before("CopyObject"); err != nil {
+		return nil, err
+	}
+	source, err := url.PathUnescape(aws.ToString(params.CopySource))
+	if err != nil {
+		return nil, fmt.Errorf("awsfake: invalid CopySource: %w", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	object, ok := f.objects[strings.TrimPrefix(source, "/")]
+	if !ok {
+		return nil, &types.NoSuchKey{Message: aws.String("The specified key does not exist.")}
+	}
+	if params.MetadataDirective == types.MetadataDirectiveReplace {
+		object.Metadata = params.Metadata
+	}
+	f.objects[objectPath(aws.ToString(params.Bucket), aws.ToString(params.Key))] = object
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (f *S3) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	if err := f.before("DeleteObject"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.objects, objectPath(aws.ToString(params.Bucket), aws.ToString(params.Key)))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (f *S3) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	if err := f.before("DeleteObjects"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &s3.DeleteObjectsOutput{}
+	if params.Delete != nil {
+		for _, object := range params.Delete.Objects {
+			delete(f.objects, objectPath(aws.ToString(params.Bucket), aws.ToString(object.Key)))
+			out.Deleted = append(out.Deleted, types.DeletedObject{Key: object.Key})
+		}
+	}
+	return out, nil
+}
+
+// ListObjectsV2 lists keys in order under Prefix, MaxKeys (default 1000) at a
+// time. The continuation token is the last key of the previous page.
+func (f *S3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	if err := f.before("ListObjectsV2"); err != nil {
+		return nil, err
+	}
+	bucket := aws.ToString(params.Bucket)
+	after := aws.ToString(params.ContinuationToken)
+	var keys []string
+	for _, key := range f.Keys(bucket, aws.ToString(params.Prefix)) {
+		if key > after {
+			keys = append(keys, key)
+		}
+	}
+
+	out := &s3.ListObjectsV2Output{}
+	maxKeys := int(aws.ToInt32(params.MaxKeys))
+	if maxKeys <= 0 {
+		maxKeys = 1000
+	}
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+		out.IsTruncated = aws.Bool(true)
+		out.NextContinuationToken = aws.String(keys[maxKeys-1])
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, key := range keys {
+		object := f.objects[objectPath(bucket, key)]
+		out.Contents = append(out.Contents, types.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(int64(len(object.Body))),
+			LastModified: aws.Time(object.LastModified),
+		})
+	}
+	out.KeyCount = aws.Int32(int32(len(out.Contents)))
+	return out, nil
+}
+
+func (f *S3) PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	if err := f.before("PutObjectTagging"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := objectPath(aws.ToString(params.Bucket), aws.ToString(params.Key))
+	object, ok := f.objects[path]
+	if !ok {
+		return nil, &types.NoSuchKey{Message: aws.String("The specified key does not exist.")}
+	}
+	object.Tags = make(map[string]string)
+	if params.Tagging != nil {
+		for _, tag := range params.Tagging.TagSet {
+			object.Tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+	}
+	f.objects[path] = object
+	return &s3.PutObjectTaggingOutput{}, nil
+}
@@ -0,0 +1,30 @@
+package awsfake
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+)
+
+// SNS records every published message
+type SNS struct {
+	// BeforeCall, when set, runs before each operation with its name (e.g.
+	// "Publish"); a non-nil error is returned in place of running it
+	BeforeCall func(operation string) error
+
+	mu        sync.Mutex
+	Published []sns.PublishInput
+}
+
+func (s *SNS) Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error) {
+	if s.BeforeCall != nil {
+		if err := s.BeforeCall("Publish"); err != nil {
+			return nil, err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Published = append(s.Published, *params)
+	return &sns.PublishOutput{}, nil
+}
@@ -0,0 +1,145 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+// errRekognitionBreakerOpen fails a record that needed a Rekognition call the
+// open circuit breaker refused
+var errRekognitionBreakerOpen = errors.New("Rekognition circuit breaker is open")
+
+// circuitBreaker stops calling a failing service for a while. It opens after
+// threshold consecutive failures, the first of them no older than window, and
+// stays open for cooldown. A single probe call is then let through (half-open):
+// success closes the breaker, failure opens it for another cooldown. While it
+// is open only the probe's result counts; calls allowed before it opened may
+// still finish, and their results are ignored.
+//
+// The Handler keeps one in memory, so its state carries across warm
+// invocations of the same Lambda instance and is shared by concurrent records.
+type circuitBreaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu           sync.Mutex
+	failures     int
+	firstFailure time.Time
+	openedAt     time.Time
+	open         bool
+	// probe is the token of the outstanding probe, or noProbe; probes counts
+	// the probes handed out, so each gets its own token
+	probe  breakerToken
+	probes breakerToken
+}
+
+// breakerToken is handed out by allow with each allowed call and passed back
+// to record with its result
+type breakerToken uint64
+
+// noProbe is the token of a call allowed while the breaker was closed
+const noProbe breakerToken = 0
+
+func newCircuitBreaker(threshold int, window, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// allow reports whether a call may go ahead, with the token to record its
+// result under. Once the cooldown has passed, the first caller gets the probe
+// and the rest are refused until it is recorded. A nil breaker always allows.
+func (b *circuitBreaker) allow() (breakerToken, bool) {
+	if b == nil {
+		return noProbe, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return noProbe, true
+	}
+	if b.probe != noProbe || b.now().Sub(b.openedAt) < b.cooldown {
+		return noProbe, false
+	}
+	b.probes++
+	b.probe = b.probes
+	return b.probe, true
+}
+
+// record feeds the outcome of an allowed call back to the breaker, returning
+// true when the call opened it. Only service failures count; a nil err or one
+// the service gave for this particular request resets the failure run. While
+// the breaker is open, only the outstanding probe's result is taken.
+func (b *circuitBreaker) record(token breakerToken, err error) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	if b.open {
+		if token == noProbe || token != b.probe {
+			return false
+		}
+		b.probe = noProbe
+		if serviceFailure(err) {
+			b.openedAt = now
+		} else {
+			b.open = false
+			b.failures = 0
+		}
+		return false
+	}
+
+	if !serviceFailure(err) {
+		b.failures = 0
+		return false
+	}
+	if b.failures == 0 || now.Sub(b.firstFailure) > b.window {
+		b.failures = 0
+		b.firstFailure = now
+	}
+	b.failures++
+	if b.failures < b.threshold {
+		return false
+	}
+	b.open = true
+	b.openedAt = now
+	return true
+}
+
+// serviceFailure reports whether err says the service itself is unwell:
+// throttling, a 5xx, a timeout or no response at all, as opposed to a
+// rejection of the request such as an unreadable image
+func serviceFailure(err error) bool {
+	if err == nil || isPermanent(err) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if isRetryable(err) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var apiErr smithy.APIError
+	return !errors.As(err, &apiErr)
+}
+
+// recordRekognition feeds the outcome of a Rekognition call, allowed under
+// token, to the Handler's breaker, logging when it opens
+func (h *Handler) recordRekognition(token breakerToken, err error) {
+	if h.rekognitionBreaker.record(token, err) {
+		h.logger.Error("opened Rekognition circuit breaker; skipping detection",
+			slog.Duration("cooldown", h.rekognitionBreaker.cooldown),
+		)
+	}
+}
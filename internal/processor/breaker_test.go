@@ -0,0 +1,336 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	rekognitionTypes "github.com/aws/aws-sdk-go-v2/service/rekognition/types"
+)
+
+// allowed reports whether b lets a call through, dropping its token
+func allowed(b *circuitBreaker) bool {
+	_, ok := b.allow()
+	return ok
+}
+
+func TestCircuitBreakerOpensAndRecovers(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	b := newCircuitBreaker(2, time.Minute, 30*time.Second)
+	b.now = func() time.Time { return now }
+	throttled := &rekognitionTypes.ThrottlingException{Message: aws.String("slow down")}
+
+	if b.record(noProbe, throttled) {
+		t.Fatal("first failure opened the breaker")
+	}
+	if !b.record(noProbe, throttled) {
+		t.Fatal("second failure did not open the breaker")
+	}
+	if allowed(b) {
+		t.Fatal("an open breaker allowed a call")
+	}
+
+	// Half-open after the cooldown: one probe, everyone else waits for it
+	now = now.Add(30 * time.Second)
+	probe, ok := b.allow()
+	if !ok || probe == noProbe {
+		t.Fatal("no probe after the cooldown")
+	}
+	if allowed(b) {
+		t.Fatal("a second call went through while the probe was out")
+	}
+
+	// A failed probe opens it for another cooldown
+	b.record(probe, throttled)
+	if allowed(b) {
+		t.Fatal("allowed a call right after a failed probe")
+	}
+	now = now.Add(30 * time.Second)
+	probe, ok = b.allow()
+	if !ok {
+		t.Fatal("no probe after the second cooldown")
+	}
+
+	// A successful probe closes it
+	b.record(probe, nil)
+	if !allowed(b) || !allowed(b) {
+		t.Fatal("breaker still refusing calls after a successful probe")
+	}
+}
+
+func TestCircuitBreakerIgnoresRequestErrors(t *testing.T) {
+	b := newCircuitBreaker(1, time.Minute, 30*time.Second)
+	invalid := &rekognitionTypes.InvalidImageFormatException{Message: aws.String("not an image")}
+	if b.record(noProbe, invalid) || !allowed(b) {
+		t.Error("an invalid image opened the breaker")
+	}
+	if b.record(noProbe, context.Canceled) || !allowed(b) {
+		t.Error("a canceled call opened the breaker")
+	}
+}
+
+func TestCircuitBreakerFailuresOutsideWindow(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	b := newCircuitBreaker(2, time.Minute, 30*time.Second)
+	b.now = func() time.Time { return now }
+	timeout := context.DeadlineExceeded
+
+	b.record(noProbe, timeout)
+	now = now.Add(2 * time.Minute)
+	if b.record(noProbe, timeout) {
+		t.Error("failures two minutes apart opened a breaker with a one-minute window")
+	}
+}
+
+func TestCircuitBreakerOnlyTakesTheProbeWhileOpen(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	b := newCircuitBreaker(1, time.Minute, 30*time.Second)
+	b.now = func() time.Time { return now }
+	throttled := &rekognitionTypes.ThrottlingException{Message: aws.String("slow down")}
+
+	// Two calls go out while closed; the first fails and opens the breaker
+	early, _ := b.allow()
+	late, _ := b.allow()
+	if !b.record(early, throttled) {
+		t.Fatal("failure did not open the breaker")
+	}
+
+	// The other call's success arrives after the cooldown, with the probe out:
+	// it must neither close the breaker nor free the probe slot
+	now = now.Add(30 * time.Second)
+	probe, ok := b.allow()
+	if !ok {
+		t.Fatal("no probe after the cooldown")
+	}
+	b.record(late, nil)
+	if allowed(b) {
+		t.Fatal("a result from before the breaker opened closed it")
+	}
+
+	// Nor does a failure from before the probe restart the cooldown
+	b.record(late, throttled)
+	b.record(probe, nil)
+	if !allowed(b) {
+		t.Fatal("the probe's success did not close the breaker")
+	}
+}
+
+func TestCircuitBreakerConcurrentCallsDuringProbe(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	b := newCircuitBreaker(1, time.Minute, 30*time.Second)
+	var mu sync.Mutex
+	b.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	throttled := &rekognitionTypes.ThrottlingException{Message: aws.String("slow down")}
+
+	// Calls allowed while closed are still in flight when the breaker opens
+	const inFlight = 50
+	tokens := make([]breakerToken, inFlight)
+	for i := range tokens {
+		tokens[i], _ = b.allow()
+	}
+	b.record(noProbe, throttled)
+	mu.Lock()
+	now = now.Add(30 * time.Second)
+	mu.Unlock()
+
+	// Their results race the probe's and each other's; however they
+	// interleave, only the probe decides
+	var probes atomic.Int32
+	var probe breakerToken
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, token := range tokens {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			<-start
+			if i%2 == 0 {
+				b.record(token, nil)
+			} else {
+				b.record(token, throttled)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			<-start
+			if token, ok := b.allow(); ok {
+				probes.Add(1)
+				probe = token
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if n := probes.Load(); n != 1 {
+		t.Fatalf("%d probes allowed, want 1", n)
+	}
+	if allowed(b) {
+		t.Fatal("stale results closed the breaker or freed the probe")
+	}
+	b.record(probe, nil)
+	if !allowed(b) {
+		t.Fatal("the probe's success did not close the breaker")
+	}
+}
+
+func TestHandleS3EventSkipsDetectionWhileBreakerOpen(t *testing.T) {
+	t.Setenv("AWS_MAX_RETRIES", "0")
+	t.Setenv("REKOGNITION_BREAKER_THRESHOLD", "2")
+	t.Setenv("ENABLE_FACE_DETECTION", "true")
+	t.Setenv("ENABLE_TEXT_DETECTION", "true")
+	t.Setenv("ENABLE_PPE_DETECTION", "true")
+	h, f := newTestHandler(t)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	h.rekognitionBreaker.now = func() time.Time { return now }
+	f.rekognition.Labels = dogLabels()
+
+	throttled := &rekognitionTypes.ThrottlingException{Message: aws.String("slow down")}
+	f.rekognition.BeforeCall = func(string) error { return throttled }
+
+	// Each upload gets its own size so none is taken for a duplicate
+	uploads := 0
+	upload := func(key string) error {
+		t.Helper()
+		uploads++
+		body := testJPEG(t, 64, 40+uploads)
+		f.s3.PutBytes(testBucket, key, body, nil)
+		return h.HandleS3Event(context.Background(), s3Event(key, len(body)))
+	}
+
+	// A throttled moderation call, which doesn't fail the record, and a
+	// throttled label call open the breaker
+	if err := upload("images/1700000001-a.jpg"); !errors.As(err, &throttled) {
+		t.Fatalf("upload: err = %v, want the throttling error", err)
+	}
+
+	// While it is open nothing reaches Rekognition's detection calls, and the
+	// image is saved with what it skipped
+	before := map[string]int{}
+	for _, op := range []string{"DetectModerationLabels", "DetectLabels", "DetectFaces", "DetectText", "DetectProtectiveEquipment"} {
+		before[op] = f.rekognition.Calls(op)
+	}
+	skipped := "images/1700000003-c.jpg"
+	if err := upload(skipped); err != nil {
+		t.Fatalf("upload while open: %v", err)
+	}
+	for op, n := range before {
+		if got := f.rekognition.Calls(op); got != n {
+			t.Errorf("%s called while the breaker was open", op)
+		}
+	}
+	metadata := storedMetadata(t, f, skipped)
+	want := []string{"moderation", "faces", "text", "ppe"}
+	if !metadata.LabelsSkipped || !slices.Equal(metadata.SkippedDetections, want) {
+		t.Errorf("labels_skipped, skipped_detections = %t, %v; want true, %v", metadata.LabelsSkipped, metadata.SkippedDetections, want)
+	}
+	if metadata.ThumbnailKey == "" {
+		t.Error("skipped image got no thumbnail")
+	}
+
+	// After the cooldown the probe succeeds and detection resumes
+	f.rekognition.BeforeCall = nil
+	now = now.Add(h.rekognitionBreaker.cooldown)
+	recovered := "images/1700000004-d.jpg"
+	if err := upload(recovered); err != nil {
+		t.Fatalf("upload after cooldown: %v", err)
+	}
+	metadata = storedMetadata(t, f, recovered)
+	if metadata.LabelsSkipped || len(metadata.SkippedDetections) != 0 || len(metadata.DetectedLabels) == 0 {
+		t.Errorf("after recovery: labels_skipped = %t, skipped_detections = %v, %d labels; want a fully labeled image",
+			metadata.LabelsSkipped, metadata.SkippedDetections, len(metadata.DetectedLabels))
+	}
+	if f.rekognition.Calls("DetectFaces") != before["DetectFaces"]+1 {
+		t.Error("DetectFaces was not called after recovery")
+	}
+}
+
+func TestHandleS3EventPPEFailuresOpenBreaker(t *testing.T) {
+	t.Setenv("AWS_MAX_RETRIES", "0")
+	t.Setenv("REKOGNITION_BREAKER_THRESHOLD", "1")
+	t.Setenv("ENABLE_FACE_DETECTION", "false")
+	t.Setenv("ENABLE_PPE_DETECTION", "true")
+	h, f := newTestHandler(t)
+	f.rekognition.Labels = dogLabels()
+
+	throttled := &rekognitionTypes.ThrottlingException{Message: aws.String("slow down")}
+	f.rekognition.BeforeCall = func(operation string) error {
+		if operation == "DetectProtectiveEquipment" {
+			return throttled
+		}
+		return nil
+	}
+
+	first := testJPEG(t, 64, 41)
+	f.s3.PutBytes(testBucket, "images/1700000001-a.jpg", first, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event("images/1700000001-a.jpg", len(first))); !errors.As(err, &throttled) {
+		t.Fatalf("first upload: err = %v, want the throttling error", err)
+	}
+
+	// The throttled PPE call counts against the breaker like a label call
+	labelCalls := f.rekognition.Calls("DetectLabels")
+	key := "images/1700000002-b.jpg"
+	second := testJPEG(t, 64, 42)
+	f.s3.PutBytes(testBucket, key, second, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(second))); err != nil {
+		t.Fatalf("upload while open: %v", err)
+	}
+	if f.rekognition.Calls("DetectLabels") != labelCalls {
+		t.Error("DetectLabels called while the breaker was open")
+	}
+	metadata := storedMetadata(t, f, key)
+	if !metadata.LabelsSkipped || !slices.Equal(metadata.SkippedDetections, []string{"moderation", "ppe"}) {
+		t.Errorf("labels_skipped, skipped_detections = %t, %v; want true, [moderation ppe]", metadata.LabelsSkipped, metadata.SkippedDetections)
+	}
+}
+
+func TestHandleS3EventModerationWhileBreakerOpen(t *testing.T) {
+	tests := []struct {
+		name     string
+		required bool
+	}{
+		{"optional moderation is skipped", false},
+		{"required moderation fails the record", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("REKOGNITION_BREAKER_THRESHOLD", "1")
+			t.Setenv("ENABLE_FACE_DETECTION", "false")
+			t.Setenv("MODERATION_REQUIRED", strconv.FormatBool(tt.required))
+			h, f := newTestHandler(t)
+			h.recordRekognition(noProbe, &rekognitionTypes.ThrottlingException{Message: aws.String("slow down")})
+
+			key := "images/1700000001-a.jpg"
+			body := testJPEG(t, 64, 48)
+			f.s3.PutBytes(testBucket, key, body, nil)
+			err := h.HandleS3Event(context.Background(), s3Event(key, len(body)))
+
+			if n := f.rekognition.Calls("DetectModerationLabels"); n != 0 {
+				t.Errorf("DetectModerationLabels called %d times while the breaker was open", n)
+			}
+			if tt.required {
+				if !errors.Is(err, errRekognitionBreakerOpen) {
+					t.Errorf("HandleS3Event error = %v, want errRekognitionBreakerOpen", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("HandleS3Event: %v", err)
+			}
+			metadata := storedMetadata(t, f, key)
+			if !slices.Equal(metadata.SkippedDetections, []string{"moderation"}) || metadata.ModerationFlagged {
+				t.Errorf("skipped_detections = %v, flagged = %t; want [moderation], unflagged", metadata.SkippedDetections, metadata.ModerationFlagged)
+			}
+		})
+	}
+}
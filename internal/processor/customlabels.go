@@ -0,0 +1,88 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition"
+	rekognitionTypes "github.com/aws/aws-sdk-go-v2/service/rekognition/types"
+)
+
+// Label sources, recorded on each LabelInfo so general and Custom Labels
+// results can be told apart once merged
+const (
+	labelSourceGeneral = "general"
+	labelSourceCustom  = "custom"
+)
+
+// detectCustomLabels runs the REKOGNITION_PROJECT_VERSION_ARN Custom Labels
+// model on the image. The model's own per-label thresholds apply. Detections of
+// the same label are folded into one LabelInfo, each kept as an instance, with
+// the highest confidence as the label's.
+func (h *Handler) detectCustomLabels(ctx context.Context, img *rekognitionTypes.Image) ([]LabelInfo, error) {
+	var result *rekognition.DetectCustomLabelsOutput
+	err := h.withRetry(ctx, "Rekognition DetectCustomLabels", func() error {
+		var err error
+		result, err = h.rekognitionClient.DetectCustomLabels(ctx, &rekognition.DetectCustomLabelsInput{
+			Image:             img,
+			ProjectVersionArn: aws.String(h.projectVersionARN),
+		})
+		return err
+	})
+	// A model version has to be started (and paid for) before it answers, so
+	// a stopped one is a deployment problem rather than one with the image
+	var notReadyErr *rekognitionTypes.ResourceNotReadyException
+	if errors.As(err, &notReadyErr) {
+		return nil, fmt.Errorf("Custom Labels model %s is not running; start it with StartProjectVersion: %w", h.projectVersionARN, err)
+	}
+	var invalidFormatErr *rekognitionTypes.InvalidImageFormatException
+	if errors.As(err, &invalidFormatErr) {
+		return nil, permanent(fmt.Errorf("Rekognition cannot read the image format: %w", err))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Rekognition DetectCustomLabels failed: %w", err)
+	}
+
+	var labels []LabelInfo
+	index := make(map[string]int)
+	for _, label := range result.CustomLabels {
+		name := aws.ToString(label.Name)
+		if !h.keepLabel(name) {
+			h.logger.Debug("filtered out custom label", slog.String("name", name))
+			continue
+		}
+
+		i, ok := index[name]
+		if !ok {
+			i = len(labels)
+			index[name] = i
+			labels = append(labels, LabelInfo{Name: name, Source: labelSourceCustom})
+		}
+		confidence := aws.ToFloat32(label.Confidence)
+		if confidence > labels[i].Confidence {
+			labels[i].Confidence = confidence
+		}
+		// Object detection models locate each detection; classifiers don't
+		if label.Geometry != nil && label.Geometry.BoundingBox != nil {
+			box := label.Geometry.BoundingBox
+			labels[i].Instances = append(labels[i].Instances, LabelInstance{
+				BoundingBox: BoundingBox{
+					Left:   aws.ToFloat32(box.Left),
+					Top:    aws.ToFloat32(box.Top),
+					Width:  aws.ToFloat32(box.Width),
+					Height: aws.ToFloat32(box.Height),
+				},
+				Confidence: confidence,
+			})
+		}
+	}
+
+	h.logger.Debug("detected custom labels",
+		slog.Int("detections", len(result.CustomLabels)),
+		slog.Int("label_count", len(labels)),
+	)
+	return labels, nil
+}
@@ -0,0 +1,110 @@
+package processor
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition"
+	rekognitionTypes "github.com/aws/aws-sdk-go-v2/service/rekognition/types"
+)
+
+const testProjectVersionARN = "arn:aws:rekognition:us-east-1:123456789012:project/dogs/version/dogs.2024-01-01/1700000000000"
+
+// customDetection is one Custom Labels detection, located when box is set
+func customDetection(name string, confidence float32, box *rekognitionTypes.BoundingBox) rekognitionTypes.CustomLabel {
+	label := rekognitionTypes.CustomLabel{Name: aws.String(name), Confidence: aws.Float32(confidence)}
+	if box != nil {
+		label.Geometry = &rekognitionTypes.Geometry{BoundingBox: box}
+	}
+	return label
+}
+
+func TestHandleS3EventMergesCustomLabels(t *testing.T) {
+	t.Setenv("REKOGNITION_PROJECT_VERSION_ARN", testProjectVersionARN)
+	t.Setenv("LABEL_BLOCKLIST", "collar")
+	h, f := newTestHandler(t)
+	f.rekognition.Labels = dogLabels()
+	left := &rekognitionTypes.BoundingBox{Left: aws.Float32(0.1), Top: aws.Float32(0.2), Width: aws.Float32(0.3), Height: aws.Float32(0.4)}
+	right := &rekognitionTypes.BoundingBox{Left: aws.Float32(0.6), Top: aws.Float32(0.2), Width: aws.Float32(0.3), Height: aws.Float32(0.4)}
+	f.rekognition.CustomLabels = rekognition.DetectCustomLabelsOutput{CustomLabels: []rekognitionTypes.CustomLabel{
+		customDetection("Golden Retriever", 88, left),
+		customDetection("Golden Retriever", 92, right),
+		customDetection("Leash", 75, nil),
+		customDetection("Collar", 80, nil),
+	}}
+
+	key := "images/1700000000-dog.jpg"
+	body := testJPEG(t, 320, 240)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	labels := storedMetadata(t, f, key).DetectedLabels
+	if len(labels) != 3 {
+		t.Fatalf("labels = %+v, want Dog, Golden Retriever and Leash", labels)
+	}
+	want := []struct {
+		name, source string
+		confidence   float32
+		instances    int
+	}{
+		{"Dog", labelSourceGeneral, 97.5, 0},
+		// Detections of one label fold into it, at the best confidence
+		{"Golden Retriever", labelSourceCustom, 92, 2},
+		// A classifier's labels have no location
+		{"Leash", labelSourceCustom, 75, 0},
+	}
+	for i, w := range want {
+		got := labels[i]
+		if got.Name != w.name || got.Source != w.source || got.Confidence != w.confidence || len(got.Instances) != w.instances {
+			t.Errorf("label %d = %s (%s, %.1f, %d instances), want %s (%s, %.1f, %d instances)",
+				i, got.Name, got.Source, got.Confidence, len(got.Instances), w.name, w.source, w.confidence, w.instances)
+		}
+	}
+	if instances := labels[1].Instances; len(instances) == 2 && (instances[0].BoundingBox.Left != 0.1 || instances[1].Confidence != 92) {
+		t.Errorf("Golden Retriever instances = %+v, want each detection's box and confidence", instances)
+	}
+}
+
+func TestHandleS3EventCustomLabels(t *testing.T) {
+	tests := []struct {
+		name      string
+		arn       string
+		err       error
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "no model configured", wantCalls: 0},
+		{name: "model configured", arn: testProjectVersionARN, wantCalls: 1},
+		// A stopped model is retried rather than recorded against the image
+		{name: "model not running", arn: testProjectVersionARN, err: &rekognitionTypes.ResourceNotReadyException{Message: aws.String("not running")}, wantCalls: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("REKOGNITION_PROJECT_VERSION_ARN", tt.arn)
+			h, f := newTestHandler(t)
+			f.rekognition.BeforeCall = func(operation string) error {
+				if operation == "DetectCustomLabels" {
+					return tt.err
+				}
+				return nil
+			}
+
+			key := "images/1700000000-dog.jpg"
+			body := testJPEG(t, 320, 240)
+			f.s3.PutBytes(testBucket, key, body, nil)
+			err := h.HandleS3Event(context.Background(), s3Event(key, len(body)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("HandleS3Event = %v, want error %t", err, tt.wantErr)
+			}
+			if n := f.rekognition.Calls("DetectCustomLabels"); n != tt.wantCalls {
+				t.Errorf("DetectCustomLabels called %d times, want %d", n, tt.wantCalls)
+			}
+			if tt.wantErr && f.dynamoDB.Item(key) != nil {
+				t.Error("item saved for a record that will be retried")
+			}
+		})
+	}
+}
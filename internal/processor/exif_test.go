@@ -0,0 +1,137 @@
+package processor
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// ifdEntry is one tag of a TIFF image file directory; values longer than four
+// bytes are moved out of line by encodeIFD
+type ifdEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+func asciiEntry(tag uint16, s string) ifdEntry {
+	return ifdEntry{tag: tag, typ: 2, count: uint32(len(s) + 1), value: append([]byte(s), 0)}
+}
+
+// rationalEntry holds whole-number RATIONALs, enough for degrees/minutes/seconds
+func rationalEntry(tag uint16, values ...uint32) ifdEntry {
+	value := make([]byte, 8*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(value[8*i:], v)
+		binary.BigEndian.PutUint32(value[8*i+4:], 1)
+	}
+	return ifdEntry{tag: tag, typ: 5, count: uint32(len(values)), value: value}
+}
+
+// encodeIFD lays out a big-endian IFD starting at offset within the TIFF
+// block, followed by its out-of-line values
+func encodeIFD(offset uint32, entries []ifdEntry) []byte {
+	ifd := make([]byte, 2+12*len(entries)+4)
+	binary.BigEndian.PutUint16(ifd, uint16(len(entries)))
+	var data []byte
+	dataOffset := offset + uint32(len(ifd))
+	for i, e := range entries {
+		entry := ifd[2+12*i:]
+		binary.BigEndian.PutUint16(entry[0:], e.tag)
+		binary.BigEndian.PutUint16(entry[2:], e.typ)
+		binary.BigEndian.PutUint32(entry[4:], e.count)
+		if len(e.value) <= 4 {
+			copy(entry[8:12], e.value)
+			continue
+		}
+		binary.BigEndian.PutUint32(entry[8:], dataOffset+uint32(len(data)))
+		data = append(data, e.value...)
+	}
+	return append(ifd, data...)
+}
+
+// withCameraEXIF inserts an APP1 Exif segment with a make, model, capture
+// time and a GPS position of 51°30'N 0°7'W straight after the SOI of a JPEG
+func withCameraEXIF(jpegBytes []byte) []byte {
+	const ifd0Offset = 8
+	ifd0 := func(gpsOffset uint32) []byte {
+		pointer := make([]byte, 4)
+		binary.BigEndian.PutUint32(pointer, gpsOffset)
+		return encodeIFD(ifd0Offset, []ifdEntry{
+			asciiEntry(0x010f, "Fujifilm  "),
+			asciiEntry(0x0110, "X100V"),
+			asciiEntry(0x0132, "2023:06:01 12:30:00"),
+			{tag: 0x8825, typ: 4, count: 1, value: pointer},
+		})
+	}
+	gpsOffset := uint32(ifd0Offset + len(ifd0(0)))
+	gps := encodeIFD(gpsOffset, []ifdEntry{
+		asciiEntry(0x0001, "N"),
+		rationalEntry(0x0002, 51, 30, 0),
+		asciiEntry(0x0003, "W"),
+		rationalEntry(0x0004, 0, 7, 0),
+	})
+
+	tiff := append([]byte("MM\x00\x2a\x00\x00\x00\x08"), ifd0(gpsOffset)...)
+	payload := append(append([]byte("Exif\x00\x00"), tiff...), gps...)
+
+	segment := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	out := append([]byte(nil), jpegBytes[:2]...)
+	out = append(out, segment...)
+	return append(out, jpegBytes[2:]...)
+}
+
+func TestHandleS3EventStoresEXIF(t *testing.T) {
+	for _, storeGPS := range []bool{false, true} {
+		if storeGPS {
+			t.Setenv("STORE_GPS", "true")
+		}
+		h, f := newTestHandler(t)
+
+		key := "images/1700000000-camera.jpg"
+		fixture := withCameraEXIF(testJPEG(t, 64, 48))
+		f.s3.PutBytes(testBucket, key, fixture, nil)
+		if err := h.HandleS3Event(context.Background(), s3Event(key, len(fixture))); err != nil {
+			t.Fatalf("HandleS3Event: %v", err)
+		}
+
+		info := storedMetadata(t, f, key).Exif
+		if info == nil {
+			t.Fatal("no EXIF stored")
+		}
+		if info.Make != "Fujifilm" || info.Model != "X100V" {
+			t.Errorf("camera = %q %q, want trimmed Fujifilm X100V", info.Make, info.Model)
+		}
+		// EXIF times carry no zone, so they are read as local time
+		if want := time.Date(2023, 6, 1, 12, 30, 0, 0, time.Local).UTC().Format(time.RFC3339); info.CapturedAt != want {
+			t.Errorf("captured_at = %q, want %q", info.CapturedAt, want)
+		}
+		switch {
+		case !storeGPS && (info.Latitude != nil || info.Longitude != nil):
+			t.Error("stored GPS position without STORE_GPS")
+		case storeGPS && (info.Latitude == nil || info.Longitude == nil):
+			t.Error("STORE_GPS=true did not store the GPS position")
+		case storeGPS && (*info.Latitude != 51.5 || *info.Longitude > -0.116 || *info.Longitude < -0.117):
+			t.Errorf("GPS = %v,%v, want 51.5,-0.1167", *info.Latitude, *info.Longitude)
+		}
+	}
+}
+
+func TestHandleS3EventWithoutEXIF(t *testing.T) {
+	h, f := newTestHandler(t)
+
+	key := "images/1700000000-plain.jpg"
+	body := testJPEG(t, 64, 48)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+	if info := storedMetadata(t, f, key).Exif; info != nil {
+		t.Errorf("exif = %+v, want none for a JPEG without EXIF", info)
+	}
+}
@@ -0,0 +1,223 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Each label name has a count item, keyed "label#<name>", holding the number of
+// images that have the label so GET /labels doesn't scan the table. The items
+// share labelCountPartition in the label count GSI, which lists them by count;
+// they have no gallery_pk, so they stay out of the gallery index.
+const (
+	LabelCountPrefix     = "label#"
+	labelCountIndexName  = "label-count-index"
+	labelCountPartition  = "LABEL"
+	maxLabelCountRetries = 3
+)
+
+// labelCountItem is the stored form of one label's count
+type labelCountItem struct {
+	Name  string `dynamodbav:"label_name"`
+	Count int    `dynamodbav:"image_count"`
+}
+
+// LabelCountKey builds the image_key of a label's count item
+func LabelCountKey(name string) string {
+	return LabelCountPrefix + name
+}
+
+// labelCountItemKey is the table key of a label's count item
+func labelCountItemKey(name string) map[string]dynamodbTypes.AttributeValue {
+	return map[string]dynamodbTypes.AttributeValue{
+		"image_key": &dynamodbTypes.AttributeValueMemberS{Value: LabelCountKey(name)},
+	}
+}
+
+// labelCountChanges returns how each label's image count changes when an
+// image's labels go from previous to current: +1 for a name it gained, -1 for
+// one it lost. A name listed twice (e.g. by general and custom detection)
+// counts once.
+func labelCountChanges(previous, current []LabelInfo) map[string]int {
+	had := make(map[string]bool, len(previous))
+	for _, label := range previous {
+		had[label.Name] = true
+	}
+	has := make(map[string]bool, len(current))
+	for _, label := range current {
+		has[label.Name] = true
+	}
+
+	changes := make(map[string]int)
+	for name := range has {
+		if !had[name] {
+			changes[name] = 1
+		}
+	}
+	for name := range had {
+		if !has[name] {
+			changes[name] = -1
+		}
+	}
+	return changes
+}
+
+// updateLabelCounts applies changes to the label counts. Each gain is an atomic
+// ADD, which also creates a missing count item; losses go through
+// ReleaseLabelCounts so no count drops below zero.
+func (h *Handler) updateLabelCounts(ctx context.Context, changes map[string]int) error {
+	names := make([]string, 0, len(changes))
+	for name := range changes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	released := make(map[string]int)
+	for _, name := range names {
+		change := changes[name]
+		if change < 0 {
+			released[name] = -change
+			continue
+		}
+		err := h.withRetry(ctx, "DynamoDB UpdateItem", func() error {
+			_, err := h.dynamoDBClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+				TableName:        aws.String(h.tableName),
+				Key:              labelCountItemKey(name),
+				UpdateExpression: aws.String("SET label_pk = :pk, label_name = :name ADD image_count :n"),
+				ExpressionAttributeValues: map[string]dynamodbTypes.AttributeValue{
+					":pk":   &dynamodbTypes.AttributeValueMemberS{Value: labelCountPartition},
+					":name": &dynamodbTypes.AttributeValueMemberS{Value: name},
+					":n":    &dynamodbTypes.AttributeValueMemberN{Value: strconv.Itoa(change)},
+				},
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return h.ReleaseLabelCounts(ctx, released)
+}
+
+// AddLabelReleases counts into released one release for each distinct label
+// name in labels, for an image being deleted. It also tallies images per label
+// the way the count items do.
+func AddLabelReleases(released map[string]int, labels []LabelInfo) {
+	seen := make(map[string]bool, len(labels))
+	for _, label := range labels {
+		if label.Name != "" && !seen[label.Name] {
+			seen[label.Name] = true
+			released[label.Name]++
+		}
+	}
+}
+
+// ReleaseLabelCounts takes released[name] images off each label's count.
+// Counts can fall behind the images, e.g. after a failed update or a TTL
+// expiry, so a count that would reach zero or below has its item deleted
+// instead of going negative.
+func (h *Handler) ReleaseLabelCounts(ctx context.Context, released map[string]int) error {
+	names := make([]string, 0, len(released))
+	for name := range released {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := h.releaseLabelCount(ctx, name, released[name]); err != nil {
+			return fmt.Errorf("failed to update count of %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// releaseLabelCount takes n off one label's count. The decrement only applies
+// while the count stays positive and the delete only while it wouldn't, so a
+// concurrent gain between the two sends it back to the decrement.
+func (h *Handler) releaseLabelCount(ctx context.Context, name string, n int) error {
+	values := map[string]dynamodbTypes.AttributeValue{
+		":n": &dynamodbTypes.AttributeValueMemberN{Value: strconv.Itoa(n)},
+	}
+	var conditionFailed *dynamodbTypes.ConditionalCheckFailedException
+	for attempt := 0; attempt < maxLabelCountRetries; attempt++ {
+		err := h.withRetry(ctx, "DynamoDB UpdateItem", func() error {
+			_, err := h.dynamoDBClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+				TableName:           aws.String(h.tableName),
+				Key:                 labelCountItemKey(name),
+				UpdateExpression:    aws.String("ADD image_count :minus"),
+				ConditionExpression: aws.String("image_count > :n"),
+				ExpressionAttributeValues: map[string]dynamodbTypes.AttributeValue{
+					":n":     values[":n"],
+					":minus": &dynamodbTypes.AttributeValueMemberN{Value: strconv.Itoa(-n)},
+				},
+			})
+			return err
+		})
+		if !errors.As(err, &conditionFailed) {
+			return err
+		}
+
+		err = h.withRetry(ctx, "DynamoDB DeleteItem", func() error {
+			_, err := h.dynamoDBClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+				TableName:                 aws.String(h.tableName),
+				Key:                       labelCountItemKey(name),
+				ConditionExpression:       aws.String("attribute_not_exists(image_count) OR image_count <= :n"),
+				ExpressionAttributeValues: values,
+			})
+			return err
+		})
+		if !errors.As(err, &conditionFailed) {
+			return err
+		}
+	}
+	return fmt.Errorf("count kept changing over %d attempts", maxLabelCountRetries)
+}
+
+// LabelCounts returns the number of images carrying each label, read from the
+// label count items. A label whose last image is gone has no item, so only
+// positive counts are returned.
+func (h *Handler) LabelCounts(ctx context.Context) (map[string]int, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(h.tableName),
+		IndexName:              aws.String(labelCountIndexName),
+		KeyConditionExpression: aws.String("label_pk = :pk"),
+		ExpressionAttributeValues: map[string]dynamodbTypes.AttributeValue{
+			":pk": &dynamodbTypes.AttributeValueMemberS{Value: labelCountPartition},
+		},
+		ProjectionExpression: aws.String("label_name, image_count"),
+	}
+
+	counts := make(map[string]int)
+	paginator := dynamodb.NewQueryPaginator(h.dynamoDBClient, input)
+	for paginator.HasMorePages() {
+		var page *dynamodb.QueryOutput
+		err := h.withRetry(ctx, "DynamoDB Query", func() error {
+			var err error
+			page, err = paginator.NextPage(ctx)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("DynamoDB Query failed: %w", err)
+		}
+
+		var items []labelCountItem
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &items); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal label counts: %w", err)
+		}
+		for _, item := range items {
+			if item.Name != "" && item.Count > 0 {
+				counts[item.Name] = item.Count
+			}
+		}
+	}
+	return counts, nil
+}
@@ -0,0 +1,114 @@
+package processor
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// processDog runs a new image through HandleS3Event; the width keeps its
+// bytes apart from other images, which would be skipped as duplicates
+func processDog(t *testing.T, h *Handler, f *fakes, key string, width int) {
+	t.Helper()
+	body := testJPEG(t, width, 48)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event %s: %v", key, err)
+	}
+}
+
+// wantCounts checks LabelCounts against want
+func wantCounts(t *testing.T, h *Handler, want map[string]int) {
+	t.Helper()
+	counts, err := h.LabelCounts(context.Background())
+	if err != nil {
+		t.Fatalf("LabelCounts: %v", err)
+	}
+	if len(counts) != len(want) {
+		t.Fatalf("LabelCounts = %v, want %v", counts, want)
+	}
+	for name, n := range want {
+		if counts[name] != n {
+			t.Fatalf("LabelCounts = %v, want %v", counts, want)
+		}
+	}
+}
+
+func TestSaveMetadataIncrementsLabelCounts(t *testing.T) {
+	h, f := newTestHandler(t)
+	f.rekognition.Labels = dogLabels()
+
+	processDog(t, h, f, "images/1700000000-a.jpg", 64)
+	wantCounts(t, h, map[string]int{"Dog": 1})
+	if f.dynamoDB.Item(LabelCountKey("Dog")) == nil {
+		t.Fatal("no count item for Dog")
+	}
+
+	processDog(t, h, f, "images/1700000001-b.jpg", 65)
+	wantCounts(t, h, map[string]int{"Dog": 2})
+
+	// Relabeling with the same labels leaves the counts alone; a lost label is
+	// taken off and a gained one added
+	if err := h.Relabel(context.Background(), "images/1700000000-a.jpg"); err != nil {
+		t.Fatalf("Relabel: %v", err)
+	}
+	wantCounts(t, h, map[string]int{"Dog": 2})
+
+	f.rekognition.Labels.Labels[0].Name = aws.String("Cat")
+	if err := h.Relabel(context.Background(), "images/1700000000-a.jpg"); err != nil {
+		t.Fatalf("Relabel: %v", err)
+	}
+	wantCounts(t, h, map[string]int{"Dog": 1, "Cat": 1})
+}
+
+func TestReleaseLabelCountsDecrementsAndDeletes(t *testing.T) {
+	h, f := newTestHandler(t)
+	f.rekognition.Labels = dogLabels()
+	processDog(t, h, f, "images/1700000000-a.jpg", 64)
+	processDog(t, h, f, "images/1700000001-b.jpg", 65)
+
+	ctx := context.Background()
+	if err := h.ReleaseLabelCounts(ctx, map[string]int{"Dog": 1}); err != nil {
+		t.Fatalf("ReleaseLabelCounts: %v", err)
+	}
+	wantCounts(t, h, map[string]int{"Dog": 1})
+
+	if err := h.ReleaseLabelCounts(ctx, map[string]int{"Dog": 1}); err != nil {
+		t.Fatalf("ReleaseLabelCounts: %v", err)
+	}
+	wantCounts(t, h, map[string]int{})
+	if f.dynamoDB.Item(LabelCountKey("Dog")) != nil {
+		t.Error("count item for Dog kept at zero")
+	}
+}
+
+func TestReleaseLabelCountsNeverGoesNegative(t *testing.T) {
+	h, f := newTestHandler(t)
+	f.rekognition.Labels = dogLabels()
+	processDog(t, h, f, "images/1700000000-a.jpg", 64)
+
+	// A release larger than the count, and one for a label with no count item
+	if err := h.ReleaseLabelCounts(context.Background(), map[string]int{"Dog": 3, "Cat": 1}); err != nil {
+		t.Fatalf("ReleaseLabelCounts: %v", err)
+	}
+	wantCounts(t, h, map[string]int{})
+	for _, name := range []string{"Dog", "Cat"} {
+		if f.dynamoDB.Item(LabelCountKey(name)) != nil {
+			t.Errorf("count item for %s left behind", name)
+		}
+	}
+}
+
+func TestAddLabelReleasesCountsDistinctNames(t *testing.T) {
+	released := map[string]int{"Dog": 1}
+	AddLabelReleases(released, []LabelInfo{
+		{Name: "Dog", Source: "general"},
+		{Name: "Dog", Source: "custom"},
+		{Name: "Cat"},
+		{Name: ""},
+	})
+	if len(released) != 2 || released["Dog"] != 2 || released["Cat"] != 1 {
+		t.Errorf("released = %v, want map[Cat:1 Dog:2]", released)
+	}
+}
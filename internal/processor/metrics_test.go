@@ -0,0 +1,120 @@
+package processor
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+// captureStdout runs fn and returns the lines it wrote to os.Stdout, where
+// the EMF metrics go
+func captureStdout(t *testing.T, fn func()) []string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("pipe: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	lines := make(chan []string)
+	go func() {
+		var out []string
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			out = append(out, scanner.Text())
+		}
+		lines <- out
+	}()
+
+	fn()
+	w.Close()
+	return <-lines
+}
+
+// emfRecord is the part of an EMF line the tests look at
+type emfRecord struct {
+	AWS struct {
+		CloudWatchMetrics []struct {
+			Namespace  string              `json:"Namespace"`
+			Dimensions [][]string          `json:"Dimensions"`
+			Metrics    []map[string]string `json:"Metrics"`
+		} `json:"CloudWatchMetrics"`
+	} `json:"_aws"`
+	Stage                string  `json:"Stage"`
+	ProcessingErrors     float64 `json:"ProcessingErrors"`
+	ProcessingDurationMs float64 `json:"ProcessingDurationMs"`
+	LabelsDetected       float64 `json:"LabelsDetected"`
+	ThumbnailBytes       float64 `json:"ThumbnailBytes"`
+}
+
+func TestHandleS3EventEmitsMetrics(t *testing.T) {
+	t.Setenv("ENABLE_METRICS", "true")
+	t.Setenv("METRICS_NAMESPACE", "TestProcessor")
+	h, f := newTestHandler(t)
+	f.rekognition.Labels = dogLabels()
+
+	key := "images/1700000000-dog.jpg"
+	body := testJPEG(t, 320, 240)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	missing := "images/1700000001-missing.jpg"
+
+	lines := captureStdout(t, func() {
+		if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+			t.Errorf("HandleS3Event: %v", err)
+		}
+		if err := h.HandleS3Event(context.Background(), s3Event(missing, len(body))); err == nil {
+			t.Error("HandleS3Event of a missing object succeeded")
+		}
+	})
+	if len(lines) != 2 {
+		t.Fatalf("got %d metric lines, want 2: %q", len(lines), lines)
+	}
+
+	var success, failure emfRecord
+	for line, record := range map[string]*emfRecord{lines[0]: &success, lines[1]: &failure} {
+		if err := json.Unmarshal([]byte(line), record); err != nil {
+			t.Fatalf("decode %q: %v", line, err)
+		}
+		if metrics := record.AWS.CloudWatchMetrics; len(metrics) != 1 || metrics[0].Namespace != "TestProcessor" {
+			t.Errorf("CloudWatchMetrics = %+v, want one set in TestProcessor", metrics)
+		}
+	}
+
+	metadata := storedMetadata(t, f, key)
+	if metadata.ThumbnailBytes <= 0 {
+		t.Errorf("thumbnail_bytes = %d, want the uploaded size", metadata.ThumbnailBytes)
+	}
+	if success.Stage != "" || success.ProcessingErrors != 0 {
+		t.Errorf("success record has stage %q and %v errors", success.Stage, success.ProcessingErrors)
+	}
+	if success.LabelsDetected != float64(len(metadata.DetectedLabels)) || success.ThumbnailBytes != float64(metadata.ThumbnailBytes) {
+		t.Errorf("success record = %+v, want %d labels and %d thumbnail bytes", success, len(metadata.DetectedLabels), metadata.ThumbnailBytes)
+	}
+	if failure.Stage != "download" || failure.ProcessingErrors != 1 {
+		t.Errorf("failure record has stage %q and %v errors, want download and 1", failure.Stage, failure.ProcessingErrors)
+	}
+	if dims := failure.AWS.CloudWatchMetrics[0].Dimensions; len(dims) != 1 || len(dims[0]) != 1 || dims[0][0] != "Stage" {
+		t.Errorf("failure dimensions = %v, want [[Stage]]", dims)
+	}
+}
+
+func TestHandleS3EventMetricsOffByDefault(t *testing.T) {
+	h, f := newTestHandler(t)
+
+	key := "images/1700000000-dog.jpg"
+	body := testJPEG(t, 64, 48)
+	f.s3.PutBytes(testBucket, key, body, nil)
+
+	lines := captureStdout(t, func() {
+		if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+			t.Errorf("HandleS3Event: %v", err)
+		}
+	})
+	if len(lines) != 0 {
+		t.Errorf("wrote %q without ENABLE_METRICS", lines)
+	}
+}
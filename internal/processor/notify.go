@@ -0,0 +1,175 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	eventBridgeTypes "github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snsTypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+)
+
+// Notification events published to COMPLETION_SNS_TOPIC_ARN
+const (
+	eventImageProcessed = "image.processed"
+	eventImageFailed    = "image.failed"
+)
+
+// EventBridge source and detail-type of the event sent for each processed image.
+// Rules match on these, so they must not change.
+const (
+	eventSource              = "image-processor"
+	eventDetailTypeProcessed = "ImageProcessed"
+)
+
+// maxNotificationLabels caps the label summary in a notification
+const maxNotificationLabels = 10
+
+// Notification is the JSON message published when an image finishes processing
+// or fails permanently. Event and status are also sent as message attributes so
+// subscribers can filter without parsing the body.
+type Notification struct {
+	Event         string   `json:"event"`
+	Key           string   `json:"key"`
+	Bucket        string   `json:"bucket"`
+	Status        string   `json:"status"`
+	Labels        []string `json:"labels,omitempty"`
+	LabelCount    int      `json:"label_count"`
+	Flagged       bool     `json:"moderation_flagged"`
+	DuplicateOf   string   `json:"duplicate_of,omitempty"`
+	ThumbnailKey  string   `json:"thumbnail_key,omitempty"`
+	FailureReason string   `json:"failure_reason,omitempty"`
+	ProcessedAt   string   `json:"processed_at"`
+}
+
+// newNotification builds the message for saved metadata, listing the most
+// confident labels first as DetectLabels returns them
+func newNotification(metadata *ImageMetadata) Notification {
+	n := Notification{
+		Event:         eventImageProcessed,
+		Key:           metadata.ImageKey,
+		Bucket:        metadata.BucketName,
+		Status:        metadata.Status,
+		LabelCount:    len(metadata.DetectedLabels),
+		Flagged:       metadata.ModerationFlagged,
+		DuplicateOf:   metadata.DuplicateOf,
+		ThumbnailKey:  metadata.ThumbnailKey,
+		FailureReason: metadata.FailureReason,
+		ProcessedAt:   metadata.ProcessedAt,
+	}
+	if metadata.Status == statusFailed {
+		n.Event = eventImageFailed
+	}
+	for i, label := range metadata.DetectedLabels {
+		if i == maxNotificationLabels {
+			break
+		}
+		n.Labels = append(n.Labels, label.Name)
+	}
+	return n
+}
+
+// ImageProcessedDetail is the detail of the ImageProcessed EventBridge event
+type ImageProcessedDetail struct {
+	Key          string   `json:"key"`
+	Bucket       string   `json:"bucket"`
+	Labels       []string `json:"labels"`
+	ThumbnailKey string   `json:"thumbnail_key,omitempty"`
+	ProcessedAt  string   `json:"processed_at"`
+}
+
+// notifyOutcome publishes the result of processing a record once its metadata is
+// saved. Transient errors are not reported since the record will be retried, and
+// skipped objects never reach a save. Publish failures are logged, not returned.
+func (h *Handler) notifyOutcome(ctx context.Context, metadata *ImageMetadata, err error) {
+	if err != nil || metadata.ProcessedAt == "" {
+		return
+	}
+	if h.completionTopicARN != "" && h.snsClient != nil {
+		h.publishNotification(ctx, metadata)
+	}
+	if h.eventBusName != "" && h.eventBridgeClient != nil && metadata.Status == statusComplete {
+		h.putProcessedEvent(ctx, metadata)
+	}
+}
+
+// imageProcessedEntry builds the PutEvents entry for a processed image
+func (h *Handler) imageProcessedEntry(metadata *ImageMetadata) (eventBridgeTypes.PutEventsRequestEntry, error) {
+	labels := make([]string, 0, len(metadata.DetectedLabels))
+	for _, label := range metadata.DetectedLabels {
+		labels = append(labels, label.Name)
+	}
+	detail, err := json.Marshal(ImageProcessedDetail{
+		Key:          metadata.ImageKey,
+		Bucket:       metadata.BucketName,
+		Labels:       labels,
+		ThumbnailKey: metadata.ThumbnailKey,
+		ProcessedAt:  metadata.ProcessedAt,
+	})
+	if err != nil {
+		return eventBridgeTypes.PutEventsRequestEntry{}, err
+	}
+
+	return eventBridgeTypes.PutEventsRequestEntry{
+		EventBusName: aws.String(h.eventBusName),
+		Source:       aws.String(eventSource),
+		DetailType:   aws.String(eventDetailTypeProcessed),
+		Detail:       aws.String(string(detail)),
+		Resources:    []string{"arn:aws:s3:::" + metadata.BucketName + "/" + metadata.ImageKey},
+	}, nil
+}
+
+// putProcessedEvent sends the ImageProcessed event to EVENTBRIDGE_BUS_NAME
+func (h *Handler) putProcessedEvent(ctx context.Context, metadata *ImageMetadata) {
+	entry, err := h.imageProcessedEntry(metadata)
+	if err != nil {
+		h.logger.Error("failed to marshal event detail", slog.String("key", metadata.ImageKey), slog.String("error", err.Error()))
+		return
+	}
+
+	result, err := h.eventBridgeClient.PutEvents(ctx, &eventbridge.PutEventsInput{
+		Entries: []eventBridgeTypes.PutEventsRequestEntry{entry},
+	})
+	// PutEvents reports rejected entries in the response rather than as an error
+	if err == nil && result.FailedEntryCount > 0 && len(result.Entries) > 0 {
+		err = fmt.Errorf("%s: %s", aws.ToString(result.Entries[0].ErrorCode), aws.ToString(result.Entries[0].ErrorMessage))
+	}
+	if err != nil {
+		h.logger.Warn("failed to put event",
+			slog.String("key", metadata.ImageKey),
+			slog.String("event_bus", h.eventBusName),
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+// publishNotification sends the completion or failure message to
+// COMPLETION_SNS_TOPIC_ARN
+func (h *Handler) publishNotification(ctx context.Context, metadata *ImageMetadata) {
+	n := newNotification(metadata)
+	body, err := json.Marshal(n)
+	if err != nil {
+		h.logger.Error("failed to marshal notification", slog.String("key", metadata.ImageKey), slog.String("error", err.Error()))
+		return
+	}
+
+	_, err = h.snsClient.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(h.completionTopicARN),
+		Message:  aws.String(string(body)),
+		MessageAttributes: map[string]snsTypes.MessageAttributeValue{
+			"event":  {DataType: aws.String("String"), StringValue: aws.String(n.Event)},
+			"status": {DataType: aws.String("String"), StringValue: aws.String(n.Status)},
+		},
+	})
+	if err != nil {
+		h.logger.Warn("failed to publish notification",
+			slog.String("key", metadata.ImageKey),
+			slog.String("event", n.Event),
+			slog.String("error", err.Error()),
+		)
+	}
+}
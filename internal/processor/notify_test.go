@@ -0,0 +1,191 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"aws-lambda-image-processor/internal/awsfake"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+)
+
+const testTopicARN = "arn:aws:sns:us-east-1:123456789012:image-events"
+
+// publishedNotification decodes the one message published to the fake SNS
+func publishedNotification(t *testing.T, f *fakes) (Notification, sns.PublishInput) {
+	t.Helper()
+	if len(f.sns.Published) != 1 {
+		t.Fatalf("published %d messages, want 1", len(f.sns.Published))
+	}
+	input := f.sns.Published[0]
+	if got := aws.ToString(input.TopicArn); got != testTopicARN {
+		t.Errorf("topic = %q, want %q", got, testTopicARN)
+	}
+	var n Notification
+	if err := json.Unmarshal([]byte(aws.ToString(input.Message)), &n); err != nil {
+		t.Fatalf("decode message %q: %v", aws.ToString(input.Message), err)
+	}
+	return n, input
+}
+
+// checkAttributes asserts the event and status message attributes
+func checkAttributes(t *testing.T, input sns.PublishInput, event, status string) {
+	t.Helper()
+	for name, want := range map[string]string{"event": event, "status": status} {
+		attribute, ok := input.MessageAttributes[name]
+		if !ok {
+			t.Errorf("no %s message attribute", name)
+			continue
+		}
+		if aws.ToString(attribute.DataType) != "String" || aws.ToString(attribute.StringValue) != want {
+			t.Errorf("%s attribute = %s %q, want String %q", name, aws.ToString(attribute.DataType), aws.ToString(attribute.StringValue), want)
+		}
+	}
+}
+
+func TestHandleS3EventPublishesCompletion(t *testing.T) {
+	t.Setenv("COMPLETION_SNS_TOPIC_ARN", testTopicARN)
+	h, f := newTestHandler(t)
+	f.rekognition.Labels = dogLabels()
+
+	key := "images/1700000000-dog.jpg"
+	body := testJPEG(t, 640, 480)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	n, input := publishedNotification(t, f)
+	metadata := storedMetadata(t, f, key)
+	if n.Event != eventImageProcessed || n.Status != statusComplete {
+		t.Errorf("event, status = %q, %q; want %q, %q", n.Event, n.Status, eventImageProcessed, statusComplete)
+	}
+	if n.Key != key || n.Bucket != testBucket {
+		t.Errorf("key, bucket = %q, %q; want %q, %q", n.Key, n.Bucket, key, testBucket)
+	}
+	if len(n.Labels) != 1 || n.Labels[0] != "Dog" || n.LabelCount != 1 {
+		t.Errorf("labels, label_count = %v, %d; want [Dog], 1", n.Labels, n.LabelCount)
+	}
+	if n.ThumbnailKey != metadata.ThumbnailKey || n.ProcessedAt != metadata.ProcessedAt {
+		t.Errorf("thumbnail_key, processed_at = %q, %q; want the saved %q, %q", n.ThumbnailKey, n.ProcessedAt, metadata.ThumbnailKey, metadata.ProcessedAt)
+	}
+	if n.FailureReason != "" {
+		t.Errorf("failure_reason = %q, want none", n.FailureReason)
+	}
+	checkAttributes(t, input, eventImageProcessed, statusComplete)
+}
+
+func TestHandleS3EventPublishesFailure(t *testing.T) {
+	t.Setenv("COMPLETION_SNS_TOPIC_ARN", testTopicARN)
+	h, f := newTestHandler(t)
+
+	// A JPEG signature followed by garbage sniffs as an image but never decodes
+	key := "images/1700000000-broken.jpg"
+	body := append([]byte{0xFF, 0xD8, 0xFF, 0xE0}, []byte("not really a jpeg")...)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	n, input := publishedNotification(t, f)
+	if n.Event != eventImageFailed || n.Status != statusFailed {
+		t.Errorf("event, status = %q, %q; want %q, %q", n.Event, n.Status, eventImageFailed, statusFailed)
+	}
+	if n.Key != key || n.FailureReason == "" {
+		t.Errorf("key, failure_reason = %q, %q; want %q and a reason", n.Key, n.FailureReason, key)
+	}
+	if len(n.Labels) != 0 || n.LabelCount != 0 {
+		t.Errorf("labels, label_count = %v, %d; want none", n.Labels, n.LabelCount)
+	}
+	checkAttributes(t, input, eventImageFailed, statusFailed)
+}
+
+func TestHandleS3EventLogsPublishErrors(t *testing.T) {
+	t.Setenv("COMPLETION_SNS_TOPIC_ARN", testTopicARN)
+	h, f := newTestHandler(t)
+	var logs bytes.Buffer
+	h.logger = slog.New(slog.NewTextHandler(&logs, nil))
+	f.sns.BeforeCall = func(string) error { return errors.New("sns unavailable") }
+
+	key := "images/1700000000-dog.jpg"
+	body := testJPEG(t, 320, 240)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event = %v, want a publish failure to be only logged", err)
+	}
+
+	if metadata := storedMetadata(t, f, key); metadata.Status != statusComplete {
+		t.Errorf("status = %q, want %q", metadata.Status, statusComplete)
+	}
+	if !strings.Contains(logs.String(), "failed to publish notification") || !strings.Contains(logs.String(), "sns unavailable") {
+		t.Errorf("publish error not logged:\n%s", logs.String())
+	}
+}
+
+func TestHandleS3EventPutsImageProcessedEvent(t *testing.T) {
+	t.Setenv("EVENTBRIDGE_BUS_NAME", "image-bus")
+	h, f := newTestHandler(t)
+	bus := &awsfake.EventBridge{}
+	h.eventBridgeClient = bus
+	f.rekognition.Labels = dogLabels()
+
+	key := "images/1700000000-dog.jpg"
+	body := testJPEG(t, 640, 480)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	if len(bus.Puts) != 1 || len(bus.Puts[0].Entries) != 1 {
+		t.Fatalf("put %+v, want one call with one entry", bus.Puts)
+	}
+	entry := bus.Puts[0].Entries[0]
+	if got := aws.ToString(entry.EventBusName); got != "image-bus" {
+		t.Errorf("event bus = %q, want image-bus", got)
+	}
+	if aws.ToString(entry.Source) != eventSource || aws.ToString(entry.DetailType) != eventDetailTypeProcessed {
+		t.Errorf("source, detail-type = %q, %q; want %q, %q", aws.ToString(entry.Source), aws.ToString(entry.DetailType), eventSource, eventDetailTypeProcessed)
+	}
+	wantResource := "arn:aws:s3:::" + testBucket + "/" + key
+	if len(entry.Resources) != 1 || entry.Resources[0] != wantResource {
+		t.Errorf("resources = %v, want [%s]", entry.Resources, wantResource)
+	}
+
+	var detail ImageProcessedDetail
+	if err := json.Unmarshal([]byte(aws.ToString(entry.Detail)), &detail); err != nil {
+		t.Fatalf("decode detail %q: %v", aws.ToString(entry.Detail), err)
+	}
+	metadata := storedMetadata(t, f, key)
+	if detail.Key != key || detail.Bucket != testBucket {
+		t.Errorf("key, bucket = %q, %q; want %q, %q", detail.Key, detail.Bucket, key, testBucket)
+	}
+	if len(detail.Labels) != 1 || detail.Labels[0] != "Dog" {
+		t.Errorf("labels = %v, want [Dog]", detail.Labels)
+	}
+	if detail.ThumbnailKey != metadata.ThumbnailKey || detail.ProcessedAt != metadata.ProcessedAt {
+		t.Errorf("thumbnail_key, processed_at = %q, %q; want the saved %q, %q", detail.ThumbnailKey, detail.ProcessedAt, metadata.ThumbnailKey, metadata.ProcessedAt)
+	}
+}
+
+func TestHandleS3EventPutsNoEventForFailures(t *testing.T) {
+	t.Setenv("EVENTBRIDGE_BUS_NAME", "image-bus")
+	h, f := newTestHandler(t)
+	bus := &awsfake.EventBridge{}
+	h.eventBridgeClient = bus
+
+	key := "images/1700000000-broken.jpg"
+	body := append([]byte{0xFF, 0xD8, 0xFF, 0xE0}, []byte("not really a jpeg")...)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+	if len(bus.Puts) != 0 {
+		t.Errorf("put %d events for a failed image, want none", len(bus.Puts))
+	}
+}
@@ -0,0 +1,92 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/disintegration/imaging"
+)
+
+// optimizedPrefix is where OPTIMIZE_ORIGINAL_MODE=copy writes downscaled
+// originals, keeping the upload itself untouched
+const optimizedPrefix = "optimized/"
+
+// optimizedOriginal is a downscaled original ready to be stored
+type optimizedOriginal struct {
+	Data        []byte
+	ContentType string
+	Width       int
+	Height      int
+}
+
+// optimizeOriginal downscales img, the decoded upright original, when its longer
+// side exceeds MAX_ORIGINAL_DIMENSION. It is re-encoded in the original's format;
+// a JPEG keeps its EXIF with the orientation reset, as AUTO_ORIENT_ORIGINAL does.
+// It returns nil when the image is within the limit or the result would not be
+// smaller than size, the original's byte count.
+func (h *Handler) optimizeOriginal(img image.Image, original []byte, size int64) (*optimizedOriginal, error) {
+	bounds := img.Bounds()
+	if bounds.Dx() <= h.maxOriginalDimension && bounds.Dy() <= h.maxOriginalDimension {
+		return nil, nil
+	}
+
+	// Fit scales the longer side to the limit, preserving the aspect ratio
+	resized := imaging.Fit(img, h.maxOriginalDimension, h.maxOriginalDimension, imaging.Lanczos)
+
+	result := &optimizedOriginal{
+		Width:  resized.Bounds().Dx(),
+		Height: resized.Bounds().Dy(),
+	}
+	if isPNG(original) {
+		var buf bytes.Buffer
+		encoder := png.Encoder{CompressionLevel: png.BestCompression}
+		if err := encoder.Encode(&buf, resized); err != nil {
+			return nil, fmt.Errorf("failed to encode optimized PNG: %w", err)
+		}
+		result.Data = buf.Bytes()
+		result.ContentType = "image/png"
+	} else {
+		data, err := encodeOrientedJPEG(resized, original)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode optimized JPEG: %w", err)
+		}
+		result.Data = data
+		result.ContentType = "image/jpeg"
+	}
+
+	if int64(len(result.Data)) >= size {
+		return nil, nil
+	}
+	return result, nil
+}
+
+// uploadOptimizedCopy stores an optimized original under optimized/<key>,
+// returning its key
+func (h *Handler) uploadOptimizedCopy(ctx context.Context, bucket, key string, optimized *optimizedOriginal) (string, error) {
+	optimizedKey := optimizedPrefix + key
+	err := h.withRetry(ctx, "S3 PutObject", func() error {
+		_, err := h.s3Putter.PutObject(ctx, h.encrypted(&s3.PutObjectInput{
+			Bucket:      aws.String(bucket),
+			Key:         aws.String(optimizedKey),
+			Body:        bytes.NewReader(optimized.Data),
+			ContentType: aws.String(optimized.ContentType),
+		}))
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload optimized original: %w", err)
+	}
+
+	h.logger.Info("stored optimized original",
+		slog.String("key", key),
+		slog.String("optimized_key", optimizedKey),
+		slog.Int("bytes", len(optimized.Data)),
+	)
+	return optimizedKey, nil
+}
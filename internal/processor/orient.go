@@ -0,0 +1,148 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// orientedJPEGQuality is the quality originals are re-encoded at when
+// AUTO_ORIENT_ORIGINAL rotates them; high, since the result replaces the upload
+const orientedJPEGQuality = 92
+
+// exifOrientationTag is the IFD0 tag holding the EXIF orientation (1-8)
+const exifOrientationTag = 0x0112
+
+// jpegExifSegment returns the APP1 Exif segment of a JPEG, marker included, or
+// nil when there is none
+func jpegExifSegment(imageBytes []byte) []byte {
+	for i := 2; i+4 <= len(imageBytes); {
+		if imageBytes[i] != 0xff {
+			return nil
+		}
+		marker := imageBytes[i+1]
+		// Entropy-coded data follows SOS, and EOI ends the image
+		if marker == 0xda || marker == 0xd9 {
+			return nil
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(imageBytes[i+2:]))
+		if end > len(imageBytes) {
+			return nil
+		}
+		if marker == 0xe1 && bytes.HasPrefix(imageBytes[i+4:end], []byte("Exif\x00\x00")) {
+			return imageBytes[i:end]
+		}
+		i = end
+	}
+	return nil
+}
+
+// exifOrientationOffset locates the orientation value inside an APP1 Exif
+// segment, returning its offset and the segment's byte order. ok is false when
+// the segment has no orientation tag.
+func exifOrientationOffset(segment []byte) (offset int, order binary.ByteOrder, ok bool) {
+	// Marker, length and "Exif\0\0" precede the TIFF header
+	const tiffStart = 10
+	if len(segment) < tiffStart+8 {
+		return 0, nil, false
+	}
+	tiff := segment[tiffStart:]
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, nil, false
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 0, nil, false
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for e := 0; e < entries; e++ {
+		entry := ifd + 2 + e*12
+		if entry+12 > len(tiff) {
+			return 0, nil, false
+		}
+		if order.Uint16(tiff[entry:]) == exifOrientationTag {
+			// A SHORT value sits in the first two bytes of the value field
+			return tiffStart + entry + 8, order, true
+		}
+	}
+	return 0, nil, false
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG, or 1 when it has none
+func jpegOrientation(imageBytes []byte) int {
+	segment := jpegExifSegment(imageBytes)
+	offset, order, ok := exifOrientationOffset(segment)
+	if !ok {
+		return 1
+	}
+	orientation := int(order.Uint16(segment[offset:]))
+	if orientation < 1 || orientation > 8 {
+		return 1
+	}
+	return orientation
+}
+
+// encodeOrientedJPEG encodes the already upright img as a JPEG carrying the EXIF
+// of the original, with its orientation reset to 1 so viewers don't rotate the
+// pixels a second time
+func encodeOrientedJPEG(img image.Image, original []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: orientedJPEGQuality}); err != nil {
+		return nil, err
+	}
+	encoded := buf.Bytes()
+
+	segment := jpegExifSegment(original)
+	offset, order, ok := exifOrientationOffset(segment)
+	if !ok {
+		return encoded, nil
+	}
+	exif := append([]byte(nil), segment...)
+	order.PutUint16(exif[offset:], 1)
+
+	// The EXIF segment goes straight after SOI
+	out := make([]byte, 0, len(encoded)+len(exif))
+	out = append(out, encoded[:2]...)
+	out = append(out, exif...)
+	out = append(out, encoded[2:]...)
+	return out, nil
+}
+
+// rewriteOriginal overwrites the original object with rewritten bytes, such as
+// an upright or optimized copy, keeping its user metadata. It is called once
+// the metadata is saved as complete, so the S3 event the overwrite triggers is
+// skipped as already processed.
+func (h *Handler) rewriteOriginal(ctx context.Context, bucket, key string, data []byte, contentType string, objectMetadata map[string]string) error {
+	err := h.withRetry(ctx, "S3 PutObject", func() error {
+		_, err := h.s3Putter.PutObject(ctx, h.encrypted(&s3.PutObjectInput{
+			Bucket:      aws.String(bucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(data),
+			ContentType: aws.String(contentType),
+			Metadata:    objectMetadata,
+		}))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to overwrite original: %w", err)
+	}
+
+	h.logger.Info("rewrote original",
+		slog.String("key", key),
+		slog.Int("bytes", len(data)),
+	)
+	return nil
+}
@@ -0,0 +1,107 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image/jpeg"
+	"testing"
+)
+
+// withOrientation inserts a big-endian APP1 Exif segment holding only the
+// given orientation straight after the SOI of a JPEG
+func withOrientation(jpegBytes []byte, orientation uint16) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	ifd := make([]byte, 2+12+4)
+	binary.BigEndian.PutUint16(ifd[0:], 1)            // one entry
+	binary.BigEndian.PutUint16(ifd[2:], 0x0112)       // Orientation tag
+	binary.BigEndian.PutUint16(ifd[4:], 3)            // SHORT
+	binary.BigEndian.PutUint32(ifd[6:], 1)            // count
+	binary.BigEndian.PutUint16(ifd[10:], orientation) // value, padded
+	payload := append(append([]byte("Exif\x00\x00"), tiff...), ifd...)
+
+	segment := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	out := append([]byte(nil), jpegBytes[:2]...)
+	out = append(out, segment...)
+	return append(out, jpegBytes[2:]...)
+}
+
+func TestHandleS3EventAppliesOrientation6(t *testing.T) {
+	h, f := newTestHandler(t)
+
+	key := "images/1700000000-phone.jpg"
+	fixture := withOrientation(testJPEG(t, 64, 48), 6)
+	f.s3.PutBytes(testBucket, key, fixture, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(fixture))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	thumbnailKey := storedMetadata(t, f, key).ThumbnailKey
+	// Orientation 6 is a 90° clockwise turn, so width and height swap
+	if bounds := storedThumbnail(t, f, thumbnailKey).Bounds(); bounds.Dx() != 48 || bounds.Dy() != 64 {
+		t.Errorf("thumbnail is %dx%d, want 48x64", bounds.Dx(), bounds.Dy())
+	}
+	// The thumbnail is already upright, so it must not carry the orientation
+	thumbnail, _ := f.s3.Object(testBucket, thumbnailKey)
+	if bytes.Contains(thumbnail.Body, []byte("Exif\x00\x00")) {
+		t.Error("thumbnail kept the EXIF segment")
+	}
+}
+
+func TestAutoOrientOriginalRewritesRotatedJPEG(t *testing.T) {
+	t.Setenv("AUTO_ORIENT_ORIGINAL", "true")
+	h, f := newTestHandler(t)
+
+	key := "images/1700000000-phone.jpg"
+	fixture := withOrientation(testJPEG(t, 64, 48), 6)
+	f.s3.PutBytes(testBucket, key, fixture, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(fixture))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	metadata := storedMetadata(t, f, key)
+	if metadata.Width != 48 || metadata.Height != 64 {
+		t.Errorf("stored dimensions = %dx%d, want 48x64", metadata.Width, metadata.Height)
+	}
+	if metadata.OriginalOrientation != 6 {
+		t.Errorf("original_orientation = %d, want 6", metadata.OriginalOrientation)
+	}
+
+	object, _ := f.s3.Object(testBucket, key)
+	if got := jpegOrientation(object.Body); got != 1 {
+		t.Errorf("rewritten original has orientation %d, want 1", got)
+	}
+	if jpegExifSegment(object.Body) == nil {
+		t.Error("rewritten original lost its EXIF")
+	}
+	config, err := jpeg.DecodeConfig(bytes.NewReader(object.Body))
+	if err != nil {
+		t.Fatalf("decode rewritten original: %v", err)
+	}
+	if config.Width != 48 || config.Height != 64 {
+		t.Errorf("rewritten original is %dx%d, want 48x64", config.Width, config.Height)
+	}
+}
+
+func TestAutoOrientOriginalLeavesUprightJPEG(t *testing.T) {
+	t.Setenv("AUTO_ORIENT_ORIGINAL", "true")
+	h, f := newTestHandler(t)
+
+	// Orientation 1 is already upright, so re-encoding would only lose quality
+	key := "images/1700000000-upright.jpg"
+	fixture := withOrientation(testJPEG(t, 64, 48), 1)
+	f.s3.PutBytes(testBucket, key, fixture, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(fixture))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	if object, _ := f.s3.Object(testBucket, key); !bytes.Equal(object.Body, fixture) {
+		t.Error("upright original was rewritten")
+	}
+	if got := storedMetadata(t, f, key).OriginalOrientation; got != 0 {
+		t.Errorf("original_orientation = %d, want unset", got)
+	}
+}
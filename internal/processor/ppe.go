@@ -0,0 +1,128 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition"
+	rekognitionTypes "github.com/aws/aws-sdk-go-v2/service/rekognition/types"
+)
+
+// ppeMinConfidence is the confidence below which Rekognition doesn't count
+// equipment when deciding whether a person wears what's required
+const ppeMinConfidence = 80
+
+// ppeEquipmentTypes maps the PPE_REQUIRED_EQUIPMENT names to Rekognition's
+var ppeEquipmentTypes = map[string]rekognitionTypes.ProtectiveEquipmentType{
+	"face_cover": rekognitionTypes.ProtectiveEquipmentTypeFaceCover,
+	"head_cover": rekognitionTypes.ProtectiveEquipmentTypeHeadCover,
+	"hand_cover": rekognitionTypes.ProtectiveEquipmentTypeHandCover,
+}
+
+// PPEPerson is one person seen by DetectProtectiveEquipment. A covering counts
+// only when the equipment is over the body part, not merely detected (a mask
+// under the chin leaves the face uncovered).
+type PPEPerson struct {
+	BoundingBox BoundingBox `dynamodbav:"bounding_box"`
+	Confidence  float32     `dynamodbav:"confidence"`
+	FaceCovered bool        `dynamodbav:"face_covered"`
+	HeadCovered bool        `dynamodbav:"head_covered"`
+	// HandsCovered is true when every hand Rekognition found is covered
+	HandsCovered bool `dynamodbav:"hands_covered"`
+	// MissingRequired marks a person without all of PPE_REQUIRED_EQUIPMENT
+	MissingRequired bool `dynamodbav:"missing_required,omitempty"`
+}
+
+// parsePPEEquipment parses PPE_REQUIRED_EQUIPMENT, a comma-separated list of
+// face_cover, head_cover and hand_cover in any case
+func parsePPEEquipment(value string) ([]rekognitionTypes.ProtectiveEquipmentType, error) {
+	var required []rekognitionTypes.ProtectiveEquipmentType
+	for _, name := range parseList(value) {
+		equipment, ok := ppeEquipmentTypes[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("invalid PPE_REQUIRED_EQUIPMENT entry %q: must be face_cover, head_cover or hand_cover", name)
+		}
+		required = append(required, equipment)
+	}
+	return required, nil
+}
+
+// detectPPE calls Rekognition DetectProtectiveEquipment on the image. With
+// PPE_REQUIRED_EQUIPMENT set, it also reports whether anyone lacks it; people
+// Rekognition can't decide about don't count as a violation.
+func (h *Handler) detectPPE(ctx context.Context, img *rekognitionTypes.Image) ([]PPEPerson, bool, error) {
+	input := &rekognition.DetectProtectiveEquipmentInput{Image: img}
+	// Rekognition only summarizes against at least one required type
+	if len(h.ppeRequired) > 0 {
+		input.SummarizationAttributes = &rekognitionTypes.ProtectiveEquipmentSummarizationAttributes{
+			MinConfidence:          aws.Float32(ppeMinConfidence),
+			RequiredEquipmentTypes: h.ppeRequired,
+		}
+	}
+
+	var result *rekognition.DetectProtectiveEquipmentOutput
+	err := h.withRetry(ctx, "Rekognition DetectProtectiveEquipment", func() error {
+		var err error
+		result, err = h.rekognitionClient.DetectProtectiveEquipment(ctx, input)
+		return err
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("Rekognition DetectProtectiveEquipment failed: %w", err)
+	}
+
+	missing := make(map[int32]bool)
+	if result.Summary != nil {
+		for _, id := range result.Summary.PersonsWithoutRequiredEquipment {
+			missing[id] = true
+		}
+	}
+
+	persons := make([]PPEPerson, 0, len(result.Persons))
+	for _, detected := range result.Persons {
+		person := PPEPerson{
+			Confidence:      aws.ToFloat32(detected.Confidence),
+			MissingRequired: detected.Id != nil && missing[*detected.Id],
+		}
+		if box := detected.BoundingBox; box != nil {
+			person.BoundingBox = BoundingBox{
+				Left:   aws.ToFloat32(box.Left),
+				Top:    aws.ToFloat32(box.Top),
+				Width:  aws.ToFloat32(box.Width),
+				Height: aws.ToFloat32(box.Height),
+			}
+		}
+
+		hands, coveredHands := 0, 0
+		for _, part := range detected.BodyParts {
+			covered := bodyPartCovered(part)
+			switch part.Name {
+			case rekognitionTypes.BodyPartFace:
+				person.FaceCovered = covered
+			case rekognitionTypes.BodyPartHead:
+				person.HeadCovered = covered
+			case rekognitionTypes.BodyPartLeftHand, rekognitionTypes.BodyPartRightHand:
+				hands++
+				if covered {
+					coveredHands++
+				}
+			}
+		}
+		person.HandsCovered = hands > 0 && coveredHands == hands
+
+		persons = append(persons, person)
+	}
+
+	return persons, len(missing) > 0, nil
+}
+
+// bodyPartCovered reports whether any equipment detected on part covers it
+func bodyPartCovered(part rekognitionTypes.ProtectiveEquipmentBodyPart) bool {
+	for _, detection := range part.EquipmentDetections {
+		if detection.CoversBodyPart != nil && detection.CoversBodyPart.Value {
+			return true
+		}
+	}
+	return false
+}
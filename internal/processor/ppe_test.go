@@ -0,0 +1,180 @@
+package processor
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition"
+	rekognitionTypes "github.com/aws/aws-sdk-go-v2/service/rekognition/types"
+)
+
+// recordingPPE keeps the DetectProtectiveEquipment requests sent to the fake
+type recordingPPE struct {
+	Rekognizer
+	inputs []rekognition.DetectProtectiveEquipmentInput
+}
+
+func (r *recordingPPE) DetectProtectiveEquipment(ctx context.Context, params *rekognition.DetectProtectiveEquipmentInput, optFns ...func(*rekognition.Options)) (*rekognition.DetectProtectiveEquipmentOutput, error) {
+	r.inputs = append(r.inputs, *params)
+	return r.Rekognizer.DetectProtectiveEquipment(ctx, params, optFns...)
+}
+
+// ppeBodyPart is a body part with one detection of equipment that does or
+// doesn't cover it
+func ppeBodyPart(name rekognitionTypes.BodyPart, equipment rekognitionTypes.ProtectiveEquipmentType, covers bool) rekognitionTypes.ProtectiveEquipmentBodyPart {
+	return rekognitionTypes.ProtectiveEquipmentBodyPart{
+		Name: name,
+		EquipmentDetections: []rekognitionTypes.EquipmentDetection{{
+			Type:           equipment,
+			Confidence:     aws.Float32(95),
+			CoversBodyPart: &rekognitionTypes.CoversBodyPart{Value: covers, Confidence: aws.Float32(95)},
+		}},
+	}
+}
+
+// sitePPE is a worker in full gear beside one with a mask under the chin, no
+// helmet and one bare hand, whom Rekognition lists as missing equipment
+func sitePPE() rekognition.DetectProtectiveEquipmentOutput {
+	return rekognition.DetectProtectiveEquipmentOutput{
+		Persons: []rekognitionTypes.ProtectiveEquipmentPerson{
+			{
+				Id:          aws.Int32(0),
+				Confidence:  aws.Float32(99),
+				BoundingBox: &rekognitionTypes.BoundingBox{Left: aws.Float32(0.1), Top: aws.Float32(0.1), Width: aws.Float32(0.3), Height: aws.Float32(0.8)},
+				BodyParts: []rekognitionTypes.ProtectiveEquipmentBodyPart{
+					ppeBodyPart(rekognitionTypes.BodyPartFace, rekognitionTypes.ProtectiveEquipmentTypeFaceCover, true),
+					ppeBodyPart(rekognitionTypes.BodyPartHead, rekognitionTypes.ProtectiveEquipmentTypeHeadCover, true),
+					ppeBodyPart(rekognitionTypes.BodyPartLeftHand, rekognitionTypes.ProtectiveEquipmentTypeHandCover, true),
+					ppeBodyPart(rekognitionTypes.BodyPartRightHand, rekognitionTypes.ProtectiveEquipmentTypeHandCover, true),
+				},
+			},
+			{
+				Id:         aws.Int32(1),
+				Confidence: aws.Float32(97),
+				BodyParts: []rekognitionTypes.ProtectiveEquipmentBodyPart{
+					ppeBodyPart(rekognitionTypes.BodyPartFace, rekognitionTypes.ProtectiveEquipmentTypeFaceCover, false),
+					{Name: rekognitionTypes.BodyPartHead},
+					ppeBodyPart(rekognitionTypes.BodyPartLeftHand, rekognitionTypes.ProtectiveEquipmentTypeHandCover, true),
+					{Name: rekognitionTypes.BodyPartRightHand},
+				},
+			},
+		},
+		Summary: &rekognitionTypes.ProtectiveEquipmentSummary{
+			PersonsWithRequiredEquipment:    []int32{0},
+			PersonsWithoutRequiredEquipment: []int32{1},
+		},
+	}
+}
+
+func TestHandleS3EventRecordsPPEViolation(t *testing.T) {
+	t.Setenv("ENABLE_PPE_DETECTION", "true")
+	t.Setenv("PPE_REQUIRED_EQUIPMENT", "FACE_COVER, head_cover")
+	h, f := newTestHandler(t)
+	f.rekognition.ProtectiveGear = sitePPE()
+	rekognizer := &recordingPPE{Rekognizer: f.rekognition}
+	h.rekognitionClient = rekognizer
+
+	key := "images/1700000000-site.jpg"
+	body := testJPEG(t, 320, 240)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	if len(rekognizer.inputs) != 1 {
+		t.Fatalf("sent %d DetectProtectiveEquipment requests, want 1", len(rekognizer.inputs))
+	}
+	summary := rekognizer.inputs[0].SummarizationAttributes
+	wantRequired := []rekognitionTypes.ProtectiveEquipmentType{rekognitionTypes.ProtectiveEquipmentTypeFaceCover, rekognitionTypes.ProtectiveEquipmentTypeHeadCover}
+	if summary == nil || !slices.Equal(summary.RequiredEquipmentTypes, wantRequired) || aws.ToFloat32(summary.MinConfidence) != ppeMinConfidence {
+		t.Errorf("summarization = %+v, want %v at %d", summary, wantRequired, ppeMinConfidence)
+	}
+
+	metadata := storedMetadata(t, f, key)
+	if !metadata.PPEViolation {
+		t.Error("ppe_violation = false, want true")
+	}
+	want := []PPEPerson{
+		{
+			BoundingBox: BoundingBox{Left: 0.1, Top: 0.1, Width: 0.3, Height: 0.8},
+			Confidence:  99, FaceCovered: true, HeadCovered: true, HandsCovered: true,
+		},
+		// The mask is detected but not over the face
+		{Confidence: 97, MissingRequired: true},
+	}
+	if !slices.Equal(metadata.PPE, want) {
+		t.Errorf("ppe = %+v, want %+v", metadata.PPE, want)
+	}
+}
+
+func TestHandleS3EventPPEDetection(t *testing.T) {
+	tests := []struct {
+		name          string
+		enable        string
+		required      string
+		wantCalls     int
+		wantSummary   bool
+		wantViolation bool
+	}{
+		{name: "off by default", wantCalls: 0},
+		// Without required equipment nobody is judged
+		{name: "detection only", enable: "true", wantCalls: 1},
+		{name: "required equipment", enable: "true", required: "hand_cover", wantCalls: 1, wantSummary: true, wantViolation: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ENABLE_PPE_DETECTION", tt.enable)
+			t.Setenv("PPE_REQUIRED_EQUIPMENT", tt.required)
+			h, f := newTestHandler(t)
+			rekognizer := &recordingPPE{Rekognizer: f.rekognition}
+			h.rekognitionClient = rekognizer
+			response := sitePPE()
+			if !tt.wantSummary {
+				// Rekognition only summarizes when asked to
+				response.Summary = nil
+			}
+			f.rekognition.ProtectiveGear = response
+
+			key := "images/1700000000-site.jpg"
+			body := testJPEG(t, 320, 240)
+			f.s3.PutBytes(testBucket, key, body, nil)
+			if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+				t.Fatalf("HandleS3Event: %v", err)
+			}
+
+			if n := f.rekognition.Calls("DetectProtectiveEquipment"); n != tt.wantCalls {
+				t.Fatalf("DetectProtectiveEquipment called %d times, want %d", n, tt.wantCalls)
+			}
+			if tt.wantCalls > 0 && (rekognizer.inputs[0].SummarizationAttributes != nil) != tt.wantSummary {
+				t.Errorf("summarization = %+v, want it sent %t", rekognizer.inputs[0].SummarizationAttributes, tt.wantSummary)
+			}
+			item := f.dynamoDB.Item(key)
+			var stored struct {
+				PPE          []PPEPerson `dynamodbav:"ppe"`
+				PPEViolation bool        `dynamodbav:"ppe_violation"`
+			}
+			if err := attributevalue.UnmarshalMap(item, &stored); err != nil {
+				t.Fatalf("unmarshal %s: %v", key, err)
+			}
+			if stored.PPEViolation != tt.wantViolation {
+				t.Errorf("ppe_violation = %t, want %t", stored.PPEViolation, tt.wantViolation)
+			}
+			if _, ok := item["ppe"]; ok != (tt.wantCalls > 0) {
+				t.Errorf("ppe stored = %t, want %t", ok, tt.wantCalls > 0)
+			}
+		})
+	}
+}
+
+func TestParsePPEEquipment(t *testing.T) {
+	if _, err := parsePPEEquipment("face_cover,goggles"); err == nil || !strings.Contains(err.Error(), `"goggles"`) {
+		t.Errorf("parsePPEEquipment = %v, want goggles rejected", err)
+	}
+	if required, err := parsePPEEquipment(""); err != nil || required != nil {
+		t.Errorf("parsePPEEquipment(\"\") = %v, %v; want nothing required", required, err)
+	}
+}
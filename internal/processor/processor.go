@@ -0,0 +1,3192 @@
+// Package processor implements the S3-triggered image processing pipeline:
+// validation, Rekognition analysis, thumbnails and DynamoDB metadata.
+package processor
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition"
+	rekognitionTypes "github.com/aws/aws-sdk-go-v2/service/rekognition/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-xray-sdk-go/instrumentation/awsv2"
+	"github.com/aws/aws-xray-sdk-go/strategy/ctxmissing"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/buckket/go-blurhash"
+	"github.com/disintegration/imaging"
+	"github.com/gen2brain/heic"
+	"github.com/rwcarlsen/goexif/exif"
+	"golang.org/x/image/webp"
+	"golang.org/x/sync/errgroup"
+)
+
+// contentHashIndexName is the GSI keyed on content_hash used to find duplicate uploads
+const contentHashIndexName = "content_hash-index"
+
+// GalleryPartition is the constant partition key value under which every image is
+// indexed in the gallery GSI, so the API can query all images by processed_at.
+const GalleryPartition = "IMAGE"
+
+// OriginalFilenameMetadataKey is the S3 user metadata key (x-amz-meta-original-filename)
+// carrying the URL-escaped filename the client uploaded
+const OriginalFilenameMetadataKey = "original-filename"
+
+// OwnerMetadataKey is the S3 user metadata key holding the token subject of the
+// authenticated uploader
+const OwnerMetadataKey = "owner"
+
+// CorrelationIDMetadataKey is the S3 user metadata key holding the API request ID
+// of the upload
+const CorrelationIDMetadataKey = "correlation-id"
+
+// CustomMetadataPrefix marks the S3 user metadata keys holding the metadata a
+// client attached at upload; they are stored without it in CustomMetadata
+const CustomMetadataPrefix = "custom-"
+
+// customMetadata extracts the client metadata from an object's user metadata,
+// returning nil when there is none. Values were URL-escaped by the upload API;
+// one that doesn't unescape is kept as it is.
+func customMetadata(objectMetadata map[string]string) map[string]string {
+	var custom map[string]string
+	for k, v := range objectMetadata {
+		name, ok := strings.CutPrefix(k, CustomMetadataPrefix)
+		if !ok || name == "" {
+			continue
+		}
+		if unescaped, err := url.PathUnescape(v); err == nil {
+			v = unescaped
+		}
+		if custom == nil {
+			custom = make(map[string]string)
+		}
+		custom[name] = v
+	}
+	return custom
+}
+
+// statusComplete marks a processed image. The API's upload-complete callback
+// writes a "processing" placeholder under the same key, whose attributes
+// saveMetadata overwrites.
+const statusComplete = "complete"
+
+// statusFailed marks an image that can never be processed, e.g. one that does
+// not decode. FailureReason holds the error.
+const statusFailed = "failed"
+
+// ImageMetadata represents the metadata stored in DynamoDB for each processed image
+type ImageMetadata struct {
+	GalleryPK         string            `dynamodbav:"gallery_pk"`
+	ImageKey          string            `dynamodbav:"image_key"`
+	BucketName        string            `dynamodbav:"bucket_name"`
+	ImageSize         int64             `dynamodbav:"image_size"`
+	OriginalFilename  string            `dynamodbav:"original_filename,omitempty"`
+	Owner             string            `dynamodbav:"owner,omitempty"`
+	Status            string            `dynamodbav:"status"`
+	FailureReason     string            `dynamodbav:"failure_reason,omitempty"`
+	ContentHash       string            `dynamodbav:"content_hash"`
+	DuplicateOf       string            `dynamodbav:"duplicate_of,omitempty"`
+	ThumbnailBytes    int64             `dynamodbav:"thumbnail_bytes"`
+	SearchTerms       []string          `dynamodbav:"search_terms,omitempty"`
+	Width             int               `dynamodbav:"width"`
+	Height            int               `dynamodbav:"height"`
+	Exif              *ExifInfo         `dynamodbav:"exif,omitempty"`
+	ProcessedAt       string            `dynamodbav:"processed_at"`
+	DetectedLabels    []LabelInfo       `dynamodbav:"detected_labels"`
+	Faces             []FaceInfo        `dynamodbav:"faces"`
+	DetectedText      []TextInfo        `dynamodbav:"detected_text"`
+	TextBlob          string            `dynamodbav:"text_blob,omitempty"`
+	ModerationFlagged bool              `dynamodbav:"moderation_flagged"`
+	ModerationLabels  []LabelInfo       `dynamodbav:"moderation_labels,omitempty"`
+	QuarantineKey     string            `dynamodbav:"quarantine_key,omitempty"`
+	ConvertedKey      string            `dynamodbav:"converted_key,omitempty"`
+	IsAnimated        bool              `dynamodbav:"is_animated"`
+	FrameCount        int               `dynamodbav:"frame_count,omitempty"`
+	ThumbnailKey      string            `dynamodbav:"thumbnail_key"`
+	ThumbnailBucket   string            `dynamodbav:"thumbnail_bucket,omitempty"`
+	Thumbnails        map[string]string `dynamodbav:"thumbnails"`
+	ThumbnailMode     string            `dynamodbav:"thumbnail_mode,omitempty"`
+	ThumbnailWidth    int               `dynamodbav:"thumbnail_width,omitempty"`
+	ThumbnailHeight   int               `dynamodbav:"thumbnail_height,omitempty"`
+	DominantColors    []string          `dynamodbav:"dominant_colors,omitempty"`
+	BlurHash          string            `dynamodbav:"blurhash,omitempty"`
+	PHash             string            `dynamodbav:"phash,omitempty"`
+	ImageQuality      *ImageQuality     `dynamodbav:"image_quality,omitempty"`
+	UserTags          []string          `dynamodbav:"user_tags,stringset,omitempty"`
+	CustomMetadata    map[string]string `dynamodbav:"custom_metadata,omitempty"`
+	ExpiresAt         int64             `dynamodbav:"expires_at,omitempty"`
+	// OriginalOrientation is the EXIF orientation the upload had before
+	// AUTO_ORIENT_ORIGINAL rewrote it upright
+	OriginalOrientation int `dynamodbav:"original_orientation,omitempty"`
+	// OriginalOptimized marks an original downscaled for MAX_ORIGINAL_DIMENSION;
+	// OptimizedKey is set when the copy was stored beside it rather than over it
+	OriginalOptimized bool   `dynamodbav:"original_optimized,omitempty"`
+	OptimizedKey      string `dynamodbav:"optimized_key,omitempty"`
+	OptimizedBytes    int64  `dynamodbav:"optimized_bytes,omitempty"`
+	OptimizedWidth    int    `dynamodbav:"optimized_width,omitempty"`
+	OptimizedHeight   int    `dynamodbav:"optimized_height,omitempty"`
+	// LabelsSkipped marks an image processed while the Rekognition circuit
+	// breaker was open, so it has no labels or quality scores yet.
+	// SkippedDetections names the other detections ("moderation", "faces",
+	// "text", "ppe") the open breaker skipped the same way.
+	LabelsSkipped     bool     `dynamodbav:"labels_skipped,omitempty"`
+	SkippedDetections []string `dynamodbav:"skipped_detections,omitempty"`
+	// PPE lists the people ENABLE_PPE_DETECTION found; PPEViolation marks an
+	// image where one lacks the PPE_REQUIRED_EQUIPMENT
+	PPE          []PPEPerson `dynamodbav:"ppe,omitempty"`
+	PPEViolation bool        `dynamodbav:"ppe_violation,omitempty"`
+}
+
+// LabelInfo represents a detected label from Rekognition
+type LabelInfo struct {
+	Name       string          `dynamodbav:"name"`
+	Confidence float32         `dynamodbav:"confidence"`
+	Parents    []string        `dynamodbav:"parents,omitempty"`
+	Categories []string        `dynamodbav:"categories,omitempty"`
+	Instances  []LabelInstance `dynamodbav:"instances,omitempty"`
+	// Source is "general" for Rekognition's own labels and "custom" for those
+	// from the REKOGNITION_PROJECT_VERSION_ARN model
+	Source string `dynamodbav:"source,omitempty"`
+}
+
+// ImageQuality holds the IMAGE_PROPERTIES quality scores Rekognition returns,
+// each from 0 to 100
+type ImageQuality struct {
+	Brightness float32 `dynamodbav:"brightness"`
+	Sharpness  float32 `dynamodbav:"sharpness"`
+	Contrast   float32 `dynamodbav:"contrast"`
+}
+
+// LabelInstance locates one occurrence of a countable object label (e.g. each car)
+type LabelInstance struct {
+	BoundingBox BoundingBox `dynamodbav:"bounding_box"`
+	Confidence  float32     `dynamodbav:"confidence"`
+}
+
+// FaceInfo represents a face detected by Rekognition
+type FaceInfo struct {
+	BoundingBox     BoundingBox `dynamodbav:"bounding_box"`
+	AgeLow          int32       `dynamodbav:"age_low"`
+	AgeHigh         int32       `dynamodbav:"age_high"`
+	DominantEmotion string      `dynamodbav:"dominant_emotion"`
+	Smiling         bool        `dynamodbav:"smiling"`
+	Confidence      float32     `dynamodbav:"confidence"`
+}
+
+// TextInfo represents a line of text detected by Rekognition
+type TextInfo struct {
+	Text       string  `dynamodbav:"text"`
+	Confidence float32 `dynamodbav:"confidence"`
+}
+
+// ExifInfo holds camera details read from the original image's EXIF block.
+// GPS coordinates are only populated when STORE_GPS is enabled.
+type ExifInfo struct {
+	Make       string   `dynamodbav:"make,omitempty"`
+	Model      string   `dynamodbav:"model,omitempty"`
+	CapturedAt string   `dynamodbav:"captured_at,omitempty"`
+	Latitude   *float64 `dynamodbav:"latitude,omitempty"`
+	Longitude  *float64 `dynamodbav:"longitude,omitempty"`
+}
+
+// BoundingBox is a region of the image expressed as fractions of its width and height
+type BoundingBox struct {
+	Left   float32 `dynamodbav:"left"`
+	Top    float32 `dynamodbav:"top"`
+	Width  float32 `dynamodbav:"width"`
+	Height float32 `dynamodbav:"height"`
+}
+
+// thumbnailContentTypes maps each supported THUMBNAIL_FORMAT to its MIME type
+var thumbnailContentTypes = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"webp": "image/webp",
+}
+
+// thumbnailExtensions maps each supported THUMBNAIL_FORMAT to its file extension
+var thumbnailExtensions = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"webp": ".webp",
+}
+
+// resampleFilters maps each supported THUMBNAIL_RESAMPLE name to its imaging filter
+var resampleFilters = map[string]imaging.ResampleFilter{
+	"lanczos":    imaging.Lanczos,
+	"catmullrom": imaging.CatmullRom,
+	"linear":     imaging.Linear,
+	"nearest":    imaging.NearestNeighbor,
+}
+
+// Handler holds the AWS service clients and configuration
+type Handler struct {
+	s3Getter               S3Getter
+	s3Putter               S3Putter
+	rekognitionClient      Rekognizer
+	dynamoDBClient         DynamoPutter
+	snsClient              Publisher
+	completionTopicARN     string
+	eventBridgeClient      EventPutter
+	eventBusName           string
+	tableName              string
+	thumbnailWidths        []int
+	thumbnailFormat        string
+	thumbnailResample      imaging.ResampleFilter
+	thumbnailPrefix        string
+	thumbnailBucket        string
+	thumbnailMode          string
+	thumbnailJPEGQuality   int
+	thumbnailProgressive   bool
+	thumbnailNoOverwrite   bool
+	thumbnailDatePartition bool
+	autoOrientOriginal     bool
+	// maxOriginalDimension above zero enables downscaling of oversized originals,
+	// written as a copy or over the upload per optimizeOriginalMode
+	maxOriginalDimension int
+	optimizeOriginalMode string
+	// objectTags are the OBJECT_TAGS names put on processed originals; none
+	// disables tagging of originals and thumbnails alike
+	objectTags        []string
+	watermarkKey      string
+	watermarkPosition string
+	watermarkOpacity  float64
+	watermark         *watermarkCache
+	labelAllowlist    map[string]bool
+	labelBlocklist    map[string]bool
+	// generalLabels holds the REKOGNITION_*_FILTERS settings, nil when none are set
+	generalLabels           *rekognitionTypes.GeneralLabelsSettings
+	imageProperties         bool
+	projectVersionARN       string
+	enableFaces             bool
+	enableText              bool
+	enablePPE               bool
+	ppeRequired             []rekognitionTypes.ProtectiveEquipmentType
+	minModerationConfidence float32
+	quarantineFlagged       bool
+	moderationRequired      bool
+	storeGPS                bool
+	reprocess               bool
+	maxImageBytes           int64
+	useS3Ref                bool
+	streamDecode            bool
+	sseKMSKeyID             string
+	metadataTTLDays         int
+	maxRetries              int
+	maxConcurrency          int
+	partialBatchFailure     bool
+	enableMetrics           bool
+	metricsNamespace        string
+	tracingEnabled          bool
+	logger                  *slog.Logger
+	// rekognitionBreaker skips moderation and label, face, text and PPE
+	// detection while Rekognition is failing; nil when
+	// REKOGNITION_BREAKER_THRESHOLD is 0
+	rekognitionBreaker *circuitBreaker
+}
+
+// NewHandler creates a new Handler with initialized AWS clients
+func NewHandler(ctx context.Context) (*Handler, error) {
+	clients, err := NewClients(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return New(clients)
+}
+
+// NewClients builds the SDK clients from the default AWS configuration
+func NewClients(ctx context.Context) (Clients, error) {
+	// Load AWS configuration
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return Clients{}, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	// Trace AWS calls with X-Ray when running with the X-Ray daemon available
+	// (Lambda sets AWS_XRAY_DAEMON_ADDRESS); otherwise tracing is a no-op
+	if os.Getenv("AWS_XRAY_DAEMON_ADDRESS") != "" {
+		awsv2.AWSV2Instrumentor(&cfg.APIOptions)
+		err = xray.Configure(xray.Config{
+			ContextMissingStrategy: ctxmissing.NewDefaultIgnoreErrorStrategy(),
+		})
+		if err != nil {
+			return Clients{}, fmt.Errorf("failed to configure X-Ray: %w", err)
+		}
+	}
+
+	// withRetry retries the S3, DynamoDB and Rekognition calls itself
+	retried := SingleAttemptConfig(cfg)
+	s3Client := s3.NewFromConfig(retried)
+	return Clients{
+		S3Getter:    s3Client,
+		S3Putter:    s3Client,
+		Rekognition: NewRekognitionClient(retried),
+		DynamoDB:    dynamodb.NewFromConfig(retried),
+		SNS:         sns.NewFromConfig(cfg),
+		EventBridge: eventbridge.NewFromConfig(cfg),
+	}, nil
+}
+
+// SingleAttemptConfig returns a copy of cfg whose clients make one attempt per
+// call. The Handler retries S3, DynamoDB and Rekognition calls up to
+// AWS_MAX_RETRIES times, so clients built with the SDK's default retryer would
+// multiply every retry by its own three attempts.
+func SingleAttemptConfig(cfg aws.Config) aws.Config {
+	cfg.Retryer = func() aws.Retryer {
+		return retry.AddWithMaxAttempts(retry.NewStandard(), 1)
+	}
+	return cfg
+}
+
+// NewRekognitionClient builds the Rekognition client from cfg. Rekognition
+// isn't offered in every region, so REKOGNITION_REGION can point it at another
+// one while S3 and DynamoDB stay in the Lambda's.
+func NewRekognitionClient(cfg aws.Config) *rekognition.Client {
+	return rekognition.NewFromConfig(cfg, func(o *rekognition.Options) {
+		if region := os.Getenv("REKOGNITION_REGION"); region != "" {
+			o.Region = region
+		}
+	})
+}
+
+// New creates a Handler around the given clients, reading its settings from
+// the environment
+func New(clients Clients) (*Handler, error) {
+	tracingEnabled := os.Getenv("AWS_XRAY_DAEMON_ADDRESS") != ""
+
+	// Get DynamoDB table name from environment variable
+	tableName := os.Getenv("DYNAMODB_TABLE_NAME")
+	if tableName == "" {
+		tableName = "image-labels" // default table name
+	}
+
+	// Parse target thumbnail widths (e.g. "150,300,800")
+	thumbnailWidths, err := parseThumbnailWidths(os.Getenv("THUMBNAIL_WIDTHS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid THUMBNAIL_WIDTHS: %w", err)
+	}
+
+	// Get thumbnail output format (jpeg, png or webp). Unset picks per image: PNG
+	// for PNG sources so transparency survives, JPEG for everything else.
+	thumbnailFormat := strings.ToLower(os.Getenv("THUMBNAIL_FORMAT"))
+	if _, ok := thumbnailContentTypes[thumbnailFormat]; thumbnailFormat != "" && !ok {
+		return nil, fmt.Errorf("invalid THUMBNAIL_FORMAT %q: must be jpeg, png or webp", thumbnailFormat)
+	}
+
+	// fit keeps the aspect ratio; fill center-crops square tiles for the grid
+	thumbnailMode := strings.ToLower(os.Getenv("THUMBNAIL_MODE"))
+	if thumbnailMode == "" {
+		thumbnailMode = "fit"
+	}
+	if thumbnailMode != "fit" && thumbnailMode != "fill" {
+		return nil, fmt.Errorf("invalid THUMBNAIL_MODE %q: must be fit or fill", thumbnailMode)
+	}
+
+	// Resize algorithm, trading quality for speed on high-volume buckets
+	resampleName := strings.ToLower(os.Getenv("THUMBNAIL_RESAMPLE"))
+	if resampleName == "" {
+		resampleName = "lanczos"
+	}
+	thumbnailResample, ok := resampleFilters[resampleName]
+	if !ok {
+		return nil, fmt.Errorf("invalid THUMBNAIL_RESAMPLE %q: must be lanczos, catmullrom, linear or nearest", resampleName)
+	}
+
+	// Key prefix for generated thumbnails, always ending in a slash
+	thumbnailPrefix := os.Getenv("THUMBNAIL_PREFIX")
+	if thumbnailPrefix == "" {
+		thumbnailPrefix = "thumbnails/"
+	}
+	if !strings.HasSuffix(thumbnailPrefix, "/") {
+		thumbnailPrefix += "/"
+	}
+
+	// JPEG quality for thumbnails (1-100)
+	thumbnailJPEGQuality, err := envInt("THUMBNAIL_JPEG_QUALITY", 82)
+	if err != nil || thumbnailJPEGQuality > 100 {
+		return nil, fmt.Errorf("invalid THUMBNAIL_JPEG_QUALITY %q: must be between 1 and 100", os.Getenv("THUMBNAIL_JPEG_QUALITY"))
+	}
+
+	// Progressive JPEG thumbnails render a coarse preview while loading
+	thumbnailProgressive, err := envBool("THUMBNAIL_PROGRESSIVE", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Never replace an existing thumbnail object; a racing invocation or a key
+	// collision then leaves the first one in place
+	thumbnailNoOverwrite, err := envBool("THUMBNAIL_NO_OVERWRITE", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Partition thumbnail keys by the date they were generated
+	thumbnailDatePartition, err := envBool("THUMBNAIL_DATE_PARTITION", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tag processed originals so lifecycle rules and cost reports can use them
+	objectTags, err := parseObjectTags(os.Getenv("OBJECT_TAGS"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Overwrite rotated JPEG originals with an upright copy
+	autoOrientOriginal, err := envBool("AUTO_ORIENT_ORIGINAL", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Downscaling originals is lossy, so it is off unless a limit is set
+	maxOriginalDimension, err := envInt("MAX_ORIGINAL_DIMENSION", 0)
+	if err != nil {
+		return nil, err
+	}
+	optimizeOriginalMode := "copy"
+	if v := os.Getenv("OPTIMIZE_ORIGINAL_MODE"); v != "" {
+		if v != "copy" && v != "overwrite" {
+			return nil, fmt.Errorf("invalid OPTIMIZE_ORIGINAL_MODE %q: must be copy or overwrite", v)
+		}
+		optimizeOriginalMode = v
+	}
+
+	// Optional watermark composited onto thumbnails from WATERMARK_S3_KEY
+	watermarkPosition := strings.ToLower(os.Getenv("WATERMARK_POSITION"))
+	if watermarkPosition == "" {
+		watermarkPosition = "bottom-right"
+	}
+	if _, ok := watermarkAnchors[watermarkPosition]; !ok {
+		return nil, fmt.Errorf("invalid WATERMARK_POSITION %q: must be top-left, top-right, bottom-left or bottom-right", watermarkPosition)
+	}
+
+	watermarkOpacity := 0.5
+	if v := os.Getenv("WATERMARK_OPACITY"); v != "" {
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil || parsed <= 0 || parsed > 1 {
+			return nil, fmt.Errorf("invalid WATERMARK_OPACITY %q: must be greater than 0 and at most 1", v)
+		}
+		watermarkOpacity = parsed
+	}
+
+	// Rekognition applies these filters itself; they narrow what it returns
+	// before LABEL_ALLOWLIST and LABEL_BLOCKLIST are checked
+	var generalLabels *rekognitionTypes.GeneralLabelsSettings
+	labelInclusions := parseList(os.Getenv("REKOGNITION_LABEL_INCLUSION_FILTERS"))
+	labelExclusions := parseList(os.Getenv("REKOGNITION_LABEL_EXCLUSION_FILTERS"))
+	categoryInclusions := parseList(os.Getenv("REKOGNITION_CATEGORY_INCLUSION_FILTERS"))
+	categoryExclusions := parseList(os.Getenv("REKOGNITION_CATEGORY_EXCLUSION_FILTERS"))
+	if len(labelInclusions)+len(labelExclusions)+len(categoryInclusions)+len(categoryExclusions) > 0 {
+		generalLabels = &rekognitionTypes.GeneralLabelsSettings{
+			LabelInclusionFilters:         labelInclusions,
+			LabelExclusionFilters:         labelExclusions,
+			LabelCategoryInclusionFilters: categoryInclusions,
+			LabelCategoryExclusionFilters: categoryExclusions,
+		}
+	}
+
+	// Quality scores come from a separately billed DetectLabels feature
+	imageProperties, err := envBool("REKOGNITION_IMAGE_PROPERTIES", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Face detection is billed separately, so allow it to be switched off
+	enableFaces, err := envBool("ENABLE_FACE_DETECTION", true)
+	if err != nil {
+		return nil, err
+	}
+
+	// Text detection (OCR) is opt-in since most uploads are photos
+	enableText, err := envBool("ENABLE_TEXT_DETECTION", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Protective equipment detection is billed separately too; images are only
+	// flagged as violations when PPE_REQUIRED_EQUIPMENT names what's required
+	enablePPE, err := envBool("ENABLE_PPE_DETECTION", false)
+	if err != nil {
+		return nil, err
+	}
+	ppeRequired, err := parsePPEEquipment(os.Getenv("PPE_REQUIRED_EQUIPMENT"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Moderation settings
+	minModerationConfidence := float32(80.0)
+	if v := os.Getenv("MIN_MODERATION_CONFIDENCE"); v != "" {
+		parsed, err := strconv.ParseFloat(v, 32)
+		if err != nil || parsed < 0 || parsed > 100 {
+			return nil, fmt.Errorf("invalid MIN_MODERATION_CONFIDENCE %q: must be between 0 and 100", v)
+		}
+		minModerationConfidence = float32(parsed)
+	}
+
+	quarantineFlagged, err := envBool("QUARANTINE_FLAGGED", false)
+	if err != nil {
+		return nil, err
+	}
+
+	moderationRequired, err := envBool("MODERATION_REQUIRED", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// GPS coordinates reveal where a photo was taken, so only store them on request
+	storeGPS, err := envBool("STORE_GPS", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Force full processing of images that already have complete metadata
+	reprocess, err := envBool("REPROCESS", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Largest image sent to Rekognition as bytes (its own limit is 5MB)
+	maxImageBytes, err := envInt("MAX_IMAGE_BYTES", 5*1024*1024)
+	if err != nil {
+		return nil, err
+	}
+
+	// Days until DynamoDB TTL purges an image's metadata; 0 keeps it forever
+	metadataTTLDays, err := envInt("METADATA_TTL_DAYS", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Let Rekognition read originals straight from S3 instead of re-sending bytes
+	useS3Ref, err := envBool("REKOGNITION_USE_S3REF", false)
+	if err != nil {
+		return nil, err
+	}
+	// Rekognition only reads S3 objects from buckets in its own region
+	if region := os.Getenv("REKOGNITION_REGION"); useS3Ref && region != "" && region != os.Getenv("AWS_REGION") {
+		return nil, fmt.Errorf("REKOGNITION_USE_S3REF requires Rekognition in the bucket's region, but REKOGNITION_REGION is %q", region)
+	}
+
+	// Decode JPEG/PNG originals from the S3 response stream instead of buffering
+	// them; only takes effect with REKOGNITION_USE_S3REF
+	streamDecode, err := envBool("STREAM_DECODE", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Number of retries for throttled or failed AWS calls
+	maxRetries := 2
+	if v := os.Getenv("AWS_MAX_RETRIES"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("invalid AWS_MAX_RETRIES %q: must be a non-negative integer", v)
+		}
+		maxRetries = parsed
+	}
+
+	// Consecutive Rekognition failures after which label detection is skipped
+	// for a cooldown, so an outage doesn't cost every record its full retries
+	breakerThreshold := 5
+	if v := os.Getenv("REKOGNITION_BREAKER_THRESHOLD"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("invalid REKOGNITION_BREAKER_THRESHOLD %q: must be a non-negative integer", v)
+		}
+		breakerThreshold = parsed
+	}
+	breakerWindow, err := envDuration("REKOGNITION_BREAKER_WINDOW", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	breakerCooldown, err := envDuration("REKOGNITION_BREAKER_COOLDOWN", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	var rekognitionBreaker *circuitBreaker
+	if breakerThreshold > 0 {
+		rekognitionBreaker = newCircuitBreaker(breakerThreshold, breakerWindow, breakerCooldown)
+	}
+
+	// Number of S3 records processed in parallel per invocation
+	maxConcurrency, err := envInt("MAX_CONCURRENCY", 4)
+	if err != nil {
+		return nil, err
+	}
+
+	// Consume S3 notifications from SQS and report partial batch failures
+	partialBatchFailure, err := envBool("PARTIAL_BATCH_FAILURE", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// CloudWatch Embedded Metric Format output
+	enableMetrics, err := envBool("ENABLE_METRICS", false)
+	if err != nil {
+		return nil, err
+	}
+
+	metricsNamespace := os.Getenv("METRICS_NAMESPACE")
+	if metricsNamespace == "" {
+		metricsNamespace = "ImageProcessor"
+	}
+
+	// Initialize structured logger for CloudWatch
+	logLevel, err := ParseLogLevel(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		return nil, err
+	}
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: logLevel,
+	}))
+
+	return &Handler{
+		s3Getter:                clients.S3Getter,
+		s3Putter:                clients.S3Putter,
+		rekognitionClient:       clients.Rekognition,
+		dynamoDBClient:          clients.DynamoDB,
+		snsClient:               clients.SNS,
+		completionTopicARN:      os.Getenv("COMPLETION_SNS_TOPIC_ARN"),
+		eventBridgeClient:       clients.EventBridge,
+		eventBusName:            os.Getenv("EVENTBRIDGE_BUS_NAME"),
+		tableName:               tableName,
+		thumbnailWidths:         thumbnailWidths,
+		thumbnailFormat:         thumbnailFormat,
+		thumbnailMode:           thumbnailMode,
+		thumbnailResample:       thumbnailResample,
+		thumbnailPrefix:         thumbnailPrefix,
+		thumbnailBucket:         os.Getenv("THUMBNAIL_BUCKET"),
+		thumbnailJPEGQuality:    thumbnailJPEGQuality,
+		thumbnailProgressive:    thumbnailProgressive,
+		thumbnailNoOverwrite:    thumbnailNoOverwrite,
+		thumbnailDatePartition:  thumbnailDatePartition,
+		autoOrientOriginal:      autoOrientOriginal,
+		maxOriginalDimension:    maxOriginalDimension,
+		optimizeOriginalMode:    optimizeOriginalMode,
+		objectTags:              objectTags,
+		watermarkKey:            os.Getenv("WATERMARK_S3_KEY"),
+		watermarkPosition:       watermarkPosition,
+		watermarkOpacity:        watermarkOpacity,
+		watermark:               &watermarkCache{},
+		labelAllowlist:          parseNameSet(os.Getenv("LABEL_ALLOWLIST")),
+		labelBlocklist:          parseNameSet(os.Getenv("LABEL_BLOCKLIST")),
+		generalLabels:           generalLabels,
+		imageProperties:         imageProperties,
+		projectVersionARN:       os.Getenv("REKOGNITION_PROJECT_VERSION_ARN"),
+		rekognitionBreaker:      rekognitionBreaker,
+		enableFaces:             enableFaces,
+		enableText:              enableText,
+		enablePPE:               enablePPE,
+		ppeRequired:             ppeRequired,
+		minModerationConfidence: minModerationConfidence,
+		quarantineFlagged:       quarantineFlagged,
+		moderationRequired:      moderationRequired,
+		storeGPS:                storeGPS,
+		reprocess:               reprocess,
+		maxImageBytes:           int64(maxImageBytes),
+		useS3Ref:                useS3Ref,
+		streamDecode:            streamDecode,
+		sseKMSKeyID:             os.Getenv("S3_SSE_KMS_KEY_ID"),
+		metadataTTLDays:         metadataTTLDays,
+		maxRetries:              maxRetries,
+		maxConcurrency:          maxConcurrency,
+		partialBatchFailure:     partialBatchFailure,
+		enableMetrics:           enableMetrics,
+		metricsNamespace:        metricsNamespace,
+		tracingEnabled:          tracingEnabled,
+		logger:                  logger,
+	}, nil
+}
+
+// withLogger returns a shallow copy of h that logs through logger
+func (h *Handler) withLogger(logger *slog.Logger) *Handler {
+	scoped := *h
+	scoped.logger = logger
+	return &scoped
+}
+
+// WithTable returns a shallow copy of h using tableName in place of
+// DYNAMODB_TABLE_NAME, for tools that take the table from a flag
+func (h *Handler) WithTable(tableName string) *Handler {
+	scoped := *h
+	scoped.tableName = tableName
+	return &scoped
+}
+
+// PartialBatchFailure reports whether the function is fed through SQS and should
+// be started with HandleSQSEvent rather than HandleS3Event
+func (h *Handler) PartialBatchFailure() bool {
+	return h.partialBatchFailure
+}
+
+// logLevels maps the accepted LOG_LEVEL values to slog levels
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// ParseLogLevel maps a LOG_LEVEL value (debug, info, warn or error, in any
+// case) to its slog level. Empty means info. The API uses it too, so both
+// Lambdas accept the same values.
+func ParseLogLevel(value string) (slog.Level, error) {
+	if value == "" {
+		return slog.LevelInfo, nil
+	}
+	level, ok := logLevels[strings.ToLower(value)]
+	if !ok {
+		return 0, fmt.Errorf("invalid LOG_LEVEL %q: must be debug, info, warn or error", value)
+	}
+	return level, nil
+}
+
+// envBool reads a boolean environment variable, returning def when it is unset
+func envBool(name string, def bool) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: must be true or false", name, value)
+	}
+	return parsed, nil
+}
+
+// envInt reads a positive integer environment variable, returning def when it is unset
+func envInt(name string, def int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a positive integer", name, value)
+	}
+	return parsed, nil
+}
+
+// envDuration reads a positive duration environment variable such as "30s",
+// returning def when it is unset
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a positive duration", name, value)
+	}
+	return parsed, nil
+}
+
+// parseNameSet splits a comma-separated list into a set of lowercased names.
+// An empty value yields an empty set.
+func parseNameSet(value string) map[string]bool {
+	names := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// parseList splits a comma-separated list into its trimmed, non-empty entries,
+// keeping their case. An empty value yields nil.
+func parseList(value string) []string {
+	var entries []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// srcsetWidths is the responsive ladder THUMBNAIL_WIDTHS=srcset selects; as with
+// any list, sizes wider than the source are skipped
+var srcsetWidths = []int{320, 640, 960, 1280}
+
+// parseThumbnailWidths parses a comma-separated list of widths into a sorted,
+// de-duplicated slice. An empty value falls back to the default 300px width and
+// "srcset" selects srcsetWidths.
+func parseThumbnailWidths(value string) ([]int, error) {
+	switch strings.TrimSpace(value) {
+	case "":
+		return []int{300}, nil
+	case "srcset":
+		return append([]int(nil), srcsetWidths...), nil
+	}
+
+	seen := make(map[int]bool)
+	widths := make([]int, 0)
+	for _, part := range strings.Split(value, ",") {
+		width, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("width %q is not a number", part)
+		}
+		if width <= 0 {
+			return nil, fmt.Errorf("width %d must be positive", width)
+		}
+		if !seen[width] {
+			seen[width] = true
+			widths = append(widths, width)
+		}
+	}
+
+	sort.Ints(widths)
+	return widths, nil
+}
+
+// HandleS3Event processes S3 PutObject events
+func (h *Handler) HandleS3Event(ctx context.Context, s3Event events.S3Event) error {
+	// Process records concurrently, bounded by MAX_CONCURRENCY. Every record runs
+	// to completion so the returned error can name each one that failed.
+	errs := make([]error, len(s3Event.Records))
+	var g errgroup.Group
+	g.SetLimit(h.maxConcurrency)
+
+	for i, record := range s3Event.Records {
+		g.Go(func() error {
+			err := h.processS3Record(ctx, record)
+			if err != nil {
+				h.logger.Error("failed to process S3 record",
+					slog.String("bucket", record.S3.Bucket.Name),
+					slog.String("key", record.S3.Object.Key),
+					slog.String("error", err.Error()),
+				)
+				errs[i] = fmt.Errorf("failed to process record %s/%s: %w",
+					record.S3.Bucket.Name, record.S3.Object.Key, err)
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	return errors.Join(errs...)
+}
+
+// HandleSQSEvent processes S3 notifications delivered through SQS and reports
+// per-message outcomes, so Lambda only retries the messages that failed
+func (h *Handler) HandleSQSEvent(ctx context.Context, sqsEvent events.SQSEvent) (events.SQSEventResponse, error) {
+	failed := make([]bool, len(sqsEvent.Records))
+	var g errgroup.Group
+	g.SetLimit(h.maxConcurrency)
+
+	for i, message := range sqsEvent.Records {
+		g.Go(func() error {
+			var s3Event events.S3Event
+			if err := json.Unmarshal([]byte(message.Body), &s3Event); err != nil {
+				h.logger.Error("failed to parse S3 event from SQS message",
+					slog.String("message_id", message.MessageId),
+					slog.String("error", err.Error()),
+				)
+				failed[i] = true
+				return nil
+			}
+
+			for _, record := range s3Event.Records {
+				if err := h.processS3Record(ctx, record); err != nil {
+					h.logger.Error("failed to process S3 record",
+						slog.String("message_id", message.MessageId),
+						slog.String("bucket", record.S3.Bucket.Name),
+						slog.String("key", record.S3.Object.Key),
+						slog.String("error", err.Error()),
+					)
+					failed[i] = true
+					return nil
+				}
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	response := events.SQSEventResponse{
+		BatchItemFailures: []events.SQSBatchItemFailure{},
+	}
+	for i, message := range sqsEvent.Records {
+		if failed[i] {
+			response.BatchItemFailures = append(response.BatchItemFailures,
+				events.SQSBatchItemFailure{ItemIdentifier: message.MessageId})
+		}
+	}
+
+	return response, nil
+}
+
+// processS3Record handles individual S3 event records
+func (h *Handler) processS3Record(ctx context.Context, record events.S3EventRecord) (err error) {
+	bucket := record.S3.Bucket.Name
+	size := record.S3.Object.Size
+
+	// Notification keys are URL-encoded (spaces arrive as '+'); the decoded form
+	// is filled in when the event is unmarshaled
+	key := record.S3.Object.URLDecodedKey
+	if key == "" {
+		key = record.S3.Object.Key
+	}
+
+	// Guard: never process the Lambda's own output, even when a notification or a
+	// THUMBNAIL_PREFIX under images/ would otherwise let it loop
+	for _, prefix := range []string{h.thumbnailPrefix, "converted/", "quarantine/", optimizedPrefix} {
+		if strings.HasPrefix(key, prefix) {
+			h.logger.Debug("skipping derived object",
+				slog.String("key", key),
+				slog.String("prefix", prefix),
+			)
+			return nil
+		}
+	}
+
+	// Guard: Only process files in the "images/" directory to prevent recursion
+	// This prevents the Lambda from triggering on its own output (thumbnails/)
+	if len(key) < 7 || key[:7] != "images/" {
+		h.logger.Info("skipping non-image object",
+			slog.String("key", key),
+			slog.String("reason", "not in images/ prefix"),
+		)
+		return nil
+	}
+
+	// Re-delivered or backfilled events for an already processed image would
+	// repeat the paid Rekognition calls, so skip them unless REPROCESS is set.
+	// Placeholders and failed records are always processed.
+	if !h.reprocess {
+		done, err := h.alreadyProcessed(ctx, key)
+		if err != nil {
+			return fmt.Errorf("failed to check existing metadata: %w", err)
+		}
+		if done {
+			h.logger.Info("skipping already processed image",
+				slog.String("key", key),
+				slog.String("reason", "status complete; set REPROCESS=true to force"),
+			)
+			return nil
+		}
+	}
+
+	h.logger.Info("processing image",
+		slog.String("bucket", bucket),
+		slog.String("key", key),
+		slog.Int64("size", size),
+		slog.String("event_time", record.EventTime.String()),
+	)
+
+	metadata := ImageMetadata{
+		ImageKey:   key,
+		BucketName: bucket,
+		ImageSize:  size,
+	}
+
+	// Registered first so it runs last, after a permanent failure is recorded
+	defer func() { h.notifyOutcome(ctx, &metadata, err) }()
+
+	// Failures retrying can't fix are saved as a failed record so the gallery can
+	// show them, and swallowed so Lambda doesn't retry. Registered before the
+	// metrics defer so metrics still see the original error.
+	defer func() {
+		if err != nil && isPermanent(err) {
+			err = h.saveFailure(ctx, &metadata, err)
+		}
+	}()
+
+	// Track the pipeline stage so failures can be attributed in metrics
+	start := time.Now()
+	stage := "download"
+	defer func() {
+		h.recordProcessingMetrics(stage, time.Since(start), &metadata, err)
+	}()
+
+	// Step 1: Download image from S3. With STREAM_DECODE, a JPEG/PNG original
+	// Rekognition reads by S3 reference is decoded straight from the response
+	// body; imageBytes then holds only its header, which is all the later steps
+	// need, and img is already set.
+	var (
+		imageBytes     []byte
+		objectMetadata map[string]string
+		img            image.Image
+		contentHash    string
+	)
+	downloadCtx, endDownload := h.beginSubsegment(ctx, "download", key)
+	if h.streamDecode && h.useS3Ref && size <= maxRekognitionS3ObjectBytes {
+		imageBytes, img, contentHash, objectMetadata, err = h.downloadStreamed(downloadCtx, bucket, key)
+	} else {
+		imageBytes, objectMetadata, err = h.downloadImage(downloadCtx, bucket, key)
+	}
+	endDownload(err)
+	if err != nil {
+		h.logger.Error("failed to download image from S3",
+			slog.String("bucket", bucket),
+			slog.String("key", key),
+			slog.String("error", err.Error()),
+		)
+		return fmt.Errorf("failed to download image: %w", err)
+	}
+
+	h.logger.Info("successfully downloaded image",
+		slog.String("key", key),
+		slog.Int("bytes_buffered", len(imageBytes)),
+		slog.Bool("streamed", img != nil),
+	)
+
+	// Uploads made through the API carry its request ID; log under it from here on
+	if id := objectMetadata[CorrelationIDMetadataKey]; id != "" {
+		h = h.withLogger(h.logger.With(slog.String("request_id", id)))
+	}
+
+	// The upload API asks clients to attach the display filename as user metadata
+	if name, err := url.PathUnescape(objectMetadata[OriginalFilenameMetadataKey]); err == nil {
+		metadata.OriginalFilename = name
+	}
+	metadata.Owner = objectMetadata[OwnerMetadataKey]
+	metadata.CustomMetadata = customMetadata(objectMetadata)
+
+	// Step 2: Verify the bytes really are a supported image. The upload URL is
+	// presigned for a client-declared content type, so this is the first point
+	// where the actual content can be checked.
+	detectedType := detectImageType(imageBytes)
+	if !allowedImageTypes[detectedType] {
+		h.logger.Warn("deleting object with unsupported content",
+			slog.String("bucket", bucket),
+			slog.String("key", key),
+			slog.String("detected_type", detectedType),
+		)
+
+		err = h.withRetry(ctx, "S3 DeleteObject", func() error {
+			_, err := h.s3Putter.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(key),
+			})
+			return err
+		})
+		if err != nil {
+			h.logger.Error("failed to delete unsupported object",
+				slog.String("bucket", bucket),
+				slog.String("key", key),
+				slog.String("error", err.Error()),
+			)
+			return fmt.Errorf("failed to delete unsupported object: %w", err)
+		}
+		return nil
+	}
+
+	// Step 3: Hash the content and short-circuit re-uploads of an existing image,
+	// skipping Rekognition and thumbnails to save cost
+	if contentHash == "" {
+		hash := sha256.Sum256(imageBytes)
+		contentHash = hex.EncodeToString(hash[:])
+	}
+	metadata.ContentHash = contentHash
+
+	original, err := h.findDuplicate(ctx, metadata.ContentHash, key)
+	if err != nil {
+		// Duplicate detection is an optimisation; fall back to full processing
+		h.logger.Warn("failed to check for duplicate image",
+			slog.String("key", key),
+			slog.String("error", err.Error()),
+		)
+	}
+	if original != nil {
+		metadata.DuplicateOf = original.ImageKey
+		metadata.ModerationFlagged = original.ModerationFlagged
+		metadata.ModerationLabels = original.ModerationLabels
+
+		h.logger.Info("image is a duplicate, skipping analysis",
+			slog.String("key", key),
+			slog.String("duplicate_of", original.ImageKey),
+		)
+
+		// A copy of flagged content is quarantined like the original was,
+		// rather than left in place under a new key
+		if metadata.ModerationFlagged && h.quarantineFlagged {
+			quarantineKey, err := h.quarantineImage(ctx, bucket, key)
+			if err != nil {
+				h.logger.Error("failed to quarantine flagged duplicate",
+					slog.String("bucket", bucket),
+					slog.String("key", key),
+					slog.String("error", err.Error()),
+				)
+				return fmt.Errorf("failed to quarantine image: %w", err)
+			}
+			metadata.QuarantineKey = quarantineKey
+		}
+
+		stage = "dynamodb"
+		saveCtx, endSave := h.beginSubsegment(ctx, "dynamodb", key)
+		err = h.saveMetadata(saveCtx, &metadata)
+		endSave(err)
+		if err != nil {
+			h.logger.Error("failed to save metadata to DynamoDB",
+				slog.String("bucket", bucket),
+				slog.String("key", key),
+				slog.String("error", err.Error()),
+			)
+			return fmt.Errorf("failed to save metadata: %w", err)
+		}
+		return nil
+	}
+
+	// Step 4: Extract EXIF from the original bytes (JPEG/TIFF only), before any
+	// transcoding drops it. Missing or malformed EXIF leaves the field empty.
+	if isJPEG(imageBytes) || isTIFF(imageBytes) {
+		metadata.Exif = h.extractEXIF(imageBytes)
+	}
+
+	stage = "decode"
+
+	// Step 5: Transcode HEIC and TIFF to a stored JPEG, since Rekognition can't
+	// read them and most browsers can't display them
+	if isHEIC(imageBytes) || isTIFF(imageBytes) {
+		convertedBytes, convertedKey, err := h.convertToJPEG(ctx, bucket, key, imageBytes)
+		if err != nil {
+			h.logger.Error("failed to convert image",
+				slog.String("bucket", bucket),
+				slog.String("key", key),
+				slog.String("detected_type", detectedType),
+				slog.String("error", err.Error()),
+			)
+			return fmt.Errorf("failed to convert %s image: %w", detectedType, err)
+		}
+		imageBytes = convertedBytes
+		metadata.ConvertedKey = convertedKey
+
+		h.logger.Info("successfully converted image",
+			slog.String("key", key),
+			slog.String("detected_type", detectedType),
+			slog.String("converted_key", convertedKey),
+		)
+	}
+
+	// Step 6: Flatten GIFs to their first frame, since Rekognition only accepts
+	// JPEG and PNG. The original GIF is left untouched in S3.
+	if isGIF(imageBytes) {
+		frameCount, err := gifFrameCount(imageBytes)
+		if err != nil {
+			h.logger.Error("failed to decode GIF frames",
+				slog.String("bucket", bucket),
+				slog.String("key", key),
+				slog.String("error", err.Error()),
+			)
+			return permanent(fmt.Errorf("failed to decode GIF: %w", err))
+		}
+		metadata.IsAnimated = frameCount > 1
+		metadata.FrameCount = frameCount
+
+		imageBytes, err = transcodeToJPEG(imageBytes)
+		if err != nil {
+			h.logger.Error("failed to transcode GIF first frame",
+				slog.String("bucket", bucket),
+				slog.String("key", key),
+				slog.String("error", err.Error()),
+			)
+			return permanent(fmt.Errorf("failed to transcode GIF: %w", err))
+		}
+
+		h.logger.Info("extracted first frame of GIF",
+			slog.String("key", key),
+			slog.Int("frame_count", frameCount),
+		)
+	}
+
+	// BMP and WebP display in browsers as they are, so only Rekognition gets a
+	// JPEG copy
+	if isBMP(imageBytes) || isWebP(imageBytes) {
+		imageBytes, err = transcodeToJPEG(imageBytes)
+		if err != nil {
+			h.logger.Error("failed to transcode image",
+				slog.String("bucket", bucket),
+				slog.String("key", key),
+				slog.String("detected_type", detectedType),
+				slog.String("error", err.Error()),
+			)
+			return permanent(fmt.Errorf("failed to transcode %s image: %w", detectedType, err))
+		}
+	}
+
+	// Step 7: Decode the image, unless it was streamed, and record its dimensions
+	if img == nil {
+		img, err = decodeImage(imageBytes)
+		if err != nil {
+			h.logger.Error("failed to decode image",
+				slog.String("bucket", bucket),
+				slog.String("key", key),
+				slog.String("error", err.Error()),
+			)
+			return permanent(fmt.Errorf("failed to decode image: %w", err))
+		}
+	}
+	metadata.Width = img.Bounds().Dx()
+	metadata.Height = img.Bounds().Dy()
+	metadata.PHash = perceptualHash(img)
+
+	// With AUTO_ORIENT_ORIGINAL, prepare an upright copy of a rotated JPEG now;
+	// the original is only overwritten once the metadata is saved. Upright
+	// originals are left alone to avoid a lossy re-encode.
+	var oriented []byte
+	if h.autoOrientOriginal && metadata.ConvertedKey == "" && isJPEG(imageBytes) {
+		if orientation := jpegOrientation(imageBytes); orientation != 1 {
+			oriented, err = encodeOrientedJPEG(img, imageBytes)
+			if err != nil {
+				h.logger.Warn("failed to re-encode original upright",
+					slog.String("key", key),
+					slog.String("error", err.Error()),
+				)
+				oriented = nil
+			} else {
+				metadata.OriginalOrientation = orientation
+			}
+		}
+	}
+
+	// With MAX_ORIGINAL_DIMENSION, prepare a downscaled copy of an oversized
+	// JPEG/PNG original. It is built from the upright img, so in overwrite mode
+	// it also stands in for the oriented copy.
+	var optimized *optimizedOriginal
+	if h.maxOriginalDimension > 0 && metadata.ConvertedKey == "" && (isJPEG(imageBytes) || isPNG(imageBytes)) {
+		optimized, err = h.optimizeOriginal(img, imageBytes, size)
+		if err != nil {
+			h.logger.Warn("failed to optimize original",
+				slog.String("key", key),
+				slog.String("error", err.Error()),
+			)
+			optimized = nil
+		}
+		if optimized != nil {
+			metadata.OriginalOptimized = true
+			metadata.OptimizedBytes = int64(len(optimized.Data))
+			metadata.OptimizedWidth = optimized.Width
+			metadata.OptimizedHeight = optimized.Height
+		}
+	}
+
+	// Step 8: Decide how to hand the image to Rekognition. In S3 reference mode an
+	// untouched JPEG/PNG original is read by Rekognition directly; otherwise bytes
+	// are sent, downscaling a copy when over the 5MB bytes limit.
+	var rekognitionImage *rekognitionTypes.Image
+	// The check is on the sniffed type of the upload, since imageBytes may
+	// already hold a transcoded copy
+	if h.useS3Ref && rekognitionTypesReadable[detectedType] && size <= maxRekognitionS3ObjectBytes {
+		rekognitionImage = s3ObjectImage(bucket, key)
+
+		h.logger.Info("using S3 object reference for Rekognition",
+			slog.String("key", key),
+		)
+	} else if int64(len(imageBytes)) > h.maxImageBytes {
+		downscaled, err := downscaleToFit(img, h.maxImageBytes)
+		if err != nil {
+			h.logger.Error("failed to downscale image for Rekognition",
+				slog.String("bucket", bucket),
+				slog.String("key", key),
+				slog.String("error", err.Error()),
+			)
+			return permanent(fmt.Errorf("failed to downscale image: %w", err))
+		}
+		rekognitionImage = bytesImage(downscaled)
+
+		h.logger.Info("using downscaled copy for Rekognition",
+			slog.String("key", key),
+			slog.Int("original_bytes", len(imageBytes)),
+			slog.Int("downscaled_bytes", len(downscaled)),
+		)
+	} else {
+		rekognitionImage = bytesImage(imageBytes)
+
+		h.logger.Debug("using original bytes for Rekognition",
+			slog.String("key", key),
+			slog.Int("bytes", len(imageBytes)),
+		)
+	}
+
+	stage = "rekognition"
+
+	// Steps 9-12b go through the Rekognition circuit breaker; while it is open
+	// they are skipped and listed in skipped_detections rather than failing the
+	// record, except moderation when MODERATION_REQUIRED is set
+	skipDetection := func(detection string) {
+		metadata.SkippedDetections = append(metadata.SkippedDetections, detection)
+		h.logger.Warn("skipped detection: Rekognition circuit breaker is open",
+			slog.String("key", key),
+			slog.String("detection", detection),
+		)
+	}
+
+	// Step 9: Check for unsafe content before anything is surfaced
+	var moderationLabels []LabelInfo
+	if probe, ok := h.rekognitionBreaker.allow(); ok {
+		moderationCtx, endModeration := h.beginSubsegment(ctx, "rekognition.moderation", key)
+		moderationLabels, err = h.moderateImage(moderationCtx, rekognitionImage)
+		endModeration(err)
+		h.recordRekognition(probe, err)
+		if err != nil {
+			h.logger.Error("failed to moderate image with Rekognition",
+				slog.String("bucket", bucket),
+				slog.String("key", key),
+				slog.Bool("moderation_required", h.moderationRequired),
+				slog.String("error", err.Error()),
+			)
+			if h.moderationRequired {
+				return fmt.Errorf("failed to moderate image: %w", err)
+			}
+		}
+	} else if h.moderationRequired {
+		return fmt.Errorf("failed to moderate image: %w", errRekognitionBreakerOpen)
+	} else {
+		skipDetection("moderation")
+	}
+
+	if len(moderationLabels) > 0 {
+		metadata.ModerationFlagged = true
+		metadata.ModerationLabels = moderationLabels
+
+		h.logger.Warn("image flagged by moderation",
+			slog.String("key", key),
+			slog.Int("moderation_label_count", len(moderationLabels)),
+		)
+
+		if h.quarantineFlagged {
+			quarantineKey, err := h.quarantineImage(ctx, bucket, key)
+			if err != nil {
+				h.logger.Error("failed to quarantine flagged image",
+					slog.String("bucket", bucket),
+					slog.String("key", key),
+					slog.String("error", err.Error()),
+				)
+				return fmt.Errorf("failed to quarantine image: %w", err)
+			}
+			metadata.QuarantineKey = quarantineKey
+
+			// The original is gone, so point Rekognition at the quarantined copy
+			if rekognitionImage.S3Object != nil {
+				rekognitionImage = s3ObjectImage(bucket, quarantineKey)
+			}
+
+			h.logger.Info("moved flagged image to quarantine",
+				slog.String("key", key),
+				slog.String("quarantine_key", quarantineKey),
+			)
+		}
+	}
+
+	// Step 10: Call Rekognition to detect labels, unless the circuit breaker
+	// is open after repeated failures; the image is then saved without them
+	if probe, ok := h.rekognitionBreaker.allow(); ok {
+		labelsCtx, endLabels := h.beginSubsegment(ctx, "rekognition.labels", key)
+		labels, quality, err := h.detectLabels(labelsCtx, rekognitionImage)
+		endLabels(err)
+		h.recordRekognition(probe, err)
+		if err != nil {
+			h.logger.Error("failed to detect labels with Rekognition",
+				slog.String("bucket", bucket),
+				slog.String("key", key),
+				slog.String("error", err.Error()),
+			)
+			// The image decoded here even though Rekognition rejected it, so the
+			// failure record still gets thumbnails to show
+			if isPermanent(err) && !metadata.ModerationFlagged {
+				h.thumbnailFailedImage(ctx, &metadata, bucket, key, img, imageBytes)
+			}
+			return fmt.Errorf("failed to detect labels: %w", err)
+		}
+		metadata.DetectedLabels = labels
+		metadata.ImageQuality = quality
+
+		h.logger.Info("successfully detected labels",
+			slog.String("key", key),
+			slog.Int("label_count", len(labels)),
+		)
+	} else {
+		metadata.LabelsSkipped = true
+		h.logger.Warn("skipped label detection: Rekognition circuit breaker is open",
+			slog.String("key", key),
+		)
+	}
+
+	// Step 11: Detect faces (optional)
+	if h.enableFaces {
+		if probe, ok := h.rekognitionBreaker.allow(); !ok {
+			skipDetection("faces")
+		} else {
+			facesCtx, endFaces := h.beginSubsegment(ctx, "rekognition.faces", key)
+			faces, err := h.detectFaces(facesCtx, rekognitionImage)
+			endFaces(err)
+			h.recordRekognition(probe, err)
+			if err != nil {
+				h.logger.Error("failed to detect faces with Rekognition",
+					slog.String("bucket", bucket),
+					slog.String("key", key),
+					slog.String("error", err.Error()),
+				)
+				return fmt.Errorf("failed to detect faces: %w", err)
+			}
+			metadata.Faces = faces
+
+			h.logger.Info("successfully detected faces",
+				slog.String("key", key),
+				slog.Int("face_count", len(faces)),
+			)
+		}
+	}
+
+	// Step 12: Detect text (optional)
+	if h.enableText {
+		if probe, ok := h.rekognitionBreaker.allow(); !ok {
+			skipDetection("text")
+		} else {
+			textCtx, endText := h.beginSubsegment(ctx, "rekognition.text", key)
+			text, err := h.detectText(textCtx, rekognitionImage)
+			endText(err)
+			h.recordRekognition(probe, err)
+			if err != nil {
+				h.logger.Error("failed to detect text with Rekognition",
+					slog.String("bucket", bucket),
+					slog.String("key", key),
+					slog.String("error", err.Error()),
+				)
+				return fmt.Errorf("failed to detect text: %w", err)
+			}
+			metadata.DetectedText = text
+			metadata.TextBlob = textBlob(text)
+
+			h.logger.Info("successfully detected text",
+				slog.String("key", key),
+				slog.Int("line_count", len(text)),
+			)
+		}
+	}
+
+	// Step 12b: Detect protective equipment (optional)
+	if h.enablePPE {
+		if probe, ok := h.rekognitionBreaker.allow(); !ok {
+			skipDetection("ppe")
+		} else {
+			ppeCtx, endPPE := h.beginSubsegment(ctx, "rekognition.ppe", key)
+			persons, violation, err := h.detectPPE(ppeCtx, rekognitionImage)
+			endPPE(err)
+			h.recordRekognition(probe, err)
+			if err != nil {
+				h.logger.Error("failed to detect protective equipment with Rekognition",
+					slog.String("bucket", bucket),
+					slog.String("key", key),
+					slog.String("error", err.Error()),
+				)
+				return fmt.Errorf("failed to detect protective equipment: %w", err)
+			}
+			metadata.PPE = persons
+			metadata.PPEViolation = violation
+
+			if violation {
+				h.logger.Warn("image is missing required protective equipment",
+					slog.String("key", key),
+					slog.Int("person_count", len(persons)),
+				)
+			}
+		}
+	}
+
+	stage = "thumbnail"
+
+	// Step 13: Generate and Upload Thumbnails
+	// Flagged content gets no thumbnail so it never shows up in the gallery.
+	if !metadata.ModerationFlagged {
+		thumbnailCtx, endThumbnail := h.beginSubsegment(ctx, "thumbnail", key)
+		thumbnails, err := h.generateAndUploadThumbnail(thumbnailCtx, bucket, key, img, h.thumbnailFormatFor(imageBytes))
+		endThumbnail(err)
+		if err != nil {
+			h.logger.Error("failed to generate thumbnail",
+				slog.String("bucket", bucket),
+				slog.String("key", key),
+				slog.String("error", err.Error()),
+			)
+			// We rely on the thumbnail, so we should probably fail or at least log error.
+			// For now let's just log and continue with empty thumbnail key if it fails?
+			// User requested thumbnail generation, so it's better to verify it works.
+			// Let's propagate error to retry.
+			return fmt.Errorf("failed to generate thumbnail: %w", err)
+		}
+		metadata.applyThumbnails(h.thumbnailMode, thumbnails)
+
+		h.logger.Info("successfully generated thumbnails",
+			slog.String("thumbnail_key", thumbnails.PrimaryKey),
+			slog.Int("thumbnail_count", len(thumbnails.Keys)),
+		)
+	}
+
+	// Step 13b: Store the optimized copy beside the original. A failure only
+	// leaves the image without one.
+	if optimized != nil && h.optimizeOriginalMode == "copy" && metadata.QuarantineKey == "" {
+		optimizedKey, err := h.uploadOptimizedCopy(ctx, bucket, key, optimized)
+		if err != nil {
+			h.logger.Warn("failed to store optimized original",
+				slog.String("key", key),
+				slog.String("error", err.Error()),
+			)
+			metadata.OriginalOptimized = false
+			metadata.OptimizedBytes, metadata.OptimizedWidth, metadata.OptimizedHeight = 0, 0, 0
+		} else {
+			metadata.OptimizedKey = optimizedKey
+		}
+	}
+
+	stage = "dynamodb"
+
+	// Step 14: Save metadata and labels to DynamoDB
+	saveCtx, endSave := h.beginSubsegment(ctx, "dynamodb", key)
+	err = h.saveMetadata(saveCtx, &metadata)
+	endSave(err)
+	if err != nil {
+		h.logger.Error("failed to save metadata to DynamoDB",
+			slog.String("bucket", bucket),
+			slog.String("key", key),
+			slog.String("error", err.Error()),
+		)
+		return fmt.Errorf("failed to save metadata: %w", err)
+	}
+
+	// Step 15: Replace a rotated original with its upright copy, or an oversized
+	// one with its optimized copy in overwrite mode. The metadata is already
+	// saved, so a failure here only leaves the original as uploaded.
+	rewrite, rewriteType := oriented, "image/jpeg"
+	if optimized != nil && h.optimizeOriginalMode == "overwrite" {
+		rewrite, rewriteType = optimized.Data, optimized.ContentType
+	}
+	if rewrite != nil && metadata.QuarantineKey == "" {
+		if err := h.rewriteOriginal(ctx, bucket, key, rewrite, rewriteType, objectMetadata); err != nil {
+			h.logger.Warn("failed to rewrite original",
+				slog.String("key", key),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+
+	// Step 16: Tag the original for lifecycle rules and cost reports. This is
+	// optional, so a failure is only logged.
+	if len(h.objectTags) > 0 && metadata.QuarantineKey == "" {
+		if err := h.tagOriginal(ctx, bucket, key, metadata.DetectedLabels); err != nil {
+			h.logger.Warn("failed to tag original",
+				slog.String("key", key),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+
+	h.logger.Info("successfully processed image",
+		slog.String("bucket", bucket),
+		slog.String("key", key),
+		slog.Int("labels_saved", len(metadata.DetectedLabels)),
+	)
+
+	return nil
+}
+
+// thumbnailFailedImage generates thumbnails for an image about to be recorded as
+// failed. It is best-effort: an error is logged and the record saved without.
+func (h *Handler) thumbnailFailedImage(ctx context.Context, metadata *ImageMetadata, bucket, key string, img image.Image, imageBytes []byte) {
+	thumbnails, err := h.generateAndUploadThumbnail(ctx, bucket, key, img, h.thumbnailFormatFor(imageBytes))
+	if err != nil {
+		h.logger.Warn("failed to generate thumbnail for failed image",
+			slog.String("key", key),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+	metadata.applyThumbnails(h.thumbnailMode, thumbnails)
+}
+
+// downloadImage downloads an image from S3 and returns its bytes
+func (h *Handler) downloadImage(ctx context.Context, bucket, key string) ([]byte, map[string]string, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+
+	var result *s3.GetObjectOutput
+	err := h.withRetry(ctx, "S3 GetObject", func() error {
+		var err error
+		result, err = h.s3Getter.GetObject(ctx, input)
+		return err
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("S3 GetObject failed: %w", err)
+	}
+	defer result.Body.Close()
+
+	imageBytes, err := io.ReadAll(result.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read S3 object body: %w", err)
+	}
+
+	return imageBytes, result.Metadata, nil
+}
+
+// allowedImageTypes lists the sniffed content types the processor accepts
+var allowedImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/heic": true,
+	"image/tiff": true,
+	"image/bmp":  true,
+	"image/webp": true,
+}
+
+// rekognitionTypesReadable lists the formats Rekognition accepts as-is; the rest
+// are transcoded to JPEG first
+var rekognitionTypesReadable = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+}
+
+// detectImageType sniffs the content type from the leading bytes.
+// http.DetectContentType doesn't recognise HEIC or TIFF, so those are checked first.
+func detectImageType(imageBytes []byte) string {
+	if isHEIC(imageBytes) {
+		return "image/heic"
+	}
+	if isTIFF(imageBytes) {
+		return "image/tiff"
+	}
+	return http.DetectContentType(imageBytes)
+}
+
+// heicBrands lists the ISO-BMFF major brands used by HEIC/HEIF files
+var heicBrands = map[string]bool{
+	"heic": true, "heix": true, "hevc": true, "hevx": true,
+	"heim": true, "heis": true, "mif1": true, "msf1": true,
+}
+
+// isHEIC reports whether the bytes look like a HEIC/HEIF file by checking the ftyp box
+func isHEIC(imageBytes []byte) bool {
+	if len(imageBytes) < 12 || string(imageBytes[4:8]) != "ftyp" {
+		return false
+	}
+	return heicBrands[string(imageBytes[8:12])]
+}
+
+// thumbnailFormatFor returns THUMBNAIL_FORMAT when set, otherwise png for PNG
+// sources (keeping their alpha channel) and jpeg for the rest
+func (h *Handler) thumbnailFormatFor(imageBytes []byte) string {
+	if h.thumbnailFormat != "" {
+		return h.thumbnailFormat
+	}
+	if isPNG(imageBytes) {
+		return "png"
+	}
+	return "jpeg"
+}
+
+// isPNG reports whether the bytes start with the PNG signature
+func isPNG(imageBytes []byte) bool {
+	return bytes.HasPrefix(imageBytes, []byte("\x89PNG\r\n\x1a\n"))
+}
+
+// isJPEG reports whether the bytes start with a JPEG SOI marker
+func isJPEG(imageBytes []byte) bool {
+	return bytes.HasPrefix(imageBytes, []byte{0xFF, 0xD8, 0xFF})
+}
+
+// isTIFF reports whether the bytes start with a little- or big-endian TIFF header
+func isTIFF(imageBytes []byte) bool {
+	return bytes.HasPrefix(imageBytes, []byte("II*\x00")) || bytes.HasPrefix(imageBytes, []byte("MM\x00*"))
+}
+
+// isBMP reports whether the bytes start with the "BM" bitmap file header
+func isBMP(imageBytes []byte) bool {
+	return bytes.HasPrefix(imageBytes, []byte("BM"))
+}
+
+// extractEXIF reads camera make/model, capture time and (if enabled) GPS position
+// from the image's EXIF block. It returns nil when no usable EXIF is present.
+func (h *Handler) extractEXIF(imageBytes []byte) *ExifInfo {
+	x, err := exif.Decode(bytes.NewReader(imageBytes))
+	if x == nil || (err != nil && exif.IsCriticalError(err)) {
+		return nil
+	}
+
+	info := &ExifInfo{}
+	if tag, err := x.Get(exif.Make); err == nil {
+		info.Make, _ = tag.StringVal()
+	}
+	if tag, err := x.Get(exif.Model); err == nil {
+		info.Model, _ = tag.StringVal()
+	}
+	if capturedAt, err := x.DateTime(); err == nil {
+		info.CapturedAt = capturedAt.UTC().Format(time.RFC3339)
+	}
+	if h.storeGPS {
+		if lat, long, err := x.LatLong(); err == nil {
+			info.Latitude = &lat
+			info.Longitude = &long
+		}
+	}
+
+	info.Make = strings.TrimSpace(info.Make)
+	info.Model = strings.TrimSpace(info.Model)
+	if *info == (ExifInfo{}) {
+		return nil
+	}
+	return info
+}
+
+// isWebP reports whether the bytes carry a RIFF container of type WEBP
+func isWebP(imageBytes []byte) bool {
+	return len(imageBytes) >= 12 && bytes.HasPrefix(imageBytes, []byte("RIFF")) && string(imageBytes[8:12]) == "WEBP"
+}
+
+// isGIF reports whether the bytes carry a GIF87a or GIF89a signature
+func isGIF(imageBytes []byte) bool {
+	return bytes.HasPrefix(imageBytes, []byte("GIF87a")) || bytes.HasPrefix(imageBytes, []byte("GIF89a"))
+}
+
+// errTruncatedGIF is returned by gifFrameCount for a GIF that ends before its
+// trailer
+var errTruncatedGIF = errors.New("truncated GIF")
+
+// gifFrameCount returns the number of frames in a GIF. It walks the block
+// structure without decompressing any frame, so a long animation costs no more
+// memory than its bytes.
+func gifFrameCount(imageBytes []byte) (int, error) {
+	// Header and logical screen descriptor, then the optional global color table
+	const headerSize = 13
+	if len(imageBytes) < headerSize {
+		return 0, errTruncatedGIF
+	}
+	i := headerSize + colorTableSize(imageBytes[10])
+
+	frames := 0
+	for i < len(imageBytes) {
+		switch imageBytes[i] {
+		case 0x21: // extension: introducer, label, data sub-blocks
+			i += 2
+		case 0x2c: // image descriptor, optional local color table, LZW code size
+			if i+10 > len(imageBytes) {
+				return 0, errTruncatedGIF
+			}
+			i += 10 + colorTableSize(imageBytes[i+9]) + 1
+			frames++
+		case 0x3b: // trailer
+			return frames, nil
+		default:
+			return 0, fmt.Errorf("invalid GIF block 0x%02x at offset %d", imageBytes[i], i)
+		}
+
+		// Skip the data sub-blocks up to their zero-length terminator
+		for {
+			if i >= len(imageBytes) {
+				return 0, errTruncatedGIF
+			}
+			size := int(imageBytes[i])
+			i += 1 + size
+			if size == 0 {
+				break
+			}
+		}
+	}
+	return 0, errTruncatedGIF
+}
+
+// colorTableSize returns the byte length of the color table a GIF packed
+// field declares, or 0 when it has none
+func colorTableSize(packed byte) int {
+	if packed&0x80 == 0 {
+		return 0
+	}
+	return 3 << (packed&0x07 + 1)
+}
+
+// decodeImage decodes image bytes, dispatching on the detected format. EXIF
+// orientation is applied so phone photos come out upright, and GIFs yield
+// their first frame.
+func decodeImage(imageBytes []byte) (image.Image, error) {
+	switch {
+	case isHEIC(imageBytes):
+		return heic.Decode(bytes.NewReader(imageBytes))
+	case isGIF(imageBytes):
+		return gif.Decode(bytes.NewReader(imageBytes))
+	case isWebP(imageBytes):
+		return webp.Decode(bytes.NewReader(imageBytes))
+	default:
+		return imaging.Decode(bytes.NewReader(imageBytes), imaging.AutoOrientation(true))
+	}
+}
+
+// transcodeToJPEG decodes image bytes and re-encodes them as JPEG
+func transcodeToJPEG(imageBytes []byte) ([]byte, error) {
+	img, err := decodeImage(imageBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode JPEG: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// downscaleToFit re-encodes the image as JPEG, shrinking it until the encoded size
+// is at most maxBytes
+func downscaleToFit(img image.Image, maxBytes int64) ([]byte, error) {
+	width := img.Bounds().Dx()
+	for attempt := 0; attempt < 8 && width > 0; attempt++ {
+		var buf bytes.Buffer
+		resized := imaging.Resize(img, width, 0, imaging.Lanczos)
+		if err := jpeg.Encode(&buf, resized, &jpeg.Options{Quality: 85}); err != nil {
+			return nil, fmt.Errorf("failed to encode JPEG: %w", err)
+		}
+		if int64(buf.Len()) <= maxBytes {
+			return buf.Bytes(), nil
+		}
+
+		// Encoded size scales roughly with pixel count, i.e. with width squared
+		scale := math.Sqrt(float64(maxBytes)/float64(buf.Len())) * 0.9
+		width = int(float64(width) * scale)
+	}
+
+	return nil, fmt.Errorf("could not shrink image below %d bytes", maxBytes)
+}
+
+// convertToJPEG transcodes an image to JPEG and stores it under converted/<key>.jpg,
+// returning the JPEG bytes and the derived key
+func (h *Handler) convertToJPEG(ctx context.Context, bucket, key string, imageBytes []byte) ([]byte, string, error) {
+	jpegBytes, err := transcodeToJPEG(imageBytes)
+	if err != nil {
+		return nil, "", permanent(err)
+	}
+
+	convertedKey := "converted/" + strings.TrimSuffix(key, path.Ext(key)) + ".jpg"
+	err = h.withRetry(ctx, "S3 PutObject", func() error {
+		_, err := h.s3Putter.PutObject(ctx, h.encrypted(&s3.PutObjectInput{
+			Bucket:      aws.String(bucket),
+			Key:         aws.String(convertedKey),
+			Body:        bytes.NewReader(jpegBytes),
+			ContentType: aws.String("image/jpeg"),
+		}))
+		return err
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to upload converted image to S3: %w", err)
+	}
+
+	return jpegBytes, convertedKey, nil
+}
+
+// maxRekognitionS3ObjectBytes is the largest image Rekognition accepts by S3 reference
+const maxRekognitionS3ObjectBytes = 15 * 1024 * 1024
+
+// bytesImage builds a Rekognition image that carries the image bytes inline
+func bytesImage(imageBytes []byte) *rekognitionTypes.Image {
+	return &rekognitionTypes.Image{
+		Bytes: imageBytes,
+	}
+}
+
+// s3ObjectImage builds a Rekognition image that references an object in S3,
+// so Rekognition reads it directly instead of receiving the bytes
+func s3ObjectImage(bucket, key string) *rekognitionTypes.Image {
+	return &rekognitionTypes.Image{
+		S3Object: &rekognitionTypes.S3Object{
+			Bucket: aws.String(bucket),
+			Name:   aws.String(key),
+		},
+	}
+}
+
+// moderateImage calls AWS Rekognition to detect unsafe content, returning the
+// moderation labels at or above the configured confidence threshold
+func (h *Handler) moderateImage(ctx context.Context, img *rekognitionTypes.Image) ([]LabelInfo, error) {
+	input := &rekognition.DetectModerationLabelsInput{
+		Image:         img,
+		MinConfidence: aws.Float32(h.minModerationConfidence),
+	}
+
+	var result *rekognition.DetectModerationLabelsOutput
+	err := h.withRetry(ctx, "Rekognition DetectModerationLabels", func() error {
+		var err error
+		result, err = h.rekognitionClient.DetectModerationLabels(ctx, input)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Rekognition DetectModerationLabels failed: %w", err)
+	}
+
+	labels := make([]LabelInfo, 0, len(result.ModerationLabels))
+	for _, label := range result.ModerationLabels {
+		confidence := aws.ToFloat32(label.Confidence)
+		if confidence < h.minModerationConfidence {
+			continue
+		}
+		labels = append(labels, LabelInfo{
+			Name:       aws.ToString(label.Name),
+			Confidence: confidence,
+		})
+	}
+
+	return labels, nil
+}
+
+// quarantineImage moves a flagged original to the quarantine/ prefix so it can no
+// longer be served from images/, returning the new key
+func (h *Handler) quarantineImage(ctx context.Context, bucket, key string) (string, error) {
+	quarantineKey := "quarantine/" + key
+	copySource := (&url.URL{Path: bucket + "/" + key}).EscapedPath()
+
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(bucket),
+		Key:        aws.String(quarantineKey),
+		CopySource: aws.String(copySource),
+	}
+	// A copy is encrypted with the bucket default unless told otherwise
+	if h.sseKMSKeyID != "" {
+		input.ServerSideEncryption = s3Types.ServerSideEncryptionAwsKms
+		input.SSEKMSKeyId = aws.String(h.sseKMSKeyID)
+	}
+	err := h.withRetry(ctx, "S3 CopyObject", func() error {
+		_, err := h.s3Putter.CopyObject(ctx, input)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("S3 CopyObject failed: %w", err)
+	}
+
+	err = h.withRetry(ctx, "S3 DeleteObject", func() error {
+		_, err := h.s3Putter.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("S3 DeleteObject failed: %w", err)
+	}
+
+	return quarantineKey, nil
+}
+
+// keepLabel applies LABEL_BLOCKLIST and LABEL_ALLOWLIST, case-insensitively. A
+// blocklisted name is dropped even if allowlisted; with an allowlist set, only
+// its names are kept.
+func (h *Handler) keepLabel(name string) bool {
+	name = strings.ToLower(name)
+	if h.labelBlocklist[name] {
+		return false
+	}
+	return len(h.labelAllowlist) == 0 || h.labelAllowlist[name]
+}
+
+// detectLabels calls AWS Rekognition to detect labels in the image, followed
+// by those of the REKOGNITION_PROJECT_VERSION_ARN Custom Labels model when one
+// is set. With REKOGNITION_IMAGE_PROPERTIES it also returns the image's
+// quality scores.
+func (h *Handler) detectLabels(ctx context.Context, img *rekognitionTypes.Image) ([]LabelInfo, *ImageQuality, error) {
+	input := &rekognition.DetectLabelsInput{
+		Image:         img,
+		MaxLabels:     aws.Int32(10),     // Limit to top 10 labels
+		MinConfidence: aws.Float32(70.0), // Minimum 70% confidence
+	}
+	// Naming features replaces the default, so GENERAL_LABELS is always listed
+	if h.generalLabels != nil || h.imageProperties {
+		input.Features = []rekognitionTypes.DetectLabelsFeatureName{rekognitionTypes.DetectLabelsFeatureNameGeneralLabels}
+		input.Settings = &rekognitionTypes.DetectLabelsSettings{GeneralLabels: h.generalLabels}
+	}
+	if h.imageProperties {
+		input.Features = append(input.Features, rekognitionTypes.DetectLabelsFeatureNameImageProperties)
+	}
+
+	var result *rekognition.DetectLabelsOutput
+	err := h.withRetry(ctx, "Rekognition DetectLabels", func() error {
+		var err error
+		result, err = h.rekognitionClient.DetectLabels(ctx, input)
+		return err
+	})
+	// Bytes Rekognition can't read (e.g. a CMYK JPEG) fail the same way on every
+	// retry, so the image is recorded as failed instead
+	var invalidFormatErr *rekognitionTypes.InvalidImageFormatException
+	if errors.As(err, &invalidFormatErr) {
+		return nil, nil, permanent(fmt.Errorf("Rekognition cannot read the image format: %w", err))
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Rekognition DetectLabels failed: %w", err)
+	}
+
+	labels := make([]LabelInfo, 0, len(result.Labels))
+	for _, label := range result.Labels {
+		if !h.keepLabel(aws.ToString(label.Name)) {
+			h.logger.Debug("filtered out label", slog.String("name", aws.ToString(label.Name)))
+			continue
+		}
+
+		labelInfo := LabelInfo{
+			Name:       aws.ToString(label.Name),
+			Confidence: aws.ToFloat32(label.Confidence),
+			Source:     labelSourceGeneral,
+		}
+		// Keep the hierarchy (Dog -> Mammal -> Animal) for category-level filtering
+		for _, parent := range label.Parents {
+			labelInfo.Parents = append(labelInfo.Parents, aws.ToString(parent.Name))
+		}
+		for _, category := range label.Categories {
+			labelInfo.Categories = append(labelInfo.Categories, aws.ToString(category.Name))
+		}
+		for _, instance := range label.Instances {
+			if instance.BoundingBox == nil {
+				continue
+			}
+			labelInfo.Instances = append(labelInfo.Instances, LabelInstance{
+				BoundingBox: BoundingBox{
+					Left:   aws.ToFloat32(instance.BoundingBox.Left),
+					Top:    aws.ToFloat32(instance.BoundingBox.Top),
+					Width:  aws.ToFloat32(instance.BoundingBox.Width),
+					Height: aws.ToFloat32(instance.BoundingBox.Height),
+				},
+				Confidence: aws.ToFloat32(instance.Confidence),
+			})
+		}
+		labels = append(labels, labelInfo)
+
+		h.logger.Debug("detected label",
+			slog.String("name", labelInfo.Name),
+			slog.Float64("confidence", float64(labelInfo.Confidence)),
+		)
+	}
+
+	if h.projectVersionARN != "" {
+		custom, err := h.detectCustomLabels(ctx, img)
+		if err != nil {
+			return nil, nil, err
+		}
+		labels = append(labels, custom...)
+	}
+
+	var quality *ImageQuality
+	if result.ImageProperties != nil && result.ImageProperties.Quality != nil {
+		quality = &ImageQuality{
+			Brightness: aws.ToFloat32(result.ImageProperties.Quality.Brightness),
+			Sharpness:  aws.ToFloat32(result.ImageProperties.Quality.Sharpness),
+			Contrast:   aws.ToFloat32(result.ImageProperties.Quality.Contrast),
+		}
+	}
+
+	return labels, quality, nil
+}
+
+// detectFaces calls AWS Rekognition to detect faces and their attributes in the image.
+// Images without faces yield an empty slice.
+func (h *Handler) detectFaces(ctx context.Context, img *rekognitionTypes.Image) ([]FaceInfo, error) {
+	input := &rekognition.DetectFacesInput{
+		Image:      img,
+		Attributes: []rekognitionTypes.Attribute{rekognitionTypes.AttributeAll},
+	}
+
+	var result *rekognition.DetectFacesOutput
+	err := h.withRetry(ctx, "Rekognition DetectFaces", func() error {
+		var err error
+		result, err = h.rekognitionClient.DetectFaces(ctx, input)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Rekognition DetectFaces failed: %w", err)
+	}
+
+	faces := make([]FaceInfo, 0, len(result.FaceDetails))
+	for _, detail := range result.FaceDetails {
+		face := FaceInfo{
+			Confidence: aws.ToFloat32(detail.Confidence),
+		}
+		if box := detail.BoundingBox; box != nil {
+			face.BoundingBox = BoundingBox{
+				Left:   aws.ToFloat32(box.Left),
+				Top:    aws.ToFloat32(box.Top),
+				Width:  aws.ToFloat32(box.Width),
+				Height: aws.ToFloat32(box.Height),
+			}
+		}
+		if ageRange := detail.AgeRange; ageRange != nil {
+			face.AgeLow = aws.ToInt32(ageRange.Low)
+			face.AgeHigh = aws.ToInt32(ageRange.High)
+		}
+		if smile := detail.Smile; smile != nil {
+			face.Smiling = smile.Value
+		}
+
+		// Rekognition returns every emotion with a confidence; keep the strongest
+		var bestConfidence float32
+		for _, emotion := range detail.Emotions {
+			if confidence := aws.ToFloat32(emotion.Confidence); confidence > bestConfidence {
+				bestConfidence = confidence
+				face.DominantEmotion = string(emotion.Type)
+			}
+		}
+
+		faces = append(faces, face)
+	}
+
+	return faces, nil
+}
+
+// detectText calls AWS Rekognition to detect lines of text in the image
+func (h *Handler) detectText(ctx context.Context, img *rekognitionTypes.Image) ([]TextInfo, error) {
+	input := &rekognition.DetectTextInput{
+		Image: img,
+	}
+
+	var result *rekognition.DetectTextOutput
+	err := h.withRetry(ctx, "Rekognition DetectText", func() error {
+		var err error
+		result, err = h.rekognitionClient.DetectText(ctx, input)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Rekognition DetectText failed: %w", err)
+	}
+
+	// Rekognition reports both LINE and WORD detections; lines already contain the words
+	text := make([]TextInfo, 0, len(result.TextDetections))
+	for _, detection := range result.TextDetections {
+		if detection.Type != rekognitionTypes.TextTypesLine {
+			continue
+		}
+		text = append(text, TextInfo{
+			Text:       aws.ToString(detection.DetectedText),
+			Confidence: aws.ToFloat32(detection.Confidence),
+		})
+	}
+
+	return text, nil
+}
+
+// textBlob joins detected lines into a single string for contains-style scan filters
+func textBlob(text []TextInfo) string {
+	lines := make([]string, 0, len(text))
+	for _, line := range text {
+		lines = append(lines, line.Text)
+	}
+	return strings.Join(lines, " ")
+}
+
+// findDuplicate looks up an already-processed image with the same content hash,
+// ignoring the image itself. It returns nil when there is no such image.
+func (h *Handler) findDuplicate(ctx context.Context, contentHash, key string) (*ImageMetadata, error) {
+	var result *dynamodb.QueryOutput
+	err := h.withRetry(ctx, "DynamoDB Query", func() error {
+		var err error
+		result, err = h.dynamoDBClient.Query(ctx, &dynamodb.QueryInput{
+			TableName:              aws.String(h.tableName),
+			IndexName:              aws.String(contentHashIndexName),
+			KeyConditionExpression: aws.String("content_hash = :hash"),
+			ExpressionAttributeValues: map[string]dynamodbTypes.AttributeValue{
+				":hash": &dynamodbTypes.AttributeValueMemberS{Value: contentHash},
+			},
+		})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("DynamoDB Query failed: %w", err)
+	}
+
+	for _, item := range result.Items {
+		var candidate ImageMetadata
+		if err := attributevalue.UnmarshalMap(item, &candidate); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal duplicate candidate: %w", err)
+		}
+		if candidate.ImageKey == key {
+			continue
+		}
+		// Point at the first upload rather than chaining duplicates
+		if candidate.DuplicateOf != "" {
+			candidate.ImageKey = candidate.DuplicateOf
+		}
+		return &candidate, nil
+	}
+
+	return nil, nil
+}
+
+// beginSubsegment starts an X-Ray subsegment annotated with the S3 key and returns
+// the derived context plus a function that closes it. It is a no-op when tracing
+// is disabled or the context carries no segment.
+func (h *Handler) beginSubsegment(ctx context.Context, name, key string) (context.Context, func(error)) {
+	if !h.tracingEnabled {
+		return ctx, func(error) {}
+	}
+
+	subCtx, seg := xray.BeginSubsegment(ctx, name)
+	if seg == nil {
+		return ctx, func(error) {}
+	}
+	_ = seg.AddAnnotation("s3_key", key)
+	return subCtx, seg.Close
+}
+
+// recordProcessingMetrics emits CloudWatch Embedded Metric Format records for a
+// processed image: duration and output sizes on success, an error count
+// dimensioned by the failing stage otherwise
+func (h *Handler) recordProcessingMetrics(stage string, duration time.Duration, metadata *ImageMetadata, err error) {
+	if !h.enableMetrics {
+		return
+	}
+
+	if err != nil {
+		h.emitMetrics(map[string]string{"Stage": stage},
+			metric{Name: "ProcessingErrors", Unit: "Count", Value: 1},
+			metric{Name: "ProcessingDurationMs", Unit: "Milliseconds", Value: float64(duration.Milliseconds())},
+		)
+		return
+	}
+
+	h.emitMetrics(nil,
+		metric{Name: "ProcessingDurationMs", Unit: "Milliseconds", Value: float64(duration.Milliseconds())},
+		metric{Name: "LabelsDetected", Unit: "Count", Value: float64(len(metadata.DetectedLabels))},
+		metric{Name: "ThumbnailBytes", Unit: "Bytes", Value: float64(metadata.ThumbnailBytes)},
+	)
+}
+
+// metric is a single CloudWatch metric value
+type metric struct {
+	Name  string
+	Unit  string
+	Value float64
+}
+
+// emitMetrics writes one EMF log line; CloudWatch extracts the metrics from it
+func (h *Handler) emitMetrics(dimensions map[string]string, metrics ...metric) {
+	dimensionKeys := make([]string, 0, len(dimensions))
+	for name := range dimensions {
+		dimensionKeys = append(dimensionKeys, name)
+	}
+	sort.Strings(dimensionKeys)
+
+	definitions := make([]map[string]string, 0, len(metrics))
+	record := make(map[string]interface{}, len(dimensions)+len(metrics)+1)
+	for name, value := range dimensions {
+		record[name] = value
+	}
+	for _, m := range metrics {
+		definitions = append(definitions, map[string]string{"Name": m.Name, "Unit": m.Unit})
+		record[m.Name] = m.Value
+	}
+	record["_aws"] = map[string]interface{}{
+		"Timestamp": time.Now().UnixMilli(),
+		"CloudWatchMetrics": []map[string]interface{}{{
+			"Namespace":  h.metricsNamespace,
+			"Dimensions": [][]string{dimensionKeys},
+			"Metrics":    definitions,
+		}},
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		h.logger.Error("failed to marshal metrics", slog.String("error", err.Error()))
+		return
+	}
+	fmt.Fprintln(os.Stdout, string(line))
+}
+
+// permanentError marks a failure that retrying the record cannot fix
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// permanent wraps err so processS3Record records it as a failed image
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// isPermanent reports whether err was marked permanent or is a Rekognition
+// rejection of the image itself
+func isPermanent(err error) bool {
+	var permanentErr *permanentError
+	if errors.As(err, &permanentErr) {
+		return true
+	}
+	var invalidFormatErr *rekognitionTypes.InvalidImageFormatException
+	if errors.As(err, &invalidFormatErr) {
+		return true
+	}
+	var tooLargeErr *rekognitionTypes.ImageTooLargeException
+	return errors.As(err, &tooLargeErr)
+}
+
+// saveFailure records a failed status with the reason in place of the image's
+// metadata. It returns nil once saved, or the save error so the record is retried.
+func (h *Handler) saveFailure(ctx context.Context, metadata *ImageMetadata, cause error) error {
+	h.logger.Warn("recording permanent processing failure",
+		slog.String("key", metadata.ImageKey),
+		slog.String("error", cause.Error()),
+	)
+
+	metadata.Status = statusFailed
+	metadata.FailureReason = cause.Error()
+	if err := h.saveMetadata(ctx, metadata); err != nil {
+		return fmt.Errorf("failed to save failure record: %w (processing error: %v)", err, cause)
+	}
+	return nil
+}
+
+// alreadyProcessed reports whether the key has a complete metadata item. Items
+// written before the status attribute existed only come from finished runs, so
+// a missing status counts as complete.
+func (h *Handler) alreadyProcessed(ctx context.Context, key string) (bool, error) {
+	var result *dynamodb.GetItemOutput
+	err := h.withRetry(ctx, "DynamoDB GetItem", func() error {
+		var err error
+		result, err = h.dynamoDBClient.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(h.tableName),
+			Key: map[string]dynamodbTypes.AttributeValue{
+				"image_key": &dynamodbTypes.AttributeValueMemberS{Value: key},
+			},
+			ProjectionExpression:     aws.String("image_key, #status"),
+			ExpressionAttributeNames: map[string]string{"#status": "status"},
+			ConsistentRead:           aws.Bool(true),
+		})
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	if result.Item == nil {
+		return false, nil
+	}
+
+	status, ok := result.Item["status"].(*dynamodbTypes.AttributeValueMemberS)
+	return !ok || status.Value == statusComplete, nil
+}
+
+// getItem reads the whole metadata item of key
+func (h *Handler) getItem(ctx context.Context, key string) (*dynamodb.GetItemOutput, error) {
+	var result *dynamodb.GetItemOutput
+	err := h.withRetry(ctx, "DynamoDB GetItem", func() error {
+		var err error
+		result, err = h.dynamoDBClient.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(h.tableName),
+			Key: map[string]dynamodbTypes.AttributeValue{
+				"image_key": &dynamodbTypes.AttributeValueMemberS{Value: key},
+			},
+		})
+		return err
+	})
+	return result, err
+}
+
+// userAttributes are the item attributes edited through the API rather than
+// derived by analysis, which saveMetadata never writes
+var userAttributes = map[string]bool{
+	"user_tags": true,
+}
+
+// metadataAttributes lists the attribute name of every ImageMetadata field, so
+// saveMetadata can remove those a reprocess no longer produces
+var metadataAttributes = func() []string {
+	t := reflect.TypeOf(ImageMetadata{})
+	names := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("dynamodbav"), ",")
+		if name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}()
+
+// saveMetadata saves the image metadata and detected labels to DynamoDB. It
+// writes with UpdateItem rather than PutItem so attributes owned by other paths,
+// such as user_tags, survive a reprocess; analysis attributes the metadata no
+// longer carries are removed, as a full replace would have done.
+func (h *Handler) saveMetadata(ctx context.Context, metadata *ImageMetadata) error {
+	metadata.GalleryPK = GalleryPartition
+	metadata.ProcessedAt = time.Now().UTC().Format(time.RFC3339)
+	metadata.SearchTerms = searchTerms(metadata)
+	if metadata.Status == "" {
+		metadata.Status = statusComplete
+	}
+	// The expiry is fixed when an image is first saved; relabeling keeps it
+	if h.metadataTTLDays > 0 && metadata.ExpiresAt == 0 {
+		metadata.ExpiresAt = expiresAt(time.Now(), h.metadataTTLDays)
+	}
+
+	item, err := attributevalue.MarshalMap(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+
+	// Every attribute goes through a placeholder name, since several (status,
+	// owner) are DynamoDB reserved words
+	names := make(map[string]string)
+	values := make(map[string]dynamodbTypes.AttributeValue)
+	var sets, removes []string
+	for i, attribute := range metadataAttributes {
+		if attribute == "image_key" || userAttributes[attribute] {
+			continue
+		}
+		name := fmt.Sprintf("#a%d", i)
+		value, ok := item[attribute]
+		switch {
+		case !ok:
+			removes = append(removes, name)
+		case attribute == "expires_at":
+			// A reprocess keeps the expiry set when the image was first saved
+			sets = append(sets, fmt.Sprintf("%s = if_not_exists(%s, :a%d)", name, name, i))
+			values[fmt.Sprintf(":a%d", i)] = value
+		default:
+			sets = append(sets, fmt.Sprintf("%s = :a%d", name, i))
+			values[fmt.Sprintf(":a%d", i)] = value
+		}
+		names[name] = attribute
+	}
+	expression := "SET " + strings.Join(sets, ", ")
+	if len(removes) > 0 {
+		expression += " REMOVE " + strings.Join(removes, ", ")
+	}
+
+	// Return the previous item so search entries for dropped terms can be
+	// removed and label counts adjusted
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(h.tableName),
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"image_key": item["image_key"],
+		},
+		UpdateExpression:          aws.String(expression),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ReturnValues:              dynamodbTypes.ReturnValueAllOld,
+	}
+
+	var result *dynamodb.UpdateItemOutput
+	err = h.withRetry(ctx, "DynamoDB UpdateItem", func() error {
+		var err error
+		result, err = h.dynamoDBClient.UpdateItem(ctx, input)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("DynamoDB UpdateItem failed: %w", err)
+	}
+
+	var previous ImageMetadata
+	if len(result.Attributes) > 0 {
+		if err := attributevalue.UnmarshalMap(result.Attributes, &previous); err != nil {
+			return fmt.Errorf("failed to unmarshal previous metadata: %w", err)
+		}
+	}
+	// The update left the stored tags and expiry as they were
+	metadata.UserTags = previous.UserTags
+	if previous.ExpiresAt != 0 {
+		metadata.ExpiresAt = previous.ExpiresAt
+	}
+
+	err = h.writeSearchEntries(ctx, metadata, previous.SearchTerms)
+	if err != nil {
+		return fmt.Errorf("failed to write search entries: %w", err)
+	}
+
+	// The counts only feed GET /labels, and a retry would see the labels as
+	// already saved and not count them again, so a failure is only logged
+	if err := h.updateLabelCounts(ctx, labelCountChanges(previous.DetectedLabels, metadata.DetectedLabels)); err != nil {
+		h.logger.Warn("failed to update label counts",
+			slog.String("key", metadata.ImageKey),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return nil
+}
+
+// expiresAt returns the epoch second, days after now, at which DynamoDB TTL
+// may delete an item
+func expiresAt(now time.Time, days int) int64 {
+	return now.Add(time.Duration(days) * 24 * time.Hour).Unix()
+}
+
+// maxSearchTerms caps how many search entries a single image can produce
+const maxSearchTerms = 100
+
+// searchTerms returns the lowercased words and full label names an image can be
+// found by: every detected label, its parents and categories, plus each word of
+// its OCR text
+func searchTerms(metadata *ImageMetadata) []string {
+	seen := make(map[string]bool)
+	terms := make([]string, 0)
+	add := func(term string) {
+		if term != "" && !seen[term] && len(terms) < maxSearchTerms {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+
+	for _, label := range metadata.DetectedLabels {
+		add(strings.ToLower(label.Name))
+		for _, word := range searchWords(label.Name) {
+			add(word)
+		}
+	}
+	// Parents and categories come after every label's own name and words, so
+	// the term cap drops them first
+	for _, label := range metadata.DetectedLabels {
+		for _, name := range append(append([]string{}, label.Parents...), label.Categories...) {
+			add(strings.ToLower(name))
+		}
+	}
+	for _, line := range metadata.DetectedText {
+		for _, word := range searchWords(line.Text) {
+			add(word)
+		}
+	}
+
+	return terms
+}
+
+// searchWords splits text into lowercased words on anything but letters and digits
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// searchEntry is one row of the label search index: an image-term pair stored in
+// the metadata table and queried through the search_term GSI. The image's owner
+// is copied as target_owner, not owner, which would put the entry in the owner
+// GSI.
+type searchEntry struct {
+	EntryKey    string `dynamodbav:"image_key"`
+	SearchTerm  string `dynamodbav:"search_term"`
+	TargetKey   string `dynamodbav:"target_key"`
+	TargetOwner string `dynamodbav:"target_owner,omitempty"`
+	ProcessedAt string `dynamodbav:"processed_at"`
+	ExpiresAt   int64  `dynamodbav:"expires_at,omitempty"`
+}
+
+// SearchEntryPrefix starts the image_key of every search entry
+const SearchEntryPrefix = "search#"
+
+// SearchEntryKey builds the table key of the search entry for an image-term pair
+func SearchEntryKey(term, key string) string {
+	return SearchEntryPrefix + term + "#" + key
+}
+
+// writeSearchEntries upserts one search entry per current term and deletes the
+// entries for terms the image no longer has
+func (h *Handler) writeSearchEntries(ctx context.Context, metadata *ImageMetadata, previousTerms []string) error {
+	current := make(map[string]bool, len(metadata.SearchTerms))
+	requests := make([]dynamodbTypes.WriteRequest, 0, len(metadata.SearchTerms))
+	for _, term := range metadata.SearchTerms {
+		current[term] = true
+		item, err := attributevalue.MarshalMap(searchEntry{
+			EntryKey:    SearchEntryKey(term, metadata.ImageKey),
+			SearchTerm:  term,
+			TargetKey:   metadata.ImageKey,
+			TargetOwner: metadata.Owner,
+			ProcessedAt: metadata.ProcessedAt,
+			ExpiresAt:   metadata.ExpiresAt,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal search entry: %w", err)
+		}
+		requests = append(requests, dynamodbTypes.WriteRequest{
+			PutRequest: &dynamodbTypes.PutRequest{Item: item},
+		})
+	}
+	for _, term := range previousTerms {
+		if !current[term] {
+			requests = append(requests, searchEntryDelete(term, metadata.ImageKey))
+		}
+	}
+
+	return h.batchWrite(ctx, requests)
+}
+
+// DeleteSearchEntries removes the search entries of a deleted image, one for
+// each of the search_terms it was saved with
+func (h *Handler) DeleteSearchEntries(ctx context.Context, key string, terms []string) error {
+	requests := make([]dynamodbTypes.WriteRequest, 0, len(terms))
+	for _, term := range terms {
+		requests = append(requests, searchEntryDelete(term, key))
+	}
+	return h.batchWrite(ctx, requests)
+}
+
+// searchEntryDelete is the batch request deleting one search entry
+func searchEntryDelete(term, key string) dynamodbTypes.WriteRequest {
+	return dynamodbTypes.WriteRequest{
+		DeleteRequest: &dynamodbTypes.DeleteRequest{
+			Key: map[string]dynamodbTypes.AttributeValue{
+				"image_key": &dynamodbTypes.AttributeValueMemberS{Value: SearchEntryKey(term, key)},
+			},
+		},
+	}
+}
+
+// batchWrite issues BatchWriteItem in chunks of 25, resubmitting unprocessed items
+func (h *Handler) batchWrite(ctx context.Context, requests []dynamodbTypes.WriteRequest) error {
+	const batchSize = 25
+
+	for start := 0; start < len(requests); start += batchSize {
+		end := start + batchSize
+		if end > len(requests) {
+			end = len(requests)
+		}
+
+		pending := map[string][]dynamodbTypes.WriteRequest{h.tableName: requests[start:end]}
+		for attempt := 0; len(pending[h.tableName]) > 0; attempt++ {
+			if attempt > h.maxRetries {
+				return fmt.Errorf("%d search entries left unprocessed", len(pending[h.tableName]))
+			}
+
+			var result *dynamodb.BatchWriteItemOutput
+			err := h.withRetry(ctx, "DynamoDB BatchWriteItem", func() error {
+				var err error
+				result, err = h.dynamoDBClient.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+					RequestItems: pending,
+				})
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("DynamoDB BatchWriteItem failed: %w", err)
+			}
+			pending = result.UnprocessedItems
+		}
+	}
+
+	return nil
+}
+
+// thumbnailResult describes the thumbnails generated for one image
+type thumbnailResult struct {
+	Bucket        string
+	Keys          map[string]string // width -> S3 key
+	PrimaryKey    string
+	PrimaryWidth  int
+	PrimaryHeight int
+	TotalBytes    int64
+
+	// DominantColors holds the top colors of the smallest thumbnail as #rrggbb
+	DominantColors []string
+	// BlurHash is a compact placeholder for the image, also from the smallest one
+	BlurHash string
+}
+
+// ThumbnailBucket returns the bucket thumbnails of an image in bucket are
+// written to
+func (h *Handler) ThumbnailBucket(bucket string) string {
+	if h.thumbnailBucket != "" {
+		return h.thumbnailBucket
+	}
+	return bucket
+}
+
+// IsThumbnailKey reports whether key is under THUMBNAIL_PREFIX
+func (h *Handler) IsThumbnailKey(key string) bool {
+	return strings.HasPrefix(key, h.thumbnailPrefix)
+}
+
+// encrypted sets SSE-KMS on input when S3_SSE_KMS_KEY_ID is configured
+func (h *Handler) encrypted(input *s3.PutObjectInput) *s3.PutObjectInput {
+	if h.sseKMSKeyID != "" {
+		input.ServerSideEncryption = s3Types.ServerSideEncryptionAwsKms
+		input.SSEKMSKeyId = aws.String(h.sseKMSKeyID)
+	}
+	return input
+}
+
+// applyThumbnails records the generated thumbnails on the metadata
+func (m *ImageMetadata) applyThumbnails(mode string, thumbnails *thumbnailResult) {
+	m.ThumbnailKey = thumbnails.PrimaryKey
+	m.ThumbnailBucket = thumbnails.Bucket
+	m.Thumbnails = thumbnails.Keys
+	m.ThumbnailBytes = thumbnails.TotalBytes
+	m.ThumbnailMode = mode
+	m.ThumbnailWidth = thumbnails.PrimaryWidth
+	m.ThumbnailHeight = thumbnails.PrimaryHeight
+	m.DominantColors = thumbnails.DominantColors
+	m.BlurHash = thumbnails.BlurHash
+}
+
+// generateAndUploadThumbnail generates one thumbnail per configured width and uploads
+// them to S3 under <THUMBNAIL_PREFIX><width>/<key>, with the key's extension replaced by
+// that of the configured output format. They go to THUMBNAIL_BUCKET when it is set and
+// to the source bucket otherwise. It returns a map of width to S3 key along
+// with the middle size, which is kept as the primary thumbnail for older clients.
+// The re-encoded thumbnails carry no EXIF, so viewers won't apply the orientation
+// a second time.
+func (h *Handler) generateAndUploadThumbnail(ctx context.Context, bucket, key string, img image.Image, format string) (*thumbnailResult, error) {
+	// Skip sizes wider than the source rather than upscaling. If the source is
+	// narrower than every configured width, keep it at its native size under the
+	// smallest width so the image still gets a thumbnail. Fill mode crops to a
+	// square, so there the native size is the shorter side.
+	nativeWidth := img.Bounds().Dx()
+	if h.thumbnailMode == "fill" && img.Bounds().Dy() < nativeWidth {
+		nativeWidth = img.Bounds().Dy()
+	}
+	widths := make([]int, 0, len(h.thumbnailWidths))
+	for _, width := range h.thumbnailWidths {
+		if width <= nativeWidth {
+			widths = append(widths, width)
+		}
+	}
+	if len(widths) == 0 {
+		widths = append(widths, h.thumbnailWidths[0])
+	}
+
+	var mark image.Image
+	if h.watermarkKey != "" {
+		var err error
+		mark, err = h.loadWatermark(ctx, bucket)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load watermark: %w", err)
+		}
+	}
+
+	result := &thumbnailResult{
+		Bucket: h.ThumbnailBucket(bucket),
+		Keys:   make(map[string]string, len(widths)),
+	}
+	primaryWidth := widths[len(widths)/2]
+	// One timestamp, so a date-partitioned set never straddles midnight
+	generatedAt := time.Now()
+	for _, width := range widths {
+		// Resize to the target width, preserving aspect ratio in fit mode and
+		// center-cropping to a width x width square in fill mode
+		size := width
+		if size > nativeWidth {
+			size = nativeWidth
+		}
+		thumbnail := img
+		if h.thumbnailMode == "fill" {
+			thumbnail = imaging.Fill(img, size, size, imaging.Center, h.thumbnailResample)
+		} else if size < img.Bounds().Dx() {
+			thumbnail = imaging.Resize(img, size, 0, h.thumbnailResample)
+		}
+
+		// Sample colors from the smallest thumbnail, which is cheap to scan,
+		// before the watermark can skew them
+		if width == widths[0] {
+			result.DominantColors = dominantColors(thumbnail, 3)
+			result.BlurHash = h.blurHash(thumbnail)
+		}
+
+		if mark != nil {
+			thumbnail = h.applyWatermark(thumbnail, mark)
+		}
+
+		// Encode in the chosen output format
+		var buf bytes.Buffer
+		err := h.encodeThumbnail(&buf, thumbnail, format)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %dpx thumbnail: %w", width, err)
+		}
+
+		// Upload to S3
+		thumbnailKey := h.thumbnailKey(key, width, format, generatedAt)
+		err = h.withRetry(ctx, "S3 PutObject", func() error {
+			// A fresh body per attempt, since a failed attempt may have consumed it
+			input := &s3.PutObjectInput{
+				Bucket:      aws.String(result.Bucket),
+				Key:         aws.String(thumbnailKey),
+				Body:        bytes.NewReader(buf.Bytes()),
+				ContentType: aws.String(thumbnailContentTypes[format]),
+			}
+			if len(h.objectTags) > 0 {
+				input.Tagging = aws.String(thumbnailTagging)
+			}
+			var optFns []func(*s3.Options)
+			if h.thumbnailNoOverwrite {
+				optFns = append(optFns, ifNoneMatch)
+			}
+			_, err := h.s3Putter.PutObject(ctx, h.encrypted(input), optFns...)
+			return err
+		})
+		if isPreconditionFailed(err) {
+			// The object exists already, so count it as generated
+			h.logger.Info("thumbnail already exists, skipping upload",
+				slog.String("key", key),
+				slog.String("thumbnail_key", thumbnailKey),
+			)
+			err = nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload %dpx thumbnail to S3: %w", width, err)
+		}
+
+		result.Keys[strconv.Itoa(width)] = thumbnailKey
+		result.TotalBytes += int64(buf.Len())
+		if width == primaryWidth {
+			result.PrimaryKey = thumbnailKey
+			result.PrimaryWidth = thumbnail.Bounds().Dx()
+			result.PrimaryHeight = thumbnail.Bounds().Dy()
+		}
+	}
+
+	return result, nil
+}
+
+// ifNoneMatch makes a PutObject conditional on the key not existing yet. The
+// SDK version in use has no IfNoneMatch field, so the header is added directly.
+func ifNoneMatch(o *s3.Options) {
+	o.APIOptions = append(o.APIOptions, smithyhttp.AddHeaderValue("If-None-Match", "*"))
+}
+
+// isPreconditionFailed reports whether a conditional write lost to an existing
+// object: S3 answers 412 PreconditionFailed, or 409 ConditionalRequestConflict
+// when another conditional write to the key is in flight
+func isPreconditionFailed(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.ErrorCode() == "PreconditionFailed" || apiErr.ErrorCode() == "ConditionalRequestConflict"
+}
+
+// thumbnailKey derives the S3 key of key's thumbnail at width:
+// <prefix><width>/<key>.<ext>, or with THUMBNAIL_DATE_PARTITION
+// <prefix>YYYY/MM/DD/<width>/<key>.<ext> by the UTC date the thumbnail was made,
+// so lifecycle rules can expire thumbnails by age
+func (h *Handler) thumbnailKey(key string, width int, format string, generatedAt time.Time) string {
+	prefix := h.thumbnailPrefix
+	if h.thumbnailDatePartition {
+		prefix += generatedAt.UTC().Format("2006/01/02/")
+	}
+	return fmt.Sprintf("%s%d/%s%s", prefix, width, strings.TrimSuffix(key, path.Ext(key)), thumbnailExtensions[format])
+}
+
+// watermarkCache holds the decoded watermark across warm invocations. It is
+// shared by pointer so per-record handler copies reuse it.
+type watermarkCache struct {
+	mu  sync.Mutex
+	img image.Image
+}
+
+// watermarkAnchors maps each WATERMARK_POSITION to the corner it pins
+var watermarkAnchors = map[string]imaging.Anchor{
+	"top-left":     imaging.TopLeft,
+	"top-right":    imaging.TopRight,
+	"bottom-left":  imaging.BottomLeft,
+	"bottom-right": imaging.BottomRight,
+}
+
+// loadWatermark returns the WATERMARK_S3_KEY image, downloading and decoding it
+// on first use. A failed load is retried on the next call.
+func (h *Handler) loadWatermark(ctx context.Context, bucket string) (image.Image, error) {
+	h.watermark.mu.Lock()
+	defer h.watermark.mu.Unlock()
+
+	if h.watermark.img != nil {
+		return h.watermark.img, nil
+	}
+
+	watermarkBytes, _, err := h.downloadImage(ctx, bucket, h.watermarkKey)
+	if err != nil {
+		return nil, err
+	}
+	img, err := png.Decode(bytes.NewReader(watermarkBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode watermark PNG: %w", err)
+	}
+
+	h.watermark.img = img
+	return img, nil
+}
+
+// applyWatermark overlays mark in the configured corner of thumbnail, inset by a
+// small margin. Marks that don't fit inside the margin are scaled down first.
+func (h *Handler) applyWatermark(thumbnail, mark image.Image) image.Image {
+	bounds := thumbnail.Bounds()
+	margin := bounds.Dx() / 25
+	if bounds.Dy() < bounds.Dx() {
+		margin = bounds.Dy() / 25
+	}
+
+	maxWidth := bounds.Dx() - 2*margin
+	maxHeight := bounds.Dy() - 2*margin
+	if maxWidth <= 0 || maxHeight <= 0 {
+		return thumbnail
+	}
+	if mark.Bounds().Dx() > maxWidth || mark.Bounds().Dy() > maxHeight {
+		mark = imaging.Fit(mark, maxWidth, maxHeight, h.thumbnailResample)
+	}
+
+	// Corner position of the mark's top-left pixel
+	x, y := margin, margin
+	switch watermarkAnchors[h.watermarkPosition] {
+	case imaging.TopRight:
+		x = bounds.Dx() - margin - mark.Bounds().Dx()
+	case imaging.BottomLeft:
+		y = bounds.Dy() - margin - mark.Bounds().Dy()
+	case imaging.BottomRight:
+		x = bounds.Dx() - margin - mark.Bounds().Dx()
+		y = bounds.Dy() - margin - mark.Bounds().Dy()
+	}
+
+	return imaging.Overlay(thumbnail, mark, image.Pt(bounds.Min.X+x, bounds.Min.Y+y), h.watermarkOpacity)
+}
+
+// blurHash components and the width the image is shrunk to first; a BlurHash
+// only keeps low frequencies, so a tiny copy gives the same result far cheaper
+const (
+	blurHashX     = 4
+	blurHashY     = 3
+	blurHashWidth = 32
+)
+
+// blurHash returns the BlurHash placeholder for img, or "" if it can't be
+// computed, since a missing placeholder shouldn't fail the thumbnail
+func (h *Handler) blurHash(img image.Image) string {
+	if img.Bounds().Dx() > blurHashWidth {
+		img = imaging.Resize(img, blurHashWidth, 0, imaging.Box)
+	}
+	hash, err := blurhash.Encode(blurHashX, blurHashY, img)
+	if err != nil {
+		h.logger.Warn("failed to compute blurhash", slog.String("error", err.Error()))
+		return ""
+	}
+	return hash
+}
+
+// dominantColors returns up to k #rrggbb colors covering most of img, largest
+// cluster first, using k-means over a sample of at most ~4096 opaque pixels
+func dominantColors(img image.Image, k int) []string {
+	bounds := img.Bounds()
+	step := int(math.Ceil(math.Sqrt(float64(bounds.Dx()*bounds.Dy()) / 4096)))
+	if step < 1 {
+		step = 1
+	}
+
+	var pixels [][3]float64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x < bounds.Max.X; x += step {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A < 128 {
+				continue
+			}
+			pixels = append(pixels, [3]float64{float64(c.R), float64(c.G), float64(c.B)})
+		}
+	}
+	if len(pixels) == 0 {
+		return nil
+	}
+	if k > len(pixels) {
+		k = len(pixels)
+	}
+
+	// Deterministic seeds spread across the pixels ordered by brightness
+	sorted := make([][3]float64, len(pixels))
+	copy(sorted, pixels)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i][0]+sorted[i][1]+sorted[i][2] < sorted[j][0]+sorted[j][1]+sorted[j][2]
+	})
+	centers := make([][3]float64, k)
+	for i := range centers {
+		centers[i] = sorted[(2*i+1)*len(sorted)/(2*k)]
+	}
+
+	counts := make([]int, k)
+	for iteration := 0; iteration < 10; iteration++ {
+		sums := make([][3]float64, k)
+		for i := range counts {
+			counts[i] = 0
+		}
+		for _, p := range pixels {
+			nearest, best := 0, math.MaxFloat64
+			for i, c := range centers {
+				d := (p[0]-c[0])*(p[0]-c[0]) + (p[1]-c[1])*(p[1]-c[1]) + (p[2]-c[2])*(p[2]-c[2])
+				if d < best {
+					nearest, best = i, d
+				}
+			}
+			counts[nearest]++
+			for ch := 0; ch < 3; ch++ {
+				sums[nearest][ch] += p[ch]
+			}
+		}
+		for i := range centers {
+			if counts[i] > 0 {
+				for ch := 0; ch < 3; ch++ {
+					centers[i][ch] = sums[i][ch] / float64(counts[i])
+				}
+			}
+		}
+	}
+
+	order := make([]int, 0, k)
+	for i := range centers {
+		if counts[i] > 0 {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool { return counts[order[a]] > counts[order[b]] })
+
+	colors := make([]string, 0, len(order))
+	for _, i := range order {
+		colors = append(colors, fmt.Sprintf("#%02x%02x%02x",
+			uint8(math.Round(centers[i][0])), uint8(math.Round(centers[i][1])), uint8(math.Round(centers[i][2]))))
+	}
+	return colors
+}
+
+// perceptualHash returns a 64-bit difference hash of img as 16 hex digits. The
+// image is shrunk to 9x8 grayscale and each bit records whether a pixel is
+// brighter than its right neighbour, so resizes and re-encodes barely change it
+// and the Hamming distance between two hashes measures visual similarity.
+func perceptualHash(img image.Image) string {
+	small := imaging.Resize(imaging.Grayscale(img), 9, 8, imaging.Box)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if small.Pix[small.PixOffset(x, y)] > small.Pix[small.PixOffset(x+1, y)] {
+				hash |= 1
+			}
+		}
+	}
+	return fmt.Sprintf("%016x", hash)
+}
+
+// encodeThumbnail writes the image to w in the given thumbnail format
+func (h *Handler) encodeThumbnail(w io.Writer, img image.Image, format string) error {
+	switch format {
+	case "png":
+		return png.Encode(w, img)
+	case "webp":
+		return nativewebp.Encode(w, img, nil)
+	default:
+		if h.thumbnailProgressive {
+			// Encode aside so a failure can still fall back to a baseline JPEG
+			var buf bytes.Buffer
+			err := encodeProgressiveJPEG(&buf, img, h.thumbnailJPEGQuality)
+			if err == nil {
+				_, err = w.Write(buf.Bytes())
+				return err
+			}
+			h.logger.Warn("progressive JPEG encode failed, falling back to baseline", slog.String("error", err.Error()))
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: h.thumbnailJPEGQuality})
+	}
+}
+
+// withRetry runs fn, retrying transient AWS failures (throttling and 5xx) with
+// exponential backoff and full jitter, up to the configured number of retries
+func (h *Handler) withRetry(ctx context.Context, operation string, fn func() error) error {
+	const baseDelay = 100 * time.Millisecond
+	const maxDelay = 5 * time.Second
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if err == nil || attempt >= h.maxRetries || !isRetryable(err) {
+			return err
+		}
+
+		delay := baseDelay << attempt
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+		delay = time.Duration(rand.Int63n(int64(delay)) + 1)
+
+		h.logger.Warn("retrying transient AWS error",
+			slog.String("operation", operation),
+			slog.Int("attempt", attempt+1),
+			slog.Duration("delay", delay),
+			slog.String("error", err.Error()),
+		)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// throttlingErrorCodes are the API error codes AWS services use for throttling
+var throttlingErrorCodes = map[string]bool{
+	"Throttling":                             true,
+	"ThrottlingException":                    true,
+	"ThrottledException":                     true,
+	"RequestThrottled":                       true,
+	"RequestThrottledException":              true,
+	"TooManyRequestsException":               true,
+	"ProvisionedThroughputExceededException": true,
+	"RequestLimitExceeded":                   true,
+	"SlowDown":                               true,
+}
+
+// isRetryable reports whether err is a throttling or server-side AWS error, or
+// a transport failure such as a reset connection, DNS error or timeout
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var throughputErr *dynamodbTypes.ProvisionedThroughputExceededException
+	if errors.As(err, &throughputErr) {
+		return true
+	}
+	var rekognitionThroughputErr *rekognitionTypes.ProvisionedThroughputExceededException
+	if errors.As(err, &rekognitionThroughputErr) {
+		return true
+	}
+	var rekognitionThrottlingErr *rekognitionTypes.ThrottlingException
+	if errors.As(err, &rekognitionThrottlingErr) {
+		return true
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && throttlingErrorCodes[apiErr.ErrorCode()] {
+		return true
+	}
+
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) && respErr.HTTPStatusCode() >= 500 {
+		return true
+	}
+
+	// The SDK's own classification of connection errors, which SingleAttemptConfig
+	// stops it from acting on
+	return retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err) == aws.TrueTernary
+}
@@ -0,0 +1,2571 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"maps"
+	"math/bits"
+	"math/rand"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"aws-lambda-image-processor/internal/awsfake"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition"
+	rekognitionTypes "github.com/aws/aws-sdk-go-v2/service/rekognition/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/buckket/go-blurhash"
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+const testBucket = "test-bucket"
+
+// fakes are the in-memory clients behind a test Handler
+type fakes struct {
+	s3          *awsfake.S3
+	rekognition *awsfake.Rekognition
+	dynamoDB    *awsfake.DynamoDB
+	sns         *awsfake.SNS
+}
+
+// newTestHandler builds a Handler over fresh fakes, reading settings from the
+// environment like New does; set any with t.Setenv before calling it
+func newTestHandler(t *testing.T) (*Handler, *fakes) {
+	t.Helper()
+	f := &fakes{
+		s3:          awsfake.NewS3(),
+		rekognition: &awsfake.Rekognition{},
+		dynamoDB:    awsfake.NewDynamoDB(),
+		sns:         &awsfake.SNS{},
+	}
+	h, err := New(Clients{
+		S3Getter:    f.s3,
+		S3Putter:    f.s3,
+		Rekognition: f.rekognition,
+		DynamoDB:    f.dynamoDB,
+		SNS:         f.sns,
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	h.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	return h, f
+}
+
+// testJPEG encodes a w x h gradient as a JPEG
+func testJPEG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(w, h), nil); err != nil {
+		t.Fatalf("encode test JPEG: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func testImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 255 / w), G: uint8(y * 255 / h), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+// s3Event is the notification for one new object in testBucket
+func s3Event(key string, size int) events.S3Event {
+	return events.S3Event{Records: []events.S3EventRecord{{
+		S3: events.S3Entity{
+			Bucket: events.S3Bucket{Name: testBucket},
+			Object: events.S3Object{Key: key, URLDecodedKey: key, Size: int64(size)},
+		},
+	}}}
+}
+
+func dogLabels() rekognition.DetectLabelsOutput {
+	return rekognition.DetectLabelsOutput{Labels: []rekognitionTypes.Label{{
+		Name:       aws.String("Dog"),
+		Confidence: aws.Float32(97.5),
+		Parents:    []rekognitionTypes.Parent{{Name: aws.String("Animal")}},
+	}}}
+}
+
+// storedMetadata reads an image's item back from the fake table
+func storedMetadata(t *testing.T, f *fakes, key string) ImageMetadata {
+	t.Helper()
+	item := f.dynamoDB.Item(key)
+	if item == nil {
+		t.Fatalf("no item saved for %s", key)
+	}
+	var metadata ImageMetadata
+	if err := attributevalue.UnmarshalMap(item, &metadata); err != nil {
+		t.Fatalf("unmarshal %s: %v", key, err)
+	}
+	return metadata
+}
+
+// storedThumbnail decodes the thumbnail stored under key
+func storedThumbnail(t *testing.T, f *fakes, key string) image.Image {
+	t.Helper()
+	object, ok := f.s3.Object(testBucket, key)
+	if !ok {
+		t.Fatalf("thumbnail %s was not uploaded", key)
+	}
+	img, _, err := image.Decode(bytes.NewReader(object.Body))
+	if err != nil {
+		t.Fatalf("decode thumbnail %s: %v", key, err)
+	}
+	return img
+}
+
+func TestHandleS3EventProcessesImage(t *testing.T) {
+	h, f := newTestHandler(t)
+	f.rekognition.Labels = dogLabels()
+
+	key := "images/1700000000-dog.jpg"
+	body := testJPEG(t, 640, 480)
+	f.s3.PutBytes(testBucket, key, body, map[string]string{
+		OwnerMetadataKey:            "user-a",
+		OriginalFilenameMetadataKey: "dog.jpg",
+	})
+
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	metadata := storedMetadata(t, f, key)
+	if metadata.Status != statusComplete {
+		t.Errorf("status = %q, want %q", metadata.Status, statusComplete)
+	}
+	if metadata.Owner != "user-a" || metadata.OriginalFilename != "dog.jpg" {
+		t.Errorf("owner, filename = %q, %q; want user-a, dog.jpg", metadata.Owner, metadata.OriginalFilename)
+	}
+	if metadata.Width != 640 || metadata.Height != 480 {
+		t.Errorf("dimensions = %dx%d, want 640x480", metadata.Width, metadata.Height)
+	}
+	if len(metadata.DetectedLabels) != 1 || metadata.DetectedLabels[0].Name != "Dog" {
+		t.Fatalf("detected labels = %+v, want Dog", metadata.DetectedLabels)
+	}
+
+	if metadata.ThumbnailKey == "" {
+		t.Fatal("no thumbnail key saved")
+	}
+	if _, ok := f.s3.Object(testBucket, metadata.ThumbnailKey); !ok {
+		t.Errorf("thumbnail %s was not uploaded", metadata.ThumbnailKey)
+	}
+
+	// Search entries carry the owner so authenticated searches can filter on it
+	for _, term := range []string{"dog", "animal"} {
+		var entry searchEntry
+		if err := attributevalue.UnmarshalMap(f.dynamoDB.Item(SearchEntryKey(term, key)), &entry); err != nil || entry.TargetKey != key {
+			t.Errorf("no search entry for %q", term)
+			continue
+		}
+		if entry.TargetOwner != "user-a" {
+			t.Errorf("search entry for %q has target_owner %q, want user-a", term, entry.TargetOwner)
+		}
+	}
+
+	// A redelivered event finds the image complete and skips Rekognition
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event (redelivery): %v", err)
+	}
+	if n := f.rekognition.Calls("DetectLabels"); n != 1 {
+		t.Errorf("DetectLabels called %d times, want 1", n)
+	}
+}
+
+func TestParseThumbnailWidths(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []int
+		wantErr bool
+	}{
+		{"", []int{300}, false},
+		{"  ", []int{300}, false},
+		{"300", []int{300}, false},
+		{"800, 150,300,150", []int{150, 300, 800}, false},
+		{"150,abc", nil, true},
+		{"0", nil, true},
+		{"-150", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseThumbnailWidths(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseThumbnailWidths(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("parseThumbnailWidths(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestHandleS3EventThumbnailWidths(t *testing.T) {
+	t.Setenv("THUMBNAIL_WIDTHS", "150,300,800")
+	h, f := newTestHandler(t)
+	f.rekognition.Labels = dogLabels()
+
+	key := "images/1700000000-dog.jpg"
+	body := testJPEG(t, 640, 480)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	// 800 is wider than the source, so it is skipped rather than upscaled
+	metadata := storedMetadata(t, f, key)
+	want := []struct {
+		width, height int
+		key           string
+	}{
+		{150, 113, "thumbnails/150/" + key},
+		{300, 225, "thumbnails/300/" + key},
+	}
+	if len(metadata.Thumbnails) != len(want) {
+		t.Fatalf("thumbnails = %v, want %d sizes", metadata.Thumbnails, len(want))
+	}
+	for _, w := range want {
+		if got := metadata.Thumbnails[strconv.Itoa(w.width)]; got != w.key {
+			t.Errorf("thumbnails[%d] = %q, want %q", w.width, got, w.key)
+		}
+		bounds := storedThumbnail(t, f, w.key).Bounds()
+		if bounds.Dx() != w.width || bounds.Dy() != w.height {
+			t.Errorf("%dpx thumbnail is %dx%d, want %dx%d", w.width, bounds.Dx(), bounds.Dy(), w.width, w.height)
+		}
+	}
+	if metadata.ThumbnailKey != want[1].key {
+		t.Errorf("thumbnail key = %q, want the middle size %q", metadata.ThumbnailKey, want[1].key)
+	}
+	if _, ok := f.s3.Object(testBucket, "thumbnails/800/"+key); ok {
+		t.Error("uploaded an 800px thumbnail of a 640px image")
+	}
+}
+
+func TestHandleS3EventKeepsNarrowImagesAtNativeSize(t *testing.T) {
+	t.Setenv("THUMBNAIL_WIDTHS", "300,800")
+	h, f := newTestHandler(t)
+
+	key := "images/1700000000-icon.jpg"
+	body := testJPEG(t, 120, 90)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	metadata := storedMetadata(t, f, key)
+	thumbnailKey := "thumbnails/300/" + key
+	if len(metadata.Thumbnails) != 1 || metadata.Thumbnails["300"] != thumbnailKey {
+		t.Fatalf("thumbnails = %v, want only the smallest width", metadata.Thumbnails)
+	}
+	if bounds := storedThumbnail(t, f, thumbnailKey).Bounds(); bounds.Dx() != 120 || bounds.Dy() != 90 {
+		t.Errorf("thumbnail is %dx%d, want the native 120x90", bounds.Dx(), bounds.Dy())
+	}
+}
+
+func TestHandleS3EventThumbnailFormat(t *testing.T) {
+	tests := []struct {
+		format      string
+		key         string
+		contentType string
+	}{
+		{"", "thumbnails/300/images/1700000000-dog.jpg", "image/jpeg"},
+		{"PNG", "thumbnails/300/images/1700000000-dog.png", "image/png"},
+		{"webp", "thumbnails/300/images/1700000000-dog.webp", "image/webp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			t.Setenv("THUMBNAIL_FORMAT", tt.format)
+			h, f := newTestHandler(t)
+
+			key := "images/1700000000-dog.jpeg"
+			body := testJPEG(t, 640, 480)
+			f.s3.PutBytes(testBucket, key, body, nil)
+			if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+				t.Fatalf("HandleS3Event: %v", err)
+			}
+
+			if got := storedMetadata(t, f, key).ThumbnailKey; got != tt.key {
+				t.Fatalf("thumbnail key = %q, want %q", got, tt.key)
+			}
+			object, _ := f.s3.Object(testBucket, tt.key)
+			if object.ContentType != tt.contentType {
+				t.Errorf("content type = %q, want %q", object.ContentType, tt.contentType)
+			}
+			_, format, err := image.Decode(bytes.NewReader(object.Body))
+			if err != nil {
+				t.Fatalf("decode thumbnail: %v", err)
+			}
+			if "image/"+format != tt.contentType {
+				t.Errorf("thumbnail decodes as %s, want %s", format, tt.contentType)
+			}
+		})
+	}
+}
+
+func TestNewRejectsUnknownThumbnailFormat(t *testing.T) {
+	t.Setenv("THUMBNAIL_FORMAT", "gif")
+	if _, err := New(Clients{}); err == nil {
+		t.Fatal("New accepted THUMBNAIL_FORMAT=gif")
+	}
+}
+
+func TestNewRejectsUnknownResample(t *testing.T) {
+	t.Setenv("THUMBNAIL_RESAMPLE", "bicubic")
+	if _, err := New(Clients{}); err == nil || !strings.Contains(err.Error(), "THUMBNAIL_RESAMPLE") {
+		t.Errorf("New = %v, want an invalid THUMBNAIL_RESAMPLE error", err)
+	}
+}
+
+func TestHandleS3EventThumbnailPrefix(t *testing.T) {
+	t.Setenv("THUMBNAIL_PREFIX", "thumbs")
+	t.Setenv("THUMBNAIL_RESAMPLE", "nearest")
+	h, f := newTestHandler(t)
+
+	key := "images/1700000000-dog.jpg"
+	body := testJPEG(t, 640, 480)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	want := "thumbs/300/" + key
+	if got := storedMetadata(t, f, key).ThumbnailKey; got != want {
+		t.Errorf("thumbnail key = %q, want %q with the prefix slash-terminated", got, want)
+	}
+	if bounds := storedThumbnail(t, f, want).Bounds(); bounds.Dx() != 300 {
+		t.Errorf("thumbnail is %d wide, want 300", bounds.Dx())
+	}
+	if keys := f.s3.Keys(testBucket, "thumbnails/"); len(keys) != 0 {
+		t.Errorf("thumbnails written under the default prefix: %v", keys)
+	}
+}
+
+func TestHandleS3EventDetectsFaces(t *testing.T) {
+	h, f := newTestHandler(t)
+	f.rekognition.Faces = rekognition.DetectFacesOutput{FaceDetails: []rekognitionTypes.FaceDetail{{
+		Confidence:  aws.Float32(99.1),
+		BoundingBox: &rekognitionTypes.BoundingBox{Left: aws.Float32(0.1), Top: aws.Float32(0.2), Width: aws.Float32(0.3), Height: aws.Float32(0.4)},
+		AgeRange:    &rekognitionTypes.AgeRange{Low: aws.Int32(25), High: aws.Int32(35)},
+		Smile:       &rekognitionTypes.Smile{Value: true},
+		Emotions: []rekognitionTypes.Emotion{
+			{Type: rekognitionTypes.EmotionNameCalm, Confidence: aws.Float32(20)},
+			{Type: rekognitionTypes.EmotionNameHappy, Confidence: aws.Float32(75)},
+		},
+	}}}
+
+	key := "images/1700000000-portrait.jpg"
+	body := testJPEG(t, 64, 48)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	faces := storedMetadata(t, f, key).Faces
+	want := FaceInfo{
+		BoundingBox:     BoundingBox{Left: 0.1, Top: 0.2, Width: 0.3, Height: 0.4},
+		AgeLow:          25,
+		AgeHigh:         35,
+		DominantEmotion: "HAPPY",
+		Smiling:         true,
+		Confidence:      99.1,
+	}
+	if len(faces) != 1 || faces[0] != want {
+		t.Errorf("faces = %+v, want [%+v]", faces, want)
+	}
+}
+
+func TestHandleS3EventSkipsDisabledFaceDetection(t *testing.T) {
+	t.Setenv("ENABLE_FACE_DETECTION", "false")
+	h, f := newTestHandler(t)
+
+	key := "images/1700000000-portrait.jpg"
+	body := testJPEG(t, 64, 48)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	if n := f.rekognition.Calls("DetectFaces"); n != 0 {
+		t.Errorf("DetectFaces called %d times with face detection off", n)
+	}
+	if faces := storedMetadata(t, f, key).Faces; len(faces) != 0 {
+		t.Errorf("faces = %+v, want none", faces)
+	}
+}
+
+func TestHandleS3EventDetectsText(t *testing.T) {
+	t.Setenv("ENABLE_TEXT_DETECTION", "true")
+	h, f := newTestHandler(t)
+	f.rekognition.Text = rekognition.DetectTextOutput{TextDetections: []rekognitionTypes.TextDetection{
+		{Type: rekognitionTypes.TextTypesLine, DetectedText: aws.String("OPEN 24 HOURS"), Confidence: aws.Float32(98)},
+		{Type: rekognitionTypes.TextTypesWord, DetectedText: aws.String("OPEN"), Confidence: aws.Float32(99)},
+		{Type: rekognitionTypes.TextTypesLine, DetectedText: aws.String("Main St"), Confidence: aws.Float32(91)},
+	}}
+
+	key := "images/1700000000-sign.jpg"
+	body := testJPEG(t, 64, 48)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	// Only LINE detections are kept; the words repeat them
+	metadata := storedMetadata(t, f, key)
+	want := []TextInfo{{Text: "OPEN 24 HOURS", Confidence: 98}, {Text: "Main St", Confidence: 91}}
+	if !slices.Equal(metadata.DetectedText, want) {
+		t.Errorf("detected text = %+v, want %+v", metadata.DetectedText, want)
+	}
+	if metadata.TextBlob != "OPEN 24 HOURS Main St" {
+		t.Errorf("text blob = %q, want %q", metadata.TextBlob, "OPEN 24 HOURS Main St")
+	}
+}
+
+func TestHandleS3EventSkipsTextDetectionByDefault(t *testing.T) {
+	h, f := newTestHandler(t)
+
+	key := "images/1700000000-sign.jpg"
+	body := testJPEG(t, 64, 48)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	if n := f.rekognition.Calls("DetectText"); n != 0 {
+		t.Errorf("DetectText called %d times without ENABLE_TEXT_DETECTION", n)
+	}
+	if _, ok := f.dynamoDB.Item(key)["text_blob"]; ok {
+		t.Error("saved a text_blob without text detection")
+	}
+}
+
+// violence is a moderation result flagging an image as violent
+func violence(confidence float32) rekognition.DetectModerationLabelsOutput {
+	return rekognition.DetectModerationLabelsOutput{
+		ModerationLabels: []rekognitionTypes.ModerationLabel{{
+			Name:       aws.String("Violence"),
+			Confidence: aws.Float32(confidence),
+		}},
+	}
+}
+
+func TestHandleS3EventSkipsThumbnailsOfFlaggedImages(t *testing.T) {
+	h, f := newTestHandler(t)
+	f.rekognition.Moderation = violence(99)
+
+	key := "images/1700000000-flagged.jpg"
+	body := testJPEG(t, 320, 240)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	metadata := storedMetadata(t, f, key)
+	if !metadata.ModerationFlagged {
+		t.Error("image not flagged")
+	}
+	if labels := metadata.ModerationLabels; len(labels) != 1 || labels[0].Name != "Violence" || labels[0].Confidence != 99 {
+		t.Errorf("moderation labels = %+v, want Violence at 99", labels)
+	}
+	if metadata.ThumbnailKey != "" {
+		t.Errorf("flagged image got thumbnail %s", metadata.ThumbnailKey)
+	}
+	if keys := f.s3.Keys(testBucket, "thumbnails/"); len(keys) != 0 {
+		t.Errorf("thumbnails uploaded for flagged image: %v", keys)
+	}
+	// Without QUARANTINE_FLAGGED the original stays where it was
+	if _, ok := f.s3.Object(testBucket, key); !ok {
+		t.Error("original was moved without QUARANTINE_FLAGGED")
+	}
+}
+
+func TestHandleS3EventIgnoresModerationBelowThreshold(t *testing.T) {
+	t.Setenv("MIN_MODERATION_CONFIDENCE", "90")
+	h, f := newTestHandler(t)
+	f.rekognition.Moderation = violence(85)
+
+	key := "images/1700000000-borderline.jpg"
+	body := testJPEG(t, 320, 240)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	metadata := storedMetadata(t, f, key)
+	if metadata.ModerationFlagged || metadata.ThumbnailKey == "" {
+		t.Errorf("flagged = %v, thumbnail = %q; want an unflagged image with a thumbnail", metadata.ModerationFlagged, metadata.ThumbnailKey)
+	}
+}
+
+func TestHandleS3EventQuarantinesFlaggedImages(t *testing.T) {
+	t.Setenv("QUARANTINE_FLAGGED", "true")
+	h, f := newTestHandler(t)
+	f.rekognition.Moderation = violence(99)
+
+	key := "images/1700000000-flagged.jpg"
+	body := testJPEG(t, 320, 240)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	quarantineKey := "quarantine/" + key
+	if got := storedMetadata(t, f, key).QuarantineKey; got != quarantineKey {
+		t.Errorf("quarantine key = %q, want %q", got, quarantineKey)
+	}
+	if _, ok := f.s3.Object(testBucket, key); ok {
+		t.Error("flagged original is still under images/")
+	}
+	if object, ok := f.s3.Object(testBucket, quarantineKey); !ok || !bytes.Equal(object.Body, body) {
+		t.Error("flagged original was not copied to quarantine/")
+	}
+}
+
+func TestHandleS3EventModerationFailures(t *testing.T) {
+	for _, required := range []bool{false, true} {
+		t.Run(strconv.FormatBool(required), func(t *testing.T) {
+			t.Setenv("MODERATION_REQUIRED", strconv.FormatBool(required))
+			h, f := newTestHandler(t)
+			f.rekognition.BeforeCall = func(operation string) error {
+				if operation == "DetectModerationLabels" {
+					return errors.New("moderation unavailable")
+				}
+				return nil
+			}
+
+			key := "images/1700000000-dog.jpg"
+			body := testJPEG(t, 320, 240)
+			f.s3.PutBytes(testBucket, key, body, nil)
+			err := h.HandleS3Event(context.Background(), s3Event(key, len(body)))
+
+			// Only MODERATION_REQUIRED makes a failed check fail the record
+			if required {
+				if err == nil {
+					t.Fatal("HandleS3Event succeeded without the required moderation check")
+				}
+				if f.dynamoDB.Item(key) != nil {
+					t.Error("saved metadata for an unmoderated image")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("HandleS3Event: %v", err)
+			}
+			if storedMetadata(t, f, key).ThumbnailKey == "" {
+				t.Error("image got no thumbnail after a failed optional check")
+			}
+		})
+	}
+}
+
+// ftyp is the start of an ISO-BMFF file with the given major brand
+func ftyp(brand string) []byte {
+	return append([]byte("\x00\x00\x00\x18ftyp"+brand), make([]byte, 16)...)
+}
+
+func TestIsHEIC(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"heic", ftyp("heic"), true},
+		{"heif", ftyp("mif1"), true},
+		{"mp4", ftyp("isom"), false},
+		{"jpeg", testJPEG(t, 8, 8), false},
+		{"short", []byte("\x00\x00\x00\x18ftyp"), false},
+	}
+	for _, tt := range tests {
+		if got := isHEIC(tt.data); got != tt.want {
+			t.Errorf("isHEIC(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHandleS3EventFailsOnUndecodableHEIC(t *testing.T) {
+	h, f := newTestHandler(t)
+
+	key := "images/1700000000-photo.heic"
+	body := ftyp("heic")
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+	// Retrying can't fix the file, so it is recorded as failed rather than retried
+	if metadata := storedMetadata(t, f, key); metadata.Status != statusFailed || !strings.Contains(metadata.FailureReason, "convert image/heic") {
+		t.Errorf("status, failure_reason = %q, %q; want %q and a HEIC conversion failure", metadata.Status, metadata.FailureReason, statusFailed)
+	}
+	if n := f.rekognition.Calls("DetectLabels"); n != 0 {
+		t.Errorf("DetectLabels called %d times with unconverted HEIC bytes", n)
+	}
+	if keys := f.s3.Keys(testBucket, "converted/"); len(keys) != 0 {
+		t.Errorf("stored converted copies %v of an undecodable file", keys)
+	}
+}
+
+// testGIF encodes a w x h GIF with one solid frame per color. With local set,
+// each frame carries its own color table instead of sharing a global one.
+func testGIF(t *testing.T, w, h int, colors []color.Color, local bool) []byte {
+	t.Helper()
+	g := &gif.GIF{LoopCount: 0}
+	if !local {
+		g.Config = image.Config{Width: w, Height: h, ColorModel: color.Palette(palette.Plan9)}
+	}
+	for _, c := range colors {
+		framePalette := color.Palette(palette.Plan9)
+		if local {
+			framePalette = color.Palette{c, color.Black}
+		}
+		frame := image.NewPaletted(image.Rect(0, 0, w, h), framePalette)
+		index := uint8(framePalette.Index(c))
+		for i := range frame.Pix {
+			frame.Pix[i] = index
+		}
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatalf("encode test GIF: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestHandleS3EventThumbnailsFirstFrameOfAnimatedGIF(t *testing.T) {
+	h, f := newTestHandler(t)
+
+	key := "images/1700000000-dance.gif"
+	red := color.RGBA{R: 255, A: 255}
+	body := testGIF(t, 640, 480, []color.Color{red, color.RGBA{G: 255, A: 255}, color.RGBA{B: 255, A: 255}}, false)
+	f.s3.PutBytes(testBucket, key, body, nil)
+
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	metadata := storedMetadata(t, f, key)
+	if !metadata.IsAnimated || metadata.FrameCount != 3 {
+		t.Errorf("is_animated, frame_count = %t, %d; want true, 3", metadata.IsAnimated, metadata.FrameCount)
+	}
+	if original, _ := f.s3.Object(testBucket, key); !bytes.Equal(original.Body, body) {
+		t.Error("original GIF was modified")
+	}
+
+	object, ok := f.s3.Object(testBucket, metadata.ThumbnailKey)
+	if !ok {
+		t.Fatalf("thumbnail %s was not uploaded", metadata.ThumbnailKey)
+	}
+	thumbnail, err := jpeg.Decode(bytes.NewReader(object.Body))
+	if err != nil {
+		t.Fatalf("thumbnail is not a JPEG: %v", err)
+	}
+	// The first frame is red
+	bounds := thumbnail.Bounds()
+	r, g, b, _ := thumbnail.At(bounds.Dx()/2, bounds.Dy()/2).RGBA()
+	if r>>8 < 200 || g>>8 > 55 || b>>8 > 55 {
+		t.Errorf("thumbnail center = (%d, %d, %d), want the red first frame", r>>8, g>>8, b>>8)
+	}
+}
+
+func TestGIFFrameCount(t *testing.T) {
+	colors := []color.Color{color.RGBA{R: 255, A: 255}, color.RGBA{G: 255, A: 255}, color.RGBA{B: 255, A: 255}}
+	three := testGIF(t, 16, 16, colors, false)
+
+	tests := []struct {
+		name    string
+		gif     []byte
+		want    int
+		wantErr bool
+	}{
+		{"global color table", three, 3, false},
+		{"local color tables", testGIF(t, 16, 16, colors, true), 3, false},
+		{"single frame", testGIF(t, 16, 16, colors[:1], false), 1, false},
+		{"no trailer", three[:len(three)-1], 0, true},
+		{"cut inside a frame", three[:len(three)/2], 0, true},
+		{"header only", three[:10], 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := gifFrameCount(tt.gif)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("gifFrameCount = %d, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("gifFrameCount: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("gifFrameCount = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleS3EventIndexesImageInGallery(t *testing.T) {
+	h, f := newTestHandler(t)
+	f.rekognition.Labels = dogLabels()
+
+	key := "images/1700000000-dog.jpg"
+	body := testJPEG(t, 320, 240)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	metadata := storedMetadata(t, f, key)
+	if metadata.GalleryPK != GalleryPartition {
+		t.Errorf("gallery_pk = %q, want %q", metadata.GalleryPK, GalleryPartition)
+	}
+	if metadata.ProcessedAt == "" {
+		t.Error("processed_at, the gallery sort key, is empty")
+	}
+}
+
+func TestHandleS3EventStoresOriginalDimensions(t *testing.T) {
+	var png123x45 bytes.Buffer
+	if err := png.Encode(&png123x45, testImage(123, 45)); err != nil {
+		t.Fatalf("encode test PNG: %v", err)
+	}
+	tests := []struct {
+		name   string
+		key    string
+		body   []byte
+		width  int
+		height int
+	}{
+		{"landscape JPEG", "images/1700000000-wide.jpg", testJPEG(t, 301, 97), 301, 97},
+		{"portrait JPEG", "images/1700000001-tall.jpg", testJPEG(t, 89, 250), 89, 250},
+		{"PNG", "images/1700000002-icon.png", png123x45.Bytes(), 123, 45},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, f := newTestHandler(t)
+			f.s3.PutBytes(testBucket, tt.key, tt.body, nil)
+			if err := h.HandleS3Event(context.Background(), s3Event(tt.key, len(tt.body))); err != nil {
+				t.Fatalf("HandleS3Event: %v", err)
+			}
+			metadata := storedMetadata(t, f, tt.key)
+			if metadata.Width != tt.width || metadata.Height != tt.height {
+				t.Errorf("dimensions = %dx%d, want %dx%d", metadata.Width, metadata.Height, tt.width, tt.height)
+			}
+		})
+	}
+}
+
+func TestHandleS3EventRecordsDuplicates(t *testing.T) {
+	h, f := newTestHandler(t)
+	f.rekognition.Labels = dogLabels()
+
+	body := testJPEG(t, 320, 240)
+	first, second := "images/1700000000-dog.jpg", "images/1700000100-dog-again.jpg"
+	for _, key := range []string{first, second} {
+		f.s3.PutBytes(testBucket, key, body, nil)
+		if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+			t.Fatalf("HandleS3Event %s: %v", key, err)
+		}
+	}
+
+	original, duplicate := storedMetadata(t, f, first), storedMetadata(t, f, second)
+	hash := sha256.Sum256(body)
+	if want := hex.EncodeToString(hash[:]); original.ContentHash != want || duplicate.ContentHash != want {
+		t.Errorf("content_hash = %q, %q; want both %q", original.ContentHash, duplicate.ContentHash, want)
+	}
+	if original.DuplicateOf != "" {
+		t.Errorf("first upload has duplicate_of %q", original.DuplicateOf)
+	}
+	if duplicate.DuplicateOf != first {
+		t.Errorf("duplicate_of = %q, want %q", duplicate.DuplicateOf, first)
+	}
+	if n := f.rekognition.Calls("DetectLabels"); n != 1 {
+		t.Errorf("DetectLabels called %d times, want 1", n)
+	}
+}
+
+func TestHandleS3EventQuarantinesFlaggedDuplicates(t *testing.T) {
+	t.Setenv("QUARANTINE_FLAGGED", "true")
+	h, f := newTestHandler(t)
+	f.rekognition.Moderation = violence(99)
+
+	body := testJPEG(t, 320, 240)
+	first, second := "images/1700000000-flagged.jpg", "images/1700000100-flagged-again.jpg"
+	for _, key := range []string{first, second} {
+		f.s3.PutBytes(testBucket, key, body, nil)
+		if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+			t.Fatalf("HandleS3Event %s: %v", key, err)
+		}
+	}
+
+	duplicate := storedMetadata(t, f, second)
+	if duplicate.DuplicateOf != first || !duplicate.ModerationFlagged {
+		t.Errorf("duplicate_of, moderation_flagged = %q, %t; want %q, true", duplicate.DuplicateOf, duplicate.ModerationFlagged, first)
+	}
+	if duplicate.QuarantineKey != "quarantine/"+second {
+		t.Errorf("quarantine_key = %q, want quarantine/%s", duplicate.QuarantineKey, second)
+	}
+	for _, key := range []string{first, second} {
+		if _, ok := f.s3.Object(testBucket, key); ok {
+			t.Errorf("flagged upload %s left in place", key)
+		}
+		if _, ok := f.s3.Object(testBucket, "quarantine/"+key); !ok {
+			t.Errorf("flagged upload %s was not quarantined", key)
+		}
+	}
+}
+
+func TestHandleS3EventDeletesUnsupportedContent(t *testing.T) {
+	h, f := newTestHandler(t)
+
+	key := "images/1700000000-notes.jpg"
+	f.s3.PutBytes(testBucket, key, []byte("plain text, not an image"), nil)
+
+	if err := h.HandleS3Event(context.Background(), s3Event(key, 24)); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+	if _, ok := f.s3.Object(testBucket, key); ok {
+		t.Error("unsupported object was not deleted")
+	}
+	if f.dynamoDB.Item(key) != nil {
+		t.Error("metadata saved for unsupported object")
+	}
+	if n := f.rekognition.Calls("DetectLabels"); n != 0 {
+		t.Errorf("DetectLabels called %d times, want 0", n)
+	}
+}
+
+func TestHandleS3EventSniffsMislabeledPNG(t *testing.T) {
+	h, f := newTestHandler(t)
+
+	// PNG bytes uploaded under a .jpg key with a JPEG content type
+	var body bytes.Buffer
+	if err := png.Encode(&body, testImage(320, 240)); err != nil {
+		t.Fatalf("encode test PNG: %v", err)
+	}
+	key := "images/1700000000-claims-jpeg.jpg"
+	_, err := f.s3.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket:      aws.String(testBucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body.Bytes()),
+		ContentType: aws.String("image/jpeg"),
+	})
+	if err != nil {
+		t.Fatalf("PutObject: %v", err)
+	}
+
+	if err := h.HandleS3Event(context.Background(), s3Event(key, body.Len())); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+	if _, ok := f.s3.Object(testBucket, key); !ok {
+		t.Error("mislabeled PNG was deleted")
+	}
+	metadata := storedMetadata(t, f, key)
+	if metadata.Width != 320 || metadata.Height != 240 {
+		t.Errorf("dimensions = %dx%d, want 320x240", metadata.Width, metadata.Height)
+	}
+	if _, ok := f.s3.Object(testBucket, metadata.ThumbnailKey); !ok {
+		t.Errorf("thumbnail %q was not uploaded", metadata.ThumbnailKey)
+	}
+}
+
+func TestHandleS3EventDownscalesOversizedImagesForRekognition(t *testing.T) {
+	body := testJPEG(t, 640, 480)
+	limit := len(body) / 2
+	t.Setenv("MAX_IMAGE_BYTES", strconv.Itoa(limit))
+	h, f := newTestHandler(t)
+
+	// Under the limit the original bytes go to Rekognition unchanged
+	small := testJPEG(t, 64, 48)
+	f.s3.PutBytes(testBucket, "images/1700000000-small.jpg", small, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event("images/1700000000-small.jpg", len(small))); err != nil {
+		t.Fatalf("HandleS3Event small: %v", err)
+	}
+	// Over it a downscaled copy is sent instead
+	f.s3.PutBytes(testBucket, "images/1700000001-large.jpg", body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event("images/1700000001-large.jpg", len(body))); err != nil {
+		t.Fatalf("HandleS3Event large: %v", err)
+	}
+
+	inputs := f.rekognition.LabelsInputs
+	if len(inputs) != 2 {
+		t.Fatalf("DetectLabels called %d times, want 2", len(inputs))
+	}
+	if !bytes.Equal(inputs[0].Image.Bytes, small) {
+		t.Error("image under the limit was not sent as is")
+	}
+	sent := inputs[1].Image.Bytes
+	if len(sent) == 0 || len(sent) > limit {
+		t.Fatalf("sent %d bytes for the large image, want 1-%d", len(sent), limit)
+	}
+	downscaled, err := jpeg.DecodeConfig(bytes.NewReader(sent))
+	if err != nil {
+		t.Fatalf("downscaled copy is not a JPEG: %v", err)
+	}
+	if downscaled.Width >= 640 {
+		t.Errorf("downscaled copy is %d wide, want under 640", downscaled.Width)
+	}
+	if original, _ := f.s3.Object(testBucket, "images/1700000001-large.jpg"); !bytes.Equal(original.Body, body) {
+		t.Error("the stored original was replaced by the downscaled copy")
+	}
+	if metadata := storedMetadata(t, f, "images/1700000001-large.jpg"); metadata.Width != 640 || metadata.Height != 480 {
+		t.Errorf("dimensions = %dx%d, want the original 640x480", metadata.Width, metadata.Height)
+	}
+}
+
+func TestHandleS3EventReferencesOversizedImagesInS3RefMode(t *testing.T) {
+	body := testJPEG(t, 640, 480)
+	t.Setenv("MAX_IMAGE_BYTES", strconv.Itoa(len(body)/2))
+	t.Setenv("REKOGNITION_USE_S3REF", "true")
+	h, f := newTestHandler(t)
+
+	key := "images/1700000000-large.jpg"
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	if len(f.rekognition.LabelsInputs) != 1 {
+		t.Fatalf("DetectLabels called %d times, want 1", len(f.rekognition.LabelsInputs))
+	}
+	image := f.rekognition.LabelsInputs[0].Image
+	if image.Bytes != nil || image.S3Object == nil || aws.ToString(image.S3Object.Name) != key {
+		t.Errorf("Rekognition image = %+v, want a reference to %s instead of bytes", image, key)
+	}
+}
+
+func TestHandleS3EventS3RefFollowsQuarantinedImage(t *testing.T) {
+	t.Setenv("REKOGNITION_USE_S3REF", "true")
+	t.Setenv("QUARANTINE_FLAGGED", "true")
+	h, f := newTestHandler(t)
+	f.rekognition.Moderation = violence(99)
+
+	key := "images/1700000000-flagged.jpg"
+	body := testJPEG(t, 320, 240)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	// Labels are detected after the move, so they must read the quarantined copy
+	if len(f.rekognition.LabelsInputs) != 1 {
+		t.Fatalf("DetectLabels called %d times, want 1", len(f.rekognition.LabelsInputs))
+	}
+	if image := f.rekognition.LabelsInputs[0].Image; image.S3Object == nil || aws.ToString(image.S3Object.Name) != "quarantine/"+key {
+		t.Errorf("Rekognition image = %+v, want a reference to quarantine/%s", image, key)
+	}
+}
+
+func TestHandleS3EventBoundsConcurrencyAndJoinsErrors(t *testing.T) {
+	const limit = 2
+	t.Setenv("MAX_CONCURRENCY", strconv.Itoa(limit))
+	h, f := newTestHandler(t)
+
+	// Hold every download briefly, tracking how many run at once
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	f.s3.BeforeCall = func(operation string) error {
+		if operation != "GetObject" {
+			return nil
+		}
+		mu.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return nil
+	}
+
+	body := testJPEG(t, 64, 48)
+	var event events.S3Event
+	var uploaded, missing []string
+	for i := 0; i < 6; i++ {
+		key := fmt.Sprintf("images/170000000%d-photo.jpg", i)
+		// Every third object was never uploaded, so its record fails
+		if i%3 == 2 {
+			missing = append(missing, key)
+		} else {
+			f.s3.PutBytes(testBucket, key, body, nil)
+			uploaded = append(uploaded, key)
+		}
+		event.Records = append(event.Records, s3Event(key, len(body)).Records...)
+	}
+
+	err := h.HandleS3Event(context.Background(), event)
+	if err == nil {
+		t.Fatal("HandleS3Event succeeded, want the failed records reported")
+	}
+	for _, key := range missing {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("error %q does not name failed key %s", err, key)
+		}
+	}
+	for _, key := range uploaded {
+		if strings.Contains(err.Error(), key) {
+			t.Errorf("error %q names successful key %s", err, key)
+		}
+		storedMetadata(t, f, key)
+	}
+	if maxInFlight > limit {
+		t.Errorf("%d downloads ran at once, want at most %d", maxInFlight, limit)
+	}
+}
+
+func TestHandleSQSEventReportsOnlyFailedMessages(t *testing.T) {
+	t.Setenv("PARTIAL_BATCH_FAILURE", "true")
+	h, f := newTestHandler(t)
+
+	good, bad := "images/1700000000-good.jpg", "images/1700000001-missing.jpg"
+	body := testJPEG(t, 320, 240)
+	f.s3.PutBytes(testBucket, good, body, nil)
+
+	message := func(id, key string) events.SQSMessage {
+		notification, err := json.Marshal(s3Event(key, len(body)))
+		if err != nil {
+			t.Fatalf("marshal S3 event: %v", err)
+		}
+		return events.SQSMessage{MessageId: id, Body: string(notification)}
+	}
+	// The second message's object was never uploaded, so its download fails
+	sqsEvent := events.SQSEvent{Records: []events.SQSMessage{message("msg-good", good), message("msg-bad", bad)}}
+
+	response, err := h.HandleSQSEvent(context.Background(), sqsEvent)
+	if err != nil {
+		t.Fatalf("HandleSQSEvent: %v", err)
+	}
+	if len(response.BatchItemFailures) != 1 || response.BatchItemFailures[0].ItemIdentifier != "msg-bad" {
+		t.Errorf("batch item failures = %+v, want only msg-bad", response.BatchItemFailures)
+	}
+	storedMetadata(t, f, good)
+}
+
+func TestThumbnailJPEGQuality(t *testing.T) {
+	key := "images/1700000000-photo.jpg"
+	body := testJPEG(t, 640, 480)
+	thumbnailSize := func(quality string) int {
+		t.Setenv("THUMBNAIL_JPEG_QUALITY", quality)
+		h, f := newTestHandler(t)
+		f.s3.PutBytes(testBucket, key, body, nil)
+		if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+			t.Fatalf("HandleS3Event at quality %s: %v", quality, err)
+		}
+		thumbnail, ok := f.s3.Object(testBucket, storedMetadata(t, f, key).ThumbnailKey)
+		if !ok {
+			t.Fatalf("no thumbnail uploaded at quality %s", quality)
+		}
+		return len(thumbnail.Body)
+	}
+
+	if low, high := thumbnailSize("50"), thumbnailSize("95"); low >= high {
+		t.Errorf("quality 50 thumbnail is %d bytes, want fewer than the %d at quality 95", low, high)
+	}
+}
+
+func TestNewRejectsOutOfRangeJPEGQuality(t *testing.T) {
+	for _, quality := range []string{"0", "-5", "101", "high"} {
+		t.Run(quality, func(t *testing.T) {
+			t.Setenv("THUMBNAIL_JPEG_QUALITY", quality)
+			if _, err := New(Clients{}); err == nil || !strings.Contains(err.Error(), "THUMBNAIL_JPEG_QUALITY") {
+				t.Errorf("New = %v, want an invalid THUMBNAIL_JPEG_QUALITY error", err)
+			}
+		})
+	}
+}
+
+func TestHandleS3EventWritesSearchEntries(t *testing.T) {
+	t.Setenv("REPROCESS", "true")
+	h, f := newTestHandler(t)
+	f.rekognition.Labels = rekognition.DetectLabelsOutput{Labels: []rekognitionTypes.Label{
+		{Name: aws.String("Golden Retriever"), Confidence: aws.Float32(95)},
+		{Name: aws.String("Dog"), Confidence: aws.Float32(97.5)},
+	}}
+
+	key := "images/1700000000-dog.jpg"
+	body := testJPEG(t, 64, 48)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	want := []string{"golden retriever", "golden", "retriever", "dog"}
+	if got := storedMetadata(t, f, key).SearchTerms; !slices.Equal(got, want) {
+		t.Errorf("search_terms = %v, want %v", got, want)
+	}
+	for _, term := range want {
+		item := f.dynamoDB.Item(SearchEntryKey(term, key))
+		if item == nil {
+			t.Errorf("no search entry for %q", term)
+			continue
+		}
+		var entry searchEntry
+		if err := attributevalue.UnmarshalMap(item, &entry); err != nil {
+			t.Fatalf("unmarshal %q entry: %v", term, err)
+		}
+		if entry.SearchTerm != term || entry.TargetKey != key {
+			t.Errorf("%q entry = %+v, want term %q targeting %q", term, entry, term, key)
+		}
+	}
+
+	// Reprocessing with fewer labels removes the entries for dropped terms
+	f.rekognition.Labels = dogLabels()
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event again: %v", err)
+	}
+	var entries []string
+	for _, k := range f.dynamoDB.Keys() {
+		if strings.HasPrefix(k, "search#") {
+			entries = append(entries, k)
+		}
+	}
+	if want := []string{SearchEntryKey("animal", key), SearchEntryKey("dog", key)}; !slices.Equal(entries, want) {
+		t.Errorf("search entries after reprocessing = %v, want %v", entries, want)
+	}
+}
+
+func TestLabelCountChanges(t *testing.T) {
+	previous := []LabelInfo{{Name: "Dog"}, {Name: "Animal"}, {Name: "Grass"}}
+	current := []LabelInfo{{Name: "Dog"}, {Name: "Animal"}, {Name: "Ball"}, {Name: "Ball"}}
+	got := labelCountChanges(previous, current)
+	if want := map[string]int{"Ball": 1, "Grass": -1}; !maps.Equal(got, want) {
+		t.Errorf("labelCountChanges = %v, want %v", got, want)
+	}
+	if got := labelCountChanges(nil, nil); len(got) != 0 {
+		t.Errorf("labelCountChanges(nil, nil) = %v, want none", got)
+	}
+}
+
+func TestHandleS3EventStoresOriginalFilename(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		want     string
+	}{
+		{"escaped", map[string]string{"original-filename": "beach%20day.jpg"}, "beach day.jpg"},
+		{"none", nil, ""},
+		{"malformed escape", map[string]string{"original-filename": "beach%zz.jpg"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, f := newTestHandler(t)
+			key := "images/1700000000-beach-day.jpg"
+			body := testJPEG(t, 64, 48)
+			f.s3.PutBytes(testBucket, key, body, tt.metadata)
+			if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+				t.Fatalf("HandleS3Event: %v", err)
+			}
+			if got := storedMetadata(t, f, key).OriginalFilename; got != tt.want {
+				t.Errorf("original_filename = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleS3EventLogsUploadRequestID(t *testing.T) {
+	h, f := newTestHandler(t)
+	var logs bytes.Buffer
+	h.logger = slog.New(slog.NewTextHandler(&logs, nil))
+
+	key := "images/1700000000-dog.jpg"
+	body := testJPEG(t, 320, 240)
+	f.s3.PutBytes(testBucket, key, body, map[string]string{CorrelationIDMetadataKey: "req-abc123"})
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	if !strings.Contains(logs.String(), "request_id=req-abc123") {
+		t.Errorf("upload request ID not logged:\n%s", logs.String())
+	}
+}
+
+func TestHandleS3EventCompletesPlaceholder(t *testing.T) {
+	h, f := newTestHandler(t)
+	key := "images/1700000000-dog.jpg"
+	placeholder, err := attributevalue.MarshalMap(map[string]string{
+		"image_key":    key,
+		"gallery_pk":   GalleryPartition,
+		"status":       "processing",
+		"processed_at": "2024-01-01T00:00:00Z",
+	})
+	if err != nil {
+		t.Fatalf("marshal placeholder: %v", err)
+	}
+	f.dynamoDB.Put(placeholder)
+
+	body := testJPEG(t, 64, 48)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+	if got := storedMetadata(t, f, key).Status; got != statusComplete {
+		t.Errorf("status = %q, want %q", got, statusComplete)
+	}
+}
+
+func TestHandleS3EventRecordsPermanentFailures(t *testing.T) {
+	undecodable := append([]byte{0xFF, 0xD8, 0xFF, 0xE0}, []byte("not really a jpeg")...)
+	tests := []struct {
+		name string
+		body []byte
+		// rekognitionErr and dynamoErr fail every call to that service
+		rekognitionErr error
+		dynamoErr      error
+		wantErr        bool
+		wantFailed     bool
+	}{
+		{name: "undecodable image", body: undecodable, wantFailed: true},
+		{name: "transient Rekognition error is retried", rekognitionErr: errors.New("connection reset"), wantErr: true},
+		{name: "failed record that cannot be saved is retried", body: undecodable, dynamoErr: errors.New("table unavailable"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, f := newTestHandler(t)
+			f.rekognition.BeforeCall = func(string) error { return tt.rekognitionErr }
+			f.dynamoDB.BeforeCall = func(string) error { return tt.dynamoErr }
+
+			key := "images/1700000000-photo.jpg"
+			body := tt.body
+			if body == nil {
+				body = testJPEG(t, 320, 240)
+			}
+			f.s3.PutBytes(testBucket, key, body, nil)
+
+			err := h.HandleS3Event(context.Background(), s3Event(key, len(body)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("HandleS3Event = %v, want error %t", err, tt.wantErr)
+			}
+			if !tt.wantFailed {
+				if f.dynamoDB.Item(key) != nil {
+					t.Error("item saved for a record that will be retried")
+				}
+				return
+			}
+			metadata := storedMetadata(t, f, key)
+			if metadata.Status != statusFailed || metadata.FailureReason == "" {
+				t.Errorf("status, failure_reason = %q, %q; want %q and a reason", metadata.Status, metadata.FailureReason, statusFailed)
+			}
+			if metadata.ThumbnailKey != "" || len(metadata.DetectedLabels) != 0 {
+				t.Errorf("failed record has thumbnail %q and labels %v", metadata.ThumbnailKey, metadata.DetectedLabels)
+			}
+		})
+	}
+}
+
+func TestHandleS3EventKeepsPNGTransparency(t *testing.T) {
+	// Opaque red on the left half, fully transparent on the right
+	src := image.NewNRGBA(image.Rect(0, 0, 400, 300))
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 200; x++ {
+			src.SetNRGBA(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatalf("encode PNG: %v", err)
+	}
+	body := buf.Bytes()
+	key := "images/1700000000-logo.png"
+
+	tests := []struct {
+		format          string
+		wantType        string
+		wantTransparent bool
+	}{
+		{"", "image/png", true},
+		{"jpeg", "image/jpeg", false},
+	}
+	for _, tt := range tests {
+		t.Run("THUMBNAIL_FORMAT="+tt.format, func(t *testing.T) {
+			t.Setenv("THUMBNAIL_FORMAT", tt.format)
+			h, f := newTestHandler(t)
+			f.s3.PutBytes(testBucket, key, body, nil)
+			if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+				t.Fatalf("HandleS3Event: %v", err)
+			}
+
+			thumbnailKey := storedMetadata(t, f, key).ThumbnailKey
+			thumbnail := storedThumbnail(t, f, thumbnailKey)
+			object, _ := f.s3.Object(testBucket, thumbnailKey)
+			if object.ContentType != tt.wantType {
+				t.Errorf("content type = %q, want %q", object.ContentType, tt.wantType)
+			}
+			wantExt := ".png"
+			if tt.wantType == "image/jpeg" {
+				wantExt = ".jpg"
+			}
+			if path.Ext(thumbnailKey) != wantExt {
+				t.Errorf("thumbnail key %s, want a %s extension", thumbnailKey, wantExt)
+			}
+
+			bounds := thumbnail.Bounds()
+			_, _, _, leftAlpha := thumbnail.At(bounds.Min.X+2, bounds.Min.Y+bounds.Dy()/2).RGBA()
+			_, _, _, rightAlpha := thumbnail.At(bounds.Max.X-3, bounds.Min.Y+bounds.Dy()/2).RGBA()
+			if leftAlpha != 0xffff {
+				t.Errorf("opaque half has alpha %#x, want opaque", leftAlpha)
+			}
+			if transparent := rightAlpha == 0; transparent != tt.wantTransparent {
+				t.Errorf("transparent half has alpha %#x, want transparent %t", rightAlpha, tt.wantTransparent)
+			}
+		})
+	}
+}
+
+func TestHandleS3EventThumbnailModes(t *testing.T) {
+	// Blue margins around a red center square, so a center crop is all red
+	bordered := func(w, h int) []byte {
+		side := min(w, h)
+		center := image.Rect((w-side)/2, (h-side)/2, (w+side)/2, (h+side)/2)
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				c := color.RGBA{B: 255, A: 255}
+				if image.Pt(x, y).In(center) {
+					c = color.RGBA{R: 255, A: 255}
+				}
+				img.Set(x, y, c)
+			}
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatalf("encode PNG: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name          string
+		mode          string
+		w, h          int
+		width, height int
+	}{
+		{"fit wide", "fit", 800, 400, 300, 150},
+		{"fit tall", "fit", 400, 800, 300, 600},
+		{"fill wide", "fill", 800, 400, 300, 300},
+		{"fill tall", "fill", 400, 800, 300, 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("THUMBNAIL_MODE", tt.mode)
+			h, f := newTestHandler(t)
+			key := "images/1700000000-photo.png"
+			body := bordered(tt.w, tt.h)
+			f.s3.PutBytes(testBucket, key, body, nil)
+			if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+				t.Fatalf("HandleS3Event: %v", err)
+			}
+
+			thumbnail := storedThumbnail(t, f, storedMetadata(t, f, key).ThumbnailKey)
+			if b := thumbnail.Bounds(); b.Dx() != tt.width || b.Dy() != tt.height {
+				t.Errorf("thumbnail is %dx%d, want %dx%d", b.Dx(), b.Dy(), tt.width, tt.height)
+			}
+			metadata := storedMetadata(t, f, key)
+			if metadata.ThumbnailMode != tt.mode || metadata.ThumbnailWidth != tt.width || metadata.ThumbnailHeight != tt.height {
+				t.Errorf("thumbnail_mode, width, height = %q, %d, %d; want %q, %d, %d",
+					metadata.ThumbnailMode, metadata.ThumbnailWidth, metadata.ThumbnailHeight, tt.mode, tt.width, tt.height)
+			}
+			if tt.mode != "fill" {
+				return
+			}
+			// Every corner of the crop comes from the red center
+			b := thumbnail.Bounds()
+			for _, p := range []image.Point{{b.Min.X + 1, b.Min.Y + 1}, {b.Max.X - 2, b.Min.Y + 1}, {b.Min.X + 1, b.Max.Y - 2}, {b.Max.X - 2, b.Max.Y - 2}} {
+				if r, _, blue, _ := thumbnail.At(p.X, p.Y).RGBA(); r>>8 < 200 || blue>>8 > 55 {
+					t.Errorf("pixel %v is not from the center", p)
+				}
+			}
+		})
+	}
+}
+
+// solidPNG encodes a w x h PNG filled with c
+func solidPNG(t *testing.T, w, h int, c color.Color) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("encode PNG: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestHandleS3EventWatermarksThumbnails(t *testing.T) {
+	white := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	isWhite := func(c color.Color) bool {
+		r, g, b, _ := c.RGBA()
+		return r>>8 > 250 && g>>8 > 250 && b>>8 > 250
+	}
+
+	tests := []struct {
+		name     string
+		markW    int
+		markH    int
+		position string
+		// marked and clear are thumbnail pixels inside and outside the mark
+		marked, clear image.Point
+	}{
+		// A 300x200 thumbnail has an 8px margin
+		{"bottom-right", 50, 20, "bottom-right", image.Pt(267, 182), image.Pt(20, 20)},
+		{"top-left", 50, 20, "top-left", image.Pt(20, 15), image.Pt(267, 182)},
+		{"larger than the thumbnail is scaled down", 1000, 1000, "bottom-right", image.Pt(150, 100), image.Pt(3, 3)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("WATERMARK_S3_KEY", "assets/watermark.png")
+			t.Setenv("WATERMARK_POSITION", tt.position)
+			t.Setenv("WATERMARK_OPACITY", "1")
+			h, f := newTestHandler(t)
+			f.s3.PutBytes(testBucket, "assets/watermark.png", solidPNG(t, tt.markW, tt.markH, white), nil)
+			watermarkGets := 0
+			f.s3.BeforeCall = func(operation string) error {
+				if operation == "GetObject" {
+					watermarkGets++
+				}
+				return nil
+			}
+
+			// Two different images, so the second reuses the cached watermark
+			for i, key := range []string{"images/1700000000-a.png", "images/1700000001-b.png"} {
+				body := solidPNG(t, 600, 400, color.Gray{Y: uint8(i * 20)})
+				f.s3.PutBytes(testBucket, key, body, nil)
+				if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+					t.Fatalf("HandleS3Event: %v", err)
+				}
+
+				thumbnail := storedThumbnail(t, f, storedMetadata(t, f, key).ThumbnailKey)
+				if !isWhite(thumbnail.At(tt.marked.X, tt.marked.Y)) {
+					t.Errorf("%s: pixel %v = %v, want the white mark", key, tt.marked, thumbnail.At(tt.marked.X, tt.marked.Y))
+				}
+				if isWhite(thumbnail.At(tt.clear.X, tt.clear.Y)) {
+					t.Errorf("%s: pixel %v is marked, want the dark source", key, tt.clear)
+				}
+			}
+			// One download per image plus one for the watermark
+			if watermarkGets != 3 {
+				t.Errorf("GetObject called %d times, want 3", watermarkGets)
+			}
+		})
+	}
+}
+
+func TestHandleS3EventStoresDominantColors(t *testing.T) {
+	h, f := newTestHandler(t)
+
+	// Mostly red with a blue stripe along the bottom
+	img := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 400; x++ {
+			c := color.RGBA{R: 220, G: 20, B: 30, A: 255}
+			if y >= 240 {
+				c = color.RGBA{R: 20, G: 40, B: 200, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("encode PNG: %v", err)
+	}
+	key := "images/1700000000-red.png"
+	f.s3.PutBytes(testBucket, key, buf.Bytes(), nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, buf.Len())); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	colors := storedMetadata(t, f, key).DominantColors
+	if len(colors) == 0 || len(colors) > 3 {
+		t.Fatalf("dominant colors = %v, want 1 to 3", colors)
+	}
+	near := func(hex string, r, g, b int) bool {
+		var cr, cg, cb int
+		if _, err := fmt.Sscanf(hex, "#%02x%02x%02x", &cr, &cg, &cb); err != nil {
+			t.Fatalf("color %q is not #rrggbb: %v", hex, err)
+		}
+		abs := func(v int) int { return max(v, -v) }
+		return abs(cr-r) <= 16 && abs(cg-g) <= 16 && abs(cb-b) <= 16
+	}
+	if !near(colors[0], 220, 20, 30) {
+		t.Errorf("top color = %s, want near #dc141e", colors[0])
+	}
+	if len(colors) < 2 || !near(colors[1], 20, 40, 200) {
+		t.Errorf("colors = %v, want the blue stripe second", colors)
+	}
+}
+
+func TestHandleS3EventSkipsCompleteImagesUnlessReprocessing(t *testing.T) {
+	tests := []struct {
+		name      string
+		reprocess string
+		status    string
+		wantCalls int
+	}{
+		{"complete is skipped", "false", statusComplete, 0},
+		{"complete is forced by REPROCESS", "true", statusComplete, 1},
+		{"failed is retried", "false", statusFailed, 1},
+		{"placeholder is processed", "false", "processing", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("REPROCESS", tt.reprocess)
+			h, f := newTestHandler(t)
+			f.rekognition.Labels = dogLabels()
+
+			key := "images/1700000000-dog.jpg"
+			body := testJPEG(t, 320, 240)
+			f.s3.PutBytes(testBucket, key, body, nil)
+			item, err := attributevalue.MarshalMap(ImageMetadata{ImageKey: key, Status: tt.status})
+			if err != nil {
+				t.Fatalf("marshal item: %v", err)
+			}
+			f.dynamoDB.Put(item)
+
+			if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+				t.Fatalf("HandleS3Event: %v", err)
+			}
+			if n := f.rekognition.Calls("DetectLabels"); n != tt.wantCalls {
+				t.Errorf("DetectLabels called %d times, want %d", n, tt.wantCalls)
+			}
+			wantStatus := tt.status
+			if tt.wantCalls > 0 {
+				wantStatus = statusComplete
+			}
+			if metadata := storedMetadata(t, f, key); metadata.Status != wantStatus {
+				t.Errorf("status = %q, want %q", metadata.Status, wantStatus)
+			}
+		})
+	}
+}
+
+func TestHandleS3EventSkipsDerivedObjects(t *testing.T) {
+	tests := []struct {
+		prefix string
+		key    string
+	}{
+		{"", "thumbnails/foo.jpg"},
+		{"", "thumbnails/300/images/1700000000-dog.jpg"},
+		{"", "converted/images/1700000000-scan.jpg"},
+		{"", "quarantine/images/1700000000-bad.jpg"},
+		// A THUMBNAIL_PREFIX under images/ would otherwise pass the images/ check
+		{"images/thumbs", "images/thumbs/300/images/1700000000-dog.jpg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			t.Setenv("THUMBNAIL_PREFIX", tt.prefix)
+			h, f := newTestHandler(t)
+			var s3Calls []string
+			f.s3.BeforeCall = func(operation string) error {
+				s3Calls = append(s3Calls, operation)
+				return nil
+			}
+
+			body := testJPEG(t, 64, 48)
+			f.s3.PutBytes(testBucket, tt.key, body, nil)
+			if err := h.HandleS3Event(context.Background(), s3Event(tt.key, len(body))); err != nil {
+				t.Fatalf("HandleS3Event: %v", err)
+			}
+			if len(s3Calls) != 0 {
+				t.Errorf("S3 calls %v, want none", s3Calls)
+			}
+			if n := f.rekognition.Calls("DetectLabels"); n != 0 {
+				t.Errorf("DetectLabels called %d times, want 0", n)
+			}
+			if keys := f.dynamoDB.Keys(); len(keys) != 0 {
+				t.Errorf("saved items %v, want none", keys)
+			}
+		})
+	}
+}
+
+func TestHandleS3EventUsesDecodedKey(t *testing.T) {
+	h, f := newTestHandler(t)
+	key := "images/1700000000-my dog.jpg"
+	body := testJPEG(t, 64, 48)
+	f.s3.PutBytes(testBucket, key, body, nil)
+
+	// S3 notifications URL-encode keys, turning spaces into '+'
+	event := s3Event(key, len(body))
+	event.Records[0].S3.Object.Key = "images/1700000000-my+dog.jpg"
+	if err := h.HandleS3Event(context.Background(), event); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+	if got := storedMetadata(t, f, key).ImageKey; got != key {
+		t.Errorf("image_key = %q, want the decoded %q", got, key)
+	}
+}
+
+func TestHandleS3EventFiltersLabels(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowlist string
+		blocklist string
+		want      []string
+	}{
+		{"no lists", "", "", []string{"Dog", "Person", "Grass"}},
+		{"blocklist", "", "person", []string{"Dog", "Grass"}},
+		{"allowlist", "DOG, grass", "", []string{"Dog", "Grass"}},
+		{"blocklist wins over allowlist", "dog,Grass", "GRASS", []string{"Dog"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LABEL_ALLOWLIST", tt.allowlist)
+			t.Setenv("LABEL_BLOCKLIST", tt.blocklist)
+			h, f := newTestHandler(t)
+			for _, name := range []string{"Dog", "Person", "Grass"} {
+				f.rekognition.Labels.Labels = append(f.rekognition.Labels.Labels, rekognitionTypes.Label{
+					Name:       aws.String(name),
+					Confidence: aws.Float32(90),
+				})
+			}
+
+			key := "images/1700000000-park.jpg"
+			body := testJPEG(t, 320, 240)
+			f.s3.PutBytes(testBucket, key, body, nil)
+			if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+				t.Fatalf("HandleS3Event: %v", err)
+			}
+
+			var got []string
+			for _, label := range storedMetadata(t, f, key).DetectedLabels {
+				got = append(got, label.Name)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("labels = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleS3EventStoresLabelInstances(t *testing.T) {
+	h, f := newTestHandler(t)
+	box := func(left, top, width, height float32) *rekognitionTypes.BoundingBox {
+		return &rekognitionTypes.BoundingBox{Left: aws.Float32(left), Top: aws.Float32(top), Width: aws.Float32(width), Height: aws.Float32(height)}
+	}
+	f.rekognition.Labels = rekognition.DetectLabelsOutput{Labels: []rekognitionTypes.Label{{
+		Name:       aws.String("Car"),
+		Confidence: aws.Float32(99),
+		Instances: []rekognitionTypes.Instance{
+			{BoundingBox: box(0.1, 0.2, 0.3, 0.25), Confidence: aws.Float32(98.5)},
+			{BoundingBox: box(0.55, 0.4, 0.2, 0.15), Confidence: aws.Float32(91)},
+			// Instances without a box can't be drawn, so they are dropped
+			{Confidence: aws.Float32(80)},
+		},
+	}}}
+
+	key := "images/1700000000-street.jpg"
+	body := testJPEG(t, 320, 240)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	labels := storedMetadata(t, f, key).DetectedLabels
+	if len(labels) != 1 {
+		t.Fatalf("detected labels = %+v, want Car", labels)
+	}
+	want := []LabelInstance{
+		{BoundingBox: BoundingBox{Left: 0.1, Top: 0.2, Width: 0.3, Height: 0.25}, Confidence: 98.5},
+		{BoundingBox: BoundingBox{Left: 0.55, Top: 0.4, Width: 0.2, Height: 0.15}, Confidence: 91},
+	}
+	if !slices.Equal(labels[0].Instances, want) {
+		t.Errorf("instances = %+v, want %+v", labels[0].Instances, want)
+	}
+}
+
+func TestRegenerateThumbnail(t *testing.T) {
+	h, f := newTestHandler(t)
+	f.rekognition.Labels = dogLabels()
+	key := "images/1700000000-dog.jpg"
+	body := testJPEG(t, 640, 480)
+	f.s3.PutBytes(testBucket, key, body, map[string]string{OwnerMetadataKey: "user-a"})
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+	before := storedMetadata(t, f, key)
+
+	// The thumbnail settings change after the image was processed
+	h.thumbnailWidths = []int{150}
+	bucket, thumbnailKey, err := h.RegenerateThumbnail(context.Background(), key, "user-a")
+	if err != nil {
+		t.Fatalf("RegenerateThumbnail: %v", err)
+	}
+	if thumbnailKey != "thumbnails/150/images/1700000000-dog.jpg" {
+		t.Errorf("regenerated %s, want thumbnails/150/images/1700000000-dog.jpg", thumbnailKey)
+	}
+	if bucket != testBucket {
+		t.Errorf("regenerated in %s, want %s", bucket, testBucket)
+	}
+
+	after := storedMetadata(t, f, key)
+	if after.ThumbnailKey != thumbnailKey || after.ThumbnailWidth != 150 || len(after.Thumbnails) != 1 {
+		t.Errorf("thumbnail_key, width, thumbnails = %q, %d, %v; want the 150px set", after.ThumbnailKey, after.ThumbnailWidth, after.Thumbnails)
+	}
+	if after.ProcessedAt != before.ProcessedAt || len(after.DetectedLabels) != 1 {
+		t.Error("regenerating changed the analysis attributes")
+	}
+	if n := f.rekognition.Calls("DetectLabels"); n != 1 {
+		t.Errorf("DetectLabels called %d times, want 1", n)
+	}
+	if _, ok := f.s3.Object(testBucket, thumbnailKey); !ok {
+		t.Errorf("%s was not uploaded", thumbnailKey)
+	}
+	if _, ok := f.s3.Object(testBucket, before.ThumbnailKey); ok {
+		t.Errorf("stale thumbnail %s was not deleted", before.ThumbnailKey)
+	}
+
+	// Another owner's image, a search entry, an unknown key and a missing
+	// original are all not found
+	if _, _, err := h.RegenerateThumbnail(context.Background(), key, "user-b"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("another owner: err = %v, want ErrNotFound", err)
+	}
+	if _, _, err := h.RegenerateThumbnail(context.Background(), SearchEntryKey("dog", key), ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("search entry: err = %v, want ErrNotFound", err)
+	}
+	if _, _, err := h.RegenerateThumbnail(context.Background(), "images/unknown.jpg", ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown key: err = %v, want ErrNotFound", err)
+	}
+	if _, err := f.s3.DeleteObject(context.Background(), &s3.DeleteObjectInput{Bucket: aws.String(testBucket), Key: aws.String(key)}); err != nil {
+		t.Fatalf("delete original: %v", err)
+	}
+	if _, _, err := h.RegenerateThumbnail(context.Background(), key, ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing original: err = %v, want ErrNotFound", err)
+	}
+}
+
+// recordingPutter keeps every PutObject input the handler sends, which the
+// fake S3 otherwise reduces to the stored body and metadata
+type recordingPutter struct {
+	S3Putter
+	puts []s3.PutObjectInput
+}
+
+func (r *recordingPutter) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	r.puts = append(r.puts, *params)
+	return r.S3Putter.PutObject(ctx, params, optFns...)
+}
+
+func TestHandleS3EventEncryptsWrites(t *testing.T) {
+	const keyID = "arn:aws:kms:us-east-1:123456789012:key/abcd-1234"
+	t.Setenv("S3_SSE_KMS_KEY_ID", keyID)
+	h, f := newTestHandler(t)
+	putter := &recordingPutter{S3Putter: f.s3}
+	h.s3Putter = putter
+
+	key := "images/1700000000-dog.jpg"
+	body := testJPEG(t, 640, 480)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	if len(putter.puts) == 0 {
+		t.Fatal("no objects written")
+	}
+	for _, input := range putter.puts {
+		if input.ServerSideEncryption != s3Types.ServerSideEncryptionAwsKms || aws.ToString(input.SSEKMSKeyId) != keyID {
+			t.Errorf("%s written with encryption %q, key %q; want aws:kms, %q", aws.ToString(input.Key), input.ServerSideEncryption, aws.ToString(input.SSEKMSKeyId), keyID)
+		}
+	}
+
+	// Without a key the bucket default applies
+	h.sseKMSKeyID = ""
+	if input := h.encrypted(&s3.PutObjectInput{}); input.ServerSideEncryption != "" || input.SSEKMSKeyId != nil {
+		t.Errorf("encryption = %q, %v; want none", input.ServerSideEncryption, input.SSEKMSKeyId)
+	}
+}
+
+func TestHandleS3EventSetsExpiresAt(t *testing.T) {
+	t.Setenv("METADATA_TTL_DAYS", "30")
+	t.Setenv("REPROCESS", "true")
+	h, f := newTestHandler(t)
+	f.rekognition.Labels = dogLabels()
+
+	key := "images/1700000000-dog.jpg"
+	body := testJPEG(t, 320, 240)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	before := time.Now()
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	first := storedMetadata(t, f, key).ExpiresAt
+	if low, high := expiresAt(before, 30), expiresAt(time.Now(), 30); first < low || first > high {
+		t.Fatalf("expires_at = %d, want between %d and %d", first, low, high)
+	}
+	var entry searchEntry
+	if err := attributevalue.UnmarshalMap(f.dynamoDB.Item(SearchEntryKey("dog", key)), &entry); err != nil {
+		t.Fatalf("unmarshal search entry: %v", err)
+	}
+	if entry.ExpiresAt != first {
+		t.Errorf("search entry expires_at = %d, want %d", entry.ExpiresAt, first)
+	}
+
+	// Age the stored expiry so a recomputed one would differ
+	item := f.dynamoDB.Item(key)
+	aged := first - 86400
+	item["expires_at"] = &dynamodbTypes.AttributeValueMemberN{Value: strconv.FormatInt(aged, 10)}
+	f.dynamoDB.Put(item)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("reprocess: %v", err)
+	}
+	if got := storedMetadata(t, f, key).ExpiresAt; got != aged {
+		t.Errorf("expires_at after reprocess = %d, want the original %d", got, aged)
+	}
+	if err := attributevalue.UnmarshalMap(f.dynamoDB.Item(SearchEntryKey("dog", key)), &entry); err != nil {
+		t.Fatalf("unmarshal search entry: %v", err)
+	}
+	if entry.ExpiresAt != aged {
+		t.Errorf("search entry expires_at after reprocess = %d, want %d", entry.ExpiresAt, aged)
+	}
+
+	// Without a TTL images never expire
+	t.Setenv("METADATA_TTL_DAYS", "")
+	h, f = newTestHandler(t)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+	if got := storedMetadata(t, f, key).ExpiresAt; got != 0 {
+		t.Errorf("expires_at = %d, want none", got)
+	}
+}
+
+func TestHandleS3EventThumbnailBucket(t *testing.T) {
+	tests := []struct {
+		name   string
+		bucket string
+		want   string
+	}{
+		{"same bucket by default", "", testBucket},
+		{"separate bucket", "thumbnail-bucket", "thumbnail-bucket"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("THUMBNAIL_BUCKET", tt.bucket)
+			h, f := newTestHandler(t)
+
+			key := "images/1700000000-dog.jpg"
+			body := testJPEG(t, 640, 480)
+			f.s3.PutBytes(testBucket, key, body, nil)
+			if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+				t.Fatalf("HandleS3Event: %v", err)
+			}
+
+			metadata := storedMetadata(t, f, key)
+			if metadata.ThumbnailBucket != tt.want {
+				t.Errorf("thumbnail_bucket = %q, want %q", metadata.ThumbnailBucket, tt.want)
+			}
+			if metadata.BucketName != testBucket {
+				t.Errorf("bucket_name = %q, want the image bucket %q", metadata.BucketName, testBucket)
+			}
+			if _, ok := f.s3.Object(tt.want, metadata.ThumbnailKey); !ok {
+				t.Errorf("thumbnail %s not in %s", metadata.ThumbnailKey, tt.want)
+			}
+			if tt.want != testBucket {
+				if _, ok := f.s3.Object(testBucket, metadata.ThumbnailKey); ok {
+					t.Errorf("thumbnail %s also written to the image bucket", metadata.ThumbnailKey)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleS3EventStoresBlurHash(t *testing.T) {
+	h, f := newTestHandler(t)
+	key := "images/1700000000-photo.jpg"
+	body := testJPEG(t, 640, 480)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	hash := storedMetadata(t, f, key).BlurHash
+	// A size flag, a maximum AC value, a 4-digit DC and two digits per AC component
+	if want := 1 + 1 + 4 + 2*(blurHashX*blurHashY-1); len(hash) != want {
+		t.Fatalf("blurhash %q is %d characters, want %d", hash, len(hash), want)
+	}
+	x, y, err := blurhash.Components(hash)
+	if err != nil || x != blurHashX || y != blurHashY {
+		t.Errorf("components = %dx%d, %v; want %dx%d", x, y, err, blurHashX, blurHashY)
+	}
+	if _, err := blurhash.Decode(hash, 32, 24, 1); err != nil {
+		t.Errorf("decode %q: %v", hash, err)
+	}
+}
+
+func TestHandleS3EventConvertsTIFF(t *testing.T) {
+	h, f := newTestHandler(t)
+	f.rekognition.Labels = dogLabels()
+
+	var buf bytes.Buffer
+	if err := tiff.Encode(&buf, testImage(640, 480), nil); err != nil {
+		t.Fatalf("encode TIFF: %v", err)
+	}
+	key := "images/1700000000-scan.tiff"
+	body := buf.Bytes()
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	metadata := storedMetadata(t, f, key)
+	if metadata.Status != statusComplete || metadata.Width != 640 || metadata.Height != 480 {
+		t.Errorf("status, dimensions = %q, %dx%d; want %q, 640x480", metadata.Status, metadata.Width, metadata.Height, statusComplete)
+	}
+	if len(metadata.DetectedLabels) != 1 || metadata.DetectedLabels[0].Name != "Dog" {
+		t.Errorf("detected labels = %+v, want Dog", metadata.DetectedLabels)
+	}
+
+	// The browser-friendly copy sits under converted/ with a .jpg extension
+	wantConverted := "converted/images/1700000000-scan.jpg"
+	if metadata.ConvertedKey != wantConverted {
+		t.Errorf("converted key = %q, want %q", metadata.ConvertedKey, wantConverted)
+	}
+	converted, ok := f.s3.Object(testBucket, wantConverted)
+	if !ok {
+		t.Fatalf("%s was not uploaded", wantConverted)
+	}
+	if converted.ContentType != "image/jpeg" || !isJPEG(converted.Body) {
+		t.Errorf("converted copy is %q, want a JPEG", converted.ContentType)
+	}
+	if original, _ := f.s3.Object(testBucket, key); !bytes.Equal(original.Body, body) {
+		t.Error("original TIFF was modified")
+	}
+
+	// Rekognition only reads JPEG and PNG
+	if len(f.rekognition.LabelsInputs) != 1 || !isJPEG(f.rekognition.LabelsInputs[0].Image.Bytes) {
+		t.Error("DetectLabels was not sent the JPEG conversion")
+	}
+	thumbnail, _ := f.s3.Object(testBucket, metadata.ThumbnailKey)
+	if width := storedThumbnail(t, f, metadata.ThumbnailKey).Bounds().Dx(); thumbnail.ContentType != "image/jpeg" || width != 300 {
+		t.Errorf("thumbnail is %q, %dpx wide; want image/jpeg, 300px", thumbnail.ContentType, width)
+	}
+}
+
+// blockImage is a size x size grayscale image of 8x8 random blocks, seeded so
+// the same seed always draws the same picture
+func blockImage(seed int64, size int) *image.Gray {
+	random := rand.New(rand.NewSource(seed))
+	var shades [8][8]uint8
+	for y := range shades {
+		for x := range shades[y] {
+			shades[y][x] = uint8(random.Intn(256))
+		}
+	}
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			img.SetGray(x, y, color.Gray{Y: shades[y*8/size][x*8/size]})
+		}
+	}
+	return img
+}
+
+func TestPerceptualHashSurvivesResize(t *testing.T) {
+	distance := func(a, b string) int {
+		x, _ := strconv.ParseUint(a, 16, 64)
+		y, _ := strconv.ParseUint(b, 16, 64)
+		return bits.OnesCount64(x ^ y)
+	}
+
+	original := blockImage(1, 512)
+	hash := perceptualHash(original)
+	if len(hash) != 16 {
+		t.Fatalf("hash = %q, want 16 hex digits", hash)
+	}
+
+	// A smaller, recompressed copy is still the same picture
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, imaging.Resize(original, 200, 0, imaging.Lanczos), &jpeg.Options{Quality: 75}); err != nil {
+		t.Fatalf("encode resized copy: %v", err)
+	}
+	resized, err := jpeg.Decode(&buf)
+	if err != nil {
+		t.Fatalf("decode resized copy: %v", err)
+	}
+	if d := distance(hash, perceptualHash(resized)); d > 4 {
+		t.Errorf("resized copy is %d bits away, want at most 4", d)
+	}
+
+	if d := distance(hash, perceptualHash(blockImage(2, 512))); d <= 10 {
+		t.Errorf("different picture is %d bits away, want more than 10", d)
+	}
+}
+
+// stubS3Server answers every request a real S3 client sends with status,
+// recording the request headers
+type stubS3Server struct {
+	mu      sync.Mutex
+	status  int
+	headers []http.Header
+}
+
+func (s *stubS3Server) Do(req *http.Request) (*http.Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.headers = append(s.headers, req.Header.Clone())
+	body := ""
+	if s.status != http.StatusOK {
+		body = `<?xml version="1.0" encoding="UTF-8"?><Error><Code>PreconditionFailed</Code><Message>At least one of the pre-conditions you specified did not hold</Message></Error>`
+	}
+	return &http.Response{
+		StatusCode: s.status,
+		Header:     http.Header{"Content-Type": {"application/xml"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func TestHandleS3EventThumbnailNoOverwrite(t *testing.T) {
+	tests := []struct {
+		name        string
+		noOverwrite string
+		status      int
+		wantHeader  string
+	}{
+		{"unconditional by default", "", http.StatusOK, ""},
+		{"conditional write", "true", http.StatusOK, "*"},
+		{"existing thumbnail is kept", "true", http.StatusPreconditionFailed, "*"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("THUMBNAIL_NO_OVERWRITE", tt.noOverwrite)
+			h, f := newTestHandler(t)
+			var logs bytes.Buffer
+			h.logger = slog.New(slog.NewTextHandler(&logs, nil))
+			// A real client, so the header is seen as S3 would see it
+			server := &stubS3Server{status: tt.status}
+			h.s3Putter = s3.New(s3.Options{
+				Region:           "us-east-1",
+				Credentials:      credentials.NewStaticCredentialsProvider("AKIDEXAMPLE", "secret", ""),
+				HTTPClient:       server,
+				RetryMaxAttempts: 1,
+			})
+
+			key := "images/1700000000-dog.jpg"
+			body := testJPEG(t, 640, 480)
+			f.s3.PutBytes(testBucket, key, body, nil)
+			if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+				t.Fatalf("HandleS3Event = %v, want an existing thumbnail to count as written", err)
+			}
+
+			if len(server.headers) == 0 {
+				t.Fatal("no thumbnail written")
+			}
+			for _, header := range server.headers {
+				if got := header.Get("If-None-Match"); got != tt.wantHeader {
+					t.Errorf("If-None-Match = %q, want %q", got, tt.wantHeader)
+				}
+			}
+			metadata := storedMetadata(t, f, key)
+			if metadata.Status != statusComplete || metadata.ThumbnailKey == "" {
+				t.Errorf("status, thumbnail_key = %q, %q; want complete with a thumbnail", metadata.Status, metadata.ThumbnailKey)
+			}
+			skipped := strings.Contains(logs.String(), "thumbnail already exists")
+			if want := tt.status == http.StatusPreconditionFailed; skipped != want {
+				t.Errorf("logged a skipped upload = %t, want %t:\n%s", skipped, want, logs.String())
+			}
+		})
+	}
+}
+
+func TestHandleS3EventRecordsUnreadableFormat(t *testing.T) {
+	h, f := newTestHandler(t)
+	f.rekognition.BeforeCall = func(operation string) error {
+		if operation == "DetectLabels" {
+			return &rekognitionTypes.InvalidImageFormatException{Message: aws.String("Request has invalid image format")}
+		}
+		return nil
+	}
+
+	// Decodable here, so a thumbnail is still made for what Rekognition rejects
+	key := "images/1700000000-cmyk.jpg"
+	body := testJPEG(t, 640, 480)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event = %v, want the format error recorded, not retried", err)
+	}
+
+	if n := f.rekognition.Calls("DetectLabels"); n != 1 {
+		t.Errorf("DetectLabels called %d times, want 1", n)
+	}
+	metadata := storedMetadata(t, f, key)
+	if metadata.Status != statusFailed || !strings.Contains(metadata.FailureReason, "image format") {
+		t.Errorf("status, failure_reason = %q, %q; want %q with the format error", metadata.Status, metadata.FailureReason, statusFailed)
+	}
+	if len(metadata.DetectedLabels) != 0 {
+		t.Errorf("labels = %v, want none", metadata.DetectedLabels)
+	}
+	if metadata.ThumbnailKey == "" {
+		t.Fatal("no thumbnail recorded for a decodable image")
+	}
+	if _, ok := f.s3.Object(testBucket, metadata.ThumbnailKey); !ok {
+		t.Errorf("thumbnail %s was not uploaded", metadata.ThumbnailKey)
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    slog.Level
+		wantErr bool
+	}{
+		{"", slog.LevelInfo, false},
+		{"debug", slog.LevelDebug, false},
+		{"INFO", slog.LevelInfo, false},
+		{"Warn", slog.LevelWarn, false},
+		{"error", slog.LevelError, false},
+		{"warning", 0, true},
+		{"trace", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseLogLevel(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseLogLevel(%q) = %v, %v; want %v, error %t", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	// New logs at the configured level and rejects unknown ones
+	t.Setenv("LOG_LEVEL", "debug")
+	h, _ := New(Clients{})
+	if h == nil || !h.logger.Enabled(context.Background(), slog.LevelDebug) {
+		t.Error("LOG_LEVEL=debug does not enable debug logs")
+	}
+	t.Setenv("LOG_LEVEL", "error")
+	h, _ = New(Clients{})
+	if h == nil || h.logger.Enabled(context.Background(), slog.LevelWarn) {
+		t.Error("LOG_LEVEL=error still logs warnings")
+	}
+	t.Setenv("LOG_LEVEL", "verbose")
+	if _, err := New(Clients{}); err == nil || !strings.Contains(err.Error(), "LOG_LEVEL") {
+		t.Errorf("New = %v, want an invalid LOG_LEVEL error", err)
+	}
+}
+
+func TestHandleS3EventStreamDecodeMatchesBuffered(t *testing.T) {
+	// Noise compresses badly, so the JPEG is well past the streamed header
+	random := rand.New(rand.NewSource(1))
+	img := image.NewRGBA(image.Rect(0, 0, 800, 600))
+	random.Read(img.Pix)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatalf("encode JPEG: %v", err)
+	}
+	body := buf.Bytes()
+	if len(body) <= 2*streamHeaderBytes {
+		t.Fatalf("fixture is %d bytes, want more than %d", len(body), 2*streamHeaderBytes)
+	}
+	key := "images/1700000000-noise.jpg"
+
+	process := func(stream string) (ImageMetadata, []byte, *Handler) {
+		t.Helper()
+		t.Setenv("REKOGNITION_USE_S3REF", "true")
+		t.Setenv("STREAM_DECODE", stream)
+		h, f := newTestHandler(t)
+		f.s3.PutBytes(testBucket, key, body, nil)
+		if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+			t.Fatalf("HandleS3Event with STREAM_DECODE=%s: %v", stream, err)
+		}
+		metadata := storedMetadata(t, f, key)
+		thumbnail, _ := f.s3.Object(testBucket, metadata.ThumbnailKey)
+		return metadata, thumbnail.Body, h
+	}
+
+	streamed, streamedThumbnail, h := process("true")
+	buffered, bufferedThumbnail, _ := process("false")
+	if streamed.ContentHash != buffered.ContentHash || streamed.PHash != buffered.PHash {
+		t.Errorf("content_hash, phash = %s, %s; want the buffered %s, %s", streamed.ContentHash, streamed.PHash, buffered.ContentHash, buffered.PHash)
+	}
+	if streamed.Width != 800 || streamed.Height != 600 {
+		t.Errorf("dimensions = %dx%d, want 800x600", streamed.Width, streamed.Height)
+	}
+	if !bytes.Equal(streamedThumbnail, bufferedThumbnail) {
+		t.Error("streamed thumbnail differs from the buffered one")
+	}
+
+	// Only the header of a streamed JPEG is held in memory
+	data, decoded, _, _, err := h.downloadStreamed(context.Background(), testBucket, key)
+	if err != nil {
+		t.Fatalf("downloadStreamed: %v", err)
+	}
+	if decoded == nil || len(data) > streamHeaderBytes {
+		t.Errorf("kept %d bytes and decoded %t, want at most %d bytes and an image", len(data), decoded != nil, streamHeaderBytes)
+	}
+}
+
+func TestThumbnailKeyDatePartition(t *testing.T) {
+	// Late evening in New York is already the next day in UTC
+	generatedAt := time.Date(2024, 3, 9, 21, 30, 0, 0, time.FixedZone("EST", -5*3600))
+	h, _ := newTestHandler(t)
+	if got, want := h.thumbnailKey("images/dog.png", 300, "jpeg", generatedAt), "thumbnails/300/images/dog.jpg"; got != want {
+		t.Errorf("unpartitioned key = %q, want %q", got, want)
+	}
+	h.thumbnailDatePartition = true
+	if got, want := h.thumbnailKey("images/dog.png", 300, "jpeg", generatedAt), "thumbnails/2024/03/10/300/images/dog.jpg"; got != want {
+		t.Errorf("partitioned key = %q, want %q", got, want)
+	}
+}
+
+func TestHandleS3EventPartitionsThumbnailsByDate(t *testing.T) {
+	t.Setenv("THUMBNAIL_DATE_PARTITION", "true")
+	t.Setenv("THUMBNAIL_WIDTHS", "150,300")
+	h, f := newTestHandler(t)
+
+	key := "images/1700000000-dog.jpg"
+	body := testJPEG(t, 640, 480)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	before := time.Now().UTC().Format("2006/01/02")
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+	after := time.Now().UTC().Format("2006/01/02")
+
+	metadata := storedMetadata(t, f, key)
+	if len(metadata.Thumbnails) != 2 {
+		t.Fatalf("thumbnails = %v, want two widths", metadata.Thumbnails)
+	}
+	for width, thumbnailKey := range metadata.Thumbnails {
+		matched := false
+		for _, date := range []string{before, after} {
+			matched = matched || thumbnailKey == "thumbnails/"+date+"/"+width+"/"+key
+		}
+		if !matched {
+			t.Errorf("%spx thumbnail key = %q, want thumbnails/%s/%s/%s", width, thumbnailKey, before, width, key)
+		}
+		if _, ok := f.s3.Object(testBucket, thumbnailKey); !ok {
+			t.Errorf("thumbnail %s was not uploaded", thumbnailKey)
+		}
+		// A partitioned thumbnail is still a derived object, not a new upload
+		if !h.IsThumbnailKey(thumbnailKey) {
+			t.Errorf("IsThumbnailKey(%q) = false", thumbnailKey)
+		}
+	}
+}
+
+func TestHandleS3EventSendsRekognitionFilters(t *testing.T) {
+	general := rekognitionTypes.DetectLabelsFeatureNameGeneralLabels
+	properties := rekognitionTypes.DetectLabelsFeatureNameImageProperties
+	tests := []struct {
+		name         string
+		env          map[string]string
+		wantFeatures []rekognitionTypes.DetectLabelsFeatureName
+		want         *rekognitionTypes.GeneralLabelsSettings
+	}{
+		{name: "no filters"},
+		{
+			name:         "label filters",
+			env:          map[string]string{"REKOGNITION_LABEL_INCLUSION_FILTERS": "Dog, Cat", "REKOGNITION_LABEL_EXCLUSION_FILTERS": "Person"},
+			wantFeatures: []rekognitionTypes.DetectLabelsFeatureName{general},
+			want:         &rekognitionTypes.GeneralLabelsSettings{LabelInclusionFilters: []string{"Dog", "Cat"}, LabelExclusionFilters: []string{"Person"}},
+		},
+		{
+			name:         "category filters",
+			env:          map[string]string{"REKOGNITION_CATEGORY_INCLUSION_FILTERS": "Animals and Pets", "REKOGNITION_CATEGORY_EXCLUSION_FILTERS": "Person Description,"},
+			wantFeatures: []rekognitionTypes.DetectLabelsFeatureName{general},
+			want:         &rekognitionTypes.GeneralLabelsSettings{LabelCategoryInclusionFilters: []string{"Animals and Pets"}, LabelCategoryExclusionFilters: []string{"Person Description"}},
+		},
+		{
+			name:         "filters with image properties",
+			env:          map[string]string{"REKOGNITION_LABEL_INCLUSION_FILTERS": "Dog", "REKOGNITION_IMAGE_PROPERTIES": "true"},
+			wantFeatures: []rekognitionTypes.DetectLabelsFeatureName{general, properties},
+			want:         &rekognitionTypes.GeneralLabelsSettings{LabelInclusionFilters: []string{"Dog"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			h, f := newTestHandler(t)
+
+			key := "images/1700000000-dog.jpg"
+			body := testJPEG(t, 320, 240)
+			f.s3.PutBytes(testBucket, key, body, nil)
+			if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+				t.Fatalf("HandleS3Event: %v", err)
+			}
+
+			if len(f.rekognition.LabelsInputs) != 1 {
+				t.Fatalf("sent %d DetectLabels requests, want 1", len(f.rekognition.LabelsInputs))
+			}
+			input := f.rekognition.LabelsInputs[0]
+			if !slices.Equal(input.Features, tt.wantFeatures) {
+				t.Errorf("features = %v, want %v", input.Features, tt.wantFeatures)
+			}
+			if tt.want == nil {
+				if input.Settings != nil {
+					t.Errorf("settings = %+v, want none", input.Settings)
+				}
+				return
+			}
+			if input.Settings == nil || input.Settings.GeneralLabels == nil {
+				t.Fatalf("settings = %+v, want general label filters", input.Settings)
+			}
+			got := input.Settings.GeneralLabels
+			for _, lists := range [][2][]string{
+				{got.LabelInclusionFilters, tt.want.LabelInclusionFilters},
+				{got.LabelExclusionFilters, tt.want.LabelExclusionFilters},
+				{got.LabelCategoryInclusionFilters, tt.want.LabelCategoryInclusionFilters},
+				{got.LabelCategoryExclusionFilters, tt.want.LabelCategoryExclusionFilters},
+			} {
+				if !slices.Equal(lists[0], lists[1]) {
+					t.Errorf("general labels = %+v, want %+v", *got, *tt.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestHandleS3EventStoresImageQuality(t *testing.T) {
+	t.Setenv("REKOGNITION_IMAGE_PROPERTIES", "true")
+	h, f := newTestHandler(t)
+	f.rekognition.Labels = dogLabels()
+	f.rekognition.Labels.ImageProperties = &rekognitionTypes.DetectLabelsImageProperties{
+		Quality: &rekognitionTypes.DetectLabelsImageQuality{
+			Brightness: aws.Float32(71.5),
+			Sharpness:  aws.Float32(23.25),
+			Contrast:   aws.Float32(64),
+		},
+	}
+
+	key := "images/1700000000-dog.jpg"
+	body := testJPEG(t, 320, 240)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	want := ImageQuality{Brightness: 71.5, Sharpness: 23.25, Contrast: 64}
+	if quality := storedMetadata(t, f, key).ImageQuality; quality == nil || *quality != want {
+		t.Errorf("image quality = %+v, want %+v", quality, want)
+	}
+	features := f.rekognition.LabelsInputs[0].Features
+	if !slices.Contains(features, rekognitionTypes.DetectLabelsFeatureNameImageProperties) {
+		t.Errorf("features = %v, want IMAGE_PROPERTIES requested", features)
+	}
+}
+
+func TestHandleS3EventKeepsUserTagsOnReprocess(t *testing.T) {
+	t.Setenv("REPROCESS", "true")
+	h, f := newTestHandler(t)
+	f.rekognition.Labels = dogLabels()
+
+	key := "images/1700000000-dog.jpg"
+	body := testJPEG(t, 320, 240)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	// Tags as the API saves them, beside a stale analysis attribute
+	item := f.dynamoDB.Item(key)
+	item["user_tags"] = &dynamodbTypes.AttributeValueMemberSS{Value: []string{"holiday", "rex"}}
+	item["failure_reason"] = &dynamodbTypes.AttributeValueMemberS{Value: "old failure"}
+	f.dynamoDB.Put(item)
+
+	f.rekognition.Labels = rekognition.DetectLabelsOutput{Labels: []rekognitionTypes.Label{
+		{Name: aws.String("Cat"), Confidence: aws.Float32(91)},
+	}}
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("reprocess: %v", err)
+	}
+
+	metadata := storedMetadata(t, f, key)
+	slices.Sort(metadata.UserTags)
+	if !slices.Equal(metadata.UserTags, []string{"holiday", "rex"}) {
+		t.Errorf("user_tags = %v, want [holiday rex]", metadata.UserTags)
+	}
+	if len(metadata.DetectedLabels) != 1 || metadata.DetectedLabels[0].Name != "Cat" {
+		t.Errorf("labels = %v, want the reprocessed [Cat]", metadata.DetectedLabels)
+	}
+	if metadata.FailureReason != "" {
+		t.Errorf("failure_reason = %q, want it removed by the reprocess", metadata.FailureReason)
+	}
+}
+
+func TestHandleS3EventOptimizesOversizedOriginals(t *testing.T) {
+	body := testJPEG(t, 1600, 1200)
+	key := "images/1700000000-big.jpg"
+
+	tests := []struct {
+		name          string
+		maxDimension  string
+		mode          string
+		wantOptimized bool
+	}{
+		{"off by default", "", "", false},
+		{"within the limit", "2000", "copy", false},
+		{"copy", "800", "copy", true},
+		{"overwrite", "800", "overwrite", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MAX_ORIGINAL_DIMENSION", tt.maxDimension)
+			t.Setenv("OPTIMIZE_ORIGINAL_MODE", tt.mode)
+			h, f := newTestHandler(t)
+			f.s3.PutBytes(testBucket, key, body, nil)
+			if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+				t.Fatalf("HandleS3Event: %v", err)
+			}
+
+			metadata := storedMetadata(t, f, key)
+			if metadata.OriginalOptimized != tt.wantOptimized {
+				t.Fatalf("original_optimized = %t, want %t", metadata.OriginalOptimized, tt.wantOptimized)
+			}
+			original, _ := f.s3.Object(testBucket, key)
+			if !tt.wantOptimized {
+				if metadata.OptimizedKey != "" || !bytes.Equal(original.Body, body) {
+					t.Errorf("optimized_key = %q and original changed %t, want neither", metadata.OptimizedKey, !bytes.Equal(original.Body, body))
+				}
+				return
+			}
+
+			if metadata.OptimizedWidth != 800 || metadata.OptimizedHeight != 600 {
+				t.Errorf("optimized dimensions = %dx%d, want 800x600", metadata.OptimizedWidth, metadata.OptimizedHeight)
+			}
+			// The recorded dimensions are those of the upload
+			if metadata.Width != 1600 || metadata.Height != 1200 {
+				t.Errorf("dimensions = %dx%d, want 1600x1200", metadata.Width, metadata.Height)
+			}
+
+			optimized := original
+			if tt.mode == "copy" {
+				if metadata.OptimizedKey != optimizedPrefix+key {
+					t.Errorf("optimized_key = %q, want %q", metadata.OptimizedKey, optimizedPrefix+key)
+				}
+				if !bytes.Equal(original.Body, body) {
+					t.Error("copy mode changed the original")
+				}
+				optimized, _ = f.s3.Object(testBucket, metadata.OptimizedKey)
+			} else if metadata.OptimizedKey != "" {
+				t.Errorf("optimized_key = %q, want none when overwriting", metadata.OptimizedKey)
+			}
+
+			if len(optimized.Body) >= len(body) || int64(len(optimized.Body)) != metadata.OptimizedBytes {
+				t.Errorf("optimized copy is %d bytes (recorded %d), want fewer than the original's %d", len(optimized.Body), metadata.OptimizedBytes, len(body))
+			}
+			decoded, err := jpeg.Decode(bytes.NewReader(optimized.Body))
+			if err != nil {
+				t.Fatalf("decode optimized copy: %v", err)
+			}
+			if b := decoded.Bounds(); b.Dx() != 800 || b.Dy() != 600 {
+				t.Errorf("optimized copy is %dx%d, want 800x600", b.Dx(), b.Dy())
+			}
+		})
+	}
+}
+
+func TestHandleS3EventSrcsetWidths(t *testing.T) {
+	tests := []struct {
+		name       string
+		w, h       int
+		wantWidths []int
+	}{
+		{"wider sizes are skipped", 1000, 750, []int{320, 640, 960}},
+		{"a small image keeps one native-size thumbnail", 200, 150, []int{320}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("THUMBNAIL_WIDTHS", "srcset")
+			h, f := newTestHandler(t)
+
+			key := "images/1700000000-dog.jpg"
+			body := testJPEG(t, tt.w, tt.h)
+			f.s3.PutBytes(testBucket, key, body, nil)
+			if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+				t.Fatalf("HandleS3Event: %v", err)
+			}
+
+			thumbnails := storedMetadata(t, f, key).Thumbnails
+			var widths []int
+			for width := range thumbnails {
+				n, _ := strconv.Atoi(width)
+				widths = append(widths, n)
+			}
+			slices.Sort(widths)
+			if !slices.Equal(widths, tt.wantWidths) {
+				t.Fatalf("thumbnail widths = %v, want %v", widths, tt.wantWidths)
+			}
+			for width, thumbnailKey := range thumbnails {
+				object, ok := f.s3.Object(testBucket, thumbnailKey)
+				if !ok {
+					t.Fatalf("thumbnail %s was not uploaded", thumbnailKey)
+				}
+				img, _, err := image.Decode(bytes.NewReader(object.Body))
+				if err != nil {
+					t.Fatalf("decode %s: %v", thumbnailKey, err)
+				}
+				want, _ := strconv.Atoi(width)
+				want = min(want, tt.w)
+				if got := img.Bounds().Dx(); got != want {
+					t.Errorf("%spx thumbnail is %d wide, want %d", width, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewRekognitionClientRegion(t *testing.T) {
+	cfg := aws.Config{Region: "us-east-1"}
+	tests := []struct {
+		override string
+		want     string
+	}{
+		{"", "us-east-1"},
+		{"eu-west-1", "eu-west-1"},
+	}
+	for _, tt := range tests {
+		t.Setenv("REKOGNITION_REGION", tt.override)
+		if got := NewRekognitionClient(cfg).Options().Region; got != tt.want {
+			t.Errorf("REKOGNITION_REGION=%q: region = %q, want %q", tt.override, got, tt.want)
+		}
+	}
+	if cfg.Region != "us-east-1" {
+		t.Errorf("shared config region changed to %q", cfg.Region)
+	}
+
+	// S3 references only resolve in the bucket's own region
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("REKOGNITION_USE_S3REF", "true")
+	for region, wantErr := range map[string]bool{"": false, "us-east-1": false, "eu-west-1": true} {
+		t.Setenv("REKOGNITION_REGION", region)
+		if _, err := New(Clients{}); (err != nil) != wantErr {
+			t.Errorf("REKOGNITION_REGION=%q with REKOGNITION_USE_S3REF: New = %v, want error %t", region, err, wantErr)
+		}
+	}
+}
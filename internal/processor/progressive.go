@@ -0,0 +1,381 @@
+package processor
+
+import (
+	"bufio"
+	"errors"
+	"image"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// The standard library only writes baseline JPEGs, so progressive thumbnails use
+// this small encoder. It keeps to the simplest progressive form: 4:4:4 sampling,
+// the Annex K Huffman tables and spectral selection only (no successive
+// approximation). One interleaved DC scan is followed by a low- and a
+// high-frequency AC scan per component, which is enough for browsers to paint a
+// coarse preview early.
+
+// progressiveBands are the AC coefficient ranges, in zig-zag order, sent as
+// separate scans after the DC scan
+var progressiveBands = [][2]int{{1, 5}, {6, 63}}
+
+// unscaledJPEGQuant holds the Annex K.1 luminance and chrominance quantization
+// tables in zig-zag order
+var unscaledJPEGQuant = [2][64]int32{
+	{
+		16, 11, 12, 14, 12, 10, 16, 14, 13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37, 29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68, 87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113, 121, 112, 100, 120, 92, 101, 103, 99,
+	},
+	{
+		17, 18, 18, 24, 21, 24, 47, 26, 26, 47, 99, 66, 56, 66, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// jpegUnzig maps a zig-zag index to its natural (row-major) index in a block
+var jpegUnzig = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10, 17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34, 27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36, 29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46, 53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// jpegHuffmanSpec is a Huffman table as stored in a DHT segment: the number of
+// codes of each length from 1 to 16 bits, then the symbols in code order
+type jpegHuffmanSpec struct {
+	counts  [16]byte
+	symbols []byte
+}
+
+// jpegHuffmanSpecs are the Annex K.3 tables: luminance DC, luminance AC,
+// chrominance DC and chrominance AC
+var jpegHuffmanSpecs = [4]jpegHuffmanSpec{
+	{
+		[16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		[]byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12, 0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08, 0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea, 0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	{
+		[16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		[]byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21, 0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91, 0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34, 0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
+
+// jpegHuffmanCode is a codeword and its length in bits
+type jpegHuffmanCode struct {
+	code uint32
+	size uint32
+}
+
+// codes assigns the canonical codewords of the table to its symbols
+func (s jpegHuffmanSpec) codes() [256]jpegHuffmanCode {
+	var table [256]jpegHuffmanCode
+	code, k := uint32(0), 0
+	for i, n := range s.counts {
+		for j := byte(0); j < n; j++ {
+			table[s.symbols[k]] = jpegHuffmanCode{code: code, size: uint32(i + 1)}
+			code++
+			k++
+		}
+		code <<= 1
+	}
+	return table
+}
+
+// jpegDCTCos[x][u] is cos((2x+1)uπ/16), the forward DCT basis
+var jpegDCTCos = func() [8][8]float64 {
+	var c [8][8]float64
+	for x := 0; x < 8; x++ {
+		for u := 0; u < 8; u++ {
+			c[x][u] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / 16)
+		}
+	}
+	return c
+}()
+
+// progressiveWriter buffers the entropy-coded bits of a scan
+type progressiveWriter struct {
+	w     *bufio.Writer
+	bits  uint32
+	nBits uint32
+	err   error
+}
+
+func (pw *progressiveWriter) write(p []byte) {
+	if pw.err == nil {
+		_, pw.err = pw.w.Write(p)
+	}
+}
+
+// emit appends the low size bits of value, stuffing a zero byte after each 0xFF
+// as the format requires
+func (pw *progressiveWriter) emit(value, size uint32) {
+	pw.bits = pw.bits<<size | value&(1<<size-1)
+	pw.nBits += size
+	for pw.nBits >= 8 {
+		b := byte(pw.bits >> (pw.nBits - 8))
+		pw.write([]byte{b})
+		if b == 0xff {
+			pw.write([]byte{0})
+		}
+		pw.nBits -= 8
+	}
+}
+
+// flush pads the final byte of a scan with one bits
+func (pw *progressiveWriter) flush() {
+	if pw.nBits > 0 {
+		pw.emit(0x7f, 8-pw.nBits)
+	}
+	pw.bits, pw.nBits = 0, 0
+}
+
+// emitValue writes the Huffman code for symbol followed by value's magnitude
+// bits; negative values are sent as their one's complement
+func (pw *progressiveWriter) emitValue(codes *[256]jpegHuffmanCode, run uint32, value int32) {
+	magnitude := value
+	if magnitude < 0 {
+		magnitude = -magnitude
+		value--
+	}
+	size := uint32(bits.Len32(uint32(magnitude)))
+	code := codes[run<<4|size]
+	pw.emit(code.code, code.size)
+	if size > 0 {
+		pw.emit(uint32(value), size)
+	}
+}
+
+// marker writes a segment with the given marker byte and payload
+func (pw *progressiveWriter) marker(m byte, payload []byte) {
+	n := len(payload) + 2
+	pw.write([]byte{0xff, m, byte(n >> 8), byte(n)})
+	pw.write(payload)
+}
+
+// encodeProgressiveJPEG writes img to w as a progressive JPEG at the given
+// quality (1-100, scaled as by image/jpeg)
+func encodeProgressiveJPEG(w io.Writer, img image.Image, quality int) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= 0 || height <= 0 || width > 65535 || height > 65535 {
+		return errors.New("jpeg: image dimensions out of range")
+	}
+
+	// Scale the quantization tables the way image/jpeg does
+	if quality < 1 {
+		quality = 1
+	} else if quality > 100 {
+		quality = 100
+	}
+	scale := int32(200 - quality*2)
+	if quality < 50 {
+		scale = int32(5000 / quality)
+	}
+	var quant [2][64]int32
+	for t := range quant {
+		for i, q := range unscaledJPEGQuant[t] {
+			q = (q*scale + 50) / 100
+			if q < 1 {
+				q = 1
+			} else if q > 255 {
+				q = 255
+			}
+			quant[t][i] = q
+		}
+	}
+
+	coefficients := progressiveCoefficients(img, &quant)
+
+	pw := &progressiveWriter{w: bufio.NewWriter(w)}
+	pw.write([]byte{0xff, 0xd8})
+
+	// DQT: both tables in zig-zag order
+	dqt := make([]byte, 0, 2*65)
+	for t := range quant {
+		dqt = append(dqt, byte(t))
+		for _, q := range quant[t] {
+			dqt = append(dqt, byte(q))
+		}
+	}
+	pw.marker(0xdb, dqt)
+
+	// SOF2: progressive DCT, three components without subsampling
+	pw.marker(0xc2, []byte{
+		8, byte(height >> 8), byte(height), byte(width >> 8), byte(width), 3,
+		1, 0x11, 0,
+		2, 0x11, 1,
+		3, 0x11, 1,
+	})
+
+	// DHT: DC tables are class 0 and AC tables class 1, luminance id 0 and
+	// chrominance id 1
+	var dht []byte
+	var codes [4][256]jpegHuffmanCode
+	for i, spec := range jpegHuffmanSpecs {
+		dht = append(dht, byte(i%2)<<4|byte(i/2))
+		dht = append(dht, spec.counts[:]...)
+		dht = append(dht, spec.symbols...)
+		codes[i] = spec.codes()
+	}
+	pw.marker(0xc4, dht)
+
+	// DC scan over all components, interleaved block by block
+	pw.marker(0xda, []byte{3, 1, 0x00, 2, 0x11, 3, 0x11, 0, 0, 0})
+	var predictor [3]int32
+	for b := range coefficients[0] {
+		for c := range coefficients {
+			dc := coefficients[c][b][0]
+			pw.emitValue(&codes[2*min(c, 1)], 0, dc-predictor[c])
+			predictor[c] = dc
+		}
+	}
+	pw.flush()
+
+	// AC scans, one component and band at a time. Each block's band ends with an
+	// EOB (an end-of-band run of one) when its remaining coefficients are zero.
+	for _, band := range progressiveBands {
+		for c := range coefficients {
+			table := byte(min(c, 1))
+			pw.marker(0xda, []byte{1, byte(c + 1), table<<4 | table, byte(band[0]), byte(band[1]), 0})
+			ac := &codes[2*min(c, 1)+1]
+			for _, block := range coefficients[c] {
+				run := uint32(0)
+				for k := band[0]; k <= band[1]; k++ {
+					if block[k] == 0 {
+						run++
+						continue
+					}
+					for ; run > 15; run -= 16 {
+						pw.emit(ac[0xf0].code, ac[0xf0].size)
+					}
+					pw.emitValue(ac, run, block[k])
+					run = 0
+				}
+				if run > 0 {
+					pw.emit(ac[0x00].code, ac[0x00].size)
+				}
+			}
+			pw.flush()
+		}
+	}
+
+	pw.write([]byte{0xff, 0xd9})
+	if pw.err != nil {
+		return pw.err
+	}
+	return pw.w.Flush()
+}
+
+// progressiveCoefficients converts img to Y, Cb and Cr and returns the quantized
+// DCT coefficients of every 8x8 block of each, in zig-zag order. Blocks are in
+// row-major order; edge blocks repeat the last row and column of pixels.
+func progressiveCoefficients(img image.Image, quant *[2][64]int32) [3][][64]int32 {
+	bounds := img.Bounds()
+	blocksX := (bounds.Dx() + 7) / 8
+	blocksY := (bounds.Dy() + 7) / 8
+
+	var coefficients [3][][64]int32
+	for c := range coefficients {
+		coefficients[c] = make([][64]int32, blocksX*blocksY)
+	}
+
+	var samples [3][64]float64
+	for by := 0; by < blocksY; by++ {
+		for bx := 0; bx < blocksX; bx++ {
+			for y := 0; y < 8; y++ {
+				py := min(bounds.Min.Y+by*8+y, bounds.Max.Y-1)
+				for x := 0; x < 8; x++ {
+					px := min(bounds.Min.X+bx*8+x, bounds.Max.X-1)
+					r, g, b, _ := img.At(px, py).RGBA()
+					rf, gf, bf := float64(r>>8), float64(g>>8), float64(b>>8)
+					// JFIF YCbCr, level-shifted to be centered on zero
+					samples[0][y*8+x] = 0.299*rf + 0.587*gf + 0.114*bf - 128
+					samples[1][y*8+x] = -0.168736*rf - 0.331264*gf + 0.5*bf
+					samples[2][y*8+x] = 0.5*rf - 0.418688*gf - 0.081312*bf
+				}
+			}
+			for c := range samples {
+				coefficients[c][by*blocksX+bx] = quantizeBlock(&samples[c], &quant[min(c, 1)])
+			}
+		}
+	}
+	return coefficients
+}
+
+// quantizeBlock applies the forward DCT to a block of level-shifted samples and
+// divides by the quantization table, returning coefficients in zig-zag order
+func quantizeBlock(samples *[64]float64, quant *[64]int32) [64]int32 {
+	// Separable DCT: transform the rows, then the columns
+	var rows [64]float64
+	for y := 0; y < 8; y++ {
+		for u := 0; u < 8; u++ {
+			sum := 0.0
+			for x := 0; x < 8; x++ {
+				sum += samples[y*8+x] * jpegDCTCos[x][u]
+			}
+			rows[y*8+u] = sum
+		}
+	}
+
+	var out [64]int32
+	for zz, natural := range jpegUnzig {
+		u, v := natural%8, natural/8
+		sum := 0.0
+		for y := 0; y < 8; y++ {
+			sum += rows[y*8+u] * jpegDCTCos[y][v]
+		}
+		cu, cv := 1.0, 1.0
+		if u == 0 {
+			cu = math.Sqrt2 / 2
+		}
+		if v == 0 {
+			cv = math.Sqrt2 / 2
+		}
+		coefficient := int32(math.Round(sum * cu * cv / 4 / float64(quant[zz])))
+		// Baseline Huffman tables only code magnitudes below 2048 for DC and
+		// 1024 for AC; clamping only matters for extreme inputs at quality 100
+		limit := int32(1023)
+		if zz == 0 {
+			limit = 2047
+		}
+		out[zz] = max(-limit, min(limit, coefficient))
+	}
+	return out
+}
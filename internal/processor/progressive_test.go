@@ -0,0 +1,64 @@
+package processor
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+func TestEncodeProgressiveJPEG(t *testing.T) {
+	// Odd dimensions leave partial blocks at the right and bottom edges
+	src := testImage(101, 67)
+	var buf bytes.Buffer
+	if err := encodeProgressiveJPEG(&buf, src, 90); err != nil {
+		t.Fatalf("encodeProgressiveJPEG: %v", err)
+	}
+	encoded := buf.Bytes()
+
+	// Entropy-coded 0xFF bytes are stuffed with 0x00, so these only match markers
+	if !bytes.Contains(encoded, []byte{0xff, 0xc2}) {
+		t.Error("no SOF2 (progressive) marker")
+	}
+	if bytes.Contains(encoded, []byte{0xff, 0xc0}) {
+		t.Error("baseline SOF0 marker present")
+	}
+
+	decoded, err := jpeg.Decode(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("image/jpeg can't decode the output: %v", err)
+	}
+	if decoded.Bounds() != src.Bounds() {
+		t.Fatalf("decoded bounds = %v, want %v", decoded.Bounds(), src.Bounds())
+	}
+	if diff := meanDifference(src, decoded); diff > 4 {
+		t.Errorf("mean channel difference = %.2f, want at most 4 at quality 90", diff)
+	}
+}
+
+func TestEncodeProgressiveJPEGRejectsEmptyImages(t *testing.T) {
+	if err := encodeProgressiveJPEG(&bytes.Buffer{}, image.NewRGBA(image.Rect(0, 0, 0, 10)), 90); err == nil {
+		t.Error("encoded an image with no width")
+	}
+}
+
+// meanDifference is the mean absolute difference of the 8-bit R, G and B
+// channels of two images with the same bounds
+func meanDifference(a, b image.Image) float64 {
+	var total, n float64
+	bounds := a.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r1, g1, b1, _ := a.At(x, y).RGBA()
+			r2, g2, b2, _ := b.At(x, y).RGBA()
+			for _, d := range []int{int(r1>>8) - int(r2>>8), int(g1>>8) - int(g2>>8), int(b1>>8) - int(b2>>8)} {
+				if d < 0 {
+					d = -d
+				}
+				total += float64(d)
+				n++
+			}
+		}
+	}
+	return total / n
+}
@@ -0,0 +1,169 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ErrNotFound is returned when an image's metadata or original object is missing
+var ErrNotFound = errors.New("image not found")
+
+// ErrModerationFlagged is returned when asked to regenerate thumbnails for an
+// image that was withheld from the gallery by moderation
+var ErrModerationFlagged = errors.New("image is flagged by moderation")
+
+// RegenerateThumbnail rebuilds an image's thumbnails with the current thumbnail
+// settings, updates the thumbnail attributes of its metadata and deletes any
+// previous thumbnails the new set no longer uses. It returns the bucket and key of
+// the new primary thumbnail. A non-empty owner must match the image's or
+// ErrNotFound is returned.
+func (h *Handler) RegenerateThumbnail(ctx context.Context, key, owner string) (bucket, thumbnailKey string, err error) {
+	// Regenerating means replacing, so THUMBNAIL_NO_OVERWRITE doesn't apply
+	if h.thumbnailNoOverwrite {
+		scoped := *h
+		scoped.thumbnailNoOverwrite = false
+		h = &scoped
+	}
+
+	result, err := h.getItem(ctx, key)
+	if err != nil {
+		return "", "", fmt.Errorf("DynamoDB GetItem failed: %w", err)
+	}
+	if result.Item == nil {
+		return "", "", ErrNotFound
+	}
+
+	var metadata ImageMetadata
+	if err := attributevalue.UnmarshalMap(result.Item, &metadata); err != nil {
+		return "", "", fmt.Errorf("failed to unmarshal metadata: %w", err)
+	}
+	// Search entries and label counts share the table but aren't images
+	if metadata.GalleryPK == "" || (owner != "" && metadata.Owner != owner) {
+		return "", "", ErrNotFound
+	}
+	if metadata.ModerationFlagged {
+		return "", "", ErrModerationFlagged
+	}
+
+	// HEIC uploads are rendered from their converted JPEG
+	sourceKey := key
+	if metadata.ConvertedKey != "" {
+		sourceKey = metadata.ConvertedKey
+	}
+	imageBytes, _, err := h.downloadImage(ctx, metadata.BucketName, sourceKey)
+	var noSuchKey *s3Types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return "", "", ErrNotFound
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed to download %s: %w", sourceKey, err)
+	}
+
+	format := h.thumbnailFormatFor(imageBytes)
+	if isGIF(imageBytes) {
+		if imageBytes, err = transcodeToJPEG(imageBytes); err != nil {
+			return "", "", fmt.Errorf("failed to transcode GIF: %w", err)
+		}
+	}
+	img, err := decodeImage(imageBytes)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	thumbnails, err := h.generateAndUploadThumbnail(ctx, metadata.BucketName, key, img, format)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate thumbnail: %w", err)
+	}
+
+	// Items saved before thumbnail_bucket existed kept thumbnails beside the original
+	previous, previousBucket := metadata.Thumbnails, metadata.ThumbnailBucket
+	if previousBucket == "" {
+		previousBucket = metadata.BucketName
+	}
+	metadata.applyThumbnails(h.thumbnailMode, thumbnails)
+	if err := h.updateThumbnailAttributes(ctx, &metadata); err != nil {
+		return "", "", err
+	}
+
+	h.deleteStaleThumbnails(ctx, previous, previousBucket, &metadata)
+
+	h.logger.Info("regenerated thumbnails",
+		slog.String("key", key),
+		slog.String("thumbnail_key", metadata.ThumbnailKey),
+		slog.Int("thumbnail_count", len(metadata.Thumbnails)),
+	)
+	return metadata.ThumbnailBucket, metadata.ThumbnailKey, nil
+}
+
+// deleteStaleThumbnails removes the previous thumbnails that metadata's new set
+// no longer uses: those whose width, format or bucket changed. Failures are
+// only logged, since they leave nothing but an orphaned object.
+func (h *Handler) deleteStaleThumbnails(ctx context.Context, previous map[string]string, previousBucket string, metadata *ImageMetadata) {
+	current := make(map[string]bool, len(metadata.Thumbnails))
+	for _, k := range metadata.Thumbnails {
+		current[k] = true
+	}
+	for _, k := range previous {
+		if current[k] && previousBucket == metadata.ThumbnailBucket {
+			continue
+		}
+		err := h.withRetry(ctx, "S3 DeleteObject", func() error {
+			_, err := h.s3Putter.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(previousBucket),
+				Key:    aws.String(k),
+			})
+			return err
+		})
+		if err != nil {
+			h.logger.Warn("failed to delete stale thumbnail", slog.String("key", k), slog.String("error", err.Error()))
+		}
+	}
+}
+
+// updateThumbnailAttributes writes only the thumbnail attributes of metadata,
+// leaving labels, status and processed_at untouched
+func (h *Handler) updateThumbnailAttributes(ctx context.Context, metadata *ImageMetadata) error {
+	values, err := attributevalue.MarshalMap(map[string]interface{}{
+		":thumbnail_key":    metadata.ThumbnailKey,
+		":thumbnail_bucket": metadata.ThumbnailBucket,
+		":thumbnails":       metadata.Thumbnails,
+		":thumbnail_bytes":  metadata.ThumbnailBytes,
+		":thumbnail_mode":   metadata.ThumbnailMode,
+		":thumbnail_width":  metadata.ThumbnailWidth,
+		":thumbnail_height": metadata.ThumbnailHeight,
+		":dominant_colors":  metadata.DominantColors,
+		":blurhash":         metadata.BlurHash,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal thumbnail attributes: %w", err)
+	}
+
+	err = h.withRetry(ctx, "DynamoDB UpdateItem", func() error {
+		_, err := h.dynamoDBClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(h.tableName),
+			Key: map[string]dynamodbTypes.AttributeValue{
+				"image_key": &dynamodbTypes.AttributeValueMemberS{Value: metadata.ImageKey},
+			},
+			UpdateExpression: aws.String("SET thumbnail_key = :thumbnail_key, thumbnail_bucket = :thumbnail_bucket, thumbnails = :thumbnails, " +
+				"thumbnail_bytes = :thumbnail_bytes, thumbnail_mode = :thumbnail_mode, " +
+				"thumbnail_width = :thumbnail_width, thumbnail_height = :thumbnail_height, " +
+				"dominant_colors = :dominant_colors, blurhash = :blurhash"),
+			ConditionExpression:       aws.String("attribute_exists(image_key)"),
+			ExpressionAttributeValues: values,
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("DynamoDB UpdateItem failed: %w", err)
+	}
+	return nil
+}
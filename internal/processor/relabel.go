@@ -0,0 +1,149 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	rekognitionTypes "github.com/aws/aws-sdk-go-v2/service/rekognition/types"
+)
+
+// galleryIndexName is the GSI listing every image by processed_at
+const galleryIndexName = "gallery-index"
+
+// ImageKeys lists the keys of every image processed at or after since (an
+// RFC3339 timestamp; empty lists all), newest first. The full list is read
+// before returning so callers can rewrite items without disturbing the query.
+func (h *Handler) ImageKeys(ctx context.Context, since string) ([]string, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(h.tableName),
+		IndexName:              aws.String(galleryIndexName),
+		KeyConditionExpression: aws.String("gallery_pk = :pk"),
+		ExpressionAttributeValues: map[string]dynamodbTypes.AttributeValue{
+			":pk": &dynamodbTypes.AttributeValueMemberS{Value: GalleryPartition},
+		},
+		ProjectionExpression: aws.String("image_key"),
+		ScanIndexForward:     aws.Bool(false),
+	}
+	if since != "" {
+		input.KeyConditionExpression = aws.String("gallery_pk = :pk AND processed_at >= :since")
+		input.ExpressionAttributeValues[":since"] = &dynamodbTypes.AttributeValueMemberS{Value: since}
+	}
+
+	var keys []string
+	paginator := dynamodb.NewQueryPaginator(h.dynamoDBClient, input)
+	for paginator.HasMorePages() {
+		// A failed NextPage leaves the paginator on the same page, so it can retry
+		var page *dynamodb.QueryOutput
+		err := h.withRetry(ctx, "DynamoDB Query", func() error {
+			var err error
+			page, err = paginator.NextPage(ctx)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("DynamoDB Query failed: %w", err)
+		}
+		for _, item := range page.Items {
+			if key, ok := item["image_key"].(*dynamodbTypes.AttributeValueMemberS); ok {
+				keys = append(keys, key.Value)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// Relabel re-runs label detection for an already processed image and saves the
+// new labels in place, leaving the rest of its metadata (thumbnails, faces,
+// moderation) as it was. It reads whichever copy of the original still exists:
+// the converted JPEG, the quarantined object or the upload itself.
+func (h *Handler) Relabel(ctx context.Context, key string) error {
+	result, err := h.getItem(ctx, key)
+	if err != nil {
+		return fmt.Errorf("DynamoDB GetItem failed: %w", err)
+	}
+	if result.Item == nil {
+		return fmt.Errorf("no metadata for %s", key)
+	}
+
+	var metadata ImageMetadata
+	if err := attributevalue.UnmarshalMap(result.Item, &metadata); err != nil {
+		return fmt.Errorf("failed to unmarshal metadata: %w", err)
+	}
+	// Search entries and label counts share the table but aren't images; only
+	// image items are in the gallery partition
+	if metadata.GalleryPK != GalleryPartition {
+		return fmt.Errorf("%s is not an image", key)
+	}
+	if metadata.DuplicateOf != "" {
+		h.logger.Info("skipping duplicate", slog.String("key", key), slog.String("duplicate_of", metadata.DuplicateOf))
+		return nil
+	}
+
+	sourceKey := key
+	if metadata.ConvertedKey != "" {
+		sourceKey = metadata.ConvertedKey
+	} else if metadata.QuarantineKey != "" {
+		sourceKey = metadata.QuarantineKey
+	}
+
+	imageBytes, _, err := h.downloadImage(ctx, metadata.BucketName, sourceKey)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", sourceKey, err)
+	}
+
+	rekognitionImage, err := h.relabelImage(imageBytes)
+	if err != nil {
+		return err
+	}
+
+	labels, quality, err := h.detectLabels(ctx, rekognitionImage)
+	if err != nil {
+		return fmt.Errorf("failed to detect labels: %w", err)
+	}
+	metadata.DetectedLabels = labels
+	metadata.LabelsSkipped = false
+	if quality != nil {
+		metadata.ImageQuality = quality
+	}
+
+	if err := h.saveMetadata(ctx, &metadata); err != nil {
+		return fmt.Errorf("failed to save metadata: %w", err)
+	}
+
+	h.logger.Info("relabeled image",
+		slog.String("key", key),
+		slog.Int("label_count", len(labels)),
+	)
+	return nil
+}
+
+// relabelImage prepares the bytes for Rekognition the way processS3Record does:
+// formats Rekognition can't read are transcoded to JPEG (GIFs to their first
+// frame) and oversized images are downscaled
+func (h *Handler) relabelImage(imageBytes []byte) (*rekognitionTypes.Image, error) {
+	if !rekognitionTypesReadable[detectImageType(imageBytes)] {
+		transcoded, err := transcodeToJPEG(imageBytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to transcode image: %w", err)
+		}
+		imageBytes = transcoded
+	}
+
+	if int64(len(imageBytes)) <= h.maxImageBytes {
+		return bytesImage(imageBytes), nil
+	}
+
+	img, err := decodeImage(imageBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	downscaled, err := downscaleToFit(img, h.maxImageBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to downscale image: %w", err)
+	}
+	return bytesImage(downscaled), nil
+}
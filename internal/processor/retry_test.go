@@ -0,0 +1,121 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// failFirst returns a BeforeCall hook failing the first n calls of operation
+// with err
+func failFirst(operation string, n int, err error) func(string) error {
+	calls := 0
+	return func(op string) error {
+		if op != operation {
+			return nil
+		}
+		calls++
+		if calls <= n {
+			return err
+		}
+		return nil
+	}
+}
+
+func TestWithRetrySucceedsAfterTransientFailures(t *testing.T) {
+	h, f := newTestHandler(t)
+	throttled := &dynamodbTypes.ProvisionedThroughputExceededException{Message: aws.String("slow down")}
+	f.dynamoDB.BeforeCall = failFirst("Query", 2, throttled)
+
+	if _, err := h.findDuplicate(context.Background(), "hash", "images/a.jpg"); err != nil {
+		t.Fatalf("findDuplicate: %v", err)
+	}
+	if n := f.dynamoDB.Calls("Query"); n != 3 {
+		t.Errorf("Query called %d times, want 3", n)
+	}
+}
+
+func TestWithRetryRetriesTransportErrors(t *testing.T) {
+	h, f := newTestHandler(t)
+	reset := &smithy.OperationError{
+		ServiceID:     "DynamoDB",
+		OperationName: "Query",
+		Err:           &smithyhttp.RequestSendError{Err: &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}},
+	}
+	f.dynamoDB.BeforeCall = failFirst("Query", 2, reset)
+
+	if _, err := h.findDuplicate(context.Background(), "hash", "images/a.jpg"); err != nil {
+		t.Fatalf("findDuplicate: %v", err)
+	}
+	if n := f.dynamoDB.Calls("Query"); n != 3 {
+		t.Errorf("Query called %d times, want 3", n)
+	}
+}
+
+func TestWithRetryGivesUpAfterMaxRetries(t *testing.T) {
+	t.Setenv("AWS_MAX_RETRIES", "1")
+	h, f := newTestHandler(t)
+	throttled := &dynamodbTypes.ProvisionedThroughputExceededException{Message: aws.String("slow down")}
+	f.dynamoDB.BeforeCall = failFirst("Query", 2, throttled)
+
+	_, err := h.findDuplicate(context.Background(), "hash", "images/a.jpg")
+	if !errors.As(err, &throttled) {
+		t.Fatalf("findDuplicate error = %v, want the throttling error", err)
+	}
+	if n := f.dynamoDB.Calls("Query"); n != 2 {
+		t.Errorf("Query called %d times, want 2", n)
+	}
+}
+
+func TestWithRetryDoesNotRetryClientErrors(t *testing.T) {
+	h, f := newTestHandler(t)
+	invalid := &dynamodbTypes.ResourceNotFoundException{Message: aws.String("no table")}
+	f.dynamoDB.BeforeCall = failFirst("Query", 1, invalid)
+
+	if _, err := h.findDuplicate(context.Background(), "hash", "images/a.jpg"); !errors.As(err, &invalid) {
+		t.Fatalf("findDuplicate error = %v, want ResourceNotFoundException", err)
+	}
+	if n := f.dynamoDB.Calls("Query"); n != 1 {
+		t.Errorf("Query called %d times, want 1", n)
+	}
+}
+
+func TestSingleAttemptConfigDisablesSDKRetries(t *testing.T) {
+	cfg := SingleAttemptConfig(aws.Config{})
+	if cfg.Retryer == nil {
+		t.Fatal("no retryer set")
+	}
+	if n := cfg.Retryer().MaxAttempts(); n != 1 {
+		t.Errorf("MaxAttempts = %d, want 1", n)
+	}
+}
+
+func TestRegenerateThumbnailRetriesTransientFailures(t *testing.T) {
+	h, f := newTestHandler(t)
+	f.rekognition.Labels = dogLabels()
+	key := "images/1700000000-dog.jpg"
+	body := testJPEG(t, 64, 48)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event: %v", err)
+	}
+
+	// The API's pipeline clients make single attempts, so the item read has to
+	// be retried here
+	throttled := &dynamodbTypes.ProvisionedThroughputExceededException{Message: aws.String("slow down")}
+	f.dynamoDB.BeforeCall = failFirst("GetItem", 2, throttled)
+	before := f.dynamoDB.Calls("GetItem")
+	if _, _, err := h.RegenerateThumbnail(context.Background(), key, ""); err != nil {
+		t.Fatalf("RegenerateThumbnail: %v", err)
+	}
+	if n := f.dynamoDB.Calls("GetItem") - before; n != 3 {
+		t.Errorf("GetItem called %d times, want 3", n)
+	}
+}
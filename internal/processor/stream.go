@@ -0,0 +1,90 @@
+package processor
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/disintegration/imaging"
+)
+
+// streamHeaderBytes is how much of a streamed object is kept in memory: enough
+// to sniff its type and to hold a JPEG's EXIF segment, which is at most 64KB
+const streamHeaderBytes = 128 << 10
+
+// errRecorder remembers the first error its reader returned, so a failed decode
+// can be told apart from a failed download
+type errRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errRecorder) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
+
+// downloadStreamed fetches an object for STREAM_DECODE. A JPEG or PNG body is
+// decoded as it arrives and hashed on the way, so only its first
+// streamHeaderBytes are kept: data holds that header and img the decoded image.
+// Other formats need their full bytes, so they are read whole as downloadImage
+// does and img is nil. contentHash is set in both cases.
+func (h *Handler) downloadStreamed(ctx context.Context, bucket, key string) (data []byte, img image.Image, contentHash string, objectMetadata map[string]string, err error) {
+	var result *s3.GetObjectOutput
+	err = h.withRetry(ctx, "S3 GetObject", func() error {
+		var err error
+		result, err = h.s3Getter.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, nil, "", nil, fmt.Errorf("S3 GetObject failed: %w", err)
+	}
+	defer result.Body.Close()
+
+	body := &errRecorder{r: result.Body}
+	hasher := sha256.New()
+	reader := bufio.NewReaderSize(io.TeeReader(body, hasher), streamHeaderBytes)
+
+	// A short object ends the peek early, which is fine
+	peeked, err := reader.Peek(streamHeaderBytes)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, nil, "", nil, fmt.Errorf("failed to read S3 object body: %w", err)
+	}
+	header := append([]byte(nil), peeked...)
+
+	if !isJPEG(header) && !isPNG(header) {
+		data, err = io.ReadAll(reader)
+		if err != nil {
+			return nil, nil, "", nil, fmt.Errorf("failed to read S3 object body: %w", err)
+		}
+		return data, nil, hex.EncodeToString(hasher.Sum(nil)), result.Metadata, nil
+	}
+
+	img, err = imaging.Decode(reader, imaging.AutoOrientation(true))
+	if err != nil {
+		if body.err != nil {
+			return nil, nil, "", nil, fmt.Errorf("failed to read S3 object body: %w", body.err)
+		}
+		return nil, nil, "", nil, permanent(fmt.Errorf("failed to decode image: %w", err))
+	}
+
+	// The decoder may stop before trailing bytes, which the hash still covers
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return nil, nil, "", nil, fmt.Errorf("failed to read S3 object body: %w", err)
+	}
+
+	return header, img, hex.EncodeToString(hasher.Sum(nil)), result.Metadata, nil
+}
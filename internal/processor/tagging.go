@@ -0,0 +1,121 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// objectTagNames are the tags OBJECT_TAGS can put on processed originals
+var objectTagNames = map[string]bool{
+	"processed":    true,
+	"labels-count": true,
+	"top-label":    true,
+}
+
+// thumbnailTagging is the Tagging header thumbnails are uploaded with when
+// OBJECT_TAGS is set, so lifecycle rules can tell them from originals
+var thumbnailTagging = url.Values{"thumbnail": {"true"}}.Encode()
+
+// maxTagValueLength is the longest value S3 accepts for an object tag
+const maxTagValueLength = 256
+
+// parseObjectTags parses OBJECT_TAGS, a comma-separated list of the tag names
+// in objectTagNames. An empty value disables tagging.
+func parseObjectTags(value string) ([]string, error) {
+	names := parseList(value)
+	for _, name := range names {
+		if !objectTagNames[name] {
+			return nil, fmt.Errorf("invalid OBJECT_TAGS entry %q: must be processed, labels-count or top-label", name)
+		}
+	}
+	return names, nil
+}
+
+// originalTags builds the configured tags for an original with these labels.
+// top-label is left out when the image has no labels.
+func (h *Handler) originalTags(labels []LabelInfo) []s3Types.Tag {
+	var tags []s3Types.Tag
+	for _, name := range h.objectTags {
+		var value string
+		switch name {
+		case "processed":
+			value = "true"
+		case "labels-count":
+			value = strconv.Itoa(len(labels))
+		case "top-label":
+			value = tagValue(topLabel(labels))
+		}
+		if value == "" {
+			continue
+		}
+		tags = append(tags, s3Types.Tag{Key: aws.String(name), Value: aws.String(value)})
+	}
+	return tags
+}
+
+// topLabel returns the name of the most confident label, or "" for none
+func topLabel(labels []LabelInfo) string {
+	var top *LabelInfo
+	for i := range labels {
+		if top == nil || labels[i].Confidence > top.Confidence {
+			top = &labels[i]
+		}
+	}
+	if top == nil {
+		return ""
+	}
+	return top.Name
+}
+
+// tagValue replaces the characters S3 rejects in tag values with underscores
+// and truncates to maxTagValueLength
+func tagValue(value string) string {
+	value = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune(" +-=._:/@", r):
+			return r
+		}
+		return '_'
+	}, value)
+	if len(value) > maxTagValueLength {
+		value = value[:maxTagValueLength]
+	}
+	return value
+}
+
+// tagOriginal replaces the original's tag set with the configured tags. It runs
+// after any rewrite of the original, since overwriting an object drops its tags.
+func (h *Handler) tagOriginal(ctx context.Context, bucket, key string, labels []LabelInfo) error {
+	tags := h.originalTags(labels)
+	if len(tags) == 0 {
+		return nil
+	}
+
+	err := h.withRetry(ctx, "S3 PutObjectTagging", func() error {
+		_, err := h.s3Putter.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+			Bucket:  aws.String(bucket),
+			Key:     aws.String(key),
+			Tagging: &s3Types.Tagging{TagSet: tags},
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to tag original: %w", err)
+	}
+
+	h.logger.Debug("tagged original",
+		slog.String("key", key),
+		slog.Int("tag_count", len(tags)),
+	)
+	return nil
+}
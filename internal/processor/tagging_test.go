@@ -0,0 +1,96 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition"
+	rekognitionTypes "github.com/aws/aws-sdk-go-v2/service/rekognition/types"
+)
+
+func TestHandleS3EventTagsObjects(t *testing.T) {
+	tests := []struct {
+		name       string
+		objectTags string
+		labels     rekognition.DetectLabelsOutput
+		want       map[string]string
+	}{
+		{name: "tagging off", labels: dogLabels()},
+		{
+			name:       "every tag",
+			objectTags: "processed,labels-count,top-label",
+			labels: rekognition.DetectLabelsOutput{Labels: []rekognitionTypes.Label{
+				{Name: aws.String("Grass"), Confidence: aws.Float32(80)},
+				{Name: aws.String("Dog & Puppy"), Confidence: aws.Float32(97.5)},
+			}},
+			// Characters S3 rejects in tag values become underscores
+			want: map[string]string{"processed": "true", "labels-count": "2", "top-label": "Dog _ Puppy"},
+		},
+		{
+			name:       "no labels leaves out top-label",
+			objectTags: "processed, top-label",
+			want:       map[string]string{"processed": "true"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OBJECT_TAGS", tt.objectTags)
+			h, f := newTestHandler(t)
+			f.rekognition.Labels = tt.labels
+
+			key := "images/1700000000-dog.jpg"
+			body := testJPEG(t, 320, 240)
+			f.s3.PutBytes(testBucket, key, body, nil)
+			if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+				t.Fatalf("HandleS3Event: %v", err)
+			}
+
+			original, _ := f.s3.Object(testBucket, key)
+			if !maps.Equal(original.Tags, tt.want) {
+				t.Errorf("original tags = %v, want %v", original.Tags, tt.want)
+			}
+			var wantThumbnail map[string]string
+			if tt.objectTags != "" {
+				wantThumbnail = map[string]string{"thumbnail": "true"}
+			}
+			thumbnail, _ := f.s3.Object(testBucket, storedMetadata(t, f, key).ThumbnailKey)
+			if !maps.Equal(thumbnail.Tags, wantThumbnail) {
+				t.Errorf("thumbnail tags = %v, want %v", thumbnail.Tags, wantThumbnail)
+			}
+		})
+	}
+}
+
+func TestHandleS3EventIgnoresTaggingErrors(t *testing.T) {
+	t.Setenv("OBJECT_TAGS", "processed")
+	h, f := newTestHandler(t)
+	f.s3.BeforeCall = func(operation string) error {
+		if operation == "PutObjectTagging" {
+			return errors.New("access denied")
+		}
+		return nil
+	}
+
+	key := "images/1700000000-dog.jpg"
+	body := testJPEG(t, 320, 240)
+	f.s3.PutBytes(testBucket, key, body, nil)
+	if err := h.HandleS3Event(context.Background(), s3Event(key, len(body))); err != nil {
+		t.Fatalf("HandleS3Event = %v, want a tagging failure to be only logged", err)
+	}
+	if metadata := storedMetadata(t, f, key); metadata.Status != statusComplete {
+		t.Errorf("status = %q, want %q", metadata.Status, statusComplete)
+	}
+}
+
+func TestParseObjectTags(t *testing.T) {
+	if names, err := parseObjectTags(" processed ,top-label,"); err != nil || len(names) != 2 {
+		t.Errorf("parseObjectTags = %v, %v; want [processed top-label]", names, err)
+	}
+	if _, err := parseObjectTags("processed,owner"); err == nil || !strings.Contains(err.Error(), `"owner"`) {
+		t.Errorf("parseObjectTags = %v, want the unknown owner tag rejected", err)
+	}
+}
@@ -0,0 +1,75 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/aws/aws-xray-sdk-go/strategy/ctxmissing"
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+// discardEmitter keeps segments in memory instead of sending them to a daemon
+type discardEmitter struct{}
+
+func (discardEmitter) Emit(*xray.Segment)                     {}
+func (discardEmitter) RefreshEmitterWithAddress(*net.UDPAddr) {}
+
+func TestBeginSubsegmentDisabled(t *testing.T) {
+	h, _ := newTestHandler(t)
+
+	ctx := context.Background()
+	subCtx, end := h.beginSubsegment(ctx, "download", "images/a.jpg")
+	if subCtx != ctx {
+		t.Error("beginSubsegment derived a new context with tracing disabled")
+	}
+	end(nil)
+}
+
+func TestBeginSubsegmentWithoutSegment(t *testing.T) {
+	h, _ := newTestHandler(t)
+	h.tracingEnabled = true
+
+	ctx, err := xray.ContextWithConfig(context.Background(), xray.Config{
+		Emitter:                discardEmitter{},
+		ContextMissingStrategy: ctxmissing.NewDefaultIgnoreErrorStrategy(),
+	})
+	if err != nil {
+		t.Fatalf("ContextWithConfig: %v", err)
+	}
+	subCtx, end := h.beginSubsegment(ctx, "download", "images/a.jpg")
+	if subCtx != ctx {
+		t.Error("beginSubsegment derived a new context without a parent segment")
+	}
+	end(errors.New("boom"))
+}
+
+func TestBeginSubsegmentAnnotatesKey(t *testing.T) {
+	h, _ := newTestHandler(t)
+	h.tracingEnabled = true
+
+	ctx, err := xray.ContextWithConfig(context.Background(), xray.Config{Emitter: discardEmitter{}})
+	if err != nil {
+		t.Fatalf("ContextWithConfig: %v", err)
+	}
+	ctx, seg := xray.BeginSegment(ctx, "image-processor")
+	defer seg.Close(nil)
+
+	subCtx, end := h.beginSubsegment(ctx, "labels", "images/a.jpg")
+	sub := xray.GetSegment(subCtx)
+	if sub == nil || sub == seg {
+		t.Fatal("beginSubsegment did not start a subsegment")
+	}
+	if sub.Name != "labels" || sub.ParentSegment != seg {
+		t.Errorf("subsegment = %q under %p, want labels under %p", sub.Name, sub.ParentSegment, seg)
+	}
+	if got := sub.Annotations["s3_key"]; got != "images/a.jpg" {
+		t.Errorf("s3_key annotation = %v, want images/a.jpg", got)
+	}
+
+	end(errors.New("rekognition unavailable"))
+	if sub.InProgress || !sub.Fault {
+		t.Errorf("closed subsegment in_progress=%v fault=%v, want closed with fault", sub.InProgress, sub.Fault)
+	}
+}
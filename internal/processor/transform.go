@@ -0,0 +1,209 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/disintegration/imaging"
+)
+
+// ErrTransformUnsupported is returned when asked to transform an image that
+// can't be re-encoded without loss of content, such as an animated GIF
+var ErrTransformUnsupported = errors.New("image format cannot be transformed")
+
+// Transform rotates and then flips an image
+type Transform struct {
+	// Rotate is the clockwise rotation in degrees: 0, 90, 180 or 270
+	Rotate int
+	// Flip mirrors the rotated image: "", "horizontal" or "vertical"
+	Flip string
+}
+
+// Validate checks the rotation and flip, returning an error naming the bad value
+func (t Transform) Validate() error {
+	switch t.Rotate {
+	case 0, 90, 180, 270:
+	default:
+		return fmt.Errorf("rotate must be 0, 90, 180 or 270")
+	}
+	switch t.Flip {
+	case "", "horizontal", "vertical":
+	default:
+		return fmt.Errorf("flip must be horizontal or vertical")
+	}
+	if t.Rotate == 0 && t.Flip == "" {
+		return fmt.Errorf("rotate or flip is required")
+	}
+	return nil
+}
+
+// apply returns img rotated and flipped. imaging rotates counter-clockwise, so
+// a clockwise 90 is its Rotate270.
+func (t Transform) apply(img image.Image) image.Image {
+	switch t.Rotate {
+	case 90:
+		img = imaging.Rotate270(img)
+	case 180:
+		img = imaging.Rotate180(img)
+	case 270:
+		img = imaging.Rotate90(img)
+	}
+	switch t.Flip {
+	case "horizontal":
+		img = imaging.FlipH(img)
+	case "vertical":
+		img = imaging.FlipV(img)
+	}
+	return img
+}
+
+// box maps a Rekognition bounding box, in fractions of the image size, onto
+// the transformed image
+func (t Transform) box(b BoundingBox) BoundingBox {
+	switch t.Rotate {
+	case 90:
+		b = BoundingBox{Left: 1 - b.Top - b.Height, Top: b.Left, Width: b.Height, Height: b.Width}
+	case 180:
+		b = BoundingBox{Left: 1 - b.Left - b.Width, Top: 1 - b.Top - b.Height, Width: b.Width, Height: b.Height}
+	case 270:
+		b = BoundingBox{Left: b.Top, Top: 1 - b.Left - b.Width, Width: b.Height, Height: b.Width}
+	}
+	switch t.Flip {
+	case "horizontal":
+		b.Left = 1 - b.Left - b.Width
+	case "vertical":
+		b.Top = 1 - b.Top - b.Height
+	}
+	return b
+}
+
+// TransformImage rotates and flips a stored image in place: the original (or
+// its converted JPEG) is overwritten, the thumbnails are regenerated and the
+// metadata is updated, with face, label and PPE boxes moved to match. A
+// non-empty owner must match the image's or ErrNotFound is returned.
+func (h *Handler) TransformImage(ctx context.Context, key, owner string, t Transform) (*ImageMetadata, error) {
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	// The thumbnails are replaced, so THUMBNAIL_NO_OVERWRITE doesn't apply
+	if h.thumbnailNoOverwrite {
+		scoped := *h
+		scoped.thumbnailNoOverwrite = false
+		h = &scoped
+	}
+
+	result, err := h.getItem(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("DynamoDB GetItem failed: %w", err)
+	}
+	if result.Item == nil {
+		return nil, ErrNotFound
+	}
+
+	var metadata ImageMetadata
+	if err := attributevalue.UnmarshalMap(result.Item, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal metadata: %w", err)
+	}
+	// Search entries and label counts share the table but aren't images
+	if metadata.GalleryPK == "" || (owner != "" && metadata.Owner != owner) {
+		return nil, ErrNotFound
+	}
+	if metadata.ModerationFlagged {
+		return nil, ErrModerationFlagged
+	}
+
+	// HEIC and TIFF uploads are shown through their converted JPEG, which is
+	// what gets transformed; the upload itself is left as it was
+	sourceKey := key
+	if metadata.ConvertedKey != "" {
+		sourceKey = metadata.ConvertedKey
+	}
+	imageBytes, objectMetadata, err := h.downloadImage(ctx, metadata.BucketName, sourceKey)
+	var noSuchKey *s3Types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", sourceKey, err)
+	}
+	if !isJPEG(imageBytes) && !isPNG(imageBytes) {
+		return nil, ErrTransformUnsupported
+	}
+
+	img, err := decodeImage(imageBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	img = t.apply(img)
+
+	// JPEGs keep their EXIF with the orientation reset, since the pixels are
+	// now stored the way they should be shown
+	transformed, contentType := []byte(nil), "image/jpeg"
+	if isPNG(imageBytes) {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, fmt.Errorf("failed to encode PNG: %w", err)
+		}
+		transformed, contentType = buf.Bytes(), "image/png"
+	} else if transformed, err = encodeOrientedJPEG(img, imageBytes); err != nil {
+		return nil, fmt.Errorf("failed to encode JPEG: %w", err)
+	}
+
+	// The metadata still says complete, so the S3 event this overwrite
+	// triggers is skipped as already processed
+	if err := h.rewriteOriginal(ctx, metadata.BucketName, sourceKey, transformed, contentType, objectMetadata); err != nil {
+		return nil, err
+	}
+
+	thumbnails, err := h.generateAndUploadThumbnail(ctx, metadata.BucketName, key, img, h.thumbnailFormatFor(transformed))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate thumbnail: %w", err)
+	}
+	previous, previousBucket := metadata.Thumbnails, metadata.ThumbnailBucket
+	if previousBucket == "" {
+		previousBucket = metadata.BucketName
+	}
+	metadata.applyThumbnails(h.thumbnailMode, thumbnails)
+
+	metadata.Width = img.Bounds().Dx()
+	metadata.Height = img.Bounds().Dy()
+	metadata.PHash = perceptualHash(img)
+	if sourceKey == key {
+		hash := sha256.Sum256(transformed)
+		metadata.ContentHash = hex.EncodeToString(hash[:])
+		metadata.ImageSize = int64(len(transformed))
+	}
+	for i := range metadata.Faces {
+		metadata.Faces[i].BoundingBox = t.box(metadata.Faces[i].BoundingBox)
+	}
+	for i := range metadata.PPE {
+		metadata.PPE[i].BoundingBox = t.box(metadata.PPE[i].BoundingBox)
+	}
+	for i := range metadata.DetectedLabels {
+		for j := range metadata.DetectedLabels[i].Instances {
+			instance := &metadata.DetectedLabels[i].Instances[j]
+			instance.BoundingBox = t.box(instance.BoundingBox)
+		}
+	}
+
+	if err := h.saveMetadata(ctx, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to save metadata: %w", err)
+	}
+	h.deleteStaleThumbnails(ctx, previous, previousBucket, &metadata)
+
+	h.logger.Info("transformed image",
+		slog.String("key", key),
+		slog.Int("rotate", t.Rotate),
+		slog.String("flip", t.Flip),
+	)
+	return &metadata, nil
+}
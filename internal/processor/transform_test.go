@@ -0,0 +1,131 @@
+package processor
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// markedImage is a w x h black image with each pixel's red and green holding
+// its x and y, so a pixel's origin can be read back after a transform
+func markedImage(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x), G: uint8(y), A: 255})
+		}
+	}
+	return img
+}
+
+func TestTransformApply(t *testing.T) {
+	const w, h = 4, 3
+	tests := []struct {
+		transform Transform
+		// to maps an original pixel to where it should land
+		to            func(x, y int) (int, int)
+		width, height int
+	}{
+		{Transform{Rotate: 90}, func(x, y int) (int, int) { return h - 1 - y, x }, h, w},
+		{Transform{Rotate: 180}, func(x, y int) (int, int) { return w - 1 - x, h - 1 - y }, w, h},
+		{Transform{Rotate: 270}, func(x, y int) (int, int) { return y, w - 1 - x }, h, w},
+		{Transform{Flip: "horizontal"}, func(x, y int) (int, int) { return w - 1 - x, y }, w, h},
+		{Transform{Flip: "vertical"}, func(x, y int) (int, int) { return x, h - 1 - y }, w, h},
+		// Rotation comes before the flip
+		{Transform{Rotate: 90, Flip: "horizontal"}, func(x, y int) (int, int) { return y, x }, h, w},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d %s", tt.transform.Rotate, tt.transform.Flip), func(t *testing.T) {
+			got := tt.transform.apply(markedImage(w, h))
+			if b := got.Bounds(); b.Dx() != tt.width || b.Dy() != tt.height {
+				t.Fatalf("size = %dx%d, want %dx%d", b.Dx(), b.Dy(), tt.width, tt.height)
+			}
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					toX, toY := tt.to(x, y)
+					r, g, _, _ := got.At(toX, toY).RGBA()
+					if int(r>>8) != x || int(g>>8) != y {
+						t.Errorf("pixel (%d,%d) holds (%d,%d), want (%d,%d)", toX, toY, r>>8, g>>8, x, y)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestTransformBox(t *testing.T) {
+	original := BoundingBox{Left: 0.1, Top: 0.2, Width: 0.3, Height: 0.4}
+	tests := []struct {
+		transform Transform
+		want      BoundingBox
+	}{
+		{Transform{Rotate: 90}, BoundingBox{Left: 0.4, Top: 0.1, Width: 0.4, Height: 0.3}},
+		{Transform{Rotate: 180}, BoundingBox{Left: 0.6, Top: 0.4, Width: 0.3, Height: 0.4}},
+		{Transform{Rotate: 270}, BoundingBox{Left: 0.2, Top: 0.6, Width: 0.4, Height: 0.3}},
+		{Transform{Flip: "horizontal"}, BoundingBox{Left: 0.6, Top: 0.2, Width: 0.3, Height: 0.4}},
+		{Transform{Flip: "vertical"}, BoundingBox{Left: 0.1, Top: 0.4, Width: 0.3, Height: 0.4}},
+		{Transform{Rotate: 90, Flip: "vertical"}, BoundingBox{Left: 0.4, Top: 0.6, Width: 0.4, Height: 0.3}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d %s", tt.transform.Rotate, tt.transform.Flip), func(t *testing.T) {
+			if got := tt.transform.box(original); !nearBox(got, tt.want, 1e-6) {
+				t.Errorf("box = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestTransformBoxFollowsPixels paints a box, transforms the image and checks
+// the painted pixels end up where box says
+func TestTransformBoxFollowsPixels(t *testing.T) {
+	const w, h = 100, 50
+	original := BoundingBox{Left: 0.1, Top: 0.2, Width: 0.3, Height: 0.4}
+	for _, rotate := range []int{0, 90, 180, 270} {
+		for _, flip := range []string{"", "horizontal", "vertical"} {
+			transform := Transform{Rotate: rotate, Flip: flip}
+			if transform.Validate() != nil {
+				continue
+			}
+			t.Run(fmt.Sprintf("%d %s", rotate, flip), func(t *testing.T) {
+				img := image.NewGray(image.Rect(0, 0, w, h))
+				for y := 0; y < h; y++ {
+					for x := 0; x < w; x++ {
+						fx, fy := float32(x)/w, float32(y)/h
+						if fx >= original.Left && fx < original.Left+original.Width && fy >= original.Top && fy < original.Top+original.Height {
+							img.SetGray(x, y, color.Gray{Y: 255})
+						}
+					}
+				}
+
+				got := transform.apply(img)
+				bounds := got.Bounds()
+				painted := image.Rectangle{}
+				for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+					for x := bounds.Min.X; x < bounds.Max.X; x++ {
+						if r, _, _, _ := got.At(x, y).RGBA(); r > 0 {
+							painted = painted.Union(image.Rect(x, y, x+1, y+1))
+						}
+					}
+				}
+				want := BoundingBox{
+					Left:   float32(painted.Min.X) / float32(bounds.Dx()),
+					Top:    float32(painted.Min.Y) / float32(bounds.Dy()),
+					Width:  float32(painted.Dx()) / float32(bounds.Dx()),
+					Height: float32(painted.Dy()) / float32(bounds.Dy()),
+				}
+				// A painted edge can land a pixel off the exact fraction
+				if got := transform.box(original); !nearBox(got, want, 0.021) {
+					t.Errorf("box = %+v, painted pixels at %+v", got, want)
+				}
+			})
+		}
+	}
+}
+
+// nearBox reports whether every edge of two boxes is within tolerance
+func nearBox(a, b BoundingBox, tolerance float64) bool {
+	near := func(x, y float32) bool { return math.Abs(float64(x-y)) <= tolerance }
+	return near(a.Left, b.Left) && near(a.Top, b.Top) && near(a.Width, b.Width) && near(a.Height, b.Height)
+}
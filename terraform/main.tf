@@ -46,6 +46,88 @@ resource "aws_dynamodb_table" "image_labels" {
     name = "image_key"
     type = "S"
   }
+
+  attribute {
+    name = "gallery_pk"
+    type = "S"
+  }
+
+  attribute {
+    name = "processed_at"
+    type = "S"
+  }
+
+  attribute {
+    name = "content_hash"
+    type = "S"
+  }
+
+  attribute {
+    name = "search_term"
+    type = "S"
+  }
+
+  attribute {
+    name = "owner"
+    type = "S"
+  }
+
+  attribute {
+    name = "label_pk"
+    type = "S"
+  }
+
+  attribute {
+    name = "image_count"
+    type = "N"
+  }
+
+  # Newest-first gallery listing: every image shares gallery_pk = "IMAGE"
+  global_secondary_index {
+    name            = "gallery-index"
+    hash_key        = "gallery_pk"
+    range_key       = "processed_at"
+    projection_type = "ALL"
+  }
+
+  # Duplicate detection by SHA-256 of the uploaded bytes
+  global_secondary_index {
+    name               = "content_hash-index"
+    hash_key           = "content_hash"
+    projection_type    = "INCLUDE"
+    non_key_attributes = ["duplicate_of", "moderation_flagged"]
+  }
+
+  # GET /search: one "search#<term>#<key>" row per image-term pair
+  global_secondary_index {
+    name               = "search-index"
+    hash_key           = "search_term"
+    range_key          = "processed_at"
+    projection_type    = "INCLUDE"
+    non_key_attributes = ["target_key", "target_owner"]
+  }
+
+  # Per-user listing when API auth is on: only images with an owner are indexed
+  global_secondary_index {
+    name            = "owner-index"
+    hash_key        = "owner"
+    range_key       = "processed_at"
+    projection_type = "ALL"
+  }
+
+  # GET /labels and /stats: one count item per label, all under label_pk = "LABEL"
+  global_secondary_index {
+    name            = "label-count-index"
+    hash_key        = "label_pk"
+    range_key       = "image_count"
+    projection_type = "ALL"
+  }
+
+  # Purges items whose expires_at (set when METADATA_TTL_DAYS is configured) has passed
+  ttl {
+    attribute_name = "expires_at"
+    enabled        = true
+  }
 }
 
 # IAM Role for Lambda (Shared Role)
@@ -73,7 +155,7 @@ resource "aws_iam_role_policy" "lambda_policy" {
 
   policy = jsonencode({
     Version = "2012-10-17"
-    Statement = [
+    Statement = concat([
       {
         Effect = "Allow"
         Action = [
@@ -83,18 +165,45 @@ resource "aws_iam_role_policy" "lambda_policy" {
         ]
         Resource = "arn:aws:logs:*:*:*"
       },
+      {
+        Effect = "Allow"
+        Action = [
+          "xray:PutTraceSegments",
+          "xray:PutTelemetryRecords"
+        ]
+        Resource = "*"
+      },
       {
         Effect = "Allow"
         Action = [
           "s3:GetObject",
-          "s3:PutObject"
+          "s3:PutObject",
+          "s3:PutObjectTagging",
+          "s3:DeleteObject"
         ]
-        Resource = "${aws_s3_bucket.image_bucket.arn}/*"
+        Resource = concat(
+          ["${aws_s3_bucket.image_bucket.arn}/*"],
+          var.thumbnail_bucket_name == "" ? [] : ["arn:aws:s3:::${var.thumbnail_bucket_name}/*"]
+        )
+      },
+      {
+        # Lets HeadObject on a missing key answer 404 rather than 403
+        Effect = "Allow"
+        Action = ["s3:ListBucket"]
+        Resource = concat(
+          [aws_s3_bucket.image_bucket.arn],
+          var.thumbnail_bucket_name == "" ? [] : ["arn:aws:s3:::${var.thumbnail_bucket_name}"]
+        )
       },
       {
         Effect = "Allow"
         Action = [
-          "rekognition:DetectLabels"
+          "rekognition:DetectLabels",
+          "rekognition:DetectFaces",
+          "rekognition:DetectText",
+          "rekognition:DetectModerationLabels",
+          "rekognition:DetectCustomLabels",
+          "rekognition:DetectProtectiveEquipment"
         ]
         Resource = "*"
       },
@@ -103,11 +212,41 @@ resource "aws_iam_role_policy" "lambda_policy" {
         Action = [
           "dynamodb:PutItem",
           "dynamodb:Scan",
-          "dynamodb:GetItem"
+          "dynamodb:GetItem",
+          "dynamodb:UpdateItem",
+          "dynamodb:DeleteItem",
+          "dynamodb:Query",
+          "dynamodb:BatchWriteItem",
+          "dynamodb:BatchGetItem",
+          "dynamodb:DescribeTable"
+        ]
+        Resource = [
+          aws_dynamodb_table.image_labels.arn,
+          "${aws_dynamodb_table.image_labels.arn}/index/*"
         ]
-        Resource = aws_dynamodb_table.image_labels.arn
       }
-    ]
+    ], var.sse_kms_key_id == "" ? [] : [
+      {
+        Effect = "Allow"
+        Action = [
+          "kms:GenerateDataKey",
+          "kms:Decrypt"
+        ]
+        Resource = var.sse_kms_key_id
+      }
+    ], var.completion_sns_topic_arn == "" ? [] : [
+      {
+        Effect   = "Allow"
+        Action   = ["sns:Publish"]
+        Resource = var.completion_sns_topic_arn
+      }
+    ], var.eventbridge_bus_name == "" ? [] : [
+      {
+        Effect   = "Allow"
+        Action   = ["events:PutEvents"]
+        Resource = "arn:aws:events:${var.aws_region}:*:event-bus/${var.eventbridge_bus_name}"
+      }
+    ])
   })
 }
 
@@ -123,9 +262,19 @@ resource "aws_lambda_function" "image_processor" {
   memory_size   = 256
   # source_code_hash = filebase64sha256("../function.zip")
 
+  tracing_config {
+    mode = "Active"
+  }
+
   environment {
     variables = {
-      DYNAMODB_TABLE_NAME = aws_dynamodb_table.image_labels.name
+      DYNAMODB_TABLE_NAME             = aws_dynamodb_table.image_labels.name
+      S3_SSE_KMS_KEY_ID               = var.sse_kms_key_id
+      COMPLETION_SNS_TOPIC_ARN        = var.completion_sns_topic_arn
+      EVENTBRIDGE_BUS_NAME            = var.eventbridge_bus_name
+      THUMBNAIL_BUCKET                = var.thumbnail_bucket_name
+      REKOGNITION_REGION              = var.rekognition_region
+      REKOGNITION_PROJECT_VERSION_ARN = var.rekognition_project_version_arn
     }
   }
 }
@@ -138,14 +287,17 @@ resource "aws_lambda_function" "image_api" {
   handler       = "bootstrap"
   runtime       = "provided.al2023"
   architectures = ["arm64"]
-  timeout       = 10
-  memory_size   = 128
+  # POST /regenerate-thumbnail decodes and resizes full images
+  timeout       = 30
+  memory_size   = 256
   # source_code_hash = filebase64sha256("../api-function.zip")
 
   environment {
     variables = {
       DYNAMODB_TABLE_NAME = aws_dynamodb_table.image_labels.name
       S3_BUCKET_NAME      = aws_s3_bucket.image_bucket.bucket
+      S3_SSE_KMS_KEY_ID   = var.sse_kms_key_id
+      THUMBNAIL_BUCKET    = var.thumbnail_bucket_name
     }
   }
 }
@@ -156,8 +308,8 @@ resource "aws_apigatewayv2_api" "http_api" {
   protocol_type = "HTTP"
   cors_configuration {
     allow_origins = ["*"]
-    allow_methods = ["GET", "POST", "OPTIONS"]
-    allow_headers = ["content-type"]
+    allow_methods = ["GET", "POST", "PATCH", "DELETE", "OPTIONS"]
+    allow_headers = ["content-type", "authorization", "idempotency-key"]
     max_age       = 300
   }
 }
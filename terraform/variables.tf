@@ -15,3 +15,39 @@ variable "dynamodb_table_name" {
   type        = string
   default     = "image-labels"
 }
+
+variable "sse_kms_key_id" {
+  description = "ARN of the KMS key used to encrypt uploads and thumbnails (empty for bucket default encryption)"
+  type        = string
+  default     = ""
+}
+
+variable "completion_sns_topic_arn" {
+  description = "SNS topic notified when an image finishes processing or fails (empty to disable)"
+  type        = string
+  default     = ""
+}
+
+variable "eventbridge_bus_name" {
+  description = "EventBridge bus that receives ImageProcessed events (empty to disable)"
+  type        = string
+  default     = ""
+}
+
+variable "thumbnail_bucket_name" {
+  description = "Existing bucket for thumbnails (empty to keep them in the image bucket)"
+  type        = string
+  default     = ""
+}
+
+variable "rekognition_region" {
+  description = "Region to call Rekognition in, for Lambda regions where it isn't offered (empty to use the Lambda's region)"
+  type        = string
+  default     = ""
+}
+
+variable "rekognition_project_version_arn" {
+  description = "Rekognition Custom Labels model version whose labels are added to the general ones (empty to disable). The model must be running"
+  type        = string
+  default     = ""
+}